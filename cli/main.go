@@ -65,5 +65,10 @@ func printHelp() {
 	fmt.Println("The modules are:")
 	fmt.Printf("  %s users help\n", os.Args[0])
 	fmt.Printf("  %s connections help\n", os.Args[0])
+	fmt.Printf("  %s certificates help\n", os.Args[0])
+	fmt.Printf("  %s listeners help\n", os.Args[0])
+	fmt.Printf("  %s bans help\n", os.Args[0])
+	fmt.Printf("  %s groups help\n", os.Args[0])
+	fmt.Printf("  %s storage help\n", os.Args[0])
 	os.Exit(0)
 }
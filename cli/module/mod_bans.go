@@ -0,0 +1,92 @@
+package module
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type modBans struct {
+	commands map[string]Command
+}
+
+func NewModBans() Module {
+	m := &modBans{
+		commands: make(map[string]Command),
+	}
+	m.commands["list"] = m.List
+	m.commands["remove"] = m.Remove
+	m.commands["help"] = m.Help
+	return m
+}
+
+func (m *modBans) Execute(client *api.Client, commandName string, args ...string) error {
+	command, ok := m.commands[commandName]
+	if !ok {
+		return m.Help(client, args...)
+	}
+	return command(client, args...)
+}
+
+func (m *modBans) List(client *api.Client, args ...string) error {
+	request := common.ListBansReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_LIST_BANS,
+		},
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.ListBansResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Printf("%-40s %-26s %s\n", "IP", "UNTIL", "REASON")
+	for _, entry := range response.Bans {
+		fmt.Printf("%-40s %-26s %s\n", entry.Ip, time.Unix(entry.Until, 0).Format(time.RFC3339), entry.Reason)
+	}
+	return nil
+}
+
+func (m *modBans) Remove(client *api.Client, args ...string) error {
+	flagSet := flag.NewFlagSet("bans remove", flag.ContinueOnError)
+	ip := flagSet.String("ip", "", "The banned IP")
+	flagSet.Parse(args)
+	if *ip == "" {
+		return errors.New("--ip is required")
+	}
+	request := common.RemoveBanReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_REMOVE_BAN,
+		},
+		Ip: *ip,
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.RemoveBanResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Printf("[OK] Ban of '%s' removed\n", *ip)
+	return nil
+}
+
+func (m *modBans) Help(client *api.Client, args ...string) error {
+	return nil
+}
@@ -0,0 +1,187 @@
+package module
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type modCertificates struct {
+	commands map[string]Command
+}
+
+func NewModCertificates() Module {
+	m := &modCertificates{
+		commands: make(map[string]Command),
+	}
+	m.commands["issue"] = m.Issue
+	m.commands["revoke"] = m.Revoke
+	m.commands["list-revoked"] = m.ListRevoked
+	m.commands["help"] = m.Help
+	return m
+}
+
+func (m *modCertificates) Execute(client *api.Client, commandName string, args ...string) error {
+	command, ok := m.commands[commandName]
+	if !ok {
+		return m.Help(client, args...)
+	}
+	return command(client, args...)
+}
+
+func (m *modCertificates) Issue(client *api.Client, args ...string) error {
+	flagSet := flag.NewFlagSet("certificates issue", flag.ContinueOnError)
+	name := flagSet.String("name", "", "Name of the certificate user")
+	admin := flagSet.Bool("admin", false, "Set to true if you want an admin certificate")
+	groups := flagSet.String("groups", "", "Comma separated list of ACL groups")
+	days := flagSet.Int("days", 0, "Validity in days, the broker default is used if not set")
+	publicKeyFile := flagSet.String("public-key", "", "Kyber public key of the device, a new key pair is generated if not set")
+	keyFile := flagSet.String("key-file", "", "The file to store a generated private key")
+	certFile := flagSet.String("cert-file", "", "The file to store the certificate")
+	flagSet.Parse(args)
+	if *name == "" {
+		return errors.New("--name is required")
+	}
+	var publicKeyPem []byte
+	var privateKeyPem []byte
+	if *publicKeyFile != "" {
+		var err error
+		publicKeyPem, err = os.ReadFile(*publicKeyFile)
+		if err != nil {
+			return err
+		}
+	} else {
+		if *keyFile == "" {
+			return errors.New("--key-file is required if no --public-key is given")
+		}
+		publicKey, privateKey, err := api.GenerateKyberKeyPair()
+		if err != nil {
+			return err
+		}
+		publicKeyPem, err = api.EncodeKyberPublicKeyPEM(publicKey)
+		if err != nil {
+			return err
+		}
+		privateKeyPem, err = api.EncodeKyberPrivateKeyPEM(privateKey)
+		if err != nil {
+			return err
+		}
+	}
+	groupList := make([]string, 0)
+	for _, group := range strings.Split(*groups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groupList = append(groupList, group)
+		}
+	}
+	request := common.IssueCertificateReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_ISSUE_CERTIFICATE,
+		},
+		Name:         *name,
+		Admin:        *admin,
+		Groups:       groupList,
+		PublicKeyPem: string(publicKeyPem),
+		ValidityDays: *days,
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.IssueCertificateResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Printf("[OK] Certificate %s issued successfully\n", response.Serial)
+	if privateKeyPem != nil {
+		if err := os.WriteFile(*keyFile, privateKeyPem, 0600); err != nil {
+			return err
+		}
+		fmt.Printf("[OK] Private key written to '%s'\n", *keyFile)
+	}
+	if *certFile == "" {
+		fmt.Println(response.CertificatePem)
+	} else {
+		if err := os.WriteFile(*certFile, []byte(response.CertificatePem), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("[OK] Certificate written to '%s'\n", *certFile)
+	}
+	return nil
+}
+
+func (m *modCertificates) Revoke(client *api.Client, args ...string) error {
+	flagSet := flag.NewFlagSet("certificates revoke", flag.ContinueOnError)
+	serial := flagSet.String("serial", "", "Serial of the certificate")
+	certFile := flagSet.String("cert-file", "", "The certificate file")
+	flagSet.Parse(args)
+	if *serial == "" && *certFile == "" {
+		return errors.New("--serial or --cert-file is required")
+	}
+	request := common.RevokeCertificateReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_REVOKE_CERTIFICATE,
+		},
+		Serial: *serial,
+	}
+	if *certFile != "" {
+		certificatePem, err := os.ReadFile(*certFile)
+		if err != nil {
+			return err
+		}
+		request.CertificatePem = string(certificatePem)
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.RevokeCertificateResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Println("[OK] Certificate revoked successfully")
+	return nil
+}
+
+func (m *modCertificates) ListRevoked(client *api.Client, args ...string) error {
+	request := common.ListRevokedCertificatesReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_LIST_REVOKED_CERTIFICATES,
+		},
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.ListRevokedCertificatesResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Printf("%-36s %-20s %s\n", "SERIAL", "NAME", "REVOKED AT")
+	for _, entry := range response.Certificates {
+		fmt.Printf("%-36s %-20s %s\n", entry.Serial, entry.Name, time.Unix(entry.RevokedAt, 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (m *modCertificates) Help(client *api.Client, args ...string) error {
+	return nil
+}
@@ -47,13 +47,13 @@ func (m *modClients) List(client *api.Client, args ...string) error {
 	if response.Error {
 		return errors.New(response.ErrorMessage)
 	}
-	fmt.Printf("%-36s %-20s %-8s\n", "ID", "USER NAME", "ROLE")
+	fmt.Printf("%-36s %-20s %-8s %-12s %s\n", "ID", "USER NAME", "ROLE", "PROVIDER", "LISTENER")
 	for _, entry := range response.Connections {
 		role := "user"
 		if entry.Admin {
 			role = "admin"
 		}
-		fmt.Printf("%-36s %-20s %s\n", entry.Id, entry.Username, role)
+		fmt.Printf("%-36s %-20s %-8s %-12s %s\n", entry.Id, entry.Username, role, entry.Provider, entry.Listener)
 	}
 	return nil
 }
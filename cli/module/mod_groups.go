@@ -0,0 +1,65 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type modGroups struct {
+	commands map[string]Command
+}
+
+func NewModGroups() Module {
+	m := &modGroups{
+		commands: make(map[string]Command),
+	}
+	m.commands["list"] = m.List
+	m.commands["help"] = m.Help
+	return m
+}
+
+func (m *modGroups) Execute(client *api.Client, commandName string, args ...string) error {
+	command, ok := m.commands[commandName]
+	if !ok {
+		return m.Help(client, args...)
+	}
+	return command(client, args...)
+}
+
+func (m *modGroups) List(client *api.Client, args ...string) error {
+	request := common.ListGroupsReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_LIST_GROUPS,
+		},
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.ListGroupsResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Printf("%-20s %-24s %-8s %-30s %-10s %-10s %-10s %s\n", "GROUP", "TOPIC", "MEMBERS", "STREAM", "COMMITTED", "NEXT", "LAG", "IN FLIGHT")
+	for _, group := range response.Groups {
+		if len(group.Streams) == 0 {
+			fmt.Printf("%-20s %-24s %-8d %-30s %-10s %-10s %-10s %s\n", group.Group, group.Topic, group.Members, "-", "-", "-", "-", "-")
+		}
+		for _, stream := range group.Streams {
+			fmt.Printf("%-20s %-24s %-8d %-30s %-10d %-10d %-10d %d\n", group.Group, group.Topic, group.Members, stream.Topic, stream.Committed, stream.Next, stream.Lag, stream.InFlight)
+		}
+	}
+	return nil
+}
+
+func (m *modGroups) Help(client *api.Client, args ...string) error {
+	return nil
+}
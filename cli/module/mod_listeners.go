@@ -0,0 +1,60 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type modListeners struct {
+	commands map[string]Command
+}
+
+func NewModListeners() Module {
+	m := &modListeners{
+		commands: make(map[string]Command),
+	}
+	m.commands["list"] = m.List
+	m.commands["help"] = m.Help
+	return m
+}
+
+func (m *modListeners) Execute(client *api.Client, commandName string, args ...string) error {
+	command, ok := m.commands[commandName]
+	if !ok {
+		return m.Help(client, args...)
+	}
+	return command(client, args...)
+}
+
+func (m *modListeners) List(client *api.Client, args ...string) error {
+	request := common.ListListenersReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_LIST_LISTENERS,
+		},
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.ListListenersResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Printf("%-16s %-8s %-8s %-30s %-30s %s\n", "NAME", "PROTOCOL", "NETWORK", "COMMAND", "PUBLISH", "CONNECTIONS")
+	for _, entry := range response.Listeners {
+		fmt.Printf("%-16s %-8s %-8s %-30s %-30s %d\n", entry.Name, entry.Protocol, entry.Network, entry.AddressCommand, entry.AddressPublish, entry.Connections)
+	}
+	return nil
+}
+
+func (m *modListeners) Help(client *api.Client, args ...string) error {
+	return nil
+}
@@ -0,0 +1,122 @@
+package module
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type modStorage struct {
+	commands map[string]Command
+}
+
+func NewModStorage() Module {
+	m := &modStorage{
+		commands: make(map[string]Command),
+	}
+	m.commands["backup"] = m.Backup
+	m.commands["export"] = m.Export
+	m.commands["help"] = m.Help
+	return m
+}
+
+func (m *modStorage) Execute(client *api.Client, commandName string, args ...string) error {
+	command, ok := m.commands[commandName]
+	if !ok {
+		return m.Help(client, args...)
+	}
+	return command(client, args...)
+}
+
+func (m *modStorage) Backup(client *api.Client, args ...string) error {
+	flagSet := flag.NewFlagSet("storage backup", flag.ContinueOnError)
+	file := flagSet.String("file", "", "The file the snapshot of the database is written to")
+	flagSet.Parse(args)
+	if *file == "" {
+		return errors.New("--file is required")
+	}
+	size, err := download(client, *file, false)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[OK] Snapshot of %d bytes written to '%s'\n", size, *file)
+	return nil
+}
+
+func (m *modStorage) Export(client *api.Client, args ...string) error {
+	flagSet := flag.NewFlagSet("storage export", flag.ContinueOnError)
+	file := flagSet.String("file", "", "The file the NDJSON export is written to")
+	flagSet.Parse(args)
+	if *file == "" {
+		return errors.New("--file is required")
+	}
+	size, err := download(client, *file, true)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[OK] Export of %d bytes written to '%s'\n", size, *file)
+	return nil
+}
+
+// download reads a backup chunk by chunk into fileName and verifies its
+// checksum
+func download(client *api.Client, fileName string, export bool) (int64, error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	request := common.BackupReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_BACKUP,
+		},
+		Export: export,
+	}
+	for {
+		requestBytes, _ := msgpack.Marshal(request)
+		responseBytes, err := client.SendCommand(requestBytes)
+		if err != nil {
+			os.Remove(fileName)
+			return 0, err
+		}
+		response := common.BackupResp{}
+		if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+			os.Remove(fileName)
+			return 0, err
+		}
+		if response.Error {
+			os.Remove(fileName)
+			return 0, errors.New(response.ErrorMessage)
+		}
+		if _, err := file.Write(response.Data); err != nil {
+			os.Remove(fileName)
+			return 0, err
+		}
+		hash.Write(response.Data)
+		request.Id = response.Id
+		request.Offset += int64(len(response.Data))
+		if request.Offset < response.Size {
+			continue
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != response.Checksum {
+			os.Remove(fileName)
+			return 0, errors.New("checksum of the backup does not match")
+		}
+		if err := file.Sync(); err != nil {
+			return 0, err
+		}
+		return request.Offset, nil
+	}
+}
+
+func (m *modStorage) Help(client *api.Client, args ...string) error {
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	api "github.com/oo-developer/mmq/pkg"
 	"github.com/oo-developer/mmq/src/common"
@@ -22,6 +23,10 @@ func NewModUsers() Module {
 	m.commands["list"] = m.List
 	m.commands["add"] = m.Add
 	m.commands["remove"] = m.Remove
+	m.commands["rotate-key"] = m.RotateKey
+	m.commands["disable"] = m.Disable
+	m.commands["enable"] = m.Enable
+	m.commands["set-expiry"] = m.SetExpiry
 	m.commands["help"] = m.Help
 	return m
 }
@@ -52,13 +57,21 @@ func (m *modUsers) List(client *api.Client, args ...string) error {
 	if response.Error {
 		return errors.New(response.ErrorMessage)
 	}
-	fmt.Printf("%-20s %-8s\n", "USER NAME", "ROLE")
+	fmt.Printf("%-20s %-8s %-10s %s\n", "USER NAME", "ROLE", "STATUS", "EXPIRES")
 	for _, entry := range response.Users {
 		role := "user"
 		if entry.Admin {
 			role = "admin"
 		}
-		fmt.Printf("%-20s %s\n", entry.Name, role)
+		status := "enabled"
+		if entry.Disabled {
+			status = "disabled"
+		}
+		expires := "never"
+		if entry.ExpiresAt != 0 {
+			expires = time.Unix(entry.ExpiresAt, 0).Format(time.RFC3339)
+		}
+		fmt.Printf("%-20s %-8s %-10s %s\n", entry.Name, role, status, expires)
 	}
 	return nil
 }
@@ -68,16 +81,26 @@ func (m *modUsers) Add(client *api.Client, args ...string) error {
 	name := flagSet.String("name", "", "Name of the new user")
 	admin := flagSet.Bool("admin", false, "Set to true if you want admin user")
 	keyFile := flagSet.String("key-file", "", "The file to store the private key of the new user")
+	publicKeyFile := flagSet.String("public-key", "", "Register this public key instead of generating a key pair on the broker")
+	expires := flagSet.String("expires", "", "Expiry of the user (RFC3339)")
 	flagSet.Parse(args)
 	if *name == "" {
 		return errors.New("name is required")
 	}
+	expiresAt, err := parseExpiry(*expires)
+	if err != nil {
+		return err
+	}
+	if *publicKeyFile != "" {
+		return m.addWithPublicKey(client, *name, *admin, *publicKeyFile, expiresAt)
+	}
 	request := common.AddUserReq{
 		CliRequest: common.CliRequest{
 			Type: common.COMMAND_ADD_USER,
 		},
-		Name:  *name,
-		Admin: *admin,
+		Name:      *name,
+		Admin:     *admin,
+		ExpiresAt: expiresAt,
 	}
 	requestBytes, _ := msgpack.Marshal(request)
 	responseBytes, err := client.SendCommand(requestBytes)
@@ -106,6 +129,40 @@ func (m *modUsers) Add(client *api.Client, args ...string) error {
 	return nil
 }
 
+func (m *modUsers) addWithPublicKey(client *api.Client, name string, admin bool, publicKeyFile string, expiresAt int64) error {
+	publicKeyPem, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return err
+	}
+	if _, err := api.LoadKyberPublicKey(publicKeyPem); err != nil {
+		return err
+	}
+	request := common.AddUserPublicKeyReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_ADD_USER_PUBLIC_KEY,
+		},
+		Name:         name,
+		Admin:        admin,
+		PublicKeyPem: string(publicKeyPem),
+		ExpiresAt:    expiresAt,
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.AddUserPublicKeyResp{}
+	err = msgpack.Unmarshal(responseBytes, &response)
+	if err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Println("[OK] User created successfully with the given public key")
+	return nil
+}
+
 func (m *modUsers) Remove(client *api.Client, args ...string) error {
 	flagSet := flag.NewFlagSet("users add", flag.ContinueOnError)
 	name := flagSet.String("name", "", "Name of the new user")
@@ -136,6 +193,169 @@ func (m *modUsers) Remove(client *api.Client, args ...string) error {
 	return nil
 }
 
+func (m *modUsers) RotateKey(client *api.Client, args ...string) error {
+	flagSet := flag.NewFlagSet("users rotate-key", flag.ContinueOnError)
+	name := flagSet.String("name", "", "Name of the user")
+	publicKeyFile := flagSet.String("public-key", "", "The new public key, the broker generates a key pair if not set")
+	keyFile := flagSet.String("key-file", "", "The file to store a generated private key")
+	flagSet.Parse(args)
+	if *name == "" {
+		return errors.New("--name is required")
+	}
+	request := common.RotateUserKeyReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_ROTATE_USER_KEY,
+		},
+		Name: *name,
+	}
+	if *publicKeyFile != "" {
+		publicKeyPem, err := os.ReadFile(*publicKeyFile)
+		if err != nil {
+			return err
+		}
+		if _, err := api.LoadKyberPublicKey(publicKeyPem); err != nil {
+			return err
+		}
+		request.PublicKeyPem = string(publicKeyPem)
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.RotateUserKeyResp{}
+	err = msgpack.Unmarshal(responseBytes, &response)
+	if err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Println("[OK] User key rotated successfully, active sessions were terminated")
+	if response.PrivateKeyPem == "" {
+		return nil
+	}
+	if *keyFile == "" {
+		fmt.Println("[OK] The private key is stored no where and can not be recovered")
+		fmt.Println(response.PrivateKeyPem)
+	} else {
+		err := os.WriteFile(*keyFile, []byte(response.PrivateKeyPem), 0600)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[OK] Private key written to '%s'\n", *keyFile)
+	}
+	return nil
+}
+
+func (m *modUsers) Disable(client *api.Client, args ...string) error {
+	flagSet := flag.NewFlagSet("users disable", flag.ContinueOnError)
+	name := flagSet.String("name", "", "Name of the user")
+	flagSet.Parse(args)
+	if *name == "" {
+		return errors.New("--name is required")
+	}
+	request := common.DisableUserReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_DISABLE_USER,
+		},
+		Name: *name,
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.DisableUserResp{}
+	err = msgpack.Unmarshal(responseBytes, &response)
+	if err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Println("[OK] User disabled successfully, active sessions were terminated")
+	return nil
+}
+
+func (m *modUsers) Enable(client *api.Client, args ...string) error {
+	flagSet := flag.NewFlagSet("users enable", flag.ContinueOnError)
+	name := flagSet.String("name", "", "Name of the user")
+	flagSet.Parse(args)
+	if *name == "" {
+		return errors.New("--name is required")
+	}
+	request := common.EnableUserReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_ENABLE_USER,
+		},
+		Name: *name,
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.EnableUserResp{}
+	err = msgpack.Unmarshal(responseBytes, &response)
+	if err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Println("[OK] User enabled successfully")
+	return nil
+}
+
+func (m *modUsers) SetExpiry(client *api.Client, args ...string) error {
+	flagSet := flag.NewFlagSet("users set-expiry", flag.ContinueOnError)
+	name := flagSet.String("name", "", "Name of the user")
+	expires := flagSet.String("expires", "", "Expiry of the user (RFC3339), empty for never")
+	flagSet.Parse(args)
+	if *name == "" {
+		return errors.New("--name is required")
+	}
+	expiresAt, err := parseExpiry(*expires)
+	if err != nil {
+		return err
+	}
+	request := common.SetUserExpiryReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_SET_USER_EXPIRY,
+		},
+		Name:      *name,
+		ExpiresAt: expiresAt,
+	}
+	requestBytes, _ := msgpack.Marshal(request)
+	responseBytes, err := client.SendCommand(requestBytes)
+	if err != nil {
+		return err
+	}
+	response := common.SetUserExpiryResp{}
+	err = msgpack.Unmarshal(responseBytes, &response)
+	if err != nil {
+		return err
+	}
+	if response.Error {
+		return errors.New(response.ErrorMessage)
+	}
+	fmt.Println("[OK] User expiry set successfully")
+	return nil
+}
+
+// parseExpiry converts an RFC3339 time to unix time, empty means no expiry
+func parseExpiry(expires string) (int64, error) {
+	if expires == "" {
+		return 0, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, expires)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expiry '%s': %w", expires, err)
+	}
+	return expiresAt.Unix(), nil
+}
+
 func (m *modUsers) Help(client *api.Client, args ...string) error {
 	return nil
 }
@@ -3,9 +3,14 @@ package module
 import api "github.com/oo-developer/mmq/pkg"
 
 var Modules = map[string]Module{
-	"users":       NewModUsers(),
-	"connections": NewModClients(),
-	"topics":      NewModTopics(),
+	"users":        NewModUsers(),
+	"connections":  NewModClients(),
+	"topics":       NewModTopics(),
+	"certificates": NewModCertificates(),
+	"listeners":    NewModListeners(),
+	"bans":         NewModBans(),
+	"groups":       NewModGroups(),
+	"storage":      NewModStorage(),
 }
 
 type Command func(client *api.Client, args ...string) error
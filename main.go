@@ -5,15 +5,27 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	api "github.com/oo-developer/mmq/pkg"
 	"github.com/oo-developer/mmq/src/application"
+	"github.com/oo-developer/mmq/src/broker"
 	"github.com/oo-developer/mmq/src/config"
 	"github.com/oo-developer/mmq/src/storage"
 	"github.com/oo-developer/mmq/src/user"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			restore(os.Args[2:])
+			return
+		case "migrate":
+			migrate(os.Args[2:])
+			return
+		}
+	}
 	configFile := flag.String("config", "server_config.json", "Path to config file")
 	flag.Parse()
 
@@ -27,6 +39,55 @@ func main() {
 	app.Start()
 }
 
+// restore restores the database of a stopped broker from a snapshot or an
+// export
+func restore(args []string) {
+	flagSet := flag.NewFlagSet("restore", flag.ExitOnError)
+	configFile := flagSet.String("config", "server_config.json", "Path to config file")
+	from := flagSet.String("from", "", "Snapshot or NDJSON export to restore")
+	flagSet.Parse(args)
+	if *from == "" {
+		fmt.Printf("[ERROR] You have to specify a snapshot or an export with --from\n")
+		os.Exit(1)
+	}
+	configuration := config.Load(*configFile)
+	if err := storage.Restore(&configuration.Storage, *from); err != nil {
+		fmt.Printf("[ERROR] Restoring from %s: %v\n", *from, err)
+		os.Exit(1)
+	}
+	fmt.Printf("[OK] Restored %s from %s\n", configuration.Storage.DbFile, *from)
+}
+
+// migrate migrates the database of a stopped broker to the schema version
+// of this binary
+func migrate(args []string) {
+	flagSet := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configFile := flagSet.String("config", "server_config.json", "Path to config file")
+	dryRun := flagSet.Bool("dry-run", false, "Check the migrations without changing the database")
+	backupFirst := flagSet.Bool("backup-first", false, "Write a snapshot of the database before migrating it")
+	flagSet.Parse(args)
+	configuration := config.Load(*configFile)
+	result, err := storage.Migrate(&configuration.Storage, *dryRun, *backupFirst)
+	if err != nil {
+		fmt.Printf("[ERROR] Migrating %s: %v\n", configuration.Storage.DbFile, err)
+		os.Exit(1)
+	}
+	if result.BackupFile != "" {
+		fmt.Printf("[OK] Backed up %s to %s\n", configuration.Storage.DbFile, result.BackupFile)
+	}
+	for _, migration := range result.Migrations {
+		fmt.Printf("  %s\n", migration)
+	}
+	switch {
+	case len(result.Migrations) == 0:
+		fmt.Printf("[OK] %s is at schema version %d\n", configuration.Storage.DbFile, result.From)
+	case *dryRun:
+		fmt.Printf("[OK] %s can be migrated from schema version %d to %d\n", configuration.Storage.DbFile, result.From, result.To)
+	default:
+		fmt.Printf("[OK] Migrated %s from schema version %d to %d\n", configuration.Storage.DbFile, result.From, result.To)
+	}
+}
+
 func initialize(configuration *config.Config) {
 
 	if configuration.Limits.MaxTopicLength > 0 {
@@ -73,9 +134,9 @@ func initialize(configuration *config.Config) {
 
 		storageService := storage.NewStorage(configuration)
 		storageService.Start()
-		userService := user.NewUserService(configuration, storageService)
+		userService := user.NewUserService(configuration, storageService, broker.NewBrokerService(storageService))
 		userService.Start()
-		privateAdminKeyPem, err := userService.AddUser("admin", true)
+		privateAdminKeyPem, err := userService.AddUser("admin", true, time.Time{})
 		userService.Shutdown()
 		if err != nil {
 			fmt.Printf("[ERROR] adding user: %s\n", err)
@@ -92,4 +153,47 @@ func initialize(configuration *config.Config) {
 		}
 		fmt.Printf("[OK] Created private admin key file: %s\n", privateAdminKeyPemFileName)
 	}
+	if configuration.Certificates.Enabled && configuration.Certificates.CaPrivateKeyFile != "" {
+		initializeCertificateAuthority(configuration)
+	}
+}
+
+func initializeCertificateAuthority(configuration *config.Config) {
+	if _, err := os.Stat(configuration.Certificates.CaPrivateKeyFile); !os.IsNotExist(err) {
+		return
+	}
+	fmt.Printf("[OK] CaPrivateKeyFile does not exist: %s\n", configuration.Certificates.CaPrivateKeyFile)
+	fmt.Printf("[OK] Generating new CA key pair ...\n")
+
+	publicKey, privateKey, err := api.GenerateMLDSAKeyPair()
+	if err != nil {
+		fmt.Printf("[ERROR] Error generating new CA key pair: %s\n", err)
+		os.Exit(1)
+	}
+	publicKeyPem, err := api.EncodeMLDSAPublicKeyPEM(publicKey)
+	if err != nil {
+		fmt.Printf("[ERROR] Error encoding CA public key: %s\n", err)
+		os.Exit(1)
+	}
+	privateKeyPem, err := api.EncodeMLDSAPrivateKeyPEM(privateKey)
+	if err != nil {
+		fmt.Printf("[ERROR] Error encoding CA private key: %s\n", err)
+		os.Exit(1)
+	}
+	err = os.MkdirAll(filepath.Dir(configuration.Certificates.CaPrivateKeyFile), 0755)
+	if err != nil {
+		fmt.Printf("[ERROR] Error creating directory: %s\n", err)
+	}
+	err = os.WriteFile(configuration.Certificates.CaPrivateKeyFile, privateKeyPem, 0600)
+	if err != nil {
+		fmt.Printf("[ERROR] Error creating CA private key file: %s\n", err)
+		os.Exit(1)
+	}
+	err = os.WriteFile(configuration.Certificates.CaPublicKeyFile, publicKeyPem, 0644)
+	if err != nil {
+		fmt.Printf("[ERROR] Error creating CA public key file: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("[OK] Created CA private key file: %s\n", configuration.Certificates.CaPrivateKeyFile)
+	fmt.Printf("[OK] Created CA public key file: %s\n", configuration.Certificates.CaPublicKeyFile)
 }
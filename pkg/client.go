@@ -1,6 +1,7 @@
 package api
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,8 +10,10 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 // MessageHandler is called when a message is received
@@ -20,6 +23,10 @@ type Subscription struct {
 	Id      string
 	Topic   string
 	Handler MessageHandler
+	// StreamHandler receives the messages of a stream subscription
+	StreamHandler StreamHandler
+	// Group is the consumer group a stream subscription belongs to
+	Group string
 }
 
 // Client represents a broker client
@@ -29,16 +36,28 @@ type Client struct {
 	connCommand      net.Conn
 	connPublish      net.Conn
 	clientPrivateKey *KyberPrivateKey
+	ephemeralKeyPem  []byte
+	certificate      []byte
+	tlsConfig        *tls.Config
 	noCipher         Cipher
 	handshakeCipher  Cipher
 	transportCipher  Cipher
+	publishCipher    Cipher
 	kemCipherText    []byte
+	pairingToken     string
+	disconnectReason string
+	reconnectAfter   time.Duration
+	ticket           *SessionTicket
 	securityEnabled  bool
+	multiplex        bool
+	responses        chan *Message
 	subscriptions    map[string]*Subscription
 	messageChannel   chan *Message
 	done             chan struct{}
 	wg               sync.WaitGroup
 	mu               sync.RWMutex
+	// subscribing is held while a subscription waits for its id
+	subscribing sync.Mutex
 }
 
 // Config holds client configuration
@@ -47,6 +66,24 @@ type Config struct {
 	Address              string `json:"address"`
 	User                 string `json:"user"`
 	ClientPrivateKeyFile string `json:"clientPrivateKeyFile"`
+	CertificateFile      string `json:"certificateFile"`
+	TicketFile           string `json:"ticketFile"`
+	Token                string `json:"token"`
+	Password             string `json:"password"`
+	TlsCaFile            string `json:"tlsCaFile"`
+	TlsCertFile          string `json:"tlsCertFile"`
+	TlsKeyFile           string `json:"tlsKeyFile"`
+	TlsServerName        string `json:"tlsServerName"`
+	WebSocketPath        string `json:"webSocketPath"`
+	WebSocketOrigin      string `json:"webSocketOrigin"`
+	// Multiplex receives the published messages on the command connection
+	Multiplex bool `json:"multiplex"`
+	// ClientId is a stable client id, a connection with the same id takes
+	// over the session. Without it every client gets a random id.
+	ClientId string `json:"clientId"`
+	// PersistentSession keeps the subscriptions and queued messages of a
+	// session that is taken over
+	PersistentSession bool `json:"persistentSession"`
 }
 
 func LoadConfig(configFile string) (*Config, error) {
@@ -72,19 +109,75 @@ func NewClient(config *Config) (*Client, error) {
 		subscriptions:   make(map[string]*Subscription),
 		messageChannel:  make(chan *Message, 1000),
 	}
-	clientPrivateKey, err := LoadKyberPrivateKeyFile(config.ClientPrivateKeyFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load client private key: %w", err)
+	if config.ClientId != "" {
+		if len(config.ClientId) > MaxClientIdLength {
+			return nil, fmt.Errorf("client id too long (%d > %d)", len(config.ClientId), MaxClientIdLength)
+		}
+		client.clientId = config.ClientId
+	}
+	var err error
+	if config.ClientPrivateKeyFile != "" {
+		client.clientPrivateKey, err = LoadKyberPrivateKeyFile(config.ClientPrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client private key: %w", err)
+		}
+	} else {
+		// Token and password users have no registered key, an ephemeral key
+		// protects the handshake
+		publicKey, privateKey, err := GenerateKyberKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		client.ephemeralKeyPem, err = EncodeKyberPublicKeyPEM(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		client.clientPrivateKey = privateKey
+	}
+	if config.CertificateFile != "" {
+		client.certificate, err = os.ReadFile(config.CertificateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+	}
+	if config.Network == NetworkTLS || config.Network == NetworkWSS {
+		client.tlsConfig, err = newClientTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
 	}
-	client.clientPrivateKey = clientPrivateKey
 	client.noCipher = NewNoCipher()
+	if config.TicketFile != "" {
+		if ticket, err := LoadSessionTicketFile(config.TicketFile); err == nil {
+			client.ticket = ticket
+		}
+	}
 	client.handlePublishMessage()
 	return client, nil
 }
 
+// Connect connects to the broker. A valid session ticket is used to resume the
+// session, if that fails the full handshake is done.
 func (c *Client) Connect() error {
+	// Connections of a previous session no longer report to this client
+	c.connPublish = nil
+	c.setDisconnect(&Disconnect{})
+	if c.ticket.Valid() {
+		err := c.resume()
+		if err == nil {
+			return nil
+		}
+		log.Printf("Session resumption failed, falling back to full handshake: %v", err)
+		c.closeConnections()
+		c.ticket = nil
+	}
+	return c.handshake()
+}
+
+func (c *Client) handshake() error {
 	var err error
-	c.connCommand, err = net.Dial(c.config.Network, c.config.Address)
+	c.pairingToken = ""
+	c.connCommand, err = c.dial(c.config.Address)
 	if err != nil {
 		return fmt.Errorf("failed to connect: %w", err)
 	}
@@ -94,6 +187,12 @@ func (c *Client) Connect() error {
 		Type:    TypeConnect,
 		Payload: []byte("wuff"),
 	}
+	if c.config.Multiplex {
+		connectMsg.Properties |= Multiplex
+	}
+	if c.config.PersistentSession {
+		connectMsg.Properties |= PersistentSession
+	}
 	if err := connectMsg.Send(c.connCommand, c.noCipher); err != nil {
 		return fmt.Errorf("failed to send CONNECT message: %w", err)
 	}
@@ -104,6 +203,13 @@ func (c *Client) Connect() error {
 	if msg.Type != TypeConnectAck {
 		return fmt.Errorf("failed to receive CONNECT_ACK")
 	}
+	secure, err := secureChannel(c.connCommand, msg)
+	if err != nil {
+		return err
+	}
+	if err := c.setMultiplex(msg); err != nil {
+		return err
+	}
 	serverPublicKey, err := LoadKyberPublicKey(msg.Payload)
 	if err != nil {
 		return fmt.Errorf("failed to load kyber public key: %w", err)
@@ -111,9 +217,13 @@ func (c *Client) Connect() error {
 	c.handshakeCipher = NewKyberCipher(c.clientPrivateKey, serverPublicKey)
 
 	// Send AUTHENTICATE message
+	credentials, err := c.credentials()
+	if err != nil {
+		return err
+	}
 	authMsg := &Message{
 		Type:     TypeAuthenticate,
-		Payload:  []byte(c.config.User),
+		Payload:  credentials,
 		ClientId: c.clientId,
 	}
 	if err = authMsg.Send(c.connCommand, c.handshakeCipher); err != nil {
@@ -126,19 +236,32 @@ func (c *Client) Connect() error {
 	if msg.Type != TypeAuthenticateAck {
 		return fmt.Errorf("expected AUTHENTICATE_ACK, got %v", msg.Type)
 	}
-	channelAddress := string(msg.Payload)
+	channelAddress := c.readGrant(msg.Payload)
 
-	// Send SESSION_KEY message
-	transportCipher, kemCipherText, err := EstablishChCha20Cipher(serverPublicKey.key)
+	// Send SESSION_KEY message, on a secure channel it only carries the
+	// pairing token that proves the key
+	sessionKey := &SessionKey{
+		PairingToken: c.pairingToken,
+	}
+	if secure {
+		c.transportCipher = c.noCipher
+	} else {
+		transportCipher, kemCipherText, err := EstablishChCha20Cipher(serverPublicKey.key)
+		if err != nil {
+			return fmt.Errorf("failed to establish chaCha20 cipher: %w", err)
+		}
+		c.transportCipher = transportCipher
+		c.kemCipherText = kemCipherText
+		c.transportCipher.Enable(true)
+		sessionKey.KemCipherText = kemCipherText
+	}
+	payload, err := msgpack.Marshal(sessionKey)
 	if err != nil {
-		return fmt.Errorf("failed to establish chaCha20 cipher: %w", err)
+		return fmt.Errorf("failed to encode SESSION_KEY: %w", err)
 	}
-	c.transportCipher = transportCipher
-	c.kemCipherText = kemCipherText
-	c.transportCipher.Enable(true)
 	sessionKeyMsg := &Message{
 		Type:     TypeSessionKey,
-		Payload:  []byte(kemCipherText),
+		Payload:  payload,
 		ClientId: c.clientId,
 	}
 	if err = sessionKeyMsg.Send(c.connCommand, c.handshakeCipher); err != nil {
@@ -148,9 +271,23 @@ func (c *Client) Connect() error {
 	if err != nil {
 		return fmt.Errorf("failed to receive SESSION_KEY_ACK: %w", err)
 	}
+	if msg.Type == TypeReject {
+		return rejectionOf(msg)
+	}
 	if msg.Type != TypeSessionKeyAck {
 		return fmt.Errorf("expected SESSION_KEY_ACK, got %v", msg.Type)
 	}
+	c.publishCipher = c.transportCipher
+	if len(msg.Payload) > 0 {
+		if err := c.storeTicket(msg.Payload, channelAddress); err != nil {
+			log.Printf("Failed to store session ticket: %v", err)
+		}
+	}
+
+	if c.multiplex {
+		c.startMultiplex()
+		return nil
+	}
 
 	// Connect to publish socket
 	err = c.connectPublishSocket(channelAddress)
@@ -160,9 +297,37 @@ func (c *Client) Connect() error {
 	return nil
 }
 
+// readGrant returns the publish address of an AUTHENTICATE_ACK and keeps the
+// pairing token for the publish connection
+func (c *Client) readGrant(payload []byte) string {
+	grant := &AuthenticateGrant{}
+	if err := msgpack.Unmarshal(payload, grant); err != nil {
+		// Older brokers send the plain publish address
+		c.pairingToken = ""
+		return string(payload)
+	}
+	c.pairingToken = grant.PairingToken
+	return grant.PublishAddress
+}
+
+func (c *Client) credentials() ([]byte, error) {
+	credentials, err := msgpack.Marshal(&Credentials{
+		User:         c.config.User,
+		Certificate:  c.certificate,
+		Token:        c.config.Token,
+		Password:     c.config.Password,
+		PublicKeyPem: string(c.ephemeralKeyPem),
+		PairingToken: c.pairingToken,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode credentials: %w", err)
+	}
+	return credentials, nil
+}
+
 func (c *Client) connectPublishSocket(address string) error {
 	var err error
-	c.connPublish, err = net.Dial(c.config.Network, address)
+	c.connPublish, err = c.dial(address)
 	if err != nil {
 		return fmt.Errorf("failed to connect: %w", err)
 	}
@@ -182,11 +347,19 @@ func (c *Client) connectPublishSocket(address string) error {
 	if msg.Type != TypeConnectAck {
 		return fmt.Errorf("failed to receive CONNECT_ACK")
 	}
+	secure, err := secureChannel(c.connPublish, msg)
+	if err != nil {
+		return err
+	}
 
 	// Send AUTHENTICATE message
+	credentials, err := c.credentials()
+	if err != nil {
+		return err
+	}
 	authMsg := &Message{
 		Type:     TypeAuthenticate,
-		Payload:  []byte(c.config.User),
+		Payload:  credentials,
 		ClientId: c.clientId,
 	}
 	if err := authMsg.Send(c.connPublish, c.handshakeCipher); err != nil {
@@ -196,9 +369,16 @@ func (c *Client) connectPublishSocket(address string) error {
 	if err != nil {
 		return fmt.Errorf("failed to receive AUTHENTICATE_ACK: %w", err)
 	}
+	if msg.Type == TypeReject {
+		return rejectionOf(msg)
+	}
 	if msg.Type != TypeAuthenticateAck {
 		return fmt.Errorf("expected AUTHENTICATE_ACK, got %v", msg.Type)
 	}
+	if secure {
+		go c.receivePublishLoop()
+		return nil
+	}
 
 	// Send SESSION_KEY message
 	sessionKeyMsg := &Message{
@@ -230,23 +410,122 @@ func (c *Client) Subscribe(topic string, handler MessageHandler) error {
 		Topic:    topic,
 		ClientId: c.clientId,
 	}
-
-	if err := msg.Send(c.connCommand, c.transportCipher); err != nil {
-		return fmt.Errorf("failed to SUBSCRIBE: %w", err)
-	}
-	msgAck, err := Receive(c.connCommand, c.transportCipher)
+	c.subscribing.Lock()
+	defer c.subscribing.Unlock()
+	subscriptionId, err := c.subscribe(msg)
 	if err != nil {
-		return fmt.Errorf("failed to receive SUBSCRIBE_ACK: %w", err)
+		return err
 	}
-	sub := &Subscription{
-		Id:      msgAck.SubscriptionId,
+	c.addSubscription(&Subscription{
+		Id:      subscriptionId,
 		Topic:   topic,
 		Handler: handler,
+	})
+	return nil
+}
+
+// SubscribeStream subscribes to stream topics from start on, the messages
+// of topics that are no streams are delivered as they are published
+func (c *Client) SubscribeStream(topic string, start StreamStart, handler StreamHandler) error {
+	payload, err := msgpack.Marshal(&start)
+	if err != nil {
+		return err
+	}
+	msg := &Message{
+		Type:       TypeSubscribe,
+		Properties: Stream,
+		Topic:      topic,
+		Payload:    payload,
+		ClientId:   c.clientId,
+	}
+	c.subscribing.Lock()
+	defer c.subscribing.Unlock()
+	subscriptionId, err := c.subscribe(msg)
+	if err != nil {
+		return err
+	}
+	c.addSubscription(&Subscription{
+		Id:            subscriptionId,
+		Topic:         topic,
+		StreamHandler: handler,
+	})
+	return nil
+}
+
+// ConsumeGroup joins the consumer group on the stream topics matching topic,
+// each message goes to one member of the group. The offset of a message is
+// committed when handler returns, uncommitted messages of a member that
+// leaves are delivered to the other members.
+func (c *Client) ConsumeGroup(group string, topic string, handler StreamHandler) error {
+	if group == "" {
+		return fmt.Errorf("group name is required")
+	}
+	payload, err := msgpack.Marshal(&StreamStart{Group: group})
+	if err != nil {
+		return err
+	}
+	msg := &Message{
+		Type:       TypeSubscribe,
+		Properties: Stream,
+		Topic:      topic,
+		Payload:    payload,
+		ClientId:   c.clientId,
+	}
+	c.subscribing.Lock()
+	defer c.subscribing.Unlock()
+	subscriptionId, err := c.subscribe(msg)
+	if err != nil {
+		return err
+	}
+	c.addSubscription(&Subscription{
+		Id:            subscriptionId,
+		Topic:         topic,
+		StreamHandler: handler,
+		Group:         group,
+	})
+	return nil
+}
+
+// commit tells the broker that a message of a consumer group was handled
+func (c *Client) commit(msg *Message) {
+	commitMsg := &Message{
+		Type:           TypeMessageAck,
+		Properties:     Stream,
+		Topic:          msg.Topic,
+		ClientId:       c.clientId,
+		SubscriptionId: msg.SubscriptionId,
+		Offset:         msg.Offset,
+	}
+	if err := c.send(commitMsg); err != nil {
+		log.Printf("Failed to commit offset %d of %s: %v", msg.Offset, msg.Topic, err)
+	}
+}
+
+func (c *Client) subscribe(msg *Message) (string, error) {
+	if err := c.send(msg); err != nil {
+		return "", fmt.Errorf("failed to SUBSCRIBE: %w", err)
 	}
+	msgAck, err := c.receive()
+	if err != nil {
+		return "", fmt.Errorf("failed to receive SUBSCRIBE_ACK: %w", err)
+	}
+	if msgAck.SubscriptionId == "" {
+		return "", fmt.Errorf("subscription to '%s' rejected", msg.Topic)
+	}
+	return msgAck.SubscriptionId, nil
+}
+
+func (c *Client) subscription(id string) (*Subscription, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	sub, ok := c.subscriptions[id]
+	return sub, ok
+}
+
+func (c *Client) addSubscription(sub *Subscription) {
 	c.mu.Lock()
 	c.subscriptions[sub.Id] = sub
 	c.mu.Unlock()
-	return nil
 }
 
 // Unsubscribe unsubscribes from a topic
@@ -269,10 +548,10 @@ func (c *Client) Unsubscribe(topic string) error {
 			ClientId:       c.clientId,
 			SubscriptionId: id,
 		}
-		if err := msg.Send(c.connCommand, c.transportCipher); err != nil {
+		if err := c.send(msg); err != nil {
 			return fmt.Errorf("failed to UNSUBSCRIBE: %w", err)
 		}
-		if _, err := Receive(c.connCommand, c.transportCipher); err != nil {
+		if _, err := c.receive(); err != nil {
 			return fmt.Errorf("failed to receive UNSUBSCRIBE_ACK: %w", err)
 		}
 	}
@@ -294,12 +573,17 @@ func (c *Client) Publish(topic string, payload []byte, properties ...MessageProp
 		ClientId:   c.clientId,
 	}
 
-	if err := msg.Send(c.connCommand, c.transportCipher); err != nil {
+	if err := c.send(msg); err != nil {
 		return fmt.Errorf("failed to PUBLISH: %w", err)
 	}
-	if _, err := Receive(c.connCommand, c.transportCipher); err != nil {
+	msgAck, err := c.receive()
+	if err != nil {
 		return fmt.Errorf("failed to receive PUBLISH_ACK: %w", err)
 	}
+	// A PUBLISH_ACK with payload tells why the message was not published
+	if len(msgAck.Payload) > 0 {
+		return fmt.Errorf("publish to '%s' failed: %s", topic, msgAck.Payload)
+	}
 
 	return nil
 }
@@ -310,10 +594,10 @@ func (c *Client) SendCommand(command []byte) ([]byte, error) {
 		Payload:  command,
 		ClientId: c.clientId,
 	}
-	if err := msg.Send(c.connCommand, c.transportCipher); err != nil {
+	if err := c.send(msg); err != nil {
 		return nil, fmt.Errorf("failed to send CLI_COMMAND: %w", err)
 	}
-	msg, err := Receive(c.connCommand, c.transportCipher)
+	msg, err := c.receive()
 	if err != nil || msg.Type != TypeCliCommandAck {
 		return nil, fmt.Errorf("failed to receive CLI_COMMAND_ACK: %w", err)
 	}
@@ -321,18 +605,58 @@ func (c *Client) SendCommand(command []byte) ([]byte, error) {
 }
 
 func (c *Client) receivePublishLoop() {
+	conn, cipher := c.connPublish, c.publishCipher
 	for {
-		msg, err := Receive(c.connPublish, c.transportCipher)
-		if errors.Is(err, io.EOF) {
+		msg, err := Receive(conn, cipher)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error receiving message: %v", err)
+			}
 			return
 		}
-		if err != nil {
-			log.Printf("Error receiving message: %v", err)
+		if msg.Type == TypeDisconnect {
+			// The connection of a session this client took over itself is not reported
+			if conn == c.connPublish {
+				c.setDisconnect(disconnectOf(msg))
+			}
+			continue
 		}
 		c.messageChannel <- msg
 	}
 }
 
+// DisconnectReason tells why the broker disconnected the client, it is empty
+// while the client is connected
+func (c *Client) DisconnectReason() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.disconnectReason
+}
+
+// ReconnectAfter is how long the broker asked the client to wait before it
+// connects again, it is zero when the broker gave no hint
+func (c *Client) ReconnectAfter() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.reconnectAfter
+}
+
+func (c *Client) setDisconnect(disconnect *Disconnect) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if disconnect.Reason != "" {
+		log.Printf("Disconnected by broker: %s", disconnect.Reason)
+	}
+	c.disconnectReason = disconnect.Reason
+	c.reconnectAfter = disconnect.ReconnectAfter()
+}
+
+func (c *Client) disconnectError() *DisconnectError {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return &DisconnectError{Reason: c.disconnectReason, ReconnectAfter: c.reconnectAfter}
+}
+
 func (c *Client) handlePublishMessage() {
 	go func() {
 		for {
@@ -340,12 +664,22 @@ func (c *Client) handlePublishMessage() {
 			case msg := <-c.messageChannel:
 				switch msg.Type {
 				case TypeMessage:
-					c.mu.RLock()
-					if sub, ok := c.subscriptions[msg.SubscriptionId]; ok {
-						c.mu.RUnlock()
-						sub.Handler(msg.Topic, msg.Payload)
-					} else {
-						c.mu.RUnlock()
+					sub, ok := c.subscription(msg.SubscriptionId)
+					if !ok {
+						// Retained and replayed messages may overtake the SUBSCRIBE_ACK
+						c.subscribing.Lock()
+						c.subscribing.Unlock()
+						sub, ok = c.subscription(msg.SubscriptionId)
+					}
+					if ok {
+						if sub.StreamHandler != nil {
+							sub.StreamHandler(msg.Topic, msg.Payload, msg.Offset, time.Unix(0, msg.Timestamp))
+							if sub.Group != "" {
+								c.commit(msg)
+							}
+						} else {
+							sub.Handler(msg.Topic, msg.Payload)
+						}
 					}
 				default:
 					log.Printf("Unhandled publish message type: %v", msg.Type)
@@ -364,10 +698,12 @@ func (c *Client) Disconnect() error {
 	}
 
 	disconnectMsg.Send(c.connCommand, c.transportCipher)
-	if _, err := Receive(c.connCommand, c.transportCipher); err != nil {
+	if _, err := c.receive(); err != nil {
 		return fmt.Errorf("failed to receive PublishAck: %w", err)
 	}
 	c.connCommand.Close()
-	c.connPublish.Close()
+	if c.connPublish != nil {
+		c.connPublish.Close()
+	}
 	return nil
 }
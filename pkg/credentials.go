@@ -0,0 +1,30 @@
+package api
+
+// Credentials are the payload of an AUTHENTICATE message
+type Credentials struct {
+	User        string `msgpack:"user"`
+	Certificate []byte `msgpack:"certificate"`
+	Token       string `msgpack:"token"`
+	Password    string `msgpack:"password"`
+	// PublicKeyPem is the ephemeral key of clients without a registered key,
+	// it is used to encrypt the handshake answers
+	PublicKeyPem string `msgpack:"publicKeyPem"`
+	// PairingToken binds a publish connection to its command connection
+	PairingToken string `msgpack:"pairingToken,omitempty"`
+}
+
+// AuthenticateGrant is the payload of the AUTHENTICATE_ACK of a command
+// connection. The pairing token is valid for a single publish connection.
+type AuthenticateGrant struct {
+	PublishAddress string `msgpack:"publishAddress"`
+	PairingToken   string `msgpack:"pairingToken"`
+}
+
+// SessionKey is the payload of the SESSION_KEY of a command connection. The
+// pairing token of the AUTHENTICATE_ACK proves the client holds the key of
+// the user, the KEM ciphertext is empty on a secure channel. After a
+// RESUME_ACK the pairing token of the ticket grant proves the ticket secret.
+type SessionKey struct {
+	KemCipherText []byte `msgpack:"kemCipherText,omitempty"`
+	PairingToken  string `msgpack:"pairingToken"`
+}
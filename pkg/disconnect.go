@@ -0,0 +1,57 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Disconnect is the payload of a DISCONNECT message of the broker
+type Disconnect struct {
+	Reason string `msgpack:"reason"`
+	// ReconnectAfterMillis hints how long the client should wait before it
+	// connects again, zero when there is no hint
+	ReconnectAfterMillis int64 `msgpack:"reconnectAfterMillis,omitempty"`
+}
+
+// ReconnectAfter is the reconnect hint of the broker
+func (d *Disconnect) ReconnectAfter() time.Duration {
+	return time.Duration(d.ReconnectAfterMillis) * time.Millisecond
+}
+
+// DisconnectError is returned when the broker disconnected the client
+type DisconnectError struct {
+	Reason         string
+	ReconnectAfter time.Duration
+}
+
+func (e *DisconnectError) Error() string {
+	if e.ReconnectAfter > 0 {
+		return fmt.Sprintf("disconnected by broker: %s (reconnect after %v)", e.Reason, e.ReconnectAfter)
+	}
+	return fmt.Sprintf("disconnected by broker: %s", e.Reason)
+}
+
+// NewDisconnectMessage builds the DISCONNECT notice to clientId
+func NewDisconnectMessage(clientId string, disconnect *Disconnect) (*Message, error) {
+	payload, err := msgpack.Marshal(disconnect)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Type:     TypeDisconnect,
+		ClientId: clientId,
+		Payload:  payload,
+	}, nil
+}
+
+// disconnectOf decodes the Disconnect of a DISCONNECT message, older brokers
+// send the plain reason
+func disconnectOf(msg *Message) *Disconnect {
+	disconnect := &Disconnect{}
+	if err := msgpack.Unmarshal(msg.Payload, disconnect); err != nil {
+		return &Disconnect{Reason: string(msg.Payload)}
+	}
+	return disconnect
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+)
+
+// setMultiplex checks that the broker confirmed the requested multiplex mode
+func (c *Client) setMultiplex(ack *Message) error {
+	if !c.config.Multiplex {
+		return nil
+	}
+	if ack.Properties&Multiplex == 0 {
+		return fmt.Errorf("broker does not support multiplex mode")
+	}
+	c.multiplex = true
+	return nil
+}
+
+// startMultiplex splits the command connection into answers and published messages
+func (c *Client) startMultiplex() {
+	c.responses = make(chan *Message, 1)
+	go c.receiveMultiplexLoop(c.responses)
+}
+
+func (c *Client) receiveMultiplexLoop(responses chan *Message) {
+	defer close(responses)
+	conn, cipher := c.connCommand, c.transportCipher
+	for {
+		msg, err := Receive(conn, cipher)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error receiving message: %v", err)
+			}
+			return
+		}
+		switch msg.Type {
+		case TypeMessage:
+			c.messageChannel <- msg
+		case TypeDisconnect:
+			if conn == c.connCommand {
+				c.setDisconnect(disconnectOf(msg))
+			}
+		default:
+			responses <- msg
+		}
+	}
+}
+
+// send writes a request to the command connection, once the broker
+// disconnected the client it returns the DisconnectError
+func (c *Client) send(msg *Message) error {
+	if c.DisconnectReason() != "" {
+		return c.disconnectError()
+	}
+	return msg.Send(c.connCommand, c.transportCipher)
+}
+
+// receive returns the answer to a request on the command connection, a
+// DISCONNECT of the broker is returned as DisconnectError
+func (c *Client) receive() (*Message, error) {
+	var msg *Message
+	if c.multiplex {
+		var ok bool
+		if msg, ok = <-c.responses; !ok {
+			if c.DisconnectReason() != "" {
+				return nil, c.disconnectError()
+			}
+			return nil, io.EOF
+		}
+	} else {
+		var err error
+		if msg, err = Receive(c.connCommand, c.transportCipher); err != nil {
+			return nil, err
+		}
+	}
+	if msg.Type == TypeDisconnect {
+		c.setDisconnect(disconnectOf(msg))
+		return nil, c.disconnectError()
+	}
+	return msg, nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 )
 
 type MessageType byte
@@ -30,11 +31,27 @@ const (
 	TypeCliCommand
 	TypeCliCommandAck
 	TypeDisconnect
+	TypeResume
+	TypeResumeAck
+	TypeReject
 )
 
 const (
 	Retained   MessageProperty = 1 << 0
 	Persistent MessageProperty = 1 << 1
+	// SecureChannel on CONNECT_ACK tells the client that the connection is
+	// protected by TLS and the session key exchange is skipped
+	SecureChannel MessageProperty = 1 << 2
+	// Multiplex on CONNECT or RESUME asks the broker to send the published
+	// messages over the command connection, the broker confirms it on the answer
+	Multiplex MessageProperty = 1 << 3
+	// PersistentSession on CONNECT or RESUME keeps the subscriptions and
+	// queued messages of a connection with the same client id that is taken over
+	PersistentSession MessageProperty = 1 << 4
+	// Stream on MESSAGE tells that offset and timestamp of the stream entry
+	// follow the subscription id, on SUBSCRIBE the payload is a StreamStart.
+	// MESSAGE_ACK with Stream commits the offset for a consumer group.
+	Stream MessageProperty = 1 << 5
 )
 
 var (
@@ -54,6 +71,17 @@ type Message struct {
 	Payload        []byte
 	ClientId       string
 	SubscriptionId string
+	// Sequence orders the messages of the broker and ReplyTo names the topic
+	// for a response, neither is sent on the wire
+	Sequence uint64
+	ReplyTo  string
+	// Replay marks a retained message sent to a new subscription, it is not
+	// sent on the wire either
+	Replay bool
+	// Offset and Timestamp (unix nanoseconds) locate a message in the log of
+	// a stream topic, they are sent with the Stream property
+	Offset    uint64
+	Timestamp int64
 }
 
 func (m *Message) IsRetained() bool {
@@ -75,10 +103,15 @@ func (m *Message) Send(w io.Writer, cypher Cipher) error {
 	if err != nil {
 		return fmt.Errorf("encrypt failed: %v", err)
 	}
-	if err := binary.Write(w, binary.BigEndian, uint16(len(encryptedData))); err != nil {
-		return fmt.Errorf("failed to write data length: %w", err)
+	if len(encryptedData) > math.MaxUint16 {
+		return fmt.Errorf("frame too long (%d > %d)", len(encryptedData), math.MaxUint16)
 	}
-	if _, err := w.Write(encryptedData); err != nil {
+	// Length and data are written at once, so a frame is a single WebSocket
+	// message and concurrent senders on a multiplexed connection do not interleave
+	frame := make([]byte, 2+len(encryptedData))
+	binary.BigEndian.PutUint16(frame, uint16(len(encryptedData)))
+	copy(frame[2:], encryptedData)
+	if _, err := w.Write(frame); err != nil {
 		return fmt.Errorf("failed to write data: %w", err)
 	}
 	return nil
@@ -157,6 +190,15 @@ func (m *Message) encode(w io.Writer) error {
 		return fmt.Errorf("failed to write subscription ID: %w", err)
 	}
 
+	// Older clients ignore the trailing stream position
+	if (m.Type == TypeMessage || m.Type == TypeMessageAck) && m.Properties&Stream != 0 {
+		if err := binary.Write(w, binary.BigEndian, m.Offset); err != nil {
+			return fmt.Errorf("failed to write offset: %w", err)
+		}
+		if err := binary.Write(w, binary.BigEndian, m.Timestamp); err != nil {
+			return fmt.Errorf("failed to write timestamp: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -220,5 +262,13 @@ func decode(r io.Reader) (*Message, error) {
 	}
 	msg.SubscriptionId = string(subscriptionIdBytes)
 
+	if (msg.Type == TypeMessage || msg.Type == TypeMessageAck) && msg.Properties&Stream != 0 {
+		if err := binary.Read(r, binary.BigEndian, &msg.Offset); err != nil {
+			return nil, fmt.Errorf("failed to read offset: %w", err)
+		}
+		if err := binary.Read(r, binary.BigEndian, &msg.Timestamp); err != nil {
+			return nil, fmt.Errorf("failed to read timestamp: %w", err)
+		}
+	}
 	return msg, nil
 }
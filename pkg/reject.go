@@ -0,0 +1,70 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// RejectReason tells a client why the broker refused a connection
+type RejectReason byte
+
+const (
+	RejectUnknownClient RejectReason = iota + 1
+	RejectUserMismatch
+	RejectInvalidPairing
+	RejectAlreadyPaired
+	RejectClientIdInUse
+	RejectKeyNotProven
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectUnknownClient:
+		return "unknown client"
+	case RejectUserMismatch:
+		return "user mismatch"
+	case RejectInvalidPairing:
+		return "invalid pairing token"
+	case RejectAlreadyPaired:
+		return "already paired"
+	case RejectClientIdInUse:
+		return "client id in use"
+	case RejectKeyNotProven:
+		return "key not proven"
+	}
+	return fmt.Sprintf("reason %d", byte(r))
+}
+
+// Rejection is the payload of a REJECT message, it is returned as error by
+// the client
+type Rejection struct {
+	Reason  RejectReason `msgpack:"reason"`
+	Message string       `msgpack:"message"`
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("rejected by broker (%s): %s", r.Reason, r.Message)
+}
+
+// NewRejectMessage builds the REJECT answer to a connection of clientId
+func NewRejectMessage(clientId string, rejection *Rejection) (*Message, error) {
+	payload, err := msgpack.Marshal(rejection)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Type:     TypeReject,
+		ClientId: clientId,
+		Payload:  payload,
+	}, nil
+}
+
+// rejectionOf decodes the Rejection of a REJECT message
+func rejectionOf(msg *Message) error {
+	rejection := &Rejection{}
+	if err := msgpack.Unmarshal(msg.Payload, rejection); err != nil {
+		return fmt.Errorf("failed to decode REJECT: %w", err)
+	}
+	return rejection
+}
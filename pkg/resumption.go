@@ -0,0 +1,273 @@
+package api
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const ResumeNonceSize = 32
+
+// TicketGrant is issued by the broker after a successful handshake. The ticket
+// itself is opaque to the client, the secret is used to derive the keys of a
+// resumed session.
+type TicketGrant struct {
+	Ticket    []byte `msgpack:"ticket"`
+	Secret    []byte `msgpack:"secret"`
+	ExpiresAt int64  `msgpack:"expiresAt"`
+	// PairingToken is handed out on a resumed command connection for the
+	// publish connection
+	PairingToken string `msgpack:"pairingToken,omitempty"`
+}
+
+// ResumeRequest is sent instead of CONNECT by a client holding a session ticket
+type ResumeRequest struct {
+	Ticket       []byte `msgpack:"ticket"`
+	Nonce        []byte `msgpack:"nonce"`
+	PairingToken string `msgpack:"pairingToken,omitempty"`
+}
+
+// ResumeResponse answers a ResumeRequest. Grant is encrypted with the resumed
+// session key, so only a client knowing the ticket secret can read it.
+type ResumeResponse struct {
+	Nonce []byte `msgpack:"nonce"`
+	Grant []byte `msgpack:"grant"`
+}
+
+// SessionTicket is the client side view of a TicketGrant
+type SessionTicket struct {
+	Ticket         []byte `json:"ticket"`
+	Secret         []byte `json:"secret"`
+	ExpiresAt      int64  `json:"expiresAt"`
+	PublishAddress string `json:"publishAddress"`
+}
+
+func (t *SessionTicket) Valid() bool {
+	return t != nil && len(t.Ticket) > 0 && time.Now().Unix() < t.ExpiresAt
+}
+
+// LoadSessionTicketFile reads a session ticket written by SaveSessionTicketFile
+func LoadSessionTicketFile(fileName string) (*SessionTicket, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	ticket := &SessionTicket{}
+	if err := json.Unmarshal(data, ticket); err != nil {
+		return nil, fmt.Errorf("failed to parse session ticket: %w", err)
+	}
+	return ticket, nil
+}
+
+// SaveSessionTicketFile stores a session ticket, the file contains the ticket secret
+func SaveSessionTicketFile(fileName string, ticket *SessionTicket) error {
+	data, err := json.Marshal(ticket)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0600)
+}
+
+// NewResumeNonce returns a fresh random nonce for session resumption
+func NewResumeNonce() ([]byte, error) {
+	nonce := make([]byte, ResumeNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return nonce, nil
+}
+
+// NewResumedCipher derives the transport cipher of a resumed session from the
+// ticket secret and the nonces of both sides
+func NewResumedCipher(secret, clientNonce, serverNonce []byte) (Cipher, error) {
+	if len(clientNonce) != ResumeNonceSize || len(serverNonce) != ResumeNonceSize {
+		return nil, fmt.Errorf("invalid resume nonce")
+	}
+	salt := make([]byte, 0, len(clientNonce)+len(serverNonce))
+	salt = append(salt, clientNonce...)
+	salt = append(salt, serverNonce...)
+	key, err := hkdf.Key(sha256.New, secret, salt, "mmq session resumption", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive session key: %w", err)
+	}
+	return &chaCha20Cipher{
+		session: &QuantumSafeSession{key: key},
+		enabled: true,
+	}, nil
+}
+
+func (c *Client) storeTicket(grantBytes []byte, publishAddress string) error {
+	grant := &TicketGrant{}
+	if err := msgpack.Unmarshal(grantBytes, grant); err != nil {
+		return fmt.Errorf("failed to decode ticket grant: %w", err)
+	}
+	if len(grant.Ticket) == 0 {
+		return nil
+	}
+	c.ticket = &SessionTicket{
+		Ticket:         grant.Ticket,
+		Secret:         grant.Secret,
+		ExpiresAt:      grant.ExpiresAt,
+		PublishAddress: publishAddress,
+	}
+	if c.config.TicketFile != "" {
+		return SaveSessionTicketFile(c.config.TicketFile, c.ticket)
+	}
+	return nil
+}
+
+// resume connects both sockets with the session ticket instead of the full handshake
+func (c *Client) resume() error {
+	ticket := c.ticket
+	var err error
+	var grant []byte
+	c.connCommand, c.transportCipher, grant, err = c.resumeConnection(c.config.Address, ticket, c.config.Multiplex, "")
+	if err != nil {
+		return err
+	}
+	ticketGrant := &TicketGrant{}
+	if err := msgpack.Unmarshal(grant, ticketGrant); err != nil {
+		return fmt.Errorf("failed to decode ticket grant: %w", err)
+	}
+	if err := c.proveTicket(ticketGrant.PairingToken); err != nil {
+		return err
+	}
+	if !c.multiplex {
+		c.connPublish, c.publishCipher, _, err = c.resumeConnection(ticket.PublishAddress, ticket, false, ticketGrant.PairingToken)
+		if err != nil {
+			return err
+		}
+	}
+	if err := c.storeTicket(grant, ticket.PublishAddress); err != nil {
+		log.Printf("Failed to store session ticket: %v", err)
+	}
+	if c.multiplex {
+		c.startMultiplex()
+		return nil
+	}
+	go c.receivePublishLoop()
+	return nil
+}
+
+// proveTicket answers the RESUME_ACK of the command connection with the
+// pairing token of the grant, the broker takes over the session once the
+// client proved the ticket secret
+func (c *Client) proveTicket(pairingToken string) error {
+	payload, err := msgpack.Marshal(&SessionKey{
+		PairingToken: pairingToken,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode SESSION_KEY: %w", err)
+	}
+	sessionKeyMsg := &Message{
+		Type:     TypeSessionKey,
+		Payload:  payload,
+		ClientId: c.clientId,
+	}
+	if err := sessionKeyMsg.Send(c.connCommand, c.transportCipher); err != nil {
+		return fmt.Errorf("failed to send SESSION_KEY: %w", err)
+	}
+	msg, err := Receive(c.connCommand, c.transportCipher)
+	if err != nil {
+		return fmt.Errorf("failed to receive SESSION_KEY_ACK: %w", err)
+	}
+	if msg.Type == TypeReject {
+		return rejectionOf(msg)
+	}
+	if msg.Type != TypeSessionKeyAck {
+		return fmt.Errorf("expected SESSION_KEY_ACK, got %v", msg.Type)
+	}
+	return nil
+}
+
+func (c *Client) resumeConnection(address string, ticket *SessionTicket, multiplex bool, pairingToken string) (net.Conn, Cipher, []byte, error) {
+	conn, err := c.dial(address)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	nonce, err := NewResumeNonce()
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	request, err := msgpack.Marshal(&ResumeRequest{
+		Ticket:       ticket.Ticket,
+		Nonce:        nonce,
+		PairingToken: pairingToken,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	resumeMsg := &Message{
+		Type:     TypeResume,
+		Payload:  request,
+		ClientId: c.clientId,
+	}
+	if multiplex {
+		resumeMsg.Properties = Multiplex
+	}
+	if c.config.PersistentSession {
+		resumeMsg.Properties |= PersistentSession
+	}
+	if err := resumeMsg.Send(conn, c.noCipher); err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to send RESUME: %w", err)
+	}
+	msg, err := Receive(conn, c.noCipher)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to receive RESUME_ACK: %w", err)
+	}
+	if msg.Type == TypeReject {
+		conn.Close()
+		return nil, nil, nil, rejectionOf(msg)
+	}
+	if msg.Type != TypeResumeAck {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("expected RESUME_ACK, got %v", msg.Type)
+	}
+	if multiplex {
+		if err := c.setMultiplex(msg); err != nil {
+			conn.Close()
+			return nil, nil, nil, err
+		}
+	}
+	response := &ResumeResponse{}
+	if err := msgpack.Unmarshal(msg.Payload, response); err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to decode RESUME_ACK: %w", err)
+	}
+	transportCipher, err := NewResumedCipher(ticket.Secret, nonce, response.Nonce)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	grant, err := transportCipher.Decrypt(response.Grant)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to verify RESUME_ACK: %w", err)
+	}
+	return conn, transportCipher, grant, nil
+}
+
+func (c *Client) closeConnections() {
+	if c.connCommand != nil {
+		c.connCommand.Close()
+		c.connCommand = nil
+	}
+	if c.connPublish != nil {
+		c.connPublish.Close()
+		c.connPublish = nil
+	}
+}
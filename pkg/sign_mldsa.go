@@ -0,0 +1,106 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/cloudflare/circl/sign/mldsa/mldsa65"
+)
+
+// ML-DSA-65 (FIPS 204) provides post-quantum signatures at NIST Level 3
+
+type MLDSAPublicKey struct {
+	key *mldsa65.PublicKey
+}
+
+type MLDSAPrivateKey struct {
+	key *mldsa65.PrivateKey
+}
+
+// GenerateMLDSAKeyPair generates a new ML-DSA signing key pair
+func GenerateMLDSAKeyPair() (*MLDSAPublicKey, *MLDSAPrivateKey, error) {
+	pub, priv, err := mldsa65.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ML-DSA key pair: %w", err)
+	}
+	return &MLDSAPublicKey{key: pub}, &MLDSAPrivateKey{key: priv}, nil
+}
+
+// LoadMLDSAPrivateKeyFile loads an ML-DSA private key from a file
+func LoadMLDSAPrivateKeyFile(filepath string) (*MLDSAPrivateKey, error) {
+	keyData, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	block, _ := pem.Decode(keyData)
+	if block != nil && block.Type == "MLDSA PRIVATE KEY" {
+		keyData = block.Bytes
+	}
+	priv := &mldsa65.PrivateKey{}
+	if err := priv.UnmarshalBinary(keyData); err != nil {
+		return nil, fmt.Errorf("failed to parse ML-DSA private key: %w", err)
+	}
+	return &MLDSAPrivateKey{key: priv}, nil
+}
+
+// LoadMLDSAPublicKeyFile loads an ML-DSA public key from a file
+func LoadMLDSAPublicKeyFile(filepath string) (*MLDSAPublicKey, error) {
+	keyData, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	return LoadMLDSAPublicKey(keyData)
+}
+
+// LoadMLDSAPublicKey parses an ML-DSA public key from bytes
+func LoadMLDSAPublicKey(keyData []byte) (*MLDSAPublicKey, error) {
+	block, _ := pem.Decode(keyData)
+	if block != nil && block.Type == "MLDSA PUBLIC KEY" {
+		keyData = block.Bytes
+	}
+	pub := &mldsa65.PublicKey{}
+	if err := pub.UnmarshalBinary(keyData); err != nil {
+		return nil, fmt.Errorf("failed to parse ML-DSA public key: %w", err)
+	}
+	return &MLDSAPublicKey{key: pub}, nil
+}
+
+// EncodeMLDSAPrivateKeyPEM encodes an ML-DSA private key to PEM format
+func EncodeMLDSAPrivateKeyPEM(key *MLDSAPrivateKey) ([]byte, error) {
+	privBytes, err := key.key.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "MLDSA PRIVATE KEY",
+		Bytes: privBytes,
+	}), nil
+}
+
+// EncodeMLDSAPublicKeyPEM encodes an ML-DSA public key to PEM format
+func EncodeMLDSAPublicKeyPEM(key *MLDSAPublicKey) ([]byte, error) {
+	pubBytes, err := key.key.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "MLDSA PUBLIC KEY",
+		Bytes: pubBytes,
+	}), nil
+}
+
+// SignMLDSA signs message, context separates signatures of different purposes
+func SignMLDSA(key *MLDSAPrivateKey, message, context []byte) ([]byte, error) {
+	signature := make([]byte, mldsa65.SignatureSize)
+	if err := mldsa65.SignTo(key.key, message, context, true, signature); err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+	return signature, nil
+}
+
+// VerifyMLDSA checks a signature created by SignMLDSA
+func VerifyMLDSA(key *MLDSAPublicKey, message, context, signature []byte) bool {
+	return mldsa65.Verify(key.key, message, context, signature)
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"time"
+)
+
+// StreamFrom selects where a stream subscription starts
+type StreamFrom byte
+
+const (
+	// StreamFromLatest delivers the messages published after subscribing
+	StreamFromLatest StreamFrom = iota
+	// StreamFromOffset starts at an offset, offsets older than the retained
+	// log start at the oldest message
+	StreamFromOffset
+	// StreamFromTime starts at the first message published at or after a time
+	StreamFromTime
+)
+
+// StreamStart is the payload of a stream SUBSCRIBE, a subscription with
+// wildcards starts at the same position in every stream topic it matches.
+// With a Group the subscription joins the consumer group, which continues at
+// its committed offsets.
+type StreamStart struct {
+	From   StreamFrom `msgpack:"from"`
+	Offset uint64     `msgpack:"offset,omitempty"`
+	Time   int64      `msgpack:"time,omitempty"`
+	Group  string     `msgpack:"group,omitempty"`
+}
+
+// FromLatest starts a stream subscription with the next message
+func FromLatest() StreamStart {
+	return StreamStart{From: StreamFromLatest}
+}
+
+// FromOffset starts a stream subscription at offset, zero is the oldest message
+func FromOffset(offset uint64) StreamStart {
+	return StreamStart{From: StreamFromOffset, Offset: offset}
+}
+
+// FromTime starts a stream subscription at the first message published at or after t
+func FromTime(t time.Time) StreamStart {
+	return StreamStart{From: StreamFromTime, Time: t.UnixNano()}
+}
+
+// StreamHandler is called with the messages of a stream subscription
+type StreamHandler func(topic string, payload []byte, offset uint64, timestamp time.Time)
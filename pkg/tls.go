@@ -0,0 +1,87 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+const NetworkTLS = "tls"
+
+// newClientTLSConfig requires TLS 1.3 and prefers the hybrid post-quantum key exchange
+func newClientTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:       tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{tls.X25519MLKEM768, tls.X25519},
+		ServerName:       config.TlsServerName,
+	}
+	if config.TlsCaFile != "" {
+		caPem, err := os.ReadFile(config.TlsCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in TLS CA file '%s'", config.TlsCaFile)
+		}
+	}
+	if config.TlsCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.TlsCertFile, config.TlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// dial connects to address, on the "tls" and "wss" networks with a TLS
+// handshake, the WebSocket networks upgrade the connection afterwards
+func (c *Client) dial(address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch c.config.Network {
+	case NetworkTLS, NetworkWSS:
+		conn, err = c.dialTLS(address)
+	case NetworkWS:
+		conn, err = net.Dial("tcp", address)
+	default:
+		return net.Dial(c.config.Network, address)
+	}
+	if err != nil || c.config.Network == NetworkTLS {
+		return conn, err
+	}
+	webSocketConn, err := DialWebSocket(conn, address, c.config.WebSocketPath, c.config.WebSocketOrigin)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return webSocketConn, nil
+}
+
+func (c *Client) dialTLS(address string) (net.Conn, error) {
+	tlsConfig := c.tlsConfig
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	return tls.Dial("tcp", address, tlsConfig)
+}
+
+// secureChannel checks the SecureChannel property of CONNECT_ACK, it is only
+// accepted on a TLS connection so it can not be used to strip the encryption
+func secureChannel(conn net.Conn, connectAck *Message) (bool, error) {
+	if connectAck.Properties&SecureChannel == 0 {
+		return false, nil
+	}
+	if _, ok := conn.(*tls.Conn); !ok {
+		return false, fmt.Errorf("secure channel announced on a connection without TLS")
+	}
+	return true, nil
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Bearer tokens use the compact JWT format, signed with HMAC-SHA256 or ML-DSA-65
+
+const (
+	TokenAlgHS256   = "HS256"
+	TokenAlgMLDSA65 = "ML-DSA-65"
+)
+
+var (
+	ErrTokenInvalid   = errors.New("token invalid")
+	ErrTokenExpired   = errors.New("token expired")
+	ErrTokenSignature = errors.New("token signature invalid")
+)
+
+type TokenClaims struct {
+	Subject   string   `json:"sub"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	Admin     bool     `json:"admin,omitempty"`
+	Acl       []string `json:"acl,omitempty"`
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// SignTokenHS256 creates a token signed with a shared secret
+func SignTokenHS256(claims *TokenClaims, secret []byte) (string, error) {
+	return signToken(TokenAlgHS256, claims, func(input []byte) ([]byte, error) {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	})
+}
+
+// SignTokenMLDSA creates a token signed with an ML-DSA private key
+func SignTokenMLDSA(claims *TokenClaims, key *MLDSAPrivateKey) (string, error) {
+	return signToken(TokenAlgMLDSA65, claims, func(input []byte) ([]byte, error) {
+		return SignMLDSA(key, input, nil)
+	})
+}
+
+// VerifyTokenHS256 checks signature and validity period of a HS256 token
+func VerifyTokenHS256(token string, secret []byte) (*TokenClaims, error) {
+	return verifyToken(token, TokenAlgHS256, func(input, signature []byte) bool {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), signature)
+	})
+}
+
+// VerifyTokenMLDSA checks signature and validity period of an ML-DSA token
+func VerifyTokenMLDSA(token string, key *MLDSAPublicKey) (*TokenClaims, error) {
+	return verifyToken(token, TokenAlgMLDSA65, func(input, signature []byte) bool {
+		return VerifyMLDSA(key, input, nil, signature)
+	})
+}
+
+func signToken(alg string, claims *TokenClaims, sign func(input []byte) ([]byte, error)) (string, error) {
+	header, err := json.Marshal(&tokenHeader{Alg: alg, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	signature, err := sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func verifyToken(token string, alg string, verify func(input, signature []byte) bool) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	header := &tokenHeader{}
+	if err := json.Unmarshal(headerBytes, header); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	// The algorithm is fixed by the verifier, never chosen by the token
+	if header.Alg != alg {
+		return nil, fmt.Errorf("%w: unexpected algorithm '%s'", ErrTokenInvalid, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if !verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrTokenSignature
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	claims := &TokenClaims{}
+	if err := json.Unmarshal(body, claims); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrTokenInvalid)
+	}
+	now := time.Now().Unix()
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, fmt.Errorf("%w: not yet valid", ErrTokenInvalid)
+	}
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	return claims, nil
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Minimal RFC 6455 WebSocket support. Every mmq frame is sent as one binary
+// WebSocket message, so a browser client can implement the protocol on top
+// of the WebSocket API.
+
+const (
+	NetworkWS  = "ws"
+	NetworkWSS = "wss"
+
+	WebSocketProtocol = "mmq"
+	webSocketGuid     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	maxControlPayload = 125
+)
+
+var errWebSocketProtocol = errors.New("websocket protocol error")
+
+// WebSocketAccept computes the Sec-WebSocket-Accept value of a key
+func WebSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGuid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+type webSocketConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	client    bool
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+// NewWebSocketConn wraps an upgraded connection, reader holds data already
+// buffered during the upgrade. Frames of a client are masked.
+func NewWebSocketConn(conn net.Conn, reader *bufio.Reader, client bool) net.Conn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &webSocketConn{
+		Conn:   conn,
+		reader: reader,
+		client: client,
+	}
+}
+
+// DialWebSocket does the client side upgrade on conn
+func DialWebSocket(conn net.Conn, host, path, origin string) (net.Conn, error) {
+	keyBytes := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, keyBytes); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+	if path == "" {
+		path = "/"
+	}
+	request := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: path},
+		Host:       host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-Websocket-Key":      {key},
+			"Sec-Websocket-Version":  {"13"},
+			"Sec-Websocket-Protocol": {WebSocketProtocol},
+		},
+	}
+	if origin != "" {
+		request.Header.Set("Origin", origin)
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to send websocket upgrade: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read websocket upgrade: %w", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade rejected: %s", response.Status)
+	}
+	if response.Header.Get("Sec-Websocket-Accept") != WebSocketAccept(key) {
+		return nil, fmt.Errorf("websocket upgrade: invalid accept key")
+	}
+	return NewWebSocketConn(conn, reader, true), nil
+}
+
+// Read returns the payload of binary messages as a stream, control frames are handled
+func (w *webSocketConn) Read(p []byte) (int, error) {
+	for w.remaining == 0 {
+		if err := w.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > w.remaining {
+		p = p[:w.remaining]
+	}
+	n, err := w.reader.Read(p)
+	if w.masked {
+		for ii := 0; ii < n; ii++ {
+			p[ii] ^= w.mask[w.maskPos%4]
+			w.maskPos++
+		}
+	}
+	w.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame starts
+func (w *webSocketConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(w.reader, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0F
+	w.masked = header[1]&0x80 != 0
+	// The server requires masked frames, the client unmasked ones
+	if w.masked == w.client {
+		return errWebSocketProtocol
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(w.reader, extended[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(w.reader, extended[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if w.masked {
+		if _, err := io.ReadFull(w.reader, w.mask[:]); err != nil {
+			return err
+		}
+	}
+	w.maskPos = 0
+	switch opcode {
+	case wsOpBinary, wsOpContinuation:
+		w.remaining = length
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > maxControlPayload {
+			return errWebSocketProtocol
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(w.reader, payload); err != nil {
+			return err
+		}
+		if w.masked {
+			for ii := range payload {
+				payload[ii] ^= w.mask[ii%4]
+			}
+		}
+		switch opcode {
+		case wsOpClose:
+			w.closeOnce.Do(func() {
+				w.writeFrame(wsOpClose, payload)
+			})
+			return io.EOF
+		case wsOpPing:
+			return w.writeFrame(wsOpPong, payload)
+		}
+		return nil
+	case wsOpText:
+		return fmt.Errorf("%w: text messages are not supported", errWebSocketProtocol)
+	}
+	return errWebSocketProtocol
+}
+
+// Write sends p as one binary message
+func (w *webSocketConn) Write(p []byte) (int, error) {
+	if err := w.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if w.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if w.client {
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for ii, b := range payload {
+			frame = append(frame, b^mask[ii%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	_, err := w.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame before closing the connection
+func (w *webSocketConn) Close() error {
+	w.closeOnce.Do(func() {
+		w.writeFrame(wsOpClose, []byte{0x03, 0xE8})
+	})
+	return w.Conn.Close()
+}
@@ -4,11 +4,16 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
 
+	"github.com/oo-developer/mmq/src/auth"
 	"github.com/oo-developer/mmq/src/broker"
+	"github.com/oo-developer/mmq/src/certificate"
 	"github.com/oo-developer/mmq/src/cli"
 	"github.com/oo-developer/mmq/src/common"
 	"github.com/oo-developer/mmq/src/config"
+	"github.com/oo-developer/mmq/src/guard"
+	"github.com/oo-developer/mmq/src/handoff"
 	"github.com/oo-developer/mmq/src/logging"
 	log "github.com/oo-developer/mmq/src/logging"
 	"github.com/oo-developer/mmq/src/storage"
@@ -18,33 +23,60 @@ import (
 
 type application struct {
 	wait             sync.WaitGroup
+	shutdownOnce     sync.Once
+	stopped          chan struct{}
 	config           *config.Config
 	loggingService   common.Service
 	brokerService    common.BrokerService
-	transportService common.Service
+	transportService common.TransportService
 	userService      common.UserService
 	storageService   common.StorageService
+	certService      common.CertificateService
+	guardService     common.GuardService
+	authService      common.AuthService
 	cliService       common.CliService
+	inherited        *handoff.Inherited
+	// release lets the successor of a restart open the storage
+	release func()
 }
 
 func NewApplication(config *config.Config) common.Service {
 	app := &application{
-		config: config,
+		config:  config,
+		stopped: make(chan struct{}),
 	}
+	app.wait.Add(1)
+	inherited, err := handoff.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.inherited = inherited
 	app.loggingService = logging.NewLoggingService(app.config.Logging.Format, app.config.Logging.Output, app.config.Logging.Level)
 	app.storageService = storage.NewStorage(app.config)
 	app.brokerService = broker.NewBrokerService(app.storageService)
-	app.userService = user.NewUserService(app.config, app.storageService)
-	app.cliService = cli.NewCliService(app.config, app.userService, app.brokerService)
-	app.transportService = transport.NewTransportService(app.config, app.brokerService, app.userService, app.cliService)
+	app.userService = user.NewUserService(app.config, app.storageService, app.brokerService)
+	app.certService = certificate.NewCertificateService(app.config, app.storageService, app.brokerService)
+	app.guardService = guard.NewGuardService(app.config, app.brokerService)
+	app.authService = auth.NewAuthService(app.config, app.userService, app.certService, app.guardService)
+	app.cliService = cli.NewCliService(app.config, app.userService, app.brokerService, app.certService, app.guardService, app.storageService)
+	app.transportService = transport.NewTransportService(app.config, app.inherited, app.brokerService, app.userService, app.authService, app.cliService, app.guardService)
 	return app
 }
 
+// Start starts the services and returns when the application is shut down
 func (a *application) Start() {
-	a.wait.Add(1)
 	a.loggingService.Start()
+	if a.inherited.Replacing() {
+		log.Info("Waiting for the previous process to release the storage")
+	}
+	if err := a.inherited.TakeOver(); err != nil {
+		log.Fatal(err)
+	}
 	a.storageService.Start()
 	a.userService.Start()
+	a.certService.Start()
+	a.guardService.Start()
+	a.authService.Start()
 	a.brokerService.Start()
 	a.transportService.Start()
 	log.Info("Application started")
@@ -52,25 +84,58 @@ func (a *application) Start() {
 	a.wait.Wait()
 }
 
+// Shutdown stops the services in reverse order, the transport drains and
+// disconnects the clients before the storage is flushed
 func (a *application) Shutdown() {
-	a.transportService.Shutdown()
-	a.brokerService.Shutdown()
-	a.userService.Shutdown()
-	a.storageService.Shutdown()
-	a.loggingService.Shutdown()
-	log.Info("Application shut down")
+	a.shutdownOnce.Do(func() {
+		close(a.stopped)
+		a.transportService.Shutdown()
+		a.brokerService.Shutdown()
+		a.authService.Shutdown()
+		a.guardService.Shutdown()
+		a.certService.Shutdown()
+		a.userService.Shutdown()
+		a.storageService.Shutdown()
+		if a.release != nil {
+			a.release()
+		}
+		a.loggingService.Shutdown()
+		log.Info("Application shut down")
+		a.wait.Done()
+	})
 }
 
+// handleInterrupt shuts down on SIGINT and SIGTERM, SIGUSR2 restarts the
+// broker without closing the listening sockets
 func (a *application) handleInterrupt() {
 	hook := make(chan os.Signal, 1)
-	signal.Notify(hook, os.Interrupt)
+	signal.Notify(hook, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR2)
 	go func(hook chan os.Signal, app *application) {
-
+		defer signal.Stop(hook)
 		for {
-			sig := <-hook
-			log.Infof("Signal received: '%s'", sig)
-			app.Shutdown()
-			os.Exit(0)
+			select {
+			case sig := <-hook:
+				log.Infof("Signal received: '%s'", sig)
+				if sig == syscall.SIGUSR2 && !app.restart() {
+					continue
+				}
+				app.Shutdown()
+				return
+			case <-app.stopped:
+				return
+			}
 		}
 	}(hook, a)
 }
+
+// restart hands the listening sockets to a new process of the broker, this
+// process drains its clients while the new one waits for the storage
+func (a *application) restart() bool {
+	release, err := a.transportService.Handoff()
+	if err != nil {
+		log.Errorf("Restart failed: %v", err)
+		return false
+	}
+	a.release = release
+	return true
+}
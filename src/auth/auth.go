@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	log "github.com/oo-developer/mmq/src/logging"
+)
+
+const (
+	PROVIDER_KEY         = "key"
+	PROVIDER_CERTIFICATE = "certificate"
+	PROVIDER_TOKEN       = "token"
+	PROVIDER_WEBHOOK     = "webhook"
+	PROVIDER_PEERCRED    = "peercred"
+	PROVIDER_MTLS        = "mtls"
+)
+
+// defaultProviders keeps the behaviour of brokers without an auth section
+var defaultProviders = []config.AuthProvider{
+	{Type: PROVIDER_KEY},
+	{Type: PROVIDER_CERTIFICATE},
+}
+
+type auth struct {
+	config         *config.Auth
+	userService    common.UserService
+	certService    common.CertificateService
+	guardService   common.GuardService
+	authenticators []common.Authenticator
+}
+
+func NewAuthService(config *config.Config, userService common.UserService, certService common.CertificateService, guardService common.GuardService) common.AuthService {
+	a := &auth{
+		config:       &config.Auth,
+		userService:  userService,
+		certService:  certService,
+		guardService: guardService,
+	}
+	return a
+}
+
+func (a *auth) Start() {
+	providers := a.config.Providers
+	if len(providers) == 0 {
+		providers = defaultProviders
+	}
+	for _, provider := range providers {
+		authenticator, err := a.newAuthenticator(provider)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		a.authenticators = append(a.authenticators, authenticator)
+		log.Infof("Authentication provider '%s' (%s) enabled", authenticator.Name(), provider.Type)
+	}
+	log.Info("AuthService started")
+}
+
+func (a *auth) Shutdown() {
+	log.Info("AuthService shut down")
+}
+
+func (a *auth) newAuthenticator(provider config.AuthProvider) (common.Authenticator, error) {
+	name := provider.Name
+	if name == "" {
+		name = provider.Type
+	}
+	switch provider.Type {
+	case PROVIDER_KEY:
+		return newKeyAuthenticator(name, a.userService), nil
+	case PROVIDER_CERTIFICATE:
+		return newCertificateAuthenticator(name, a.certService), nil
+	case PROVIDER_TOKEN:
+		return newTokenAuthenticator(name, &provider)
+	case PROVIDER_WEBHOOK:
+		return newWebhookAuthenticator(name, &provider)
+	case PROVIDER_PEERCRED:
+		return newPeerCredAuthenticator(name, &provider)
+	case PROVIDER_MTLS:
+		return newMTLSAuthenticator(name, a.userService), nil
+	}
+	return nil, fmt.Errorf("unknown authentication provider type '%s'", provider.Type)
+}
+
+// Authenticate tries the configured providers in order, the first one that
+// accepts the credentials provides the identity. Failures are charged to the
+// IP of the connection.
+func (a *auth) Authenticate(request *common.AuthRequest) (*common.Identity, error) {
+	if a.guardService.Banned(request.Conn) {
+		return nil, fmt.Errorf("'%s' is banned", request.Conn.RemoteAddr())
+	}
+	identity, err := a.authenticate(request)
+	if err != nil {
+		a.guardService.AuthFailed(request.Conn)
+		return nil, err
+	}
+	if request.NewSession {
+		if err := a.guardService.CheckUser(identity.User.Name(), request.ClientId); err != nil {
+			return nil, err
+		}
+	}
+	return identity, nil
+}
+
+func (a *auth) authenticate(request *common.AuthRequest) (*common.Identity, error) {
+	var errs []error
+	for _, authenticator := range a.authenticators {
+		if len(request.Providers) > 0 && !slices.Contains(request.Providers, authenticator.Name()) {
+			continue
+		}
+		identity, err := authenticator.Authenticate(request)
+		if errors.Is(err, common.ErrNotApplicable) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", authenticator.Name(), err))
+			continue
+		}
+		if err := common.CheckUser(identity.User); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", authenticator.Name(), err))
+			continue
+		}
+		identity.Provider = authenticator.Name()
+		return identity, nil
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no authentication provider accepted the credentials")
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"github.com/oo-developer/mmq/src/common"
+)
+
+// certificateAuthenticator accepts users with a certificate signed by the broker
+// CA, the ACL groups of the certificate restrict the topics
+type certificateAuthenticator struct {
+	name        string
+	certService common.CertificateService
+}
+
+func newCertificateAuthenticator(name string, certService common.CertificateService) *certificateAuthenticator {
+	return &certificateAuthenticator{
+		name:        name,
+		certService: certService,
+	}
+}
+
+func (c *certificateAuthenticator) Name() string {
+	return c.name
+}
+
+func (c *certificateAuthenticator) Authenticate(request *common.AuthRequest) (*common.Identity, error) {
+	if len(request.Credentials.Certificate) == 0 || !c.certService.Enabled() {
+		return nil, common.ErrNotApplicable
+	}
+	user, err := c.certService.Verify(request.Credentials.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := c.certService.Acl(user)
+	if err != nil {
+		return nil, err
+	}
+	return &common.Identity{
+		User: user,
+		Acl:  acl,
+	}, nil
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/oo-developer/mmq/src/common"
+)
+
+// keyAuthenticator accepts users registered with a Kyber public key. The
+// client proves the key by decrypting the handshake answers.
+type keyAuthenticator struct {
+	name        string
+	userService common.UserService
+}
+
+func newKeyAuthenticator(name string, userService common.UserService) *keyAuthenticator {
+	return &keyAuthenticator{
+		name:        name,
+		userService: userService,
+	}
+}
+
+func (k *keyAuthenticator) Name() string {
+	return k.name
+}
+
+func (k *keyAuthenticator) Authenticate(request *common.AuthRequest) (*common.Identity, error) {
+	credentials := request.Credentials
+	if credentials.User == "" || credentials.PublicKeyPem != "" || len(credentials.Certificate) > 0 || credentials.Token != "" || credentials.Password != "" {
+		return nil, common.ErrNotApplicable
+	}
+	user, ok := k.userService.LookupUserByName(credentials.User)
+	if !ok {
+		return nil, fmt.Errorf("user '%s' not found", credentials.User)
+	}
+	return &common.Identity{
+		User: user,
+	}, nil
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/oo-developer/mmq/src/common"
+)
+
+// mtlsAuthenticator accepts TLS client certificates verified against the
+// client CA, the common name is the name of a registered user
+type mtlsAuthenticator struct {
+	name        string
+	userService common.UserService
+}
+
+func newMTLSAuthenticator(name string, userService common.UserService) *mtlsAuthenticator {
+	return &mtlsAuthenticator{
+		name:        name,
+		userService: userService,
+	}
+}
+
+func (m *mtlsAuthenticator) Name() string {
+	return m.name
+}
+
+func (m *mtlsAuthenticator) Authenticate(request *common.AuthRequest) (*common.Identity, error) {
+	credentials := request.Credentials
+	if credentials.PublicKeyPem == "" || len(credentials.Certificate) > 0 || credentials.Token != "" || credentials.Password != "" {
+		return nil, common.ErrNotApplicable
+	}
+	tlsConn, ok := request.Conn.(*tls.Conn)
+	if !ok {
+		return nil, common.ErrNotApplicable
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil, common.ErrNotApplicable
+	}
+	commonName := state.VerifiedChains[0][0].Subject.CommonName
+	if credentials.User != "" && credentials.User != commonName {
+		return nil, fmt.Errorf("client certificate of '%s' used for user '%s'", commonName, credentials.User)
+	}
+	registered, ok := m.userService.LookupUserByName(commonName)
+	if !ok {
+		return nil, fmt.Errorf("user '%s' not found", commonName)
+	}
+	if err := common.CheckUser(registered); err != nil {
+		return nil, err
+	}
+	var expiresAt int64
+	if !registered.ExpiresAt().IsZero() {
+		expiresAt = registered.ExpiresAt().Unix()
+	}
+	user, err := newUser(commonName, registered.IsAdmin(), expiresAt, credentials)
+	if err != nil {
+		return nil, err
+	}
+	return &common.Identity{
+		User: user,
+	}, nil
+}
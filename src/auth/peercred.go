@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+)
+
+var errNoUnixSocket = errors.New("not a unix socket connection")
+
+type peerCredentials struct {
+	Uid uint32
+	Gid uint32
+	Pid int32
+}
+
+// peerCredAuthenticator accepts local processes on unix sockets by the uid and
+// gid of the peer, the client needs no registered key
+type peerCredAuthenticator struct {
+	name  string
+	peers []config.PeerMapping
+}
+
+func newPeerCredAuthenticator(name string, provider *config.AuthProvider) (*peerCredAuthenticator, error) {
+	for _, peer := range provider.Peers {
+		if peer.User == "" {
+			return nil, fmt.Errorf("peer mapping of provider '%s' has no user", name)
+		}
+	}
+	return &peerCredAuthenticator{
+		name:  name,
+		peers: provider.Peers,
+	}, nil
+}
+
+func (p *peerCredAuthenticator) Name() string {
+	return p.name
+}
+
+func (p *peerCredAuthenticator) Authenticate(request *common.AuthRequest) (*common.Identity, error) {
+	credentials := request.Credentials
+	if credentials.PublicKeyPem == "" || len(credentials.Certificate) > 0 || credentials.Token != "" || credentials.Password != "" {
+		return nil, common.ErrNotApplicable
+	}
+	peer, err := peerCredentialsOf(request.Conn)
+	if errors.Is(err, errNoUnixSocket) {
+		return nil, common.ErrNotApplicable
+	}
+	if err != nil {
+		return nil, err
+	}
+	mapping := p.lookup(peer)
+	if mapping == nil {
+		return nil, fmt.Errorf("no user mapped to uid %d gid %d (pid %d)", peer.Uid, peer.Gid, peer.Pid)
+	}
+	if credentials.User != "" && credentials.User != mapping.User {
+		return nil, fmt.Errorf("uid %d is mapped to '%s', not '%s'", peer.Uid, mapping.User, credentials.User)
+	}
+	user, err := newUser(mapping.User, mapping.Admin, 0, credentials)
+	if err != nil {
+		return nil, err
+	}
+	return &common.Identity{
+		User: user,
+	}, nil
+}
+
+// lookup returns the first mapping matching the peer
+func (p *peerCredAuthenticator) lookup(peer *peerCredentials) *config.PeerMapping {
+	for ii := range p.peers {
+		mapping := &p.peers[ii]
+		if mapping.Uid != nil && *mapping.Uid != peer.Uid {
+			continue
+		}
+		if mapping.Gid != nil && *mapping.Gid != peer.Gid {
+			continue
+		}
+		return mapping
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package auth
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentialsOf reads SO_PEERCRED of a unix socket connection
+func peerCredentialsOf(conn net.Conn) (*peerCredentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errNoUnixSocket
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("failed to read peer credentials: %w", credErr)
+	}
+	return &peerCredentials{
+		Uid: ucred.Uid,
+		Gid: ucred.Gid,
+		Pid: ucred.Pid,
+	}, nil
+}
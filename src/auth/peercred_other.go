@@ -0,0 +1,15 @@
+//go:build !linux
+
+package auth
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCredentialsOf(conn net.Conn) (*peerCredentials, error) {
+	if _, ok := conn.(*net.UnixConn); !ok {
+		return nil, errNoUnixSocket
+	}
+	return nil, errors.New("peer credentials are only supported on linux")
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+)
+
+// tokenAuthenticator accepts signed bearer tokens, the claims provide name,
+// admin flag, topic ACL and expiry of the identity
+type tokenAuthenticator struct {
+	name   string
+	verify func(token string) (*api.TokenClaims, error)
+}
+
+func newTokenAuthenticator(name string, provider *config.AuthProvider) (*tokenAuthenticator, error) {
+	t := &tokenAuthenticator{
+		name: name,
+	}
+	switch provider.Algorithm {
+	case api.TokenAlgHS256:
+		secret, err := os.ReadFile(provider.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token secret of provider '%s': %w", name, err)
+		}
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("token secret of provider '%s' is shorter than 32 bytes", name)
+		}
+		t.verify = func(token string) (*api.TokenClaims, error) {
+			return api.VerifyTokenHS256(token, secret)
+		}
+	case api.TokenAlgMLDSA65:
+		publicKey, err := api.LoadMLDSAPublicKeyFile(provider.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load token key of provider '%s': %w", name, err)
+		}
+		t.verify = func(token string) (*api.TokenClaims, error) {
+			return api.VerifyTokenMLDSA(token, publicKey)
+		}
+	default:
+		return nil, fmt.Errorf("unknown token algorithm '%s' of provider '%s'", provider.Algorithm, name)
+	}
+	return t, nil
+}
+
+func (t *tokenAuthenticator) Name() string {
+	return t.name
+}
+
+func (t *tokenAuthenticator) Authenticate(request *common.AuthRequest) (*common.Identity, error) {
+	credentials := request.Credentials
+	if credentials.Token == "" {
+		return nil, common.ErrNotApplicable
+	}
+	claims, err := t.verify(credentials.Token)
+	if err != nil {
+		return nil, err
+	}
+	if credentials.User != "" && credentials.User != claims.Subject {
+		return nil, fmt.Errorf("token subject '%s' does not match user '%s'", claims.Subject, credentials.User)
+	}
+	user, err := newUser(claims.Subject, claims.Admin, claims.ExpiresAt, credentials)
+	if err != nil {
+		return nil, err
+	}
+	return &common.Identity{
+		User: user,
+		Acl:  claims.Acl,
+	}, nil
+}
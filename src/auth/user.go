@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"time"
+
+	api "github.com/oo-developer/mmq/pkg"
+)
+
+// user is an identity not known to the UserService, its key is the ephemeral
+// key the client sent with the credentials. Clients of protocols without the
+// mmq handshake send no key.
+type user struct {
+	name         string
+	admin        bool
+	expiresAt    time.Time
+	publicKeyPem string
+	publicKey    *api.KyberPublicKey
+}
+
+func newUser(name string, admin bool, expiresAt int64, credentials *api.Credentials) (*user, error) {
+	u := &user{
+		name:  name,
+		admin: admin,
+	}
+	if credentials.PublicKeyPem != "" {
+		publicKey, err := api.LoadKyberPublicKey([]byte(credentials.PublicKeyPem))
+		if err != nil {
+			return nil, err
+		}
+		u.publicKeyPem = credentials.PublicKeyPem
+		u.publicKey = publicKey
+	}
+	if expiresAt != 0 {
+		u.expiresAt = time.Unix(expiresAt, 0)
+	}
+	return u, nil
+}
+
+func (u *user) Name() string {
+	return u.name
+}
+
+func (u *user) IsAdmin() bool {
+	return u.admin
+}
+
+func (u *user) IsDisabled() bool {
+	return false
+}
+
+func (u *user) ExpiresAt() time.Time {
+	return u.expiresAt
+}
+
+func (u *user) SessionsRevokedAt() time.Time {
+	return time.Time{}
+}
+
+func (u *user) PublicKeyPem() string {
+	return u.publicKeyPem
+}
+
+func (u *user) PublicKey() *api.KyberPublicKey {
+	return u.publicKey
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+)
+
+const (
+	defaultWebhookTimeout  = 5 * time.Second
+	maxWebhookResponseSize = 65536
+)
+
+// webhookRequest is POSTed as JSON to the webhook url
+type webhookRequest struct {
+	User          string `json:"user"`
+	Password      string `json:"password,omitempty"`
+	Token         string `json:"token,omitempty"`
+	RemoteAddress string `json:"remoteAddress"`
+}
+
+// webhookResponse is the answer of the webhook, any status other than 200 rejects
+type webhookResponse struct {
+	Allow     bool     `json:"allow"`
+	Reason    string   `json:"reason"`
+	User      string   `json:"user"`
+	Admin     bool     `json:"admin"`
+	Acl       []string `json:"acl"`
+	ExpiresAt int64    `json:"expiresAt"`
+}
+
+// webhookAuthenticator delegates the decision to an external HTTP service
+type webhookAuthenticator struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func newWebhookAuthenticator(name string, provider *config.AuthProvider) (*webhookAuthenticator, error) {
+	if provider.Url == "" {
+		return nil, fmt.Errorf("webhook provider '%s' has no url", name)
+	}
+	timeout := defaultWebhookTimeout
+	if provider.TimeoutMillis > 0 {
+		timeout = time.Duration(provider.TimeoutMillis) * time.Millisecond
+	}
+	return &webhookAuthenticator{
+		name: name,
+		url:  provider.Url,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}, nil
+}
+
+func (w *webhookAuthenticator) Name() string {
+	return w.name
+}
+
+func (w *webhookAuthenticator) Authenticate(request *common.AuthRequest) (*common.Identity, error) {
+	credentials := request.Credentials
+	if credentials.User == "" || (credentials.Password == "" && credentials.Token == "") {
+		return nil, common.ErrNotApplicable
+	}
+	body, err := json.Marshal(&webhookRequest{
+		User:          credentials.User,
+		Password:      credentials.Password,
+		Token:         credentials.Token,
+		RemoteAddress: request.Conn.RemoteAddr().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	httpResponse, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("webhook answered with status %d", httpResponse.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(httpResponse.Body, maxWebhookResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	response := &webhookResponse{}
+	if err := json.Unmarshal(data, response); err != nil {
+		return nil, fmt.Errorf("invalid webhook response: %w", err)
+	}
+	if !response.Allow {
+		if response.Reason != "" {
+			return nil, fmt.Errorf("rejected by webhook: %s", response.Reason)
+		}
+		return nil, fmt.Errorf("rejected by webhook")
+	}
+	name := credentials.User
+	if response.User != "" {
+		name = response.User
+	}
+	user, err := newUser(name, response.Admin, response.ExpiresAt, credentials)
+	if err != nil {
+		return nil, err
+	}
+	return &common.Identity{
+		User: user,
+		Acl:  response.Acl,
+	}, nil
+}
@@ -2,8 +2,9 @@ package broker
 
 import (
 	"fmt"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/oo-developer/mmq/pkg"
@@ -15,12 +16,18 @@ type subscription struct {
 	id       string
 	clientId string
 	topic    string
+	// stream is set for a subscription that replays stream topics
+	stream *streamCursor
 }
 
 type clientInfo struct {
 	id             string
-	user           common.User
+	identity       *common.Identity
+	options        common.ClientOptions
 	messageChannel chan *api.Message
+	done           chan struct{}
+	doneOnce       sync.Once
+	reason         string
 	mutex          sync.RWMutex
 }
 
@@ -29,22 +36,62 @@ func (c *clientInfo) Id() string {
 }
 
 func (c *clientInfo) User() common.User {
-	return c.user
+	return c.identity.User
+}
+
+func (c *clientInfo) Identity() *common.Identity {
+	return c.identity
+}
+
+func (c *clientInfo) Listener() string {
+	return c.options.Listener
 }
 
 func (c *clientInfo) MessageChan() <-chan *api.Message {
 	return c.messageChannel
 }
 
+func (c *clientInfo) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *clientInfo) DisconnectReason() string {
+	select {
+	case <-c.done:
+		return c.reason
+	default:
+		return ""
+	}
+}
+
+func (c *clientInfo) terminate() {
+	c.disconnect("")
+}
+
+// disconnect terminates the client, the first reason is kept
+func (c *clientInfo) disconnect(reason string) {
+	c.doneOnce.Do(func() {
+		c.reason = reason
+		close(c.done)
+	})
+}
+
 // broker manages message routing
 type broker struct {
 	clients        map[string]*clientInfo
 	subscriptions  map[string]map[string]*subscription
 	matchCache     map[string][]string
 	messages       map[string]*api.Message
+	groups         map[string]*group
+	members        map[string]*groupMember
 	storage        common.StorageService
 	publishChannel chan *api.Message
-	mu             sync.RWMutex
+	// pending counts the published messages that are not yet queued for the subscribers
+	pending  atomic.Int64
+	sequence uint64
+	stop     chan struct{}
+	workers  sync.WaitGroup
+	mu       sync.RWMutex
 }
 
 func NewBrokerService(storage common.StorageService) common.BrokerService {
@@ -53,8 +100,11 @@ func NewBrokerService(storage common.StorageService) common.BrokerService {
 		subscriptions:  make(map[string]map[string]*subscription),
 		matchCache:     make(map[string][]string),
 		messages:       make(map[string]*api.Message),
+		groups:         make(map[string]*group),
+		members:        make(map[string]*groupMember),
 		storage:        storage,
 		publishChannel: make(chan *api.Message, 100000),
+		stop:           make(chan struct{}),
 	}
 	return b
 }
@@ -62,47 +112,123 @@ func NewBrokerService(storage common.StorageService) common.BrokerService {
 func (b *broker) Start() {
 	// Publish go func pool
 	for ii := 0; ii < 10; ii++ {
+		b.workers.Add(1)
 		go func() {
+			defer b.workers.Done()
 			for {
-				msg := <-b.publishChannel
-				b.publish(msg)
+				select {
+				case msg := <-b.publishChannel:
+					b.publish(msg)
+					b.pending.Add(-1)
+				case <-b.stop:
+					return
+				}
 			}
 		}()
 	}
 	// Load persistent message
 	for _, msg := range b.storage.GetAllMessages() {
 		b.messages[msg.Topic] = msg
+		b.sequence = max(b.sequence, msg.Sequence)
 	}
+	b.loadGroups()
+	b.workers.Add(1)
+	go b.expireClients()
 	log.Info("BrokerService started")
 }
 
+// Shutdown stops routing, messages published later are dropped
 func (b *broker) Shutdown() {
+	close(b.stop)
+	b.workers.Wait()
 	log.Info("BrokerService shut down")
 }
 
-func (b *broker) RegisterClient(clientId string, user common.User) common.BrokerClient {
+func (b *broker) RegisterClient(clientId string, identity *common.Identity, options common.ClientOptions) (common.BrokerClient, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	previous, exists := b.clients[clientId]
+	if exists && previous.User().Name() != identity.User.Name() {
+		log.Warnf("Client %s of user '%s' refused, the id is connected for user '%s'", clientId, identity.User.Name(), previous.User().Name())
+		return nil, common.ErrClientIdInUse
+	}
 	client := &clientInfo{
-		id:             uuid.NewString(),
-		user:           user,
+		id:             clientId,
+		identity:       identity,
+		options:        options,
 		messageChannel: make(chan *api.Message, 1000),
+		done:           make(chan struct{}),
 	}
 
+	if exists {
+		b.takeOver(previous, client)
+	}
 	b.clients[clientId] = client
-	log.Infof("Client registered: %s", clientId)
-	return client
+	log.Infof("Client registered: %s on listener '%s'", clientId, options.Listener)
+	return client, nil
+}
+
+// takeOver disconnects previous in favour of client with the same id and
+// user. A persistent client keeps the subscriptions and gets the queued
+// messages its own ACL allows.
+func (b *broker) takeOver(previous *clientInfo, client *clientInfo) {
+	previous.disconnect(common.DISCONNECT_TAKEN_OVER)
+	if !client.options.Persistent {
+		b.removeSubscriptions(client.id)
+		log.Infof("Client %s taken over", client.id)
+		return
+	}
+	for _, topic := range b.subscriptions {
+		for id, sub := range topic {
+			if sub.clientId == client.id && !b.allowed(client, sub.topic) {
+				log.Infof("Subscription of client %s to '%s' not taken over: topic not allowed", client.id, sub.topic)
+				delete(topic, id)
+			}
+		}
+	}
+	for _, member := range b.members {
+		if member.clientId == client.id && !b.allowed(client, member.group.topic) {
+			log.Infof("Membership of client %s in group '%s' not taken over: topic not allowed", client.id, member.group.name)
+			b.leaveGroup(member)
+		}
+	}
+	moved := 0
+	for drained := false; !drained; {
+		select {
+		case msg := <-previous.messageChannel:
+			if b.allowed(client, msg.Topic) {
+				client.messageChannel <- msg
+				moved++
+			}
+		default:
+			drained = true
+		}
+	}
+	log.Infof("Client %s taken over with %d queued messages", client.id, moved)
 }
 
-func (b *broker) UnregisterClient(clientId string) {
+// UnregisterClient removes a client, a client that was taken over leaves the
+// state of its successor untouched
+func (b *broker) UnregisterClient(c common.BrokerClient) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	client, exists := b.clients[clientId]
-	if !exists {
+	client, ok := c.(*clientInfo)
+	if !ok {
+		return
+	}
+	close(client.messageChannel)
+	client.terminate()
+	if b.clients[client.id] != client {
+		log.Infof("Client unregistered: %s (taken over)", client.id)
 		return
 	}
+	b.removeSubscriptions(client.id)
+	delete(b.clients, client.id)
+	log.Infof("Client unregistered: %s", client.id)
+}
 
+func (b *broker) removeSubscriptions(clientId string) {
 	for _, topic := range b.subscriptions {
 		toDelete := make([]*subscription, 0)
 		for _, sub := range topic {
@@ -114,10 +240,90 @@ func (b *broker) UnregisterClient(clientId string) {
 			delete(topic, sub.id)
 		}
 	}
+	b.leaveGroups(clientId)
+}
 
-	close(client.messageChannel)
-	delete(b.clients, clientId)
-	log.Infof("Client unregistered: %s", clientId)
+// DisconnectClient terminates the connections of a client, the transport
+// unregisters it when the connections are closed
+func (b *broker) DisconnectClient(clientId string, reason string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if client, exists := b.clients[clientId]; exists {
+		log.Infof("Disconnecting client %s: %s", clientId, reason)
+		client.disconnect(reason)
+	}
+}
+
+// DisconnectUser terminates all sessions of a user
+func (b *broker) DisconnectUser(userName string, reason string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for clientId, client := range b.clients {
+		if client.User().Name() == userName {
+			log.Infof("Disconnecting client %s of user '%s': %s", clientId, userName, reason)
+			client.disconnect(reason)
+		}
+	}
+}
+
+func (b *broker) DisconnectAll(reason string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for clientId, client := range b.clients {
+		log.Infof("Disconnecting client %s: %s", clientId, reason)
+		client.disconnect(reason)
+	}
+}
+
+func (b *broker) Drain(deadline time.Time) bool {
+	for !b.drained() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func (b *broker) drained() bool {
+	if b.pending.Load() > 0 {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, client := range b.clients {
+		if len(client.messageChannel) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// expireClients terminates sessions of users that expired while connected
+func (b *broker) expireClients() {
+	defer b.workers.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+		b.mu.RLock()
+		for clientId, client := range b.clients {
+			select {
+			case <-client.done:
+				continue
+			default:
+			}
+			if common.UserExpired(client.User()) {
+				log.Infof("Disconnecting client %s of user '%s': user expired", clientId, client.User().Name())
+				client.disconnect("user expired")
+			}
+		}
+		b.mu.RUnlock()
+	}
 }
 
 func (b *broker) Client(clientId string) common.BrokerClient {
@@ -153,6 +359,42 @@ func (b *broker) AllTopics() []*common.Topic {
 	return topics
 }
 
+func (b *broker) Subscriptions(clientId string) []common.Subscription {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	subscriptions := make([]common.Subscription, 0)
+	for _, topic := range b.subscriptions {
+		for _, sub := range topic {
+			if sub.clientId == clientId {
+				subscriptions = append(subscriptions, common.Subscription{
+					Id:    sub.id,
+					Topic: sub.topic,
+				})
+			}
+		}
+	}
+	for _, member := range b.members {
+		if member.clientId == clientId {
+			subscriptions = append(subscriptions, common.Subscription{
+				Id:    member.id,
+				Topic: member.group.topic,
+			})
+		}
+	}
+	return subscriptions
+}
+
+func (b *broker) RetainedMessage(topic string) (*api.Message, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	msg, ok := b.messages[topic]
+	if !ok || !msg.IsRetained() {
+		return nil, false
+	}
+	msgCopy := *msg
+	return &msgCopy, true
+}
+
 // Subscribe adds a subscription for a clientInfo
 func (b *broker) Subscribe(clientID, topic string) (string, error) {
 	b.mu.Lock()
@@ -163,6 +405,10 @@ func (b *broker) Subscribe(clientID, topic string) (string, error) {
 		return "", fmt.Errorf("Client not found: %s", clientID)
 	}
 
+	if !b.allowed(client, topic) {
+		return "", fmt.Errorf("topic '%s' not allowed for client %s", topic, clientID)
+	}
+
 	client.mutex.Lock()
 	defer client.mutex.Unlock()
 	sub := &subscription{
@@ -173,14 +419,17 @@ func (b *broker) Subscribe(clientID, topic string) (string, error) {
 
 	if _, ok := b.subscriptions[topic]; !ok {
 		b.subscriptions[topic] = make(map[string]*subscription)
+		// A new subscription topic may match topics already in the cache
+		clear(b.matchCache)
 	}
 	b.subscriptions[topic][sub.id] = sub
 	// Send retained messages
 	for _, msg := range b.messages {
-		if b.topicMatches(msg.Topic, topic) {
+		if common.TopicMatches(topic, msg.Topic) {
 			if msg.IsRetained() {
 				msgCopy := *msg
 				msgCopy.SubscriptionId = sub.id
+				msgCopy.Replay = true
 				client.messageChannel <- &msgCopy
 			}
 		}
@@ -190,6 +439,17 @@ func (b *broker) Subscribe(clientID, topic string) (string, error) {
 	return sub.id, nil
 }
 
+func (b *broker) SubscriberCount(topic string) int {
+	matches := b.findMatchingTopics(topic)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	count := 0
+	for _, match := range matches {
+		count += len(b.subscriptions[match])
+	}
+	return count
+}
+
 // Unsubscribe removes a subscription
 func (b *broker) Unsubscribe(clientID, topic string, subscriptionId string) error {
 	b.mu.Lock()
@@ -203,6 +463,9 @@ func (b *broker) Unsubscribe(clientID, topic string, subscriptionId string) erro
 	client.mutex.Lock()
 	defer client.mutex.Unlock()
 
+	if member, ok := b.members[subscriptionId]; ok && member.clientId == clientID {
+		b.leaveGroup(member)
+	}
 	for _, topicEntry := range b.subscriptions {
 		toDelete := make([]*subscription, 0)
 		for _, sub := range topicEntry {
@@ -223,32 +486,103 @@ func (b *broker) Unsubscribe(clientID, topic string, subscriptionId string) erro
 	return nil
 }
 
-func (b *broker) Publish(properties api.MessageProperty, topic string, payload []byte, publisherID string) {
+func (b *broker) Publish(properties api.MessageProperty, topic string, payload []byte, publisherID string) error {
+	return b.PublishWithReply(properties, topic, "", payload, publisherID)
+}
+
+func (b *broker) PublishWithReply(properties api.MessageProperty, topic string, replyTo string, payload []byte, publisherID string) error {
+	stored, err := b.route(properties, topic, replyTo, payload, publisherID)
+	if err != nil || stored == nil {
+		return err
+	}
+	// The storage is waited for without holding the broker
+	if err := <-stored; err != nil {
+		return fmt.Errorf("failed to store message to topic %s: %w", topic, err)
+	}
+	return nil
+}
+
+// route queues a message for the subscribers, the returned channel reports
+// when the storage of a persistent message, a stream append or a removal is
+// done. Only the offset of a stream append is assigned under the lock, it is
+// written ahead with the other records.
+func (b *broker) route(properties api.MessageProperty, topic string, replyTo string, payload []byte, publisherID string) (<-chan error, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	select {
+	case <-b.stop:
+		log.Warnf("Message of client %s to topic %s dropped: broker shut down", publisherID, topic)
+		return nil, fmt.Errorf("broker shut down")
+	default:
+	}
+	if client, exists := b.clients[publisherID]; exists && !b.allowed(client, topic) {
+		log.Warnf("Client %s is not allowed to publish to topic: %s", publisherID, topic)
+		return nil, fmt.Errorf("topic '%s' not allowed for client %s", topic, publisherID)
+	}
 	msg := &api.Message{
-		Properties: properties,
+		Properties: properties &^ api.Stream,
 		Type:       api.TypeMessage,
 		Topic:      topic,
 		Payload:    payload,
 		ClientId:   publisherID,
+		Sequence:   b.nextSequence(),
+		ReplyTo:    replyTo,
 	}
-	if msg.Payload == nil || len(msg.Payload) == 0 {
+	// An empty retained message clears the topic, other empty messages are
+	// delivered like any message
+	if len(msg.Payload) == 0 && msg.IsRetained() {
 		delete(b.messages, topic)
-		b.storage.RemoveMessageChannel() <- msg.Topic
-		return
+		return b.storage.RemoveMessage(msg.Topic), nil
+	}
+	var stored <-chan error
+	if b.storage.IsStream(topic) {
+		msg.Properties |= api.Stream
+		stored = b.storage.AppendStream(msg)
+		for _, g := range b.groups {
+			if common.TopicMatches(g.topic, topic) {
+				g.wakeUp()
+			}
+		}
 	}
 	b.messages[topic] = msg
 	if msg.IsPersistent() {
-		b.storage.AddMessageChannel() <- msg
+		stored = joinStored(stored, b.storage.AddMessage(msg))
 	}
+	b.pending.Add(1)
 	b.publishChannel <- msg
+	return stored, nil
+}
+
+// joinStored reports the first error of two storage results
+func joinStored(first, second <-chan error) <-chan error {
+	if first == nil {
+		return second
+	}
+	joined := make(chan error, 1)
+	go func() {
+		err := <-first
+		if secondErr := <-second; err == nil {
+			err = secondErr
+		}
+		joined <- err
+	}()
+	return joined
+}
+
+// nextSequence follows the clock so sequences keep growing across restarts,
+// even for messages that were not persisted
+func (b *broker) nextSequence() uint64 {
+	b.sequence = max(b.sequence+1, uint64(time.Now().UnixNano()))
+	return b.sequence
 }
 
 func (b *broker) publish(msg *api.Message) {
 	matches := b.findMatchingTopics(msg.Topic)
 	for _, match := range matches {
 		for _, subs := range b.subscriptions[match] {
+			if subs.stream != nil && msg.Properties&api.Stream != 0 && !subs.stream.live(msg) {
+				continue
+			}
 			if client, ok := b.clients[subs.clientId]; ok {
 				msgCopy := *msg
 				msgCopy.SubscriptionId = subs.id
@@ -259,12 +593,12 @@ func (b *broker) publish(msg *api.Message) {
 }
 
 func (b *broker) findMatchingTopics(publishedTopic string) []string {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	if _, ok := b.matchCache[publishedTopic]; !ok {
 		b.matchCache[publishedTopic] = make([]string, 0)
 		for subTopic := range b.subscriptions {
-			if b.topicMatches(subTopic, publishedTopic) {
+			if common.TopicMatches(subTopic, publishedTopic) {
 				b.matchCache[publishedTopic] = append(b.matchCache[publishedTopic], subTopic)
 			}
 		}
@@ -272,56 +606,9 @@ func (b *broker) findMatchingTopics(publishedTopic string) []string {
 	return b.matchCache[publishedTopic]
 }
 
-// topicMatches checks if a subscription topic matches a published topic
-// Supports MQTT-style wildcards:
-// - "+" matches a single level: "sensor/+/temp" matches "sensor/room1/temp"
-// - "#" matches multiple levels: "sensor/#" matches "sensor/room1/temp"
-func (b *broker) topicMatches(subTopic, pubTopic string) bool {
-	// Exact match
-	if subTopic == pubTopic {
-		return true
-	}
-
-	// Split topics into levels
-	subLevels := strings.Split(subTopic, "/")
-	pubLevels := strings.Split(pubTopic, "/")
-
-	// Check for multi-level wildcard "#"
-	// Must be at the end and alone in its level
-	if len(subLevels) > 0 && subLevels[len(subLevels)-1] == "#" {
-		// "#" alone matches everything
-		if len(subLevels) == 1 {
-			return true
-		}
-		// Match all levels before "#"
-		if len(pubLevels) < len(subLevels)-1 {
-			return false
-		}
-		for i := 0; i < len(subLevels)-1; i++ {
-			if subLevels[i] != pubLevels[i] && subLevels[i] != "+" {
-				return false
-			}
-		}
-		return true
-	}
-
-	// For non-# wildcards, level count must match exactly
-	if len(subLevels) != len(pubLevels) {
-		return false
-	}
-
-	// Check each level with "+" wildcard support
-	for i := 0; i < len(subLevels); i++ {
-		if subLevels[i] == "+" {
-			// "+" matches any single level
-			continue
-		}
-		if subLevels[i] != pubLevels[i] {
-			return false
-		}
-	}
-
-	return true
+// allowed checks a topic against the ACL of the client identity
+func (b *broker) allowed(client *clientInfo, topic string) bool {
+	return client.identity.Allowed(topic)
 }
 
 // GetClientCount returns the number of connected clients
@@ -0,0 +1,383 @@
+package broker
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	log "github.com/oo-developer/mmq/src/logging"
+)
+
+const (
+	// groupInFlight limits the uncommitted messages of a group member
+	groupInFlight = 100
+	groupBatch    = 100
+)
+
+// group is a consumer group, each message of the stream topics matching
+// topic goes to one of its members
+type group struct {
+	name    string
+	topic   string
+	members []*groupMember
+	// next is the member the round robin starts with
+	next    int
+	streams map[string]*groupStream
+	// dirty is set when offsets were committed since they were saved
+	dirty bool
+	wake  chan struct{}
+	mu    sync.Mutex
+}
+
+type groupMember struct {
+	group    *group
+	id       string
+	clientId string
+	// active is set once the client knows the subscription id
+	active   bool
+	inFlight int
+}
+
+// groupStream is the position of a group in a stream topic. All offsets
+// below committed are consumed, those from dispatched on are not sent yet.
+type groupStream struct {
+	committed  uint64
+	dispatched uint64
+	inFlight   map[uint64]*groupMember
+	acked      map[uint64]bool
+	// redeliver holds the offsets members left without committing
+	redeliver []uint64
+}
+
+func newGroupStream(offset uint64) *groupStream {
+	return &groupStream{
+		committed:  offset,
+		dispatched: offset,
+		inFlight:   make(map[uint64]*groupMember),
+		acked:      make(map[uint64]bool),
+	}
+}
+
+// skipTo moves the position to first when retention dropped older messages
+func (s *groupStream) skipTo(first uint64) {
+	if s.committed >= first {
+		return
+	}
+	s.committed = first
+	s.dispatched = max(s.dispatched, first)
+	for offset, member := range s.inFlight {
+		if offset < first {
+			member.inFlight--
+			delete(s.inFlight, offset)
+		}
+	}
+	for offset := range s.acked {
+		if offset < first {
+			delete(s.acked, offset)
+		}
+	}
+	s.redeliver = slices.DeleteFunc(s.redeliver, func(offset uint64) bool { return offset < first })
+}
+
+// ack commits offset and moves committed over the consumed offsets
+func (s *groupStream) ack(offset uint64) {
+	if offset < s.committed || offset >= s.dispatched {
+		return
+	}
+	if member, ok := s.inFlight[offset]; ok {
+		member.inFlight--
+		delete(s.inFlight, offset)
+	}
+	s.redeliver = slices.DeleteFunc(s.redeliver, func(o uint64) bool { return o == offset })
+	s.acked[offset] = true
+	for s.acked[s.committed] {
+		delete(s.acked, s.committed)
+		s.committed++
+	}
+}
+
+func (g *group) wakeUp() {
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+}
+
+// loadGroups restores the committed offsets of the stored groups
+func (b *broker) loadGroups() {
+	for _, stored := range b.storage.Groups() {
+		g := b.newGroup(stored.Group, stored.Topic)
+		for topic, offset := range stored.Offsets {
+			g.streams[topic] = newGroupStream(offset)
+		}
+	}
+}
+
+// newGroup adds a group and starts its dispatcher, b.mu is held or the
+// broker is starting
+func (b *broker) newGroup(name, topic string) *group {
+	g := &group{
+		name:    name,
+		topic:   topic,
+		streams: make(map[string]*groupStream),
+		wake:    make(chan struct{}, 1),
+	}
+	b.groups[name] = g
+	b.workers.Add(1)
+	go b.runGroup(g)
+	return g
+}
+
+// joinGroup adds a member to a group, a new group starts with the oldest
+// retained messages
+func (b *broker) joinGroup(client *clientInfo, name, topic string) (string, func(), error) {
+	select {
+	case <-b.stop:
+		return "", nil, fmt.Errorf("broker shut down")
+	default:
+	}
+	g, ok := b.groups[name]
+	if !ok {
+		g = b.newGroup(name, topic)
+		g.dirty = true
+	}
+	if g.topic != topic {
+		return "", nil, fmt.Errorf("group '%s' consumes '%s', not '%s'", name, g.topic, topic)
+	}
+	member := &groupMember{
+		group:    g,
+		id:       uuid.NewString(),
+		clientId: client.id,
+	}
+	b.members[member.id] = member
+	g.mu.Lock()
+	g.members = append(g.members, member)
+	count := len(g.members)
+	g.mu.Unlock()
+	log.Infof("Client %s joined group '%s' on %s, %d members", client.id, name, topic, count)
+	return member.id, func() {
+		g.mu.Lock()
+		member.active = true
+		g.mu.Unlock()
+		g.wakeUp()
+	}, nil
+}
+
+// leaveGroup removes a member, its uncommitted messages go to the other
+// members. b.mu is held.
+func (b *broker) leaveGroup(member *groupMember) {
+	delete(b.members, member.id)
+	g := member.group
+	g.mu.Lock()
+	g.members = slices.DeleteFunc(g.members, func(m *groupMember) bool { return m == member })
+	moved := 0
+	for _, s := range g.streams {
+		for offset, holder := range s.inFlight {
+			if holder == member {
+				delete(s.inFlight, offset)
+				s.redeliver = append(s.redeliver, offset)
+				moved++
+			}
+		}
+		slices.Sort(s.redeliver)
+	}
+	count := len(g.members)
+	g.mu.Unlock()
+	log.Infof("Client %s left group '%s', %d members, %d messages rebalanced", member.clientId, g.name, count, moved)
+	g.wakeUp()
+}
+
+// leaveGroups removes the group members of a client, b.mu is held
+func (b *broker) leaveGroups(clientId string) {
+	for _, member := range b.members {
+		if member.clientId == clientId {
+			b.leaveGroup(member)
+		}
+	}
+}
+
+func (b *broker) Commit(clientID, subscriptionId, topic string, offset uint64) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	member, ok := b.members[subscriptionId]
+	if !ok || member.clientId != clientID {
+		return fmt.Errorf("client %s is no member with subscription %s", clientID, subscriptionId)
+	}
+	g := member.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.streams[topic]
+	if !ok {
+		return fmt.Errorf("group '%s' does not consume '%s'", g.name, topic)
+	}
+	committed := s.committed
+	s.ack(offset)
+	g.dirty = g.dirty || s.committed != committed
+	g.wakeUp()
+	return nil
+}
+
+func (b *broker) Groups() []common.GroupInfo {
+	streams := b.storage.Streams()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	groups := make([]common.GroupInfo, 0, len(b.groups))
+	for _, g := range b.groups {
+		g.mu.Lock()
+		info := common.GroupInfo{
+			Group:   g.name,
+			Topic:   g.topic,
+			Members: len(g.members),
+			Streams: make([]common.GroupStreamInfo, 0),
+		}
+		for _, stream := range streams {
+			if !common.TopicMatches(g.topic, stream.Topic) {
+				continue
+			}
+			committed := stream.First
+			inFlight := 0
+			if s, ok := g.streams[stream.Topic]; ok {
+				committed = max(s.committed, stream.First)
+				inFlight = len(s.inFlight)
+			}
+			info.Streams = append(info.Streams, common.GroupStreamInfo{
+				Topic:     stream.Topic,
+				Committed: committed,
+				Next:      stream.Next,
+				Lag:       stream.Next - min(committed, stream.Next),
+				InFlight:  inFlight,
+			})
+		}
+		g.mu.Unlock()
+		groups = append(groups, info)
+	}
+	return groups
+}
+
+// runGroup dispatches the messages of a group when it is woken up and saves
+// its offsets every second
+func (b *broker) runGroup(g *group) {
+	defer b.workers.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.wake:
+			b.dispatch(g)
+		case <-ticker.C:
+			b.dispatch(g)
+			b.saveGroup(g)
+		case <-b.stop:
+			b.saveGroup(g)
+			return
+		}
+	}
+}
+
+// dispatch sends messages to the active members until their share of
+// uncommitted messages is reached
+func (b *broker) dispatch(g *group) {
+	streams := b.storage.Streams()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, stream := range streams {
+		if !common.TopicMatches(g.topic, stream.Topic) {
+			continue
+		}
+		s, ok := g.streams[stream.Topic]
+		if !ok {
+			s = newGroupStream(stream.First)
+			g.streams[stream.Topic] = s
+		}
+		committed := s.committed
+		s.skipTo(stream.First)
+		g.dirty = g.dirty || s.committed != committed
+		for len(s.redeliver) > 0 {
+			offset := s.redeliver[0]
+			messages, err := b.storage.ReadStream(stream.Topic, offset, 1)
+			if err != nil {
+				log.Errorf("Group '%s' failed to read %s: %v", g.name, stream.Topic, err)
+				return
+			}
+			if len(messages) == 0 || messages[0].Offset != offset {
+				// Dropped by retention meanwhile
+				s.redeliver = s.redeliver[1:]
+				continue
+			}
+			if !b.send(g, s, messages[0]) {
+				break
+			}
+			s.redeliver = s.redeliver[1:]
+		}
+		for full := false; !full && s.dispatched < stream.Next; {
+			messages, err := b.storage.ReadStream(stream.Topic, s.dispatched, groupBatch)
+			if err != nil {
+				log.Errorf("Group '%s' failed to read %s: %v", g.name, stream.Topic, err)
+				return
+			}
+			if len(messages) == 0 {
+				break
+			}
+			for _, msg := range messages {
+				if full = !b.send(g, s, msg); full {
+					break
+				}
+				s.dispatched = msg.Offset + 1
+			}
+		}
+	}
+}
+
+// send queues msg for the next active member with room, it reports false
+// when all members are busy
+func (b *broker) send(g *group, s *groupStream, msg *api.Message) bool {
+	for ii := range g.members {
+		member := g.members[(g.next+ii)%len(g.members)]
+		client, ok := b.clients[member.clientId]
+		if !ok || !member.active || member.inFlight >= groupInFlight {
+			continue
+		}
+		msgCopy := *msg
+		msgCopy.SubscriptionId = member.id
+		select {
+		case client.messageChannel <- &msgCopy:
+		default:
+			continue
+		}
+		member.inFlight++
+		s.inFlight[msg.Offset] = member
+		g.next = (g.next + ii + 1) % len(g.members)
+		return true
+	}
+	return false
+}
+
+func (b *broker) saveGroup(g *group) {
+	g.mu.Lock()
+	if !g.dirty {
+		g.mu.Unlock()
+		return
+	}
+	stored := common.GroupOffsets{
+		Group:   g.name,
+		Topic:   g.topic,
+		Offsets: make(map[string]uint64),
+	}
+	for topic, s := range g.streams {
+		stored.Offsets[topic] = s.committed
+	}
+	g.dirty = false
+	g.mu.Unlock()
+	if err := b.storage.SaveGroup(stored); err != nil {
+		log.Errorf("Failed to save offsets of group '%s': %v", g.name, err)
+		g.mu.Lock()
+		g.dirty = true
+		g.mu.Unlock()
+	}
+}
@@ -0,0 +1,223 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	log "github.com/oo-developer/mmq/src/logging"
+)
+
+const replayBatch = 100
+
+// streamCursor tracks a stream subscription. While it catches up the
+// messages are read from the log, afterwards the live messages from next on
+// are delivered.
+type streamCursor struct {
+	catchingUp bool
+	next       map[string]uint64
+	mu         sync.Mutex
+}
+
+// live reports whether a published stream message is delivered live
+func (c *streamCursor) live(msg *api.Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.catchingUp && msg.Offset >= c.next[msg.Topic]
+}
+
+func (b *broker) SubscribeStream(clientID, topic string, start api.StreamStart) (string, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client, exists := b.clients[clientID]
+	if !exists {
+		return "", nil, fmt.Errorf("Client not found: %s", clientID)
+	}
+	if !b.allowed(client, topic) {
+		return "", nil, fmt.Errorf("topic '%s' not allowed for client %s", topic, clientID)
+	}
+	if start.Group != "" {
+		return b.joinGroup(client, start.Group, topic)
+	}
+
+	sub := &subscription{
+		id:       uuid.NewString(),
+		clientId: clientID,
+		topic:    topic,
+		stream: &streamCursor{
+			catchingUp: start.From != api.StreamFromLatest,
+			next:       make(map[string]uint64),
+		},
+	}
+	if _, ok := b.subscriptions[topic]; !ok {
+		b.subscriptions[topic] = make(map[string]*subscription)
+		clear(b.matchCache)
+	}
+	b.subscriptions[topic][sub.id] = sub
+	log.Infof("Client %s subscribed to stream: %s", clientID, topic)
+	if start.From == api.StreamFromLatest {
+		for _, info := range b.storage.Streams() {
+			if common.TopicMatches(topic, info.Topic) {
+				sub.stream.next[info.Topic] = info.Next
+			}
+		}
+		return sub.id, func() {}, nil
+	}
+	// The replay waits for the client to learn the subscription id
+	return sub.id, func() {
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+		b.workers.Add(1)
+		go b.replay(sub, start)
+	}, nil
+}
+
+func (b *broker) SubscribeAfter(clientID, topic string, sequence uint64) (string, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client, exists := b.clients[clientID]
+	if !exists {
+		return "", nil, fmt.Errorf("Client not found: %s", clientID)
+	}
+	if !b.allowed(client, topic) {
+		return "", nil, fmt.Errorf("topic '%s' not allowed for client %s", topic, clientID)
+	}
+	sub := &subscription{
+		id:       uuid.NewString(),
+		clientId: clientID,
+		topic:    topic,
+		stream: &streamCursor{
+			catchingUp: true,
+			next:       make(map[string]uint64),
+		},
+	}
+	if _, ok := b.subscriptions[topic]; !ok {
+		b.subscriptions[topic] = make(map[string]*subscription)
+		clear(b.matchCache)
+	}
+	b.subscriptions[topic][sub.id] = sub
+	for _, msg := range b.messages {
+		if msg.Sequence > sequence && msg.Properties&api.Stream == 0 && common.TopicMatches(topic, msg.Topic) {
+			msgCopy := *msg
+			msgCopy.SubscriptionId = sub.id
+			client.messageChannel <- &msgCopy
+		}
+	}
+	log.Infof("Client %s subscribed to topic %s after sequence %d", clientID, topic, sequence)
+	// Sequences follow the clock, the log is read from the time of sequence on
+	start := api.StreamStart{From: api.StreamFromTime, Time: int64(sequence)}
+	return sub.id, func() {
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+		b.workers.Add(1)
+		go b.replay(sub, start)
+	}, nil
+}
+
+// replay delivers the logged messages of the stream topics matching sub, it
+// hands over to the live delivery once all logs are read to their end
+func (b *broker) replay(sub *subscription, start api.StreamStart) {
+	defer b.workers.Done()
+	positions := make(map[string]uint64)
+	for {
+		read := 0
+		for _, info := range b.storage.Streams() {
+			if !common.TopicMatches(sub.topic, info.Topic) {
+				continue
+			}
+			position, ok := positions[info.Topic]
+			if !ok {
+				position = b.startOffset(info.Topic, start)
+			}
+			messages, err := b.storage.ReadStream(info.Topic, position, replayBatch)
+			if err != nil {
+				log.Errorf("Replay of stream %s for client %s stopped: %v", info.Topic, sub.clientId, err)
+				return
+			}
+			for _, msg := range messages {
+				msg.SubscriptionId = sub.id
+				if !b.deliver(sub, msg) {
+					return
+				}
+				position = msg.Offset + 1
+			}
+			positions[info.Topic] = position
+			read += len(messages)
+		}
+		if read == 0 && b.caughtUp(sub, positions, start) {
+			log.Infof("Client %s caught up with stream: %s", sub.clientId, sub.topic)
+			return
+		}
+	}
+}
+
+func (b *broker) startOffset(topic string, start api.StreamStart) uint64 {
+	if start.From == api.StreamFromTime {
+		return b.storage.StreamOffset(topic, time.Unix(0, start.Time))
+	}
+	return start.Offset
+}
+
+// caughtUp switches sub to the live messages when nothing was appended
+// after positions, appends wait for the broker lock
+func (b *broker) caughtUp(sub *subscription, positions map[string]uint64, start api.StreamStart) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	next := make(map[string]uint64)
+	for _, info := range b.storage.Streams() {
+		if !common.TopicMatches(sub.topic, info.Topic) {
+			continue
+		}
+		position, ok := positions[info.Topic]
+		if !ok {
+			position = b.startOffset(info.Topic, start)
+		}
+		if position < info.Next {
+			if messages, err := b.storage.ReadStream(info.Topic, position, 1); err != nil || len(messages) > 0 {
+				return false
+			}
+		}
+		next[info.Topic] = info.Next
+	}
+	sub.stream.mu.Lock()
+	defer sub.stream.mu.Unlock()
+	sub.stream.next = next
+	sub.stream.catchingUp = false
+	return true
+}
+
+// deliver queues a replayed message without holding the broker while the
+// queue of the client is full, it reports false once the subscription is gone
+func (b *broker) deliver(sub *subscription, msg *api.Message) bool {
+	for {
+		b.mu.RLock()
+		client, ok := b.clients[sub.clientId]
+		if _, subscribed := b.subscriptions[sub.topic][sub.id]; !ok || !subscribed {
+			b.mu.RUnlock()
+			return false
+		}
+		select {
+		case client.messageChannel <- msg:
+			b.mu.RUnlock()
+			return true
+		default:
+		}
+		b.mu.RUnlock()
+		select {
+		case <-b.stop:
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package certificate
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	log "github.com/oo-developer/mmq/src/logging"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	PEM_TYPE               = "MMQ CERTIFICATE"
+	defaultValidityDays    = 365
+	signatureContext       = "mmq user certificate"
+	maxCertificatePemBytes = 16384
+)
+
+var (
+	errCertificatesDisabled = errors.New("certificates are disabled")
+	errInvalidCertificate   = errors.New("invalid certificate")
+	errInvalidSignature     = errors.New("invalid certificate signature")
+)
+
+// body is the signed part of a user certificate
+type body struct {
+	Serial       string   `msgpack:"serial"`
+	Name         string   `msgpack:"name"`
+	Admin        bool     `msgpack:"admin"`
+	Groups       []string `msgpack:"groups"`
+	PublicKeyPem string   `msgpack:"publicKeyPem"`
+	NotBefore    int64    `msgpack:"notBefore"`
+	NotAfter     int64    `msgpack:"notAfter"`
+}
+
+type signedCertificate struct {
+	Body      []byte `msgpack:"body"`
+	Signature []byte `msgpack:"signature"`
+}
+
+// user is the identity described by a valid certificate
+type user struct {
+	body      *body
+	publicKey *api.KyberPublicKey
+}
+
+func (u *user) Name() string {
+	return u.body.Name
+}
+
+func (u *user) IsAdmin() bool {
+	return u.body.Admin
+}
+
+func (u *user) IsDisabled() bool {
+	return false
+}
+
+// ExpiresAt of a certificate user is the end of the certificate validity
+func (u *user) ExpiresAt() time.Time {
+	return time.Unix(u.body.NotAfter, 0)
+}
+
+// SessionsRevokedAt of a certificate user is never set, certificates are
+// revoked by their serial
+func (u *user) SessionsRevokedAt() time.Time {
+	return time.Time{}
+}
+
+func (u *user) PublicKeyPem() string {
+	return u.body.PublicKeyPem
+}
+
+func (u *user) PublicKey() *api.KyberPublicKey {
+	return u.publicKey
+}
+
+func (u *user) Groups() []string {
+	return u.body.Groups
+}
+
+func (u *user) Serial() string {
+	return u.body.Serial
+}
+
+type certificates struct {
+	config         *config.Certificates
+	storageService common.StorageService
+	brokerService  common.BrokerService
+	caPrivateKey   *api.MLDSAPrivateKey
+	caPublicKey    *api.MLDSAPublicKey
+	revoked        map[string]common.RevokedCertificate
+	mu             sync.RWMutex
+}
+
+func NewCertificateService(config *config.Config, storageService common.StorageService, brokerService common.BrokerService) common.CertificateService {
+	c := &certificates{
+		config:         &config.Certificates,
+		storageService: storageService,
+		brokerService:  brokerService,
+		revoked:        make(map[string]common.RevokedCertificate),
+	}
+	return c
+}
+
+func (c *certificates) Start() {
+	if !c.config.Enabled {
+		return
+	}
+	var err error
+	c.caPublicKey, err = api.LoadMLDSAPublicKeyFile(c.config.CaPublicKeyFile)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	// The private key is only needed to issue certificates, a broker may verify only
+	if c.config.CaPrivateKeyFile != "" {
+		c.caPrivateKey, err = api.LoadMLDSAPrivateKeyFile(c.config.CaPrivateKeyFile)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	for _, entry := range c.storageService.GetAllRevokedCertificates() {
+		c.revoked[entry.Serial] = entry
+	}
+	log.Info("CertificateService started")
+}
+
+func (c *certificates) Shutdown() {
+	if c.config.Enabled {
+		log.Info("CertificateService shut down")
+	}
+}
+
+func (c *certificates) Enabled() bool {
+	return c.config.Enabled
+}
+
+// Issue signs a certificate for the given Kyber public key and returns its serial and PEM
+func (c *certificates) Issue(name string, admin bool, groups []string, publicKeyPem string, validity time.Duration) (string, string, error) {
+	if !c.config.Enabled {
+		return "", "", errCertificatesDisabled
+	}
+	if c.caPrivateKey == nil {
+		return "", "", fmt.Errorf("no CA private key configured")
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("certificate name is required")
+	}
+	if _, err := api.LoadKyberPublicKey([]byte(publicKeyPem)); err != nil {
+		return "", "", err
+	}
+	for _, group := range groups {
+		if _, ok := c.config.Groups[group]; !ok {
+			return "", "", fmt.Errorf("unknown ACL group '%s'", group)
+		}
+	}
+	if validity <= 0 {
+		days := c.config.DefaultValidityDays
+		if days <= 0 {
+			days = defaultValidityDays
+		}
+		validity = time.Duration(days) * 24 * time.Hour
+	}
+	now := time.Now()
+	certBody := &body{
+		Serial:       uuid.NewString(),
+		Name:         name,
+		Admin:        admin,
+		Groups:       groups,
+		PublicKeyPem: publicKeyPem,
+		NotBefore:    now.Unix(),
+		NotAfter:     now.Add(validity).Unix(),
+	}
+	bodyBytes, err := msgpack.Marshal(certBody)
+	if err != nil {
+		return "", "", err
+	}
+	signature, err := api.SignMLDSA(c.caPrivateKey, bodyBytes, []byte(signatureContext))
+	if err != nil {
+		return "", "", err
+	}
+	signed, err := msgpack.Marshal(&signedCertificate{
+		Body:      bodyBytes,
+		Signature: signature,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	certificatePem := pem.EncodeToMemory(&pem.Block{
+		Type:  PEM_TYPE,
+		Bytes: signed,
+	})
+	log.Infof("Issued certificate %s for '%s'", certBody.Serial, name)
+	return certBody.Serial, string(certificatePem), nil
+}
+
+func (c *certificates) Revoke(serial string) error {
+	return c.revoke(serial, "")
+}
+
+// RevokeCertificate revokes a certificate given as PEM, which records the name as well
+func (c *certificates) RevokeCertificate(certificatePem []byte) error {
+	certBody, err := c.parse(certificatePem)
+	if err != nil {
+		return err
+	}
+	return c.revoke(certBody.Serial, certBody.Name)
+}
+
+func (c *certificates) revoke(serial, name string) error {
+	if !c.config.Enabled {
+		return errCertificatesDisabled
+	}
+	if serial == "" {
+		return fmt.Errorf("certificate serial is required")
+	}
+	entry := common.RevokedCertificate{
+		Serial:    serial,
+		Name:      name,
+		RevokedAt: time.Now(),
+	}
+	if err := c.storageService.AddRevokedCertificate(entry); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.revoked[serial] = entry
+	c.mu.Unlock()
+	log.Infof("Revoked certificate %s", serial)
+	for _, client := range c.brokerService.AllClients() {
+		if certUser, ok := client.User().(*user); ok && certUser.Serial() == serial {
+			c.brokerService.DisconnectClient(client.Id(), "certificate revoked")
+		}
+	}
+	return nil
+}
+
+func (c *certificates) Revoked() []common.RevokedCertificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	revoked := make([]common.RevokedCertificate, 0, len(c.revoked))
+	for _, entry := range c.revoked {
+		revoked = append(revoked, entry)
+	}
+	return revoked
+}
+
+// Verify checks signature, validity period and revocation of a certificate
+func (c *certificates) Verify(certificatePem []byte) (common.User, error) {
+	if !c.config.Enabled {
+		return nil, errCertificatesDisabled
+	}
+	certBody, err := c.parse(certificatePem)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if now < certBody.NotBefore {
+		return nil, fmt.Errorf("certificate %s is not yet valid", certBody.Serial)
+	}
+	if now >= certBody.NotAfter {
+		return nil, fmt.Errorf("certificate %s expired", certBody.Serial)
+	}
+	c.mu.RLock()
+	_, revoked := c.revoked[certBody.Serial]
+	c.mu.RUnlock()
+	if revoked {
+		return nil, fmt.Errorf("certificate %s is revoked", certBody.Serial)
+	}
+	publicKey, err := api.LoadKyberPublicKey([]byte(certBody.PublicKeyPem))
+	if err != nil {
+		return nil, err
+	}
+	return &user{
+		body:      certBody,
+		publicKey: publicKey,
+	}, nil
+}
+
+func (c *certificates) Acl(verified common.User) ([]string, error) {
+	certUser, ok := verified.(*user)
+	if !ok {
+		return nil, fmt.Errorf("user '%s' has no certificate", verified.Name())
+	}
+	acl := make([]string, 0)
+	for _, group := range certUser.Groups() {
+		patterns, ok := c.config.Groups[group]
+		if !ok {
+			return nil, fmt.Errorf("certificate %s has the unknown ACL group '%s'", certUser.Serial(), group)
+		}
+		acl = append(acl, patterns...)
+	}
+	// An empty ACL allows every topic
+	if len(certUser.Groups()) > 0 && len(acl) == 0 {
+		return nil, fmt.Errorf("ACL groups of certificate %s allow no topic", certUser.Serial())
+	}
+	return acl, nil
+}
+
+// parse decodes a certificate and checks its signature
+func (c *certificates) parse(certificatePem []byte) (*body, error) {
+	if len(certificatePem) > maxCertificatePemBytes {
+		return nil, errInvalidCertificate
+	}
+	block, _ := pem.Decode(certificatePem)
+	if block == nil || block.Type != PEM_TYPE {
+		return nil, errInvalidCertificate
+	}
+	signed := &signedCertificate{}
+	if err := msgpack.Unmarshal(block.Bytes, signed); err != nil {
+		return nil, errInvalidCertificate
+	}
+	if !api.VerifyMLDSA(c.caPublicKey, signed.Body, []byte(signatureContext), signed.Signature) {
+		return nil, errInvalidSignature
+	}
+	certBody := &body{}
+	if err := msgpack.Unmarshal(signed.Body, certBody); err != nil {
+		return nil, errInvalidCertificate
+	}
+	return certBody, nil
+}
@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oo-developer/mmq/src/common"
+	log "github.com/oo-developer/mmq/src/logging"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// backupChunk is the size of the chunks a backup is sent in
+	backupChunk = 1024 * 1024
+	// backupExpiry removes a backup the client stopped reading
+	backupExpiry = 10 * time.Minute
+)
+
+// backup is a snapshot or export in a temporary file until it is read
+type backup struct {
+	file     *os.File
+	size     int64
+	checksum string
+	used     time.Time
+}
+
+func (c *cli) backup(client common.BrokerClient, payload []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	request := common.BackupReq{}
+	if err := msgpack.Unmarshal(payload, &request); err != nil {
+		return c.returnError(err)
+	}
+	id := request.Id
+	if id == "" {
+		created, err := c.createBackup(request.Export)
+		if err != nil {
+			return c.returnError(err)
+		}
+		id = created
+	}
+	c.backupsMu.Lock()
+	b, ok := c.backups[id]
+	if ok {
+		b.used = time.Now()
+	}
+	c.backupsMu.Unlock()
+	if !ok {
+		return c.returnError(fmt.Errorf("backup '%s' not found", id))
+	}
+	if request.Offset < 0 || request.Offset > b.size {
+		return c.returnError(fmt.Errorf("offset %d beyond backup of %d bytes", request.Offset, b.size))
+	}
+	data := make([]byte, min(backupChunk, b.size-request.Offset))
+	if _, err := b.file.ReadAt(data, request.Offset); err != nil && !errors.Is(err, io.EOF) {
+		return c.returnError(err)
+	}
+	if request.Offset+int64(len(data)) == b.size {
+		c.removeBackup(id)
+	}
+	value, err := msgpack.Marshal(&common.BackupResp{
+		Id:       id,
+		Size:     b.size,
+		Checksum: b.checksum,
+		Data:     data,
+	})
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
+// createBackup writes a snapshot or an export to a temporary file
+func (c *cli) createBackup(export bool) (string, error) {
+	c.removeBackups(backupExpiry)
+	file, err := os.CreateTemp("", "mmq_backup")
+	if err != nil {
+		return "", err
+	}
+	os.Remove(file.Name())
+	hash := sha256.New()
+	writer := io.MultiWriter(file, hash)
+	if export {
+		err = c.storageService.Export(writer)
+	} else {
+		err = c.storageService.Backup(writer)
+	}
+	if err != nil {
+		file.Close()
+		return "", fmt.Errorf("creating backup: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return "", err
+	}
+	id := uuid.NewString()
+	c.backupsMu.Lock()
+	c.backups[id] = &backup{
+		file:     file,
+		size:     info.Size(),
+		checksum: hex.EncodeToString(hash.Sum(nil)),
+		used:     time.Now(),
+	}
+	c.backupsMu.Unlock()
+	log.Infof("Created backup %s of %d bytes", id, info.Size())
+	return id, nil
+}
+
+func (c *cli) removeBackup(id string) {
+	c.backupsMu.Lock()
+	defer c.backupsMu.Unlock()
+	if b, ok := c.backups[id]; ok {
+		b.file.Close()
+		delete(c.backups, id)
+	}
+}
+
+// removeBackups removes the backups unused for longer than age
+func (c *cli) removeBackups(age time.Duration) {
+	c.backupsMu.Lock()
+	defer c.backupsMu.Unlock()
+	for id, b := range c.backups {
+		if time.Since(b.used) >= age {
+			b.file.Close()
+			delete(c.backups, id)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package cli
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/oo-developer/mmq/src/common"
 	"github.com/oo-developer/mmq/src/config"
@@ -10,16 +12,25 @@ import (
 )
 
 type cli struct {
-	config        *config.Config
-	userService   common.UserService
-	brokerService common.BrokerService
+	config         *config.Config
+	userService    common.UserService
+	brokerService  common.BrokerService
+	certService    common.CertificateService
+	guardService   common.GuardService
+	storageService common.StorageService
+	backups        map[string]*backup
+	backupsMu      sync.Mutex
 }
 
-func NewCliService(config *config.Config, userService common.UserService, brokerService common.BrokerService) common.CliService {
+func NewCliService(config *config.Config, userService common.UserService, brokerService common.BrokerService, certService common.CertificateService, guardService common.GuardService, storageService common.StorageService) common.CliService {
 	c := &cli{
-		config:        config,
-		userService:   userService,
-		brokerService: brokerService,
+		config:         config,
+		userService:    userService,
+		brokerService:  brokerService,
+		certService:    certService,
+		guardService:   guardService,
+		storageService: storageService,
+		backups:        make(map[string]*backup),
 	}
 	return c
 }
@@ -29,6 +40,7 @@ func (c *cli) Start() {
 }
 
 func (c *cli) Shutdown() {
+	c.removeBackups(0)
 }
 
 func (c *cli) Execute(clientId string, payload []byte) []byte {
@@ -41,6 +53,16 @@ func (c *cli) Execute(clientId string, payload []byte) []byte {
 	switch request.Type {
 	case common.COMMAND_ADD_USER:
 		return c.addUser(client, payload)
+	case common.COMMAND_ADD_USER_PUBLIC_KEY:
+		return c.addUserWithPublicKey(client, payload)
+	case common.COMMAND_ROTATE_USER_KEY:
+		return c.rotateUserKey(client, payload)
+	case common.COMMAND_DISABLE_USER:
+		return c.disableUser(client, payload)
+	case common.COMMAND_ENABLE_USER:
+		return c.enableUser(client, payload)
+	case common.COMMAND_SET_USER_EXPIRY:
+		return c.setUserExpiry(client, payload)
 	case common.COMMAND_REMOVE_USER:
 		return c.removeUser(client, payload)
 	case common.COMMAND_LIST_USERS:
@@ -49,6 +71,22 @@ func (c *cli) Execute(clientId string, payload []byte) []byte {
 		return c.allConnections(client, payload)
 	case common.COMMAND_LIST_TOPICS:
 		return c.allTopics(client, payload)
+	case common.COMMAND_LIST_LISTENERS:
+		return c.allListeners(client, payload)
+	case common.COMMAND_LIST_BANS:
+		return c.allBans(client, payload)
+	case common.COMMAND_REMOVE_BAN:
+		return c.removeBan(client, payload)
+	case common.COMMAND_LIST_GROUPS:
+		return c.allGroups(client, payload)
+	case common.COMMAND_BACKUP:
+		return c.backup(client, payload)
+	case common.COMMAND_ISSUE_CERTIFICATE:
+		return c.issueCertificate(client, payload)
+	case common.COMMAND_REVOKE_CERTIFICATE:
+		return c.revokeCertificate(client, payload)
+	case common.COMMAND_LIST_REVOKED_CERTIFICATES:
+		return c.revokedCertificates(client, payload)
 	default:
 		log.Errorf("Unknown cli command type: %v", request.Type)
 		c.returnError(fmt.Errorf("unknown cli command type: %v", request.Type))
@@ -65,7 +103,7 @@ func (c *cli) addUser(client common.BrokerClient, command []byte) []byte {
 	if err != nil {
 		return c.returnError(err)
 	}
-	privateKeyPem, err := c.userService.AddUser(request.Name, request.Admin)
+	privateKeyPem, err := c.userService.AddUser(request.Name, request.Admin, expiry(request.ExpiresAt))
 	if err != nil {
 		return c.returnError(err)
 	}
@@ -79,6 +117,27 @@ func (c *cli) addUser(client common.BrokerClient, command []byte) []byte {
 	return value
 }
 
+func (c *cli) addUserWithPublicKey(client common.BrokerClient, command []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	request := common.AddUserPublicKeyReq{}
+	err := msgpack.Unmarshal(command, &request)
+	if err != nil {
+		return c.returnError(err)
+	}
+	err = c.userService.AddUserWithPublicKey(request.Name, request.Admin, request.PublicKeyPem, expiry(request.ExpiresAt))
+	if err != nil {
+		return c.returnError(err)
+	}
+	response := &common.AddUserPublicKeyResp{}
+	value, err := msgpack.Marshal(response)
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
 func (c *cli) removeUser(client common.BrokerClient, command []byte) []byte {
 	if !client.User().IsAdmin() {
 		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
@@ -103,6 +162,95 @@ func (c *cli) removeUser(client common.BrokerClient, command []byte) []byte {
 	return value
 }
 
+func (c *cli) rotateUserKey(client common.BrokerClient, command []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	request := common.RotateUserKeyReq{}
+	err := msgpack.Unmarshal(command, &request)
+	if err != nil {
+		return c.returnError(err)
+	}
+	privateKeyPem, err := c.userService.RotateKey(request.Name, request.PublicKeyPem)
+	if err != nil {
+		return c.returnError(err)
+	}
+	response := &common.RotateUserKeyResp{
+		PrivateKeyPem: privateKeyPem,
+	}
+	value, err := msgpack.Marshal(response)
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
+func (c *cli) disableUser(client common.BrokerClient, command []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	request := common.DisableUserReq{}
+	err := msgpack.Unmarshal(command, &request)
+	if err != nil {
+		return c.returnError(err)
+	}
+	if request.Name == client.User().Name() {
+		return c.returnError(fmt.Errorf("user '%s' cannot be disabled", client.User().Name()))
+	}
+	err = c.userService.SetDisabled(request.Name, true)
+	if err != nil {
+		return c.returnError(err)
+	}
+	response := &common.DisableUserResp{}
+	value, err := msgpack.Marshal(response)
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
+func (c *cli) enableUser(client common.BrokerClient, command []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	request := common.EnableUserReq{}
+	err := msgpack.Unmarshal(command, &request)
+	if err != nil {
+		return c.returnError(err)
+	}
+	err = c.userService.SetDisabled(request.Name, false)
+	if err != nil {
+		return c.returnError(err)
+	}
+	response := &common.EnableUserResp{}
+	value, err := msgpack.Marshal(response)
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
+func (c *cli) setUserExpiry(client common.BrokerClient, command []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	request := common.SetUserExpiryReq{}
+	err := msgpack.Unmarshal(command, &request)
+	if err != nil {
+		return c.returnError(err)
+	}
+	err = c.userService.SetExpiry(request.Name, expiry(request.ExpiresAt))
+	if err != nil {
+		return c.returnError(err)
+	}
+	response := &common.SetUserExpiryResp{}
+	value, err := msgpack.Marshal(response)
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
 func (c *cli) allUsers(client common.BrokerClient, payload []byte) []byte {
 	if !client.User().IsAdmin() {
 		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
@@ -111,8 +259,10 @@ func (c *cli) allUsers(client common.BrokerClient, payload []byte) []byte {
 	resultList.Users = make([]common.UserResp, 0)
 	for _, entry := range c.userService.AllUsers() {
 		resultList.Users = append(resultList.Users, common.UserResp{
-			Name:  entry.Name(),
-			Admin: entry.IsAdmin(),
+			Name:      entry.Name(),
+			Admin:     entry.IsAdmin(),
+			Disabled:  entry.IsDisabled(),
+			ExpiresAt: unixTime(entry.ExpiresAt()),
 		})
 	}
 	value, err := msgpack.Marshal(resultList)
@@ -133,6 +283,8 @@ func (c *cli) allConnections(client common.BrokerClient, payload []byte) []byte
 			Id:       entry.Id(),
 			Username: entry.User().Name(),
 			Admin:    entry.User().IsAdmin(),
+			Provider: entry.Identity().Provider,
+			Listener: entry.Listener(),
 		})
 	}
 	value, err := msgpack.Marshal(resultList)
@@ -142,6 +294,103 @@ func (c *cli) allConnections(client common.BrokerClient, payload []byte) []byte
 	return value
 }
 
+func (c *cli) allListeners(client common.BrokerClient, payload []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	connections := make(map[string]int)
+	for _, entry := range c.brokerService.AllClients() {
+		connections[entry.Listener()]++
+	}
+	resultList := &common.ListListenersResp{}
+	resultList.Listeners = make([]common.ListenerResp, 0)
+	for _, entry := range c.config.AllListeners() {
+		resultList.Listeners = append(resultList.Listeners, common.ListenerResp{
+			Name:           entry.Name,
+			Protocol:       entry.Protocol,
+			Network:        entry.Network,
+			AddressCommand: entry.AddressCommand,
+			AddressPublish: entry.AddressPublish,
+			Connections:    connections[entry.Name],
+		})
+	}
+	value, err := msgpack.Marshal(resultList)
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
+func (c *cli) allBans(client common.BrokerClient, payload []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	resultList := &common.ListBansResp{}
+	resultList.Bans = make([]common.BanResp, 0)
+	for _, entry := range c.guardService.Bans() {
+		resultList.Bans = append(resultList.Bans, common.BanResp{
+			Ip:     entry.Ip,
+			Reason: entry.Reason,
+			Until:  entry.Until.Unix(),
+		})
+	}
+	value, err := msgpack.Marshal(resultList)
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
+func (c *cli) removeBan(client common.BrokerClient, command []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	request := common.RemoveBanReq{}
+	err := msgpack.Unmarshal(command, &request)
+	if err != nil {
+		return c.returnError(err)
+	}
+	if err := c.guardService.Unban(request.Ip); err != nil {
+		return c.returnError(err)
+	}
+	value, err := msgpack.Marshal(&common.RemoveBanResp{})
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
+func (c *cli) allGroups(client common.BrokerClient, payload []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	resultList := &common.ListGroupsResp{}
+	resultList.Groups = make([]common.GroupResp, 0)
+	for _, group := range c.brokerService.Groups() {
+		entry := common.GroupResp{
+			Group:   group.Group,
+			Topic:   group.Topic,
+			Members: group.Members,
+			Streams: make([]common.GroupStreamResp, 0, len(group.Streams)),
+		}
+		for _, stream := range group.Streams {
+			entry.Streams = append(entry.Streams, common.GroupStreamResp{
+				Topic:     stream.Topic,
+				Committed: stream.Committed,
+				Next:      stream.Next,
+				Lag:       stream.Lag,
+				InFlight:  stream.InFlight,
+			})
+		}
+		resultList.Groups = append(resultList.Groups, entry)
+	}
+	value, err := msgpack.Marshal(resultList)
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
 func (c *cli) allTopics(client common.BrokerClient, payload []byte) []byte {
 	if !client.User().IsAdmin() {
 		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
@@ -162,6 +411,92 @@ func (c *cli) allTopics(client common.BrokerClient, payload []byte) []byte {
 	return value
 }
 
+func (c *cli) issueCertificate(client common.BrokerClient, command []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	request := common.IssueCertificateReq{}
+	err := msgpack.Unmarshal(command, &request)
+	if err != nil {
+		return c.returnError(err)
+	}
+	validity := time.Duration(request.ValidityDays) * 24 * time.Hour
+	serial, certificatePem, err := c.certService.Issue(request.Name, request.Admin, request.Groups, request.PublicKeyPem, validity)
+	if err != nil {
+		return c.returnError(err)
+	}
+	response := &common.IssueCertificateResp{
+		Serial:         serial,
+		CertificatePem: certificatePem,
+	}
+	value, err := msgpack.Marshal(response)
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
+func (c *cli) revokeCertificate(client common.BrokerClient, command []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	request := common.RevokeCertificateReq{}
+	err := msgpack.Unmarshal(command, &request)
+	if err != nil {
+		return c.returnError(err)
+	}
+	if request.CertificatePem != "" {
+		err = c.certService.RevokeCertificate([]byte(request.CertificatePem))
+	} else {
+		err = c.certService.Revoke(request.Serial)
+	}
+	if err != nil {
+		return c.returnError(err)
+	}
+	response := &common.RevokeCertificateResp{}
+	value, err := msgpack.Marshal(response)
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
+func (c *cli) revokedCertificates(client common.BrokerClient, payload []byte) []byte {
+	if !client.User().IsAdmin() {
+		return c.returnError(fmt.Errorf("user '%s' is not admin", client.User().Name()))
+	}
+	resultList := &common.ListRevokedCertificatesResp{}
+	resultList.Certificates = make([]common.RevokedCertificateResp, 0)
+	for _, entry := range c.certService.Revoked() {
+		resultList.Certificates = append(resultList.Certificates, common.RevokedCertificateResp{
+			Serial:    entry.Serial,
+			Name:      entry.Name,
+			RevokedAt: entry.RevokedAt.Unix(),
+		})
+	}
+	value, err := msgpack.Marshal(resultList)
+	if err != nil {
+		return c.returnError(err)
+	}
+	return value
+}
+
+// unixTime converts t for responses, the zero time is sent as 0
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// expiry converts the expiry of a request, 0 means never
+func expiry(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
 func (c *cli) returnError(err error) []byte {
 	response := common.CliResponse{
 		Error:        true,
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"errors"
+	"net"
+
+	api "github.com/oo-developer/mmq/pkg"
+)
+
+// ErrNotApplicable is returned by an Authenticator that can not handle the
+// given credentials, the next authenticator of the chain is tried
+var ErrNotApplicable = errors.New("authenticator not applicable")
+
+// Identity is the result of a successful authentication
+type Identity struct {
+	Provider string
+	User     User
+	// Acl restricts the topics of the client, empty means no restriction
+	Acl []string
+}
+
+// Allowed checks a topic against the ACL of the identity
+func (i *Identity) Allowed(topic string) bool {
+	if len(i.Acl) == 0 {
+		return true
+	}
+	for _, pattern := range i.Acl {
+		if TopicMatches(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+type AuthRequest struct {
+	Conn        net.Conn
+	Credentials *api.Credentials
+	// Providers restricts the authenticators by name, empty allows all
+	Providers []string
+	// NewSession marks requests that open a session, they count against the
+	// per-user connection cap
+	NewSession bool
+	// ClientId of the new session, a connected client with this id is taken
+	// over and not counted against the cap
+	ClientId string
+}
+
+type Authenticator interface {
+	Name() string
+	Authenticate(request *AuthRequest) (*Identity, error)
+}
+
+type AuthService interface {
+	Service
+	Authenticate(request *AuthRequest) (*Identity, error)
+}
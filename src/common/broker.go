@@ -1,13 +1,46 @@
 package common
 
 import (
+	"errors"
+	"time"
+
 	"github.com/oo-developer/mmq/pkg"
 )
 
+// ErrClientIdInUse refuses a client whose id is connected for another user
+var ErrClientIdInUse = errors.New("client id in use by another user")
+
 type BrokerClient interface {
 	Id() string
 	User() User
+	Identity() *Identity
+	Listener() string
 	MessageChan() <-chan *api.Message
+	// Done is closed when the client is disconnected by the broker or unregistered
+	Done() <-chan struct{}
+	// DisconnectReason tells why the broker disconnected the client, it is
+	// empty for clients that disconnected themselves
+	DisconnectReason() string
+}
+
+// DISCONNECT_TAKEN_OVER is the reason given to a client whose id was
+// registered by a new connection
+const DISCONNECT_TAKEN_OVER = "session taken over"
+
+// DISCONNECT_SHUTDOWN is the reason given to the clients when the broker shuts down
+const DISCONNECT_SHUTDOWN = "server shutdown"
+
+// ClientOptions describe how a client is connected
+type ClientOptions struct {
+	Listener string
+	// Persistent keeps the subscriptions and queued messages of a client
+	// with the same id that is taken over
+	Persistent bool
+}
+
+type Subscription struct {
+	Id    string
+	Topic string
 }
 
 type Topic struct {
@@ -18,12 +51,47 @@ type Topic struct {
 
 type BrokerService interface {
 	Service
-	RegisterClient(clientID string, user User) BrokerClient
-	UnregisterClient(clientID string)
+	// RegisterClient registers a client, a connected client with the same id
+	// and user is taken over. A client id of another user is refused with
+	// ErrClientIdInUse.
+	RegisterClient(clientID string, identity *Identity, options ClientOptions) (BrokerClient, error)
+	UnregisterClient(client BrokerClient)
+	DisconnectClient(clientId string, reason string)
+	DisconnectUser(userName string, reason string)
+	// DisconnectAll terminates the sessions of all clients
+	DisconnectAll(reason string)
+	// Drain waits until the published messages are queued for their
+	// subscribers and the queues of the clients are empty, it reports false
+	// when the deadline passed first
+	Drain(deadline time.Time) bool
 	Client(clientId string) BrokerClient
 	AllClients() []BrokerClient
 	AllTopics() []*Topic
+	// Subscriptions returns the subscriptions of a client
+	Subscriptions(clientId string) []Subscription
+	// RetainedMessage returns the retained message of a topic
+	RetainedMessage(topic string) (*api.Message, bool)
 	Subscribe(clientID, topic string) (string, error)
+	// SubscribeStream subscribes to the stream topics matching topic from
+	// start on, the logged messages are replayed before the live ones once
+	// replay is called. With a group in start the subscription joins the
+	// consumer group instead and gets its share of the messages.
+	SubscribeStream(clientID, topic string, start api.StreamStart) (subscriptionId string, replay func(), err error)
+	// SubscribeAfter subscribes to topic and queues what was published after
+	// sequence instead of the retained messages: the last message of every
+	// topic and the logged messages of the stream topics once replay is called
+	SubscribeAfter(clientID, topic string, sequence uint64) (subscriptionId string, replay func(), err error)
+	// Commit marks offset of a stream topic as consumed by the consumer
+	// group member subscriptionId
+	Commit(clientID, subscriptionId, topic string, offset uint64) error
+	// Groups describes the consumer groups
+	Groups() []GroupInfo
+	// SubscriberCount returns the number of subscriptions matching a topic
+	SubscriberCount(topic string) int
 	Unsubscribe(clientID, topic string, subscriptionId string) error
-	Publish(properties api.MessageProperty, topic string, payload []byte, publisherID string)
+	// Publish routes a message, a persistent message is stored as the sync
+	// policy of the storage says before it returns
+	Publish(properties api.MessageProperty, topic string, payload []byte, publisherID string) error
+	// PublishWithReply publishes a request, subscribers answer on the topic replyTo
+	PublishWithReply(properties api.MessageProperty, topic string, replyTo string, payload []byte, publisherID string) error
 }
@@ -0,0 +1,22 @@
+package common
+
+import "time"
+
+type RevokedCertificate struct {
+	Serial    string
+	Name      string
+	RevokedAt time.Time
+}
+
+type CertificateService interface {
+	Service
+	Enabled() bool
+	Issue(name string, admin bool, groups []string, publicKeyPem string, validity time.Duration) (string, string, error)
+	Revoke(serial string) error
+	RevokeCertificate(certificatePem []byte) error
+	Revoked() []RevokedCertificate
+	Verify(certificatePem []byte) (User, error)
+	// Acl returns the topic patterns of the ACL groups in the certificate of
+	// a verified user, a certificate without groups is not restricted
+	Acl(user User) ([]string, error)
+}
@@ -6,6 +6,19 @@ const (
 	COMMAND_LIST_USERS
 	COMMAND_LIST_CONNECTIONS
 	COMMAND_LIST_TOPICS
+	COMMAND_ISSUE_CERTIFICATE
+	COMMAND_REVOKE_CERTIFICATE
+	COMMAND_LIST_REVOKED_CERTIFICATES
+	COMMAND_ADD_USER_PUBLIC_KEY
+	COMMAND_ROTATE_USER_KEY
+	COMMAND_DISABLE_USER
+	COMMAND_ENABLE_USER
+	COMMAND_SET_USER_EXPIRY
+	COMMAND_LIST_LISTENERS
+	COMMAND_LIST_BANS
+	COMMAND_REMOVE_BAN
+	COMMAND_LIST_GROUPS
+	COMMAND_BACKUP
 )
 
 type CliService interface {
@@ -24,8 +37,9 @@ type CliResponse struct {
 
 type AddUserReq struct {
 	CliRequest
-	Name  string `json:"name"`
-	Admin bool   `json:"admin"`
+	Name      string `json:"name"`
+	Admin     bool   `json:"admin"`
+	ExpiresAt int64  `json:"expiresAt"`
 }
 
 type AddUserResp struct {
@@ -33,6 +47,19 @@ type AddUserResp struct {
 	PrivateKeyPem string `json:"privateKeyPem"`
 }
 
+// AddUserPublicKeyReq registers a user with a key pair generated on the device
+type AddUserPublicKeyReq struct {
+	CliRequest
+	Name         string `json:"name"`
+	Admin        bool   `json:"admin"`
+	PublicKeyPem string `json:"publicKeyPem"`
+	ExpiresAt    int64  `json:"expiresAt"`
+}
+
+type AddUserPublicKeyResp struct {
+	CliResponse
+}
+
 type RemoveUserReq struct {
 	CliRequest
 	Name string `json:"name"`
@@ -42,13 +69,57 @@ type RemoveUserResp struct {
 	CliResponse
 }
 
+// RotateUserKeyReq replaces the key of a user, a new key pair is generated
+// by the broker if PublicKeyPem is empty
+type RotateUserKeyReq struct {
+	CliRequest
+	Name         string `json:"name"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type RotateUserKeyResp struct {
+	CliResponse
+	PrivateKeyPem string `json:"privateKeyPem"`
+}
+
+type DisableUserReq struct {
+	CliRequest
+	Name string `json:"name"`
+}
+
+type DisableUserResp struct {
+	CliResponse
+}
+
+type EnableUserReq struct {
+	CliRequest
+	Name string `json:"name"`
+}
+
+type EnableUserResp struct {
+	CliResponse
+}
+
+// SetUserExpiryReq sets the expiry as unix time, 0 removes the expiry
+type SetUserExpiryReq struct {
+	CliRequest
+	Name      string `json:"name"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+type SetUserExpiryResp struct {
+	CliResponse
+}
+
 type ListUsersReq struct {
 	CliRequest
 }
 
 type UserResp struct {
-	Name  string `json:"name"`
-	Admin bool   `json:"admin"`
+	Name      string `json:"name"`
+	Admin     bool   `json:"admin"`
+	Disabled  bool   `json:"disabled"`
+	ExpiresAt int64  `json:"expiresAt"`
 }
 
 type ListUsersResp struct {
@@ -64,6 +135,8 @@ type ConnectionResp struct {
 	Id       string `json:"id"`
 	Username string `json:"username"`
 	Admin    bool   `json:"admin"`
+	Provider string `json:"provider"`
+	Listener string `json:"listener"`
 }
 
 type ListConnectionsResp struct {
@@ -71,6 +144,24 @@ type ListConnectionsResp struct {
 	Connections []ConnectionResp `json:"connections"`
 }
 
+type ListListenersReq struct {
+	CliRequest
+}
+
+type ListenerResp struct {
+	Name           string `json:"name"`
+	Protocol       string `json:"protocol"`
+	Network        string `json:"network"`
+	AddressCommand string `json:"addressCommand"`
+	AddressPublish string `json:"addressPublish"`
+	Connections    int    `json:"connections"`
+}
+
+type ListListenersResp struct {
+	CliResponse
+	Listeners []ListenerResp `json:"listeners"`
+}
+
 type ListTopicsReq struct {
 	CliRequest
 }
@@ -85,3 +176,110 @@ type ListTopicsResp struct {
 	CliResponse
 	Topics []TopicResp `json:"topics"`
 }
+
+type IssueCertificateReq struct {
+	CliRequest
+	Name         string   `json:"name"`
+	Admin        bool     `json:"admin"`
+	Groups       []string `json:"groups"`
+	PublicKeyPem string   `json:"publicKeyPem"`
+	ValidityDays int      `json:"validityDays"`
+}
+
+type IssueCertificateResp struct {
+	CliResponse
+	Serial         string `json:"serial"`
+	CertificatePem string `json:"certificatePem"`
+}
+
+type RevokeCertificateReq struct {
+	CliRequest
+	Serial         string `json:"serial"`
+	CertificatePem string `json:"certificatePem"`
+}
+
+type RevokeCertificateResp struct {
+	CliResponse
+}
+
+type ListRevokedCertificatesReq struct {
+	CliRequest
+}
+
+type RevokedCertificateResp struct {
+	Serial    string `json:"serial"`
+	Name      string `json:"name"`
+	RevokedAt int64  `json:"revokedAt"`
+}
+
+type ListRevokedCertificatesResp struct {
+	CliResponse
+	Certificates []RevokedCertificateResp `json:"certificates"`
+}
+
+type ListBansReq struct {
+	CliRequest
+}
+
+type BanResp struct {
+	Ip     string `json:"ip"`
+	Reason string `json:"reason"`
+	Until  int64  `json:"until"`
+}
+
+type ListBansResp struct {
+	CliResponse
+	Bans []BanResp `json:"bans"`
+}
+
+type RemoveBanReq struct {
+	CliRequest
+	Ip string `json:"ip"`
+}
+
+type RemoveBanResp struct {
+	CliResponse
+}
+
+type ListGroupsReq struct {
+	CliRequest
+}
+
+type GroupStreamResp struct {
+	Topic     string `json:"topic"`
+	Committed uint64 `json:"committed"`
+	Next      uint64 `json:"next"`
+	Lag       uint64 `json:"lag"`
+	InFlight  int    `json:"inFlight"`
+}
+
+type GroupResp struct {
+	Group   string            `json:"group"`
+	Topic   string            `json:"topic"`
+	Members int               `json:"members"`
+	Streams []GroupStreamResp `json:"streams"`
+}
+
+type ListGroupsResp struct {
+	CliResponse
+	Groups []GroupResp `json:"groups"`
+}
+
+// BackupReq asks for a snapshot of the database, or an export with Export
+// set, in chunks. The first request without Id creates it, the others read it
+// from Offset on.
+type BackupReq struct {
+	CliRequest
+	Export bool   `json:"export"`
+	Id     string `json:"id"`
+	Offset int64  `json:"offset"`
+}
+
+// BackupResp holds a chunk of a backup, Checksum is the SHA-256 of all of it
+type BackupResp struct {
+	CliResponse
+	Id       string `json:"id"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	Data     []byte `json:"data"`
+}
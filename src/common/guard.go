@@ -0,0 +1,29 @@
+package common
+
+import (
+	"net"
+	"time"
+)
+
+type Ban struct {
+	Ip     string
+	Reason string
+	Until  time.Time
+}
+
+type GuardService interface {
+	Service
+	// Admit counts a connection against the global and per-IP caps, release
+	// has to be called when the connection is closed
+	Admit(conn net.Conn) (release func(), err error)
+	// Banned reports whether the IP of conn is banned
+	Banned(conn net.Conn) bool
+	// CheckUser refuses users that reached their connection cap, the client
+	// of clientId is replaced by the new session and not counted
+	CheckUser(userName, clientId string) error
+	// AuthFailed charges a failed authentication to the IP of conn
+	AuthFailed(conn net.Conn)
+	HandshakeTimeout() time.Duration
+	Bans() []Ban
+	Unban(ip string) error
+}
@@ -4,3 +4,11 @@ type Service interface {
 	Start()
 	Shutdown()
 }
+
+// TransportService serves the connections of the clients
+type TransportService interface {
+	Service
+	// Handoff passes the listening sockets to a new broker process, release
+	// lets the new process open the storage once this one shut down
+	Handoff() (release func(), err error)
+}
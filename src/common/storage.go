@@ -1,13 +1,42 @@
 package common
 
-import api "github.com/oo-developer/mmq/pkg"
+import (
+	"io"
+	"time"
+
+	api "github.com/oo-developer/mmq/pkg"
+)
 
 type StorageService interface {
 	Service
 	GetAllMessages() []*api.Message
-	AddMessageChannel() chan *api.Message
-	RemoveMessageChannel() chan string
+	// AddMessage writes msg ahead, the channel reports once the sync policy is met
+	AddMessage(msg *api.Message) <-chan error
+	// RemoveMessage removes the stored message of topic like AddMessage adds one
+	RemoveMessage(topic string) <-chan error
 	GetAllUsers() []User
 	AddUser(user User) error
 	RemoveUserByName(userName string) error
+	GetAllRevokedCertificates() []RevokedCertificate
+	AddRevokedCertificate(revoked RevokedCertificate) error
+	// IsStream reports whether topic is logged as stream
+	IsStream(topic string) bool
+	// AppendStream appends msg to the log of its topic and sets offset and
+	// timestamp, the returned channel reports when the append is stored as
+	// the sync policy says
+	AppendStream(msg *api.Message) <-chan error
+	// ReadStream returns up to limit messages of topic from offset on
+	ReadStream(topic string, offset uint64, limit int) ([]*api.Message, error)
+	// StreamOffset returns the offset of the first message of topic published at or after t
+	StreamOffset(topic string, t time.Time) uint64
+	// Streams describes the logs of all stream topics
+	Streams() []StreamInfo
+	// Groups returns the stored consumer groups
+	Groups() []GroupOffsets
+	// SaveGroup stores the committed offsets of a consumer group
+	SaveGroup(group GroupOffsets) error
+	// Backup writes a consistent snapshot of the database
+	Backup(w io.Writer) error
+	// Export writes the stored state as newline-delimited JSON records
+	Export(w io.Writer) error
 }
@@ -0,0 +1,37 @@
+package common
+
+// StreamInfo describes the log of a stream topic
+type StreamInfo struct {
+	Topic string
+	// First is the oldest offset retained, Next the offset of the next message
+	First    uint64
+	Next     uint64
+	Messages int64
+	Bytes    int64
+	Segments int
+}
+
+// GroupOffsets is the stored state of a consumer group, Offsets holds the
+// next offset to consume per stream topic
+type GroupOffsets struct {
+	Group   string            `msgpack:"group" json:"group"`
+	Topic   string            `msgpack:"topic" json:"topic"`
+	Offsets map[string]uint64 `msgpack:"offsets" json:"offsets"`
+}
+
+// GroupInfo describes a consumer group and its position in the streams
+type GroupInfo struct {
+	Group   string
+	Topic   string
+	Members int
+	Streams []GroupStreamInfo
+}
+
+// GroupStreamInfo is the position of a consumer group in a stream topic
+type GroupStreamInfo struct {
+	Topic     string
+	Committed uint64
+	Next      uint64
+	Lag       uint64
+	InFlight  int
+}
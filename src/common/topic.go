@@ -0,0 +1,57 @@
+package common
+
+import (
+	"strings"
+)
+
+// TopicMatches checks if a subscription topic matches a published topic
+// Supports MQTT-style wildcards:
+// - "+" matches a single level: "sensor/+/temp" matches "sensor/room1/temp"
+// - "#" matches multiple levels: "sensor/#" matches "sensor/room1/temp"
+func TopicMatches(subTopic, pubTopic string) bool {
+	// Exact match
+	if subTopic == pubTopic {
+		return true
+	}
+
+	// Split topics into levels
+	subLevels := strings.Split(subTopic, "/")
+	pubLevels := strings.Split(pubTopic, "/")
+
+	// Check for multi-level wildcard "#"
+	// Must be at the end and alone in its level
+	if len(subLevels) > 0 && subLevels[len(subLevels)-1] == "#" {
+		// "#" alone matches everything
+		if len(subLevels) == 1 {
+			return true
+		}
+		// Match all levels before "#"
+		if len(pubLevels) < len(subLevels)-1 {
+			return false
+		}
+		for i := 0; i < len(subLevels)-1; i++ {
+			if subLevels[i] != pubLevels[i] && subLevels[i] != "+" {
+				return false
+			}
+		}
+		return true
+	}
+
+	// For non-# wildcards, level count must match exactly
+	if len(subLevels) != len(pubLevels) {
+		return false
+	}
+
+	// Check each level with "+" wildcard support
+	for i := 0; i < len(subLevels); i++ {
+		if subLevels[i] == "+" {
+			// "+" matches any single level
+			continue
+		}
+		if subLevels[i] != pubLevels[i] {
+			return false
+		}
+	}
+
+	return true
+}
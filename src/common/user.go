@@ -1,20 +1,49 @@
 package common
 
 import (
+	"fmt"
+	"time"
+
 	api "github.com/oo-developer/mmq/pkg"
 )
 
 type User interface {
 	Name() string
 	IsAdmin() bool
+	IsDisabled() bool
+	ExpiresAt() time.Time
+	// SessionsRevokedAt is the time the user last changed, session tickets
+	// issued until then are not resumed
+	SessionsRevokedAt() time.Time
 	PublicKeyPem() string
 	PublicKey() *api.KyberPublicKey
 }
 
+// UserExpired reports whether the expiry time of user has passed
+func UserExpired(user User) bool {
+	expiresAt := user.ExpiresAt()
+	return !expiresAt.IsZero() && !time.Now().Before(expiresAt)
+}
+
+// CheckUser rejects disabled and expired users
+func CheckUser(user User) error {
+	if user.IsDisabled() {
+		return fmt.Errorf("user '%s' is disabled", user.Name())
+	}
+	if UserExpired(user) {
+		return fmt.Errorf("user '%s' is expired", user.Name())
+	}
+	return nil
+}
+
 type UserService interface {
 	Service
 	LookupUserByName(name string) (User, bool)
-	AddUser(userName string, admin bool) (string, error)
+	AddUser(userName string, admin bool, expiresAt time.Time) (string, error)
+	AddUserWithPublicKey(userName string, admin bool, publicKeyPem string, expiresAt time.Time) error
 	RemoveUserByName(userName string) error
+	RotateKey(userName string, publicKeyPem string) (string, error)
+	SetDisabled(userName string, disabled bool) error
+	SetExpiry(userName string, expiresAt time.Time) error
 	AllUsers() []User
 }
@@ -2,14 +2,58 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 )
 
+// Tls configures the "tls" network. SkipSessionCipher drops the Kyber/ChaCha
+// session layer on top of TLS, authentication is still done by mmq.
+type Tls struct {
+	CertFile          string `json:"certFile"`
+	KeyFile           string `json:"keyFile"`
+	ClientCaFile      string `json:"clientCaFile"`
+	RequireClientCert bool   `json:"requireClientCert"`
+	SkipSessionCipher bool   `json:"skipSessionCipher"`
+}
+
+// WebSocket configures the "ws" and "wss" networks, "wss" uses the Tls settings.
+// Path is a prefix of the upgrade request path. Without AllowedOrigins only
+// requests of the same host or without origin are accepted, "*" allows all.
+type WebSocket struct {
+	Path           string   `json:"path"`
+	AllowedOrigins []string `json:"allowedOrigins"`
+}
+
+// Listener is one endpoint of the broker, all listeners feed the same broker.
+// Protocol is "mmq", "mqtt", "http", "nats" or "resp", other protocols than mmq only use AddressCommand.
+// AuthProviders restricts the providers by name, empty allows all of them.
+type Listener struct {
+	Name           string    `json:"name"`
+	Protocol       string    `json:"protocol"`
+	Network        string    `json:"network"`
+	AddressCommand string    `json:"addressCommand"`
+	AddressPublish string    `json:"addressPublish"`
+	SocketMode     string    `json:"socketMode"`
+	SocketOwner    string    `json:"socketOwner"`
+	SocketGroup    string    `json:"socketGroup"`
+	Tls            Tls       `json:"tls"`
+	WebSocket      WebSocket `json:"webSocket"`
+	AuthProviders  []string  `json:"authProviders"`
+	Limits         Limits    `json:"limits"`
+}
+
 type Transport struct {
 	Network        string `json:"network"`
 	AddressCommand string `json:"addressCommand"`
 	AddressPublish string `json:"addressPublish"`
+	// SocketMode, SocketOwner and SocketGroup apply to unix sockets, mode is octal like "0660"
+	SocketMode  string     `json:"socketMode"`
+	SocketOwner string     `json:"socketOwner"`
+	SocketGroup string     `json:"socketGroup"`
+	Tls         Tls        `json:"tls"`
+	WebSocket   WebSocket  `json:"webSocket"`
+	Listeners   []Listener `json:"listeners"`
 }
 
 type Logging struct {
@@ -23,21 +67,158 @@ type Crypto struct {
 	PublicKeyFile  string `json:"publicKeyFile"`
 }
 
+// Storage writes persistent messages ahead to WalFile, next to DbFile by
+// default, before they are acknowledged. Sync "always" syncs the log before
+// PUBLISH_ACK, "interval" every SyncIntervalMillis and "none" leaves it to
+// the operating system. Backend is "bbolt" by default, "file" keeps an
+// append-only log in DbFile and "memory" keeps nothing across restarts.
 type Storage struct {
-	DbFile string `json:"dbFile"`
+	Backend            string `json:"backend"`
+	DbFile             string `json:"dbFile"`
+	WalFile            string `json:"walFile"`
+	Sync               string `json:"sync"`
+	SyncIntervalMillis int    `json:"syncIntervalMillis"`
+}
+
+// Stream keeps every message of the topics matching Pattern in an append-only
+// log, each topic has its own offsets. The log is split into segments of
+// SegmentMessages messages and retention drops whole segments, the oldest
+// first, while a limit is exceeded. A zero limit is unlimited.
+type Stream struct {
+	Pattern         string `json:"pattern"`
+	SegmentMessages int    `json:"segmentMessages"`
+	MaxAgeSeconds   int    `json:"maxAgeSeconds"`
+	MaxBytes        int64  `json:"maxBytes"`
+	MaxMessages     int64  `json:"maxMessages"`
 }
 
 type Limits struct {
 	MaxTopicLength   int `json:"maxTopicLength"`
 	MaxPayloadLength int `json:"maxPayloadLength"`
+	MaxConnections   int `json:"maxConnections"`
+}
+
+type Tickets struct {
+	Enabled         bool     `json:"enabled"`
+	LifetimeSeconds int      `json:"lifetimeSeconds"`
+	KeyFile         string   `json:"keyFile"`
+	RevokedUsers    []string `json:"revokedUsers"`
+}
+
+type Certificates struct {
+	Enabled             bool   `json:"enabled"`
+	CaPrivateKeyFile    string `json:"caPrivateKeyFile"`
+	CaPublicKeyFile     string `json:"caPublicKeyFile"`
+	DefaultValidityDays int    `json:"defaultValidityDays"`
+	// Groups maps the ACL groups signed into certificates to the topic
+	// patterns they allow
+	Groups map[string][]string `json:"groups"`
+}
+
+// PeerMapping maps the uid and/or gid of a local process to a user, an unset
+// id matches any process
+type PeerMapping struct {
+	Uid   *uint32 `json:"uid"`
+	Gid   *uint32 `json:"gid"`
+	User  string  `json:"user"`
+	Admin bool    `json:"admin"`
+}
+
+// AuthProvider configures one authenticator of the chain. Type is one of
+// key, certificate, token, webhook, peercred and mtls.
+type AuthProvider struct {
+	Name          string        `json:"name"`
+	Type          string        `json:"type"`
+	Algorithm     string        `json:"algorithm"`
+	SecretFile    string        `json:"secretFile"`
+	PublicKeyFile string        `json:"publicKeyFile"`
+	Url           string        `json:"url"`
+	TimeoutMillis int           `json:"timeoutMillis"`
+	Peers         []PeerMapping `json:"peers"`
+}
+
+type Auth struct {
+	Providers []AuthProvider `json:"providers"`
+}
+
+// Guard hardens the handshake. Every handshake frame has to arrive within
+// HandshakeTimeoutMillis, connection caps of 0 are unlimited. Failed
+// authentications of an IP drain a bucket of AuthFailureBurst tokens that
+// refills with AuthFailuresPerMinute, an empty bucket bans the IP for BanSeconds.
+type Guard struct {
+	HandshakeTimeoutMillis int     `json:"handshakeTimeoutMillis"`
+	MaxConnections         int     `json:"maxConnections"`
+	MaxConnectionsPerIp    int     `json:"maxConnectionsPerIp"`
+	MaxConnectionsPerUser  int     `json:"maxConnectionsPerUser"`
+	AuthFailureBurst       int     `json:"authFailureBurst"`
+	AuthFailuresPerMinute  float64 `json:"authFailuresPerMinute"`
+	BanSeconds             int     `json:"banSeconds"`
+}
+
+// Shutdown bounds a graceful shutdown. The broker drains the client queues
+// for up to DrainTimeoutMillis and waits as long for the connections to close,
+// disconnected clients are told to reconnect after ReconnectDelayMillis. A
+// restart waits up to HandoffTimeoutMillis for the new process to get ready.
+type Shutdown struct {
+	DrainTimeoutMillis   int `json:"drainTimeoutMillis"`
+	ReconnectDelayMillis int `json:"reconnectDelayMillis"`
+	HandoffTimeoutMillis int `json:"handoffTimeoutMillis"`
 }
 
 type Config struct {
-	Transport Transport `json:"transport"`
-	Logging   Logging   `json:"logging"`
-	Storage   Storage   `json:"storage"`
-	Crypto    Crypto    `json:"crypto"`
-	Limits    Limits    `json:"limits"`
+	Transport    Transport    `json:"transport"`
+	Logging      Logging      `json:"logging"`
+	Storage      Storage      `json:"storage"`
+	Crypto       Crypto       `json:"crypto"`
+	Limits       Limits       `json:"limits"`
+	Tickets      Tickets      `json:"tickets"`
+	Certificates Certificates `json:"certificates"`
+	Auth         Auth         `json:"auth"`
+	Guard        Guard        `json:"guard"`
+	Shutdown     Shutdown     `json:"shutdown"`
+	Streams      []Stream     `json:"streams"`
+}
+
+// AllListeners returns the configured listeners, without a listener list the
+// top-level transport fields describe the only listener "default". Unset
+// limits of a listener are taken from the top-level limits, the protocol
+// defaults to mmq.
+func (c *Config) AllListeners() []Listener {
+	if len(c.Transport.Listeners) == 0 {
+		return []Listener{{
+			Name:           "default",
+			Protocol:       "mmq",
+			Network:        c.Transport.Network,
+			AddressCommand: c.Transport.AddressCommand,
+			AddressPublish: c.Transport.AddressPublish,
+			SocketMode:     c.Transport.SocketMode,
+			SocketOwner:    c.Transport.SocketOwner,
+			SocketGroup:    c.Transport.SocketGroup,
+			Tls:            c.Transport.Tls,
+			WebSocket:      c.Transport.WebSocket,
+			Limits:         c.Limits,
+		}}
+	}
+	listeners := make([]Listener, 0, len(c.Transport.Listeners))
+	for ii, listener := range c.Transport.Listeners {
+		if listener.Name == "" {
+			listener.Name = fmt.Sprintf("listener%d", ii)
+		}
+		if listener.Protocol == "" {
+			listener.Protocol = "mmq"
+		}
+		if listener.Limits.MaxTopicLength == 0 {
+			listener.Limits.MaxTopicLength = c.Limits.MaxTopicLength
+		}
+		if listener.Limits.MaxPayloadLength == 0 {
+			listener.Limits.MaxPayloadLength = c.Limits.MaxPayloadLength
+		}
+		if listener.Limits.MaxConnections == 0 {
+			listener.Limits.MaxConnections = c.Limits.MaxConnections
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners
 }
 
 func Load(fileName string) *Config {
@@ -0,0 +1,303 @@
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	log "github.com/oo-developer/mmq/src/logging"
+)
+
+// HEARTBEAT_INTERVAL keeps idle event streams open through proxies
+const HEARTBEAT_INTERVAL = 15 * time.Second
+
+type connKey struct{}
+
+// Server is the HTTP gateway to the broker. Requests are authenticated with a
+// bearer token by the auth providers of the listener.
+type Server struct {
+	brokerService common.BrokerService
+	authService   common.AuthService
+}
+
+type topicResp struct {
+	Topic      string `json:"topic"`
+	Persistent bool   `json:"persistent"`
+	Retained   bool   `json:"retained"`
+}
+
+type eventResp struct {
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	Encoding string `json:"encoding,omitempty"`
+	Retained bool   `json:"retained"`
+}
+
+func NewServer(brokerService common.BrokerService, authService common.AuthService) *Server {
+	return &Server{
+		brokerService: brokerService,
+		authService:   authService,
+	}
+}
+
+// ConnContext keeps the connection of a request for the auth providers
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// Handler returns the routes of listener
+func (s *Server) Handler(listener *config.Listener) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /topics", s.authenticated(listener, false, s.listTopics))
+	mux.HandleFunc("GET /topics/{topic...}", s.authenticated(listener, false, s.getTopic))
+	mux.HandleFunc("POST /topics/{topic...}", s.authenticated(listener, false, func(w http.ResponseWriter, r *http.Request, identity *common.Identity) {
+		s.publish(w, r, identity, listener)
+	}))
+	mux.HandleFunc("GET /subscribe", s.authenticated(listener, true, func(w http.ResponseWriter, r *http.Request, identity *common.Identity) {
+		s.subscribe(w, r, identity, listener)
+	}))
+	return mux
+}
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request, identity *common.Identity)
+
+// authenticated resolves the identity of a request before handler, event
+// streams open a session
+func (s *Server) authenticated(listener *config.Listener, newSession bool, handler handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "bearer token required", http.StatusUnauthorized)
+			return
+		}
+		conn, _ := r.Context().Value(connKey{}).(net.Conn)
+		identity, err := s.authService.Authenticate(&common.AuthRequest{
+			Conn: conn,
+			Credentials: &api.Credentials{
+				Token: strings.TrimSpace(token),
+			},
+			Providers:  listener.AuthProviders,
+			NewSession: newSession,
+		})
+		if err != nil {
+			log.Warnf("HTTP authentication from '%s' failed: %v", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r, identity)
+	}
+}
+
+func (s *Server) listTopics(w http.ResponseWriter, r *http.Request, identity *common.Identity) {
+	topics := make([]topicResp, 0)
+	for _, topic := range s.brokerService.AllTopics() {
+		if !identity.Allowed(topic.Topic) {
+			continue
+		}
+		topics = append(topics, topicResp{
+			Topic:      topic.Topic,
+			Persistent: topic.Persistent,
+			Retained:   topic.Retained,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topics)
+}
+
+func (s *Server) getTopic(w http.ResponseWriter, r *http.Request, identity *common.Identity) {
+	topic := r.PathValue("topic")
+	if !identity.Allowed(topic) {
+		http.Error(w, fmt.Sprintf("topic '%s' not allowed", topic), http.StatusForbidden)
+		return
+	}
+	msg, ok := s.brokerService.RetainedMessage(topic)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no retained message for topic '%s'", topic), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Mmq-Persistent", strconv.FormatBool(msg.IsPersistent()))
+	w.Write(msg.Payload)
+}
+
+// publish takes the body as payload, the query flags retained and persistent
+// set the message properties
+func (s *Server) publish(w http.ResponseWriter, r *http.Request, identity *common.Identity, listener *config.Listener) {
+	topic := r.PathValue("topic")
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		http.Error(w, fmt.Sprintf("invalid topic '%s'", topic), http.StatusBadRequest)
+		return
+	}
+	if !identity.Allowed(topic) {
+		http.Error(w, fmt.Sprintf("topic '%s' not allowed", topic), http.StatusForbidden)
+		return
+	}
+	if listener.Limits.MaxTopicLength > 0 && len(topic) > listener.Limits.MaxTopicLength {
+		http.Error(w, "topic exceeds the limit of the listener", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var properties api.MessageProperty
+	for flag, property := range map[string]api.MessageProperty{"retained": api.Retained, "persistent": api.Persistent} {
+		value := r.URL.Query().Get(flag)
+		if value == "" {
+			continue
+		}
+		set, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid value '%s' of %s", value, flag), http.StatusBadRequest)
+			return
+		}
+		if set {
+			properties |= property
+		}
+	}
+	maxPayloadLength := api.MaxPayloadLength
+	if listener.Limits.MaxPayloadLength > 0 {
+		maxPayloadLength = listener.Limits.MaxPayloadLength
+	}
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxPayloadLength)))
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		http.Error(w, "payload exceeds the limit of the listener", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.brokerService.Publish(properties, topic, payload, "http-"+identity.User.Name()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// subscribe streams the messages of the topic query parameters as server-sent
+// events. Retained messages come first, a Last-Event-ID replaces them with the
+// messages published after that event.
+func (s *Server) subscribe(w http.ResponseWriter, r *http.Request, identity *common.Identity, listener *config.Listener) {
+	topics := r.URL.Query()["topic"]
+	if len(topics) == 0 {
+		http.Error(w, "topic required", http.StatusBadRequest)
+		return
+	}
+	var lastEventId uint64
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		var err error
+		lastEventId, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID '%s'", value), http.StatusBadRequest)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientId := "sse-" + uuid.NewString()
+	client, err := s.brokerService.RegisterClient(clientId, identity, common.ClientOptions{
+		Listener: listener.Name,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer s.brokerService.UnregisterClient(client)
+	replays := make([]func(), 0, len(topics))
+	for _, topic := range topics {
+		if topic == "" {
+			http.Error(w, "topic required", http.StatusBadRequest)
+			return
+		}
+		if listener.Limits.MaxTopicLength > 0 && len(topic) > listener.Limits.MaxTopicLength {
+			http.Error(w, "topic exceeds the limit of the listener", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if lastEventId == 0 {
+			if _, err := s.brokerService.Subscribe(clientId, topic); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			continue
+		}
+		_, replay, err := s.brokerService.SubscribeAfter(clientId, topic, lastEventId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		replays = append(replays, replay)
+	}
+	log.Infof("New event stream from '%s' for user '%s' as client %s", r.RemoteAddr, identity.User.Name(), clientId)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for _, replay := range replays {
+		replay()
+	}
+	heartbeat := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.Done():
+			return
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		case msg, ok := <-client.MessageChan():
+			if !ok {
+				return
+			}
+			// Messages up to the last event were seen before the reconnect
+			if msg.Sequence <= lastEventId {
+				continue
+			}
+			err = writeEvent(w, msg)
+		}
+		if err != nil {
+			log.Infof("Event stream of client %s closed: %v", clientId, err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent sends msg with its sequence as event id, binary payloads are
+// base64 encoded
+func writeEvent(w io.Writer, msg *api.Message) error {
+	event := eventResp{
+		Topic:    msg.Topic,
+		Payload:  string(msg.Payload),
+		Retained: msg.IsRetained(),
+	}
+	if !utf8.Valid(msg.Payload) {
+		event.Payload = base64.StdEncoding.EncodeToString(msg.Payload)
+		event.Encoding = "base64"
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", msg.Sequence, data)
+	return err
+}
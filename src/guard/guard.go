@@ -0,0 +1,227 @@
+package guard
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	log "github.com/oo-developer/mmq/src/logging"
+)
+
+const (
+	defaultHandshakeTimeout      = 10 * time.Second
+	defaultAuthFailureBurst      = 5
+	defaultAuthFailuresPerMinute = 1.0
+	defaultBanDuration           = 5 * time.Minute
+)
+
+// bucket limits the failed authentications of an IP
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type guard struct {
+	config        *config.Guard
+	brokerService common.BrokerService
+	connections   int
+	perIp         map[string]int
+	buckets       map[string]*bucket
+	bans          map[string]*common.Ban
+	stop          chan struct{}
+	stopped       sync.WaitGroup
+	mu            sync.Mutex
+}
+
+func NewGuardService(config *config.Config, brokerService common.BrokerService) common.GuardService {
+	return &guard{
+		config:        &config.Guard,
+		brokerService: brokerService,
+		perIp:         make(map[string]int),
+		buckets:       make(map[string]*bucket),
+		bans:          make(map[string]*common.Ban),
+		stop:          make(chan struct{}),
+	}
+}
+
+func (g *guard) Start() {
+	g.stopped.Add(1)
+	go g.cleanup()
+	log.Info("GuardService started")
+}
+
+func (g *guard) Shutdown() {
+	close(g.stop)
+	g.stopped.Wait()
+	log.Info("GuardService shut down")
+}
+
+func (g *guard) Admit(conn net.Conn) (func(), error) {
+	ip := remoteIp(conn)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ban, ok := g.bans[ip]; ok && time.Now().Before(ban.Until) {
+		return nil, fmt.Errorf("'%s' is banned until %s: %s", ip, ban.Until.Format(time.RFC3339), ban.Reason)
+	}
+	if g.config.MaxConnections > 0 && g.connections >= g.config.MaxConnections {
+		return nil, fmt.Errorf("connection limit %d reached", g.config.MaxConnections)
+	}
+	if ip != "" && g.config.MaxConnectionsPerIp > 0 && g.perIp[ip] >= g.config.MaxConnectionsPerIp {
+		return nil, fmt.Errorf("connection limit %d of '%s' reached", g.config.MaxConnectionsPerIp, ip)
+	}
+	g.connections++
+	if ip != "" {
+		g.perIp[ip]++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.connections--
+			if ip != "" {
+				if g.perIp[ip]--; g.perIp[ip] <= 0 {
+					delete(g.perIp, ip)
+				}
+			}
+		})
+	}, nil
+}
+
+func (g *guard) Banned(conn net.Conn) bool {
+	ip := remoteIp(conn)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ban, ok := g.bans[ip]
+	return ok && time.Now().Before(ban.Until)
+}
+
+func (g *guard) CheckUser(userName, clientId string) error {
+	if g.config.MaxConnectionsPerUser <= 0 {
+		return nil
+	}
+	count := 0
+	for _, client := range g.brokerService.AllClients() {
+		if client.User().Name() == userName && client.Id() != clientId {
+			count++
+		}
+	}
+	if count >= g.config.MaxConnectionsPerUser {
+		return fmt.Errorf("connection limit %d of user '%s' reached", g.config.MaxConnectionsPerUser, userName)
+	}
+	return nil
+}
+
+// AuthFailed takes a token from the bucket of the IP, the IP is banned when
+// the bucket is empty
+func (g *guard) AuthFailed(conn net.Conn) {
+	ip := remoteIp(conn)
+	if ip == "" {
+		return
+	}
+	burst := float64(g.config.AuthFailureBurst)
+	if burst <= 0 {
+		burst = defaultAuthFailureBurst
+	}
+	perMinute := g.config.AuthFailuresPerMinute
+	if perMinute <= 0 {
+		perMinute = defaultAuthFailuresPerMinute
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	b, ok := g.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		g.buckets[ip] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.updated).Minutes()*perMinute)
+	b.updated = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return
+	}
+	banDuration := defaultBanDuration
+	if g.config.BanSeconds > 0 {
+		banDuration = time.Duration(g.config.BanSeconds) * time.Second
+	}
+	g.bans[ip] = &common.Ban{
+		Ip:     ip,
+		Reason: "too many failed authentications",
+		Until:  now.Add(banDuration),
+	}
+	delete(g.buckets, ip)
+	log.Warnf("Banned '%s' for %s: too many failed authentications", ip, banDuration)
+}
+
+func (g *guard) HandshakeTimeout() time.Duration {
+	if g.config.HandshakeTimeoutMillis > 0 {
+		return time.Duration(g.config.HandshakeTimeoutMillis) * time.Millisecond
+	}
+	return defaultHandshakeTimeout
+}
+
+func (g *guard) Bans() []common.Ban {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	bans := make([]common.Ban, 0, len(g.bans))
+	for _, ban := range g.bans {
+		if time.Now().Before(ban.Until) {
+			bans = append(bans, *ban)
+		}
+	}
+	return bans
+}
+
+func (g *guard) Unban(ip string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.bans[ip]; !ok {
+		return fmt.Errorf("'%s' is not banned", ip)
+	}
+	delete(g.bans, ip)
+	log.Infof("Ban of '%s' removed", ip)
+	return nil
+}
+
+// cleanup drops expired bans and buckets without failures for an hour
+func (g *guard) cleanup() {
+	defer g.stopped.Done()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-g.stop:
+			return
+		}
+		g.mu.Lock()
+		now := time.Now()
+		for ip, ban := range g.bans {
+			if now.After(ban.Until) {
+				delete(g.bans, ip)
+			}
+		}
+		for ip, b := range g.buckets {
+			if now.Sub(b.updated) > time.Hour {
+				delete(g.buckets, ip)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// remoteIp returns the IP of the peer of conn, local sockets have none
+func remoteIp(conn net.Conn) string {
+	if conn == nil || conn.RemoteAddr() == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,242 @@
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The listening sockets are passed like systemd socket activation does, a
+// broker started by systemd with named sockets picks them up as well
+const (
+	ENV_LISTEN_FDS     = "LISTEN_FDS"
+	ENV_LISTEN_PID     = "LISTEN_PID"
+	ENV_LISTEN_FDNAMES = "LISTEN_FDNAMES"
+	// ENV_READY_FD is written to when the new process is ready to take over
+	ENV_READY_FD = "MMQ_HANDOFF_READY_FD"
+	// ENV_RELEASE_FD reaches EOF when the previous process released the storage
+	ENV_RELEASE_FD = "MMQ_HANDOFF_RELEASE_FD"
+
+	listenFdsStart = 3
+)
+
+// Socket is a listening socket passed to the new process under its name
+type Socket struct {
+	Name     string
+	Listener net.Listener
+}
+
+// Inherited holds what a process got from the process it replaces
+type Inherited struct {
+	listeners map[string]net.Listener
+	ready     *os.File
+	release   *os.File
+}
+
+// Load takes the sockets passed to this process, the variables are removed
+// from the environment so they are not passed on by accident
+func Load() (*Inherited, error) {
+	inherited := &Inherited{
+		listeners: make(map[string]net.Listener),
+	}
+	defer func() {
+		for _, name := range []string{ENV_LISTEN_FDS, ENV_LISTEN_PID, ENV_LISTEN_FDNAMES, ENV_READY_FD, ENV_RELEASE_FD} {
+			os.Unsetenv(name)
+		}
+	}()
+	if pid := os.Getenv(ENV_LISTEN_PID); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return inherited, nil
+	}
+	count, _ := strconv.Atoi(os.Getenv(ENV_LISTEN_FDS))
+	names := strings.Split(os.Getenv(ENV_LISTEN_FDNAMES), ":")
+	for ii := 0; ii < count; ii++ {
+		fd := listenFdsStart + ii
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%d", fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited socket %d: %w", fd, err)
+		}
+		name := strconv.Itoa(fd)
+		if ii < len(names) && names[ii] != "" {
+			name = names[ii]
+		}
+		inherited.listeners[name] = listener
+	}
+	var err error
+	if inherited.ready, err = inheritedFile(ENV_READY_FD); err != nil {
+		return nil, err
+	}
+	if inherited.release, err = inheritedFile(ENV_RELEASE_FD); err != nil {
+		return nil, err
+	}
+	return inherited, nil
+}
+
+func inheritedFile(env string) (*os.File, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return nil, nil
+	}
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s '%s'", env, value)
+	}
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), env), nil
+}
+
+// Listener returns the inherited socket of name, each socket is handed out once
+func (i *Inherited) Listener(name string) (net.Listener, bool) {
+	listener, ok := i.listeners[name]
+	delete(i.listeners, name)
+	return listener, ok
+}
+
+// Close closes the inherited sockets no listener took
+func (i *Inherited) Close() {
+	for name, listener := range i.listeners {
+		listener.Close()
+		delete(i.listeners, name)
+	}
+}
+
+// Replacing reports whether this process replaces a running broker
+func (i *Inherited) Replacing() bool {
+	return i.ready != nil
+}
+
+// TakeOver tells the previous process that this one is ready to take over,
+// then it waits until the previous process released the storage
+func (i *Inherited) TakeOver() error {
+	if i.ready == nil {
+		return nil
+	}
+	_, err := i.ready.Write([]byte{1})
+	i.ready.Close()
+	if err != nil {
+		return fmt.Errorf("failed to signal readiness: %w", err)
+	}
+	if i.release != nil {
+		defer i.release.Close()
+		if _, err := io.Copy(io.Discard, i.release); err != nil {
+			return fmt.Errorf("failed to wait for release: %w", err)
+		}
+	}
+	return nil
+}
+
+// Successor is the process a restart handed the sockets to
+type Successor struct {
+	Pid     int
+	release *os.File
+}
+
+// Release lets the successor open the storage
+func (s *Successor) Release() {
+	s.release.Close()
+}
+
+// Restart starts the running binary again with the same arguments and passes
+// sockets, it returns once the new process is ready to take over
+func Restart(sockets []Socket, timeout time.Duration) (*Successor, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*os.File, 0, len(sockets)+2)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	names := make([]string, 0, len(sockets))
+	for _, socket := range sockets {
+		file, err := fileOf(socket.Listener)
+		if err != nil {
+			return nil, fmt.Errorf("socket '%s': %w", socket.Name, err)
+		}
+		files = append(files, file)
+		names = append(names, socket.Name)
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+	files = append(files, readyWriter)
+	releaseReader, releaseWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, releaseReader)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(environment(),
+		fmt.Sprintf("%s=%d", ENV_LISTEN_FDS, len(sockets)),
+		fmt.Sprintf("%s=%s", ENV_LISTEN_FDNAMES, strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", ENV_READY_FD, listenFdsStart+len(sockets)),
+		fmt.Sprintf("%s=%d", ENV_RELEASE_FD, listenFdsStart+len(sockets)+1),
+	)
+	if err := cmd.Start(); err != nil {
+		releaseWriter.Close()
+		return nil, err
+	}
+	successor := &Successor{Pid: cmd.Process.Pid, release: releaseWriter}
+	// The new process holds its own copies now, EOF on ready means it exited
+	for _, file := range files {
+		file.Close()
+	}
+	files = nil
+	readyReader.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := readyReader.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		releaseWriter.Close()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("process %d exited before it was ready", successor.Pid)
+		}
+		return nil, fmt.Errorf("process %d not ready: %w", successor.Pid, err)
+	}
+	cmd.Process.Release()
+	return successor, nil
+}
+
+// fileOf duplicates the descriptor of a listening socket, a unix socket keeps
+// its path when the listener of this process is closed
+func fileOf(listener net.Listener) (*os.File, error) {
+	switch l := listener.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	}
+	return nil, fmt.Errorf("cannot pass %T", listener)
+}
+
+// environment is the environment of this process without handoff variables
+func environment() []string {
+	env := make([]string, 0)
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		switch name {
+		case ENV_LISTEN_FDS, ENV_LISTEN_PID, ENV_LISTEN_FDNAMES, ENV_READY_FD, ENV_RELEASE_FD:
+			continue
+		}
+		env = append(env, entry)
+	}
+	return env
+}
@@ -0,0 +1,559 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	log "github.com/oo-developer/mmq/src/logging"
+)
+
+const (
+	maxConnectSize = 65536
+	// receiveMaximum bounds the QoS 2 messages of a client waiting for
+	// PUBREL, MQTT 5 clients are told in CONNACK
+	receiveMaximum = 64
+)
+
+// Server maps MQTT 3.1.1 and 5 connections onto the broker, every connection
+// is a broker client. Messages are delivered with QoS 0, published messages
+// of QoS 1 and 2 are acknowledged once they are handed to the broker.
+type Server struct {
+	brokerService    common.BrokerService
+	authService      common.AuthService
+	handshakeTimeout time.Duration
+}
+
+func NewServer(brokerService common.BrokerService, authService common.AuthService, handshakeTimeout time.Duration) *Server {
+	return &Server{
+		brokerService:    brokerService,
+		authService:      authService,
+		handshakeTimeout: handshakeTimeout,
+	}
+}
+
+type will struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+type session struct {
+	server        *Server
+	listener      *config.Listener
+	conn          net.Conn
+	reader        *bufio.Reader
+	version       byte
+	clientId      string
+	persistent    bool
+	keepAlive     time.Duration
+	maxPacketSize int
+	will          *will
+	subscriptions map[string]string
+	pendingQos2   map[uint16]bool
+	writeMu       sync.Mutex
+}
+
+// Serve handles one MQTT connection of listener until it is closed
+func (s *Server) Serve(conn net.Conn, listener *config.Listener) {
+	defer conn.Close()
+	session := &session{
+		server:        s,
+		listener:      listener,
+		conn:          conn,
+		reader:        bufio.NewReader(conn),
+		subscriptions: make(map[string]string),
+		pendingQos2:   make(map[uint16]bool),
+	}
+	identity, properties, err := session.connect()
+	if err != nil {
+		log.Warnf("MQTT connection from '%s' rejected: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log.Infof("New MQTT connection from '%s' for user '%s' (%s)", conn.RemoteAddr(), identity.User.Name(), identity.Provider)
+
+	client, err := s.brokerService.RegisterClient(session.clientId, identity, common.ClientOptions{
+		Listener:   listener.Name,
+		Persistent: session.persistent,
+	})
+	if err != nil {
+		// Identifier rejected, Client Identifier not valid for MQTT 5
+		log.Warnf("MQTT connection from '%s' rejected: %v", conn.RemoteAddr(), session.refuse(0x02, 0x85, err))
+		return
+	}
+	defer s.brokerService.UnregisterClient(client)
+	go func() {
+		<-client.Done()
+		session.disconnect(client.DisconnectReason())
+		conn.Close()
+	}()
+	// A session without clean session continues the subscriptions of a
+	// connection it took over
+	var ackFlags byte
+	if session.persistent {
+		for _, subscription := range s.brokerService.Subscriptions(session.clientId) {
+			session.subscriptions[subscription.Topic] = subscription.Id
+			ackFlags = 0x01
+		}
+	}
+	if err := session.connack(ackFlags, 0x00, properties); err != nil {
+		log.Errorf("Failed to send CONNACK: %v", err)
+		return
+	}
+	go session.forward(client)
+	session.serve()
+}
+
+// connect reads CONNECT and authenticates the client, a refused connection
+// is answered with CONNACK
+func (s *session) connect() (*common.Identity, properties, error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.server.handshakeTimeout))
+	p, err := readPacket(s.reader, maxConnectSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.kind != CONNECT {
+		return nil, nil, fmt.Errorf("expected CONNECT, got packet type %d", p.kind)
+	}
+	d := &decoder{data: p.body}
+	protocolName := d.string()
+	s.version = d.byte()
+	flags := d.byte()
+	s.keepAlive = time.Duration(d.uint16()) * time.Second
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	if protocolName != "MQTT" || (s.version != VERSION_311 && s.version != VERSION_5) {
+		version := s.version
+		s.version = VERSION_311
+		return nil, nil, s.refuse(0x01, 0x84, fmt.Errorf("unsupported protocol '%s' level %d", protocolName, version))
+	}
+	if flags&0x01 != 0 {
+		return nil, nil, s.refuse(0x00, 0x81, errMalformed)
+	}
+	var connectProperties map[byte]any
+	if s.version == VERSION_5 {
+		connectProperties = d.properties()
+	}
+	s.clientId = d.string()
+	s.persistent = flags&0x02 == 0
+	if flags&0x04 != 0 {
+		if s.version == VERSION_5 {
+			d.properties()
+		}
+		s.will = &will{
+			topic:   d.string(),
+			payload: d.bytes(),
+			retain:  flags&0x20 != 0,
+		}
+		if flags>>3&0x03 == 0x03 || !validTopic(s.will.topic) {
+			return nil, nil, s.refuse(0x00, 0x81, fmt.Errorf("invalid will"))
+		}
+	} else if flags&0x38 != 0 {
+		return nil, nil, s.refuse(0x00, 0x81, errMalformed)
+	}
+	var username, password string
+	if flags&0x80 != 0 {
+		username = d.string()
+	}
+	if flags&0x40 != 0 {
+		password = string(d.bytes())
+	}
+	if d.err != nil || !d.empty() {
+		return nil, nil, s.refuse(0x00, 0x81, errMalformed)
+	}
+
+	var ackProperties properties
+	if s.version == VERSION_5 {
+		if _, ok := connectProperties[propAuthenticationMethod]; ok {
+			return nil, nil, s.refuse(0x00, 0x8C, fmt.Errorf("enhanced authentication is not supported"))
+		}
+		if size, ok := connectProperties[propMaximumPacketSize].(uint32); ok {
+			s.maxPacketSize = int(size)
+		}
+		// Sessions end with the connection
+		if expiry, ok := connectProperties[propSessionExpiryInterval].(uint32); ok && expiry > 0 {
+			ackProperties = ackProperties.uint32(propSessionExpiryInterval, 0)
+		}
+		ackProperties = ackProperties.uint16(propReceiveMaximum, receiveMaximum)
+		ackProperties = ackProperties.byte(propSubscriptionIdAvailable, 0)
+		ackProperties = ackProperties.byte(propSharedSubAvailable, 0)
+	}
+	if s.clientId == "" {
+		if s.version == VERSION_311 && flags&0x02 == 0 {
+			return nil, nil, s.refuse(0x02, 0x85, fmt.Errorf("empty client id without clean session"))
+		}
+		s.clientId = "mqtt-" + strings.ReplaceAll(uuid.NewString(), "-", "")
+		if s.version == VERSION_5 {
+			ackProperties = ackProperties.string(propAssignedClientId, s.clientId)
+		}
+	}
+	if password == "" {
+		return nil, nil, s.refuse(0x04, 0x86, fmt.Errorf("no password or token for user '%s'", username))
+	}
+	identity, err := s.server.authService.Authenticate(&common.AuthRequest{
+		Conn:        s.conn,
+		Credentials: credentials(username, password),
+		Providers:   s.listener.AuthProviders,
+		NewSession:  true,
+		ClientId:    s.clientId,
+	})
+	if err != nil {
+		return nil, nil, s.refuse(0x04, 0x86, err)
+	}
+	return identity, ackProperties, nil
+}
+
+// credentials maps the MQTT user name and password, a password in the
+// compact token format is passed as token
+func credentials(username, password string) *api.Credentials {
+	credentials := &api.Credentials{
+		User: username,
+	}
+	if strings.Count(password, ".") == 2 && !strings.ContainsAny(password, " \t") {
+		credentials.Token = password
+	} else {
+		credentials.Password = password
+	}
+	return credentials
+}
+
+// refuse answers CONNECT with the return code of the protocol version
+func (s *session) refuse(code311, code5 byte, err error) error {
+	code := code311
+	if s.version == VERSION_5 {
+		code = code5
+	}
+	// A malformed CONNECT of MQTT 3.1.1 is closed without answer
+	if code != 0x00 {
+		s.connack(0x00, code, nil)
+	}
+	return err
+}
+
+func (s *session) connack(flags, code byte, ackProperties properties) error {
+	body := []byte{flags, code}
+	if s.version == VERSION_5 {
+		body = appendProperties(body, ackProperties)
+	}
+	return s.write(encodePacket(CONNACK, 0, body))
+}
+
+// disconnect tells an MQTT 5 client why the broker disconnected it, MQTT
+// 3.1.1 has no DISCONNECT from the server
+func (s *session) disconnect(reason string) {
+	if s.version != VERSION_5 || reason == "" {
+		return
+	}
+	// Session taken over, server shutting down or administrative action
+	code := byte(0x98)
+	switch reason {
+	case common.DISCONNECT_TAKEN_OVER:
+		code = 0x8E
+	case common.DISCONNECT_SHUTDOWN:
+		code = 0x8B
+	}
+	s.sendDisconnect(code, reason)
+}
+
+// sendDisconnect sends an MQTT 5 DISCONNECT with reason code and string
+func (s *session) sendDisconnect(code byte, reason string) {
+	body := appendProperties([]byte{code}, properties(nil).string(propReasonString, reason))
+	if err := s.write(encodePacket(DISCONNECT, 0, body)); err != nil {
+		log.Warnf("Failed to send DISCONNECT to MQTT client %s: %v", s.clientId, err)
+	}
+}
+
+func (s *session) write(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *session) serve() {
+	maxSize := api.MaxTopicLength + api.MaxPayloadLength + 1024
+	for {
+		deadline := time.Time{}
+		if s.keepAlive > 0 {
+			deadline = time.Now().Add(s.keepAlive * 3 / 2)
+		}
+		s.conn.SetReadDeadline(deadline)
+		p, err := readPacket(s.reader, maxSize)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Warnf("MQTT client %s receive error: %v", s.clientId, err)
+			}
+			break
+		}
+		done, err := s.handle(p)
+		if err != nil {
+			log.Warnf("MQTT client %s protocol error: %v", s.clientId, err)
+			break
+		}
+		if done {
+			break
+		}
+	}
+	if s.will != nil {
+		s.publishWill()
+	}
+	log.Infof("MQTT client %s disconnected", s.clientId)
+}
+
+// handle processes one packet, it reports true when the client disconnected
+func (s *session) handle(p *packet) (bool, error) {
+	switch p.kind {
+	case PUBLISH:
+		return false, s.publish(p)
+	case PUBREL:
+		if p.flags != 0x02 {
+			return false, errMalformed
+		}
+		d := &decoder{data: p.body}
+		id := d.uint16()
+		if d.err != nil {
+			return false, d.err
+		}
+		delete(s.pendingQos2, id)
+		return false, s.write(encodePacket(PUBCOMP, 0, packetId(id)))
+	case SUBSCRIBE:
+		if p.flags != 0x02 {
+			return false, errMalformed
+		}
+		return false, s.subscribe(p)
+	case UNSUBSCRIBE:
+		if p.flags != 0x02 {
+			return false, errMalformed
+		}
+		return false, s.unsubscribe(p)
+	case PINGREQ:
+		return false, s.write(encodePacket(PINGRESP, 0, nil))
+	case DISCONNECT:
+		// MQTT 5 reason 0x04 asks for the will message to be published
+		if s.version != VERSION_5 || len(p.body) == 0 || p.body[0] != 0x04 {
+			s.will = nil
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("unexpected packet type %d", p.kind)
+}
+
+func (s *session) publish(p *packet) error {
+	qos := p.flags >> 1 & 0x03
+	if qos == 0x03 {
+		return errMalformed
+	}
+	d := &decoder{data: p.body}
+	topic := d.string()
+	var id uint16
+	if qos > 0 {
+		id = d.uint16()
+	}
+	if s.version == VERSION_5 {
+		if _, ok := d.properties()[propTopicAlias]; ok {
+			return fmt.Errorf("topic aliases are not supported")
+		}
+	}
+	payload := d.rest()
+	if d.err != nil {
+		return d.err
+	}
+	if !validTopic(topic) {
+		return fmt.Errorf("invalid topic name '%s'", topic)
+	}
+	if qos == 2 && !s.pendingQos2[id] && len(s.pendingQos2) >= receiveMaximum {
+		if s.version == VERSION_5 {
+			s.sendDisconnect(0x93, "receive maximum exceeded")
+		}
+		return fmt.Errorf("more than %d QoS 2 messages waiting for PUBREL", receiveMaximum)
+	}
+	// A resent QoS 2 message is only acknowledged again
+	if qos < 2 || !s.pendingQos2[id] {
+		s.forwardToBroker(topic, payload, p.flags&0x01 != 0)
+	}
+	switch qos {
+	case 1:
+		return s.write(encodePacket(PUBACK, 0, packetId(id)))
+	case 2:
+		s.pendingQos2[id] = true
+		return s.write(encodePacket(PUBREC, 0, packetId(id)))
+	}
+	return nil
+}
+
+func (s *session) forwardToBroker(topic string, payload []byte, retain bool) {
+	if !topicAllowed(s.listener, topic) || !payloadAllowed(s.listener, payload) {
+		log.Warnf("MQTT client %s exceeded the limits of listener '%s' publishing to topic: %s", s.clientId, s.listener.Name, topic)
+		return
+	}
+	var properties api.MessageProperty
+	if retain {
+		properties = api.Retained
+	}
+	if err := s.server.brokerService.Publish(properties, topic, payload, s.clientId); err != nil {
+		log.Warnf("Message of MQTT client %s to topic %s not published: %v", s.clientId, topic, err)
+	}
+}
+
+func (s *session) publishWill() {
+	log.Infof("Publishing will of MQTT client %s to topic: %s", s.clientId, s.will.topic)
+	s.forwardToBroker(s.will.topic, s.will.payload, s.will.retain)
+}
+
+func (s *session) subscribe(p *packet) error {
+	d := &decoder{data: p.body}
+	id := d.uint16()
+	if s.version == VERSION_5 {
+		d.properties()
+	}
+	codes := make([]byte, 0)
+	for !d.empty() && d.err == nil {
+		filter := d.string()
+		options := d.byte()
+		if options&0x03 == 0x03 || (s.version == VERSION_311 && options&0xFC != 0) {
+			return errMalformed
+		}
+		codes = append(codes, s.subscribeFilter(filter))
+	}
+	if d.err != nil || len(codes) == 0 {
+		return errMalformed
+	}
+	body := packetId(id)
+	if s.version == VERSION_5 {
+		body = appendProperties(body, nil)
+	}
+	return s.write(encodePacket(SUBACK, 0, append(body, codes...)))
+}
+
+// subscribeFilter returns the SUBACK code of one filter, the granted QoS is
+// always 0. A subscription of the same filter replaces the previous one.
+func (s *session) subscribeFilter(filter string) byte {
+	if !validFilter(filter) {
+		return s.failure(0x8F)
+	}
+	if strings.HasPrefix(filter, "$share/") {
+		return s.failure(0x9E)
+	}
+	if !topicAllowed(s.listener, filter) {
+		return s.failure(0x97)
+	}
+	if subscriptionId, ok := s.subscriptions[filter]; ok {
+		s.server.brokerService.Unsubscribe(s.clientId, filter, subscriptionId)
+		delete(s.subscriptions, filter)
+	}
+	subscriptionId, err := s.server.brokerService.Subscribe(s.clientId, filter)
+	if err != nil {
+		log.Errorf("Subscribe error for MQTT client %s: %v", s.clientId, err)
+		return s.failure(0x87)
+	}
+	s.subscriptions[filter] = subscriptionId
+	return 0x00
+}
+
+// failure returns the MQTT 5 reason code or the single failure code of 3.1.1
+func (s *session) failure(code5 byte) byte {
+	if s.version == VERSION_5 {
+		return code5
+	}
+	return 0x80
+}
+
+func (s *session) unsubscribe(p *packet) error {
+	d := &decoder{data: p.body}
+	id := d.uint16()
+	if s.version == VERSION_5 {
+		d.properties()
+	}
+	codes := make([]byte, 0)
+	for !d.empty() && d.err == nil {
+		filter := d.string()
+		subscriptionId, ok := s.subscriptions[filter]
+		if !ok {
+			codes = append(codes, 0x11)
+			continue
+		}
+		if err := s.server.brokerService.Unsubscribe(s.clientId, filter, subscriptionId); err != nil {
+			log.Errorf("Unsubscribe error for MQTT client %s: %v", s.clientId, err)
+		}
+		delete(s.subscriptions, filter)
+		codes = append(codes, 0x00)
+	}
+	if d.err != nil || len(codes) == 0 {
+		return errMalformed
+	}
+	body := packetId(id)
+	if s.version == VERSION_5 {
+		body = appendProperties(body, nil)
+		body = append(body, codes...)
+	}
+	return s.write(encodePacket(UNSUBACK, 0, body))
+}
+
+// forward sends the messages of the broker client as QoS 0 PUBLISH packets.
+// RETAIN is only set on retained messages sent to a new subscription
+// (MQTT-3.3.1-9), not on the live delivery of a message published retained.
+func (s *session) forward(client common.BrokerClient) {
+	for msg := range client.MessageChan() {
+		var flags byte
+		if msg.Replay && msg.IsRetained() {
+			flags = 0x01
+		}
+		body := appendString(nil, msg.Topic)
+		if s.version == VERSION_5 {
+			body = appendProperties(body, nil)
+		}
+		data := encodePacket(PUBLISH, flags, append(body, msg.Payload...))
+		if s.maxPacketSize > 0 && len(data) > s.maxPacketSize {
+			log.Warnf("Message to topic %s exceeds the maximum packet size of MQTT client %s", msg.Topic, s.clientId)
+			continue
+		}
+		if err := s.write(data); err != nil {
+			log.Errorf("Failed to publish message to MQTT client %s: %v", s.clientId, err)
+		}
+	}
+}
+
+func packetId(id uint16) []byte {
+	return []byte{byte(id >> 8), byte(id)}
+}
+
+// validTopic checks a topic name of PUBLISH, wildcards are not allowed
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// validFilter checks the wildcards of a topic filter, "#" has to be the last
+// level and both wildcards have to fill a level
+func validFilter(filter string) bool {
+	if filter == "" || strings.Contains(filter, "\x00") {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for ii, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || ii != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+func topicAllowed(listener *config.Listener, topic string) bool {
+	return listener.Limits.MaxTopicLength <= 0 || len(topic) <= listener.Limits.MaxTopicLength
+}
+
+func payloadAllowed(listener *config.Listener, payload []byte) bool {
+	return listener.Limits.MaxPayloadLength <= 0 || len(payload) <= listener.Limits.MaxPayloadLength
+}
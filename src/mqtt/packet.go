@@ -0,0 +1,263 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	CONNECT     = 1
+	CONNACK     = 2
+	PUBLISH     = 3
+	PUBACK      = 4
+	PUBREC      = 5
+	PUBREL      = 6
+	PUBCOMP     = 7
+	SUBSCRIBE   = 8
+	SUBACK      = 9
+	UNSUBSCRIBE = 10
+	UNSUBACK    = 11
+	PINGREQ     = 12
+	PINGRESP    = 13
+	DISCONNECT  = 14
+	AUTH        = 15
+)
+
+const (
+	VERSION_311 = 4
+	VERSION_5   = 5
+)
+
+// MQTT 5 property identifiers used by the adapter
+const (
+	propSessionExpiryInterval   = 0x11
+	propAssignedClientId        = 0x12
+	propAuthenticationMethod    = 0x15
+	propReasonString            = 0x1F
+	propReceiveMaximum          = 0x21
+	propTopicAlias              = 0x23
+	propMaximumPacketSize       = 0x27
+	propSubscriptionIdAvailable = 0x29
+	propSharedSubAvailable      = 0x2A
+)
+
+var errMalformed = errors.New("malformed packet")
+
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads the fixed header and the body of a control packet
+func readPacket(reader *bufio.Reader, maxSize int) (*packet, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readVarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxSize {
+		return nil, fmt.Errorf("packet of %d bytes exceeds the maximum of %d", length, maxSize)
+	}
+	p := &packet{
+		kind:  header >> 4,
+		flags: header & 0x0F,
+		body:  make([]byte, length),
+	}
+	if _, err := io.ReadFull(reader, p.body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func readVarint(reader io.ByteReader) (int, error) {
+	value := 0
+	for ii := 0; ii < 4; ii++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= int(b&0x7F) << (7 * ii)
+		if b&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, errMalformed
+}
+
+// encodePacket returns the complete packet so it is written with a single Write
+func encodePacket(kind, flags byte, body []byte) []byte {
+	data := make([]byte, 0, 5+len(body))
+	data = append(data, kind<<4|flags)
+	data = appendVarint(data, len(body))
+	return append(data, body...)
+}
+
+func appendVarint(data []byte, value int) []byte {
+	for {
+		b := byte(value & 0x7F)
+		value >>= 7
+		if value > 0 {
+			b |= 0x80
+		}
+		data = append(data, b)
+		if value == 0 {
+			return data
+		}
+	}
+}
+
+func appendString(data []byte, value string) []byte {
+	data = binary.BigEndian.AppendUint16(data, uint16(len(value)))
+	return append(data, value...)
+}
+
+// decoder reads the fields of a packet body, the first error sticks
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errMalformed
+	}
+	d.data = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) < 1 {
+		d.fail()
+		return 0
+	}
+	value := d.data[0]
+	d.data = d.data[1:]
+	return value
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.data) < 2 {
+		d.fail()
+		return 0
+	}
+	value := binary.BigEndian.Uint16(d.data)
+	d.data = d.data[2:]
+	return value
+}
+
+func (d *decoder) uint32() uint32 {
+	if len(d.data) < 4 {
+		d.fail()
+		return 0
+	}
+	value := binary.BigEndian.Uint32(d.data)
+	d.data = d.data[4:]
+	return value
+}
+
+func (d *decoder) varint() int {
+	value := 0
+	for ii := 0; ii < 4; ii++ {
+		b := d.byte()
+		value |= int(b&0x7F) << (7 * ii)
+		if b&0x80 == 0 {
+			return value
+		}
+	}
+	d.fail()
+	return 0
+}
+
+func (d *decoder) bytes() []byte {
+	length := int(d.uint16())
+	if len(d.data) < length {
+		d.fail()
+		return nil
+	}
+	value := d.data[:length]
+	d.data = d.data[length:]
+	return value
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) rest() []byte {
+	value := d.data
+	d.data = nil
+	return value
+}
+
+func (d *decoder) empty() bool {
+	return len(d.data) == 0
+}
+
+// properties reads an MQTT 5 property list and keeps the numeric values and
+// strings, repeatable properties like user properties are skipped
+func (d *decoder) properties() map[byte]any {
+	length := d.varint()
+	if d.err != nil || len(d.data) < length {
+		d.fail()
+		return nil
+	}
+	inner := &decoder{data: d.data[:length]}
+	d.data = d.data[length:]
+	properties := make(map[byte]any)
+	for !inner.empty() && inner.err == nil {
+		id := inner.byte()
+		switch id {
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2A:
+			properties[id] = uint32(inner.byte())
+		case 0x13, 0x21, 0x22, 0x23:
+			properties[id] = uint32(inner.uint16())
+		case 0x02, 0x11, 0x18, 0x27:
+			properties[id] = inner.uint32()
+		case 0x0B:
+			properties[id] = uint32(inner.varint())
+		case 0x03, 0x08, 0x12, 0x15, 0x1A, 0x1C, 0x1F:
+			properties[id] = inner.string()
+		case 0x09, 0x16:
+			properties[id] = inner.bytes()
+		case 0x26:
+			inner.string()
+			inner.string()
+		default:
+			inner.fail()
+		}
+	}
+	if inner.err != nil {
+		d.fail()
+	}
+	return properties
+}
+
+// properties collects MQTT 5 properties for an outgoing packet
+type properties []byte
+
+func (p properties) byte(id, value byte) properties {
+	return append(p, id, value)
+}
+
+func (p properties) uint16(id byte, value uint16) properties {
+	return binary.BigEndian.AppendUint16(append(p, id), value)
+}
+
+func (p properties) uint32(id byte, value uint32) properties {
+	return binary.BigEndian.AppendUint32(append(p, id), value)
+}
+
+func (p properties) string(id byte, value string) properties {
+	return appendString(append(p, id), value)
+}
+
+func appendProperties(data []byte, p properties) []byte {
+	data = appendVarint(data, len(p))
+	return append(data, p...)
+}
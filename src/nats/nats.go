@@ -0,0 +1,460 @@
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	log "github.com/oo-developer/mmq/src/logging"
+)
+
+const (
+	maxControlLine = 4096
+	pingInterval   = 2 * time.Minute
+	maxPingsOut    = 2
+	// serverVersion is the NATS server version whose protocol is spoken
+	serverVersion = "2.2.0"
+)
+
+// Server maps connections of the core NATS text protocol onto the broker,
+// every connection is a broker client. Queue groups and headers are not
+// supported.
+type Server struct {
+	brokerService    common.BrokerService
+	authService      common.AuthService
+	handshakeTimeout time.Duration
+	id               string
+}
+
+func NewServer(brokerService common.BrokerService, authService common.AuthService, handshakeTimeout time.Duration) *Server {
+	return &Server{
+		brokerService:    brokerService,
+		authService:      authService,
+		handshakeTimeout: handshakeTimeout,
+		id:               uuid.NewString(),
+	}
+}
+
+type infoResp struct {
+	ServerId     string `json:"server_id"`
+	ServerName   string `json:"server_name"`
+	Version      string `json:"version"`
+	Proto        int    `json:"proto"`
+	Headers      bool   `json:"headers"`
+	MaxPayload   int    `json:"max_payload"`
+	AuthRequired bool   `json:"auth_required"`
+	ClientIp     string `json:"client_ip,omitempty"`
+}
+
+type connectReq struct {
+	Verbose   bool   `json:"verbose"`
+	User      string `json:"user"`
+	Pass      string `json:"pass"`
+	AuthToken string `json:"auth_token"`
+	Name      string `json:"name"`
+	Echo      *bool  `json:"echo"`
+}
+
+// subscription is the state of a SUB, max is the message count of an
+// automatic unsubscribe
+type subscription struct {
+	sid            string
+	topic          string
+	subscriptionId string
+	max            int
+	delivered      int
+}
+
+type session struct {
+	server        *Server
+	listener      *config.Listener
+	conn          net.Conn
+	reader        *bufio.Reader
+	clientId      string
+	identity      *common.Identity
+	verbose       bool
+	echo          bool
+	maxPayload    int
+	subscriptions map[string]*subscription
+	mu            sync.Mutex
+	writeMu       sync.Mutex
+	pingsOut      atomic.Int32
+}
+
+var errProtocol = errors.New("unknown protocol operation")
+
+// Serve handles one NATS connection of listener until it is closed
+func (s *Server) Serve(conn net.Conn, listener *config.Listener) {
+	defer conn.Close()
+	session := &session{
+		server:        s,
+		listener:      listener,
+		conn:          conn,
+		reader:        bufio.NewReaderSize(conn, maxControlLine),
+		clientId:      "nats-" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		echo:          true,
+		maxPayload:    api.MaxPayloadLength,
+		subscriptions: make(map[string]*subscription),
+	}
+	if listener.Limits.MaxPayloadLength > 0 {
+		session.maxPayload = listener.Limits.MaxPayloadLength
+	}
+	if err := session.connect(); err != nil {
+		log.Warnf("NATS connection from '%s' rejected: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log.Infof("New NATS connection from '%s' for user '%s' (%s)", conn.RemoteAddr(), session.identity.User.Name(), session.identity.Provider)
+
+	client, err := s.brokerService.RegisterClient(session.clientId, session.identity, common.ClientOptions{
+		Listener: listener.Name,
+	})
+	if err != nil {
+		session.fail(err.Error())
+		return
+	}
+	defer s.brokerService.UnregisterClient(client)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-client.Done():
+			if reason := client.DisconnectReason(); reason != "" {
+				session.fail(reason)
+			}
+			conn.Close()
+		case <-done:
+		}
+	}()
+	go session.ping(done)
+	go session.forward(client)
+	session.serve()
+}
+
+// connect sends INFO and authenticates the CONNECT of the client
+func (s *session) connect() error {
+	info := infoResp{
+		ServerId:     s.server.id,
+		ServerName:   "mmq",
+		Version:      serverVersion,
+		Proto:        1,
+		MaxPayload:   s.maxPayload,
+		AuthRequired: true,
+	}
+	if addr, ok := s.conn.RemoteAddr().(*net.TCPAddr); ok {
+		info.ClientIp = addr.IP.String()
+	}
+	data, _ := json.Marshal(info)
+	if err := s.write([]byte("INFO " + string(data) + "\r\n")); err != nil {
+		return err
+	}
+	s.conn.SetReadDeadline(time.Now().Add(s.server.handshakeTimeout))
+	defer s.conn.SetReadDeadline(time.Time{})
+	line, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	op, args, _ := strings.Cut(line, " ")
+	if !strings.EqualFold(op, "CONNECT") {
+		s.fail("Authorization Violation")
+		return fmt.Errorf("expected CONNECT, got '%s'", op)
+	}
+	request := connectReq{}
+	if err := json.Unmarshal([]byte(args), &request); err != nil {
+		s.fail("Invalid CONNECT")
+		return fmt.Errorf("invalid CONNECT: %v", err)
+	}
+	s.verbose = request.Verbose
+	if request.Echo != nil {
+		s.echo = *request.Echo
+	}
+	credentials := &api.Credentials{
+		User:     request.User,
+		Password: request.Pass,
+		Token:    request.AuthToken,
+	}
+	if credentials.Token == "" && credentials.Password == "" {
+		s.fail("Authorization Violation")
+		return fmt.Errorf("no password or token for user '%s'", request.User)
+	}
+	identity, err := s.server.authService.Authenticate(&common.AuthRequest{
+		Conn:        s.conn,
+		Credentials: credentials,
+		Providers:   s.listener.AuthProviders,
+		NewSession:  true,
+	})
+	if err != nil {
+		s.fail("Authorization Violation")
+		return err
+	}
+	s.identity = identity
+	if request.Name != "" {
+		log.Infof("NATS client %s is named '%s'", s.clientId, request.Name)
+	}
+	return s.ok()
+}
+
+// readLine reads a control line without its line end
+func (s *session) readLine() (string, error) {
+	line, err := s.reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		s.fail("Maximum Control Line Exceeded")
+		return "", fmt.Errorf("control line exceeds %d bytes", maxControlLine)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (s *session) write(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *session) ok() error {
+	if !s.verbose {
+		return nil
+	}
+	return s.write([]byte("+OK\r\n"))
+}
+
+// fail sends an error, the connection stays open unless the caller ends it
+func (s *session) fail(message string) error {
+	return s.write([]byte("-ERR '" + message + "'\r\n"))
+}
+
+func (s *session) serve() {
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Warnf("NATS client %s receive error: %v", s.clientId, err)
+			}
+			break
+		}
+		if err := s.handle(line); err != nil {
+			log.Warnf("NATS client %s protocol error: %v", s.clientId, err)
+			break
+		}
+	}
+	log.Infof("NATS client %s disconnected", s.clientId)
+}
+
+// handle processes one operation, an error ends the connection
+func (s *session) handle(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "PUB":
+		return s.publish(fields[1:])
+	case "SUB":
+		return s.subscribe(fields[1:])
+	case "UNSUB":
+		return s.unsubscribe(fields[1:])
+	case "PING":
+		return s.write([]byte("PONG\r\n"))
+	case "PONG":
+		s.pingsOut.Store(0)
+		return nil
+	case "CONNECT":
+		return s.ok()
+	}
+	s.fail("Unknown Protocol Operation")
+	return fmt.Errorf("%w '%s'", errProtocol, fields[0])
+}
+
+// publish handles PUB <subject> [reply-to] <#bytes>, the payload follows
+func (s *session) publish(args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		s.fail("Unknown Protocol Operation")
+		return fmt.Errorf("%w PUB with %d arguments", errProtocol, len(args))
+	}
+	size, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || size < 0 {
+		s.fail("Unknown Protocol Operation")
+		return fmt.Errorf("invalid payload size '%s'", args[len(args)-1])
+	}
+	if size > s.maxPayload {
+		s.fail("Maximum Payload Violation")
+		return fmt.Errorf("payload of %d bytes exceeds %d", size, s.maxPayload)
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(s.reader, data); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		s.fail("Unknown Protocol Operation")
+		return fmt.Errorf("payload of %d bytes not terminated", size)
+	}
+	payload := data[:size]
+
+	publishTopic, ok := topic(args[0], false)
+	if !ok {
+		return s.fail("Invalid Publish Subject")
+	}
+	var replyTo string
+	if len(args) == 3 {
+		if replyTo, ok = topic(args[1], false); !ok {
+			return s.fail("Invalid Publish Subject")
+		}
+	}
+	if s.listener.Limits.MaxTopicLength > 0 && len(publishTopic) > s.listener.Limits.MaxTopicLength {
+		return s.fail("Maximum Subject Length Exceeded")
+	}
+	if !s.identity.Allowed(publishTopic) {
+		return s.fail(fmt.Sprintf("Permissions Violation for Publish to \"%s\"", args[0]))
+	}
+	if err := s.server.brokerService.PublishWithReply(0, publishTopic, replyTo, payload, s.clientId); err != nil {
+		return s.fail(err.Error())
+	}
+	return s.ok()
+}
+
+// subscribe handles SUB <subject> [queue group] <sid>
+func (s *session) subscribe(args []string) error {
+	if len(args) == 3 {
+		return s.fail("Queue Groups Not Supported")
+	}
+	if len(args) != 2 {
+		s.fail("Unknown Protocol Operation")
+		return fmt.Errorf("%w SUB with %d arguments", errProtocol, len(args))
+	}
+	filter, ok := topic(args[0], true)
+	if !ok {
+		return s.fail("Invalid Subject")
+	}
+	if s.listener.Limits.MaxTopicLength > 0 && len(filter) > s.listener.Limits.MaxTopicLength {
+		return s.fail("Maximum Subject Length Exceeded")
+	}
+	sid := args[1]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscriptions[sid]; ok {
+		return s.fail(fmt.Sprintf("Duplicate Subscription Id %s", sid))
+	}
+	subscriptionId, err := s.server.brokerService.Subscribe(s.clientId, filter)
+	if err != nil {
+		log.Errorf("Subscribe error for NATS client %s: %v", s.clientId, err)
+		return s.fail(fmt.Sprintf("Permissions Violation for Subscription to \"%s\"", args[0]))
+	}
+	s.subscriptions[sid] = &subscription{
+		sid:            sid,
+		topic:          filter,
+		subscriptionId: subscriptionId,
+	}
+	return s.ok()
+}
+
+// unsubscribe handles UNSUB <sid> [max_msgs], with max_msgs the subscription
+// ends after that many messages
+func (s *session) unsubscribe(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		s.fail("Unknown Protocol Operation")
+		return fmt.Errorf("%w UNSUB with %d arguments", errProtocol, len(args))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscriptions[args[0]]
+	if !ok {
+		return s.ok()
+	}
+	if len(args) == 2 {
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			s.fail("Unknown Protocol Operation")
+			return fmt.Errorf("invalid message count '%s'", args[1])
+		}
+		if count > sub.delivered {
+			sub.max = count
+			return s.ok()
+		}
+	}
+	s.remove(sub)
+	return s.ok()
+}
+
+// remove ends a subscription, the caller holds mu
+func (s *session) remove(sub *subscription) {
+	if err := s.server.brokerService.Unsubscribe(s.clientId, sub.topic, sub.subscriptionId); err != nil {
+		log.Errorf("Unsubscribe error for NATS client %s: %v", s.clientId, err)
+	}
+	delete(s.subscriptions, sub.sid)
+}
+
+// forward sends the messages of the broker client as MSG
+func (s *session) forward(client common.BrokerClient) {
+	for msg := range client.MessageChan() {
+		if !s.echo && msg.ClientId == s.clientId {
+			continue
+		}
+		if err := s.deliver(msg); err != nil {
+			log.Errorf("Failed to publish message to NATS client %s: %v", s.clientId, err)
+		}
+	}
+}
+
+func (s *session) deliver(msg *api.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sub *subscription
+	for _, entry := range s.subscriptions {
+		if entry.subscriptionId == msg.SubscriptionId {
+			sub = entry
+			break
+		}
+	}
+	if sub == nil {
+		return nil
+	}
+	header := "MSG " + subject(msg.Topic) + " " + sub.sid
+	if msg.ReplyTo != "" {
+		header += " " + subject(msg.ReplyTo)
+	}
+	data := fmt.Appendf(nil, "%s %d\r\n", header, len(msg.Payload))
+	data = append(data, msg.Payload...)
+	sub.delivered++
+	if sub.max > 0 && sub.delivered >= sub.max {
+		s.remove(sub)
+	}
+	return s.write(append(data, "\r\n"...))
+}
+
+// ping checks that the client is alive, it is closed after maxPingsOut
+// unanswered pings
+func (s *session) ping(done <-chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if s.pingsOut.Add(1) > maxPingsOut {
+			log.Warnf("NATS client %s is stale", s.clientId)
+			s.fail("Stale Connection")
+			s.conn.Close()
+			return
+		}
+		if err := s.write([]byte("PING\r\n")); err != nil {
+			return
+		}
+	}
+}
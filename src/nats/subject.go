@@ -0,0 +1,34 @@
+package nats
+
+import (
+	"strings"
+)
+
+// topic maps a subject onto an mmq topic, "." separates the levels and the
+// wildcards "*" and ">" become "+" and "#". Subjects using characters with a
+// meaning in mmq topics are invalid.
+func topic(subject string, wildcards bool) (string, bool) {
+	if subject == "" || strings.ContainsAny(subject, "/+#\x00 \t\r\n") {
+		return "", false
+	}
+	tokens := strings.Split(subject, ".")
+	for ii, token := range tokens {
+		switch {
+		case token == "":
+			return "", false
+		case token == "*" && wildcards:
+			tokens[ii] = "+"
+		case token == ">" && wildcards && ii == len(tokens)-1:
+			tokens[ii] = "#"
+		case strings.ContainsAny(token, "*>"):
+			return "", false
+		}
+	}
+	return strings.Join(tokens, "/"), true
+}
+
+// subject maps an mmq topic onto a subject, a "." within a topic level
+// splits it into several tokens
+func subject(topic string) string {
+	return strings.ReplaceAll(topic, "/", ".")
+}
@@ -0,0 +1,99 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxInlineSize = 65536
+	maxArgs       = 1024
+)
+
+var errMalformed = errors.New("malformed command")
+
+// readCommand reads an array of bulk strings or an inline command, maxSize
+// limits the length of one argument
+func readCommand(reader *bufio.Reader, maxSize int) ([][]byte, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		args := make([][]byte, 0)
+		for _, field := range strings.Fields(line) {
+			args = append(args, []byte(field))
+		}
+		return args, nil
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > maxArgs {
+		return nil, errMalformed
+	}
+	args := make([][]byte, 0, max(count, 0))
+	for ii := 0; ii < count; ii++ {
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errMalformed
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errMalformed
+		}
+		if size > maxSize {
+			return nil, fmt.Errorf("argument of %d bytes exceeds %d", size, maxSize)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		if string(data[size:]) != "\r\n" {
+			return nil, errMalformed
+		}
+		args = append(args, data[:size])
+	}
+	return args, nil
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("line exceeds %d bytes", maxInlineSize)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func appendSimple(data []byte, value string) []byte {
+	return append(append(append(data, '+'), value...), "\r\n"...)
+}
+
+func appendError(data []byte, message string) []byte {
+	return append(append(append(data, '-'), message...), "\r\n"...)
+}
+
+func appendInteger(data []byte, value int) []byte {
+	return append(strconv.AppendInt(append(data, ':'), int64(value), 10), "\r\n"...)
+}
+
+// appendBulk appends a bulk string, nil is the null bulk string
+func appendBulk(data []byte, value []byte) []byte {
+	if value == nil {
+		return append(data, "$-1\r\n"...)
+	}
+	data = strconv.AppendInt(append(data, '$'), int64(len(value)), 10)
+	return append(append(append(data, "\r\n"...), value...), "\r\n"...)
+}
+
+func appendArray(data []byte, count int) []byte {
+	return append(strconv.AppendInt(append(data, '*'), int64(count), 10), "\r\n"...)
+}
@@ -0,0 +1,405 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	log "github.com/oo-developer/mmq/src/logging"
+)
+
+// Server maps Redis RESP2 pub/sub connections onto the broker. Channels are
+// mmq topics, GET reads retained messages. A connection becomes a broker
+// client once it is authenticated.
+type Server struct {
+	brokerService    common.BrokerService
+	authService      common.AuthService
+	handshakeTimeout time.Duration
+}
+
+func NewServer(brokerService common.BrokerService, authService common.AuthService, handshakeTimeout time.Duration) *Server {
+	return &Server{
+		brokerService:    brokerService,
+		authService:      authService,
+		handshakeTimeout: handshakeTimeout,
+	}
+}
+
+// subscription is a SUBSCRIBE of a channel or a PSUBSCRIBE of a pattern
+type subscription struct {
+	name    string
+	topic   string
+	pattern bool
+}
+
+type session struct {
+	server        *Server
+	listener      *config.Listener
+	conn          net.Conn
+	reader        *bufio.Reader
+	clientId      string
+	identity      *common.Identity
+	client        common.BrokerClient
+	subscriptions map[string]*subscription
+	mu            sync.Mutex
+	writeMu       sync.Mutex
+}
+
+var errQuit = errors.New("quit")
+
+// Serve handles one RESP connection of listener until it is closed
+func (s *Server) Serve(conn net.Conn, listener *config.Listener) {
+	defer conn.Close()
+	session := &session{
+		server:        s,
+		listener:      listener,
+		conn:          conn,
+		reader:        bufio.NewReaderSize(conn, maxInlineSize),
+		clientId:      "resp-" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		subscriptions: make(map[string]*subscription),
+	}
+	defer func() {
+		if session.client != nil {
+			s.brokerService.UnregisterClient(session.client)
+		}
+	}()
+	// AUTH has to arrive within the handshake timeout
+	conn.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
+	session.serve()
+}
+
+func (s *session) write(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *session) maxSize() int {
+	maxSize := api.MaxPayloadLength
+	if s.listener.Limits.MaxPayloadLength > 0 {
+		maxSize = s.listener.Limits.MaxPayloadLength
+	}
+	return maxSize
+}
+
+func (s *session) serve() {
+	for {
+		args, err := readCommand(s.reader, s.maxSize())
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Warnf("RESP client %s receive error: %v", s.clientId, err)
+				s.write(appendError(nil, "ERR Protocol error: "+err.Error()))
+			}
+			break
+		}
+		if len(args) == 0 {
+			continue
+		}
+		reply, err := s.handle(strings.ToUpper(string(args[0])), args[1:])
+		if len(reply) > 0 {
+			if err := s.write(reply); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	log.Infof("RESP client %s disconnected", s.clientId)
+}
+
+// handle processes one command and returns its reply, an error ends the
+// connection
+func (s *session) handle(command string, args [][]byte) ([]byte, error) {
+	switch command {
+	case "AUTH":
+		return s.auth(args), nil
+	case "QUIT":
+		return appendSimple(nil, "OK"), errQuit
+	}
+	if s.client == nil {
+		return appendError(nil, "NOAUTH Authentication required."), nil
+	}
+	subscribed := s.subscriptionCount() > 0
+	switch command {
+	case "PING":
+		if subscribed {
+			message := []byte{}
+			if len(args) > 0 {
+				message = args[0]
+			}
+			return appendBulk(appendBulk(appendArray(nil, 2), []byte("pong")), message), nil
+		}
+		if len(args) > 0 {
+			return appendBulk(nil, args[0]), nil
+		}
+		return appendSimple(nil, "PONG"), nil
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(args) == 0 {
+			return wrongArgs(command), nil
+		}
+		return s.subscribe(args, command == "PSUBSCRIBE"), nil
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		return s.unsubscribe(args, command == "PUNSUBSCRIBE"), nil
+	}
+	if subscribed {
+		return appendError(nil, fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(command))), nil
+	}
+	switch command {
+	case "PUBLISH":
+		if len(args) != 2 {
+			return wrongArgs(command), nil
+		}
+		return s.publish(string(args[0]), args[1]), nil
+	case "GET":
+		if len(args) != 1 {
+			return wrongArgs(command), nil
+		}
+		return s.get(string(args[0])), nil
+	}
+	return appendError(nil, fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(command))), nil
+}
+
+func wrongArgs(command string) []byte {
+	return appendError(nil, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+}
+
+// auth handles AUTH [username] password, a password in the compact token
+// format is passed as token
+func (s *session) auth(args [][]byte) []byte {
+	if len(args) != 1 && len(args) != 2 {
+		return wrongArgs("AUTH")
+	}
+	if s.client != nil {
+		return appendError(nil, "ERR already authenticated")
+	}
+	credentials := &api.Credentials{}
+	password := string(args[len(args)-1])
+	if len(args) == 2 {
+		credentials.User = string(args[0])
+	}
+	if strings.Count(password, ".") == 2 && !strings.ContainsAny(password, " \t") {
+		credentials.Token = password
+	} else {
+		credentials.Password = password
+	}
+	identity, err := s.server.authService.Authenticate(&common.AuthRequest{
+		Conn:        s.conn,
+		Credentials: credentials,
+		Providers:   s.listener.AuthProviders,
+		NewSession:  true,
+	})
+	if err != nil {
+		log.Warnf("RESP authentication from '%s' failed: %v", s.conn.RemoteAddr(), err)
+		return appendError(nil, "WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	log.Infof("New RESP connection from '%s' for user '%s' (%s)", s.conn.RemoteAddr(), identity.User.Name(), identity.Provider)
+	client, err := s.server.brokerService.RegisterClient(s.clientId, identity, common.ClientOptions{
+		Listener: s.listener.Name,
+	})
+	if err != nil {
+		return appendError(nil, "ERR "+err.Error())
+	}
+	s.identity = identity
+	s.client = client
+	s.conn.SetReadDeadline(time.Time{})
+	go func() {
+		<-s.client.Done()
+		s.conn.Close()
+	}()
+	go s.forward(s.client)
+	return appendSimple(nil, "OK")
+}
+
+func (s *session) publish(channel string, payload []byte) []byte {
+	if !validChannel(channel) {
+		return appendError(nil, fmt.Sprintf("ERR invalid channel '%s'", channel))
+	}
+	if s.listener.Limits.MaxTopicLength > 0 && len(channel) > s.listener.Limits.MaxTopicLength {
+		return appendError(nil, "ERR channel exceeds the limit of the listener")
+	}
+	if !s.identity.Allowed(channel) {
+		return noPermission(channel)
+	}
+	count := s.server.brokerService.SubscriberCount(channel)
+	if err := s.server.brokerService.Publish(0, channel, payload, s.clientId); err != nil {
+		return appendError(nil, "ERR "+err.Error())
+	}
+	return appendInteger(nil, count)
+}
+
+func (s *session) get(key string) []byte {
+	if !s.identity.Allowed(key) {
+		return noPermission(key)
+	}
+	msg, ok := s.server.brokerService.RetainedMessage(key)
+	if !ok {
+		return appendBulk(nil, nil)
+	}
+	return appendBulk(nil, msg.Payload)
+}
+
+func noPermission(channel string) []byte {
+	return appendError(nil, fmt.Sprintf("NOPERM no permissions to access the '%s' channel", channel))
+}
+
+func (s *session) subscriptionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscriptions)
+}
+
+// subscribe confirms every channel or pattern with its own reply
+func (s *session) subscribe(args [][]byte, pattern bool) []byte {
+	kind := "subscribe"
+	if pattern {
+		kind = "psubscribe"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply := make([]byte, 0)
+	for _, arg := range args {
+		name := string(arg)
+		topic, ok := name, validChannel(name)
+		if pattern {
+			topic, ok = patternTopic(name)
+		}
+		if !ok {
+			return append(reply, appendError(nil, fmt.Sprintf("ERR '%s' cannot be mapped onto an mmq topic", name))...)
+		}
+		if s.listener.Limits.MaxTopicLength > 0 && len(topic) > s.listener.Limits.MaxTopicLength {
+			return append(reply, appendError(nil, "ERR channel exceeds the limit of the listener")...)
+		}
+		if s.find(name, pattern) == "" {
+			subscriptionId, err := s.server.brokerService.Subscribe(s.clientId, topic)
+			if err != nil {
+				log.Errorf("Subscribe error for RESP client %s: %v", s.clientId, err)
+				return append(reply, noPermission(name)...)
+			}
+			s.subscriptions[subscriptionId] = &subscription{
+				name:    name,
+				topic:   topic,
+				pattern: pattern,
+			}
+		}
+		reply = appendArray(reply, 3)
+		reply = appendBulk(reply, []byte(kind))
+		reply = appendBulk(reply, arg)
+		reply = appendInteger(reply, len(s.subscriptions))
+	}
+	return reply
+}
+
+// unsubscribe ends the given or, without arguments, all subscriptions of a kind
+func (s *session) unsubscribe(args [][]byte, pattern bool) []byte {
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0)
+	for _, arg := range args {
+		names = append(names, string(arg))
+	}
+	if len(args) == 0 {
+		for _, sub := range s.subscriptions {
+			if sub.pattern == pattern {
+				names = append(names, sub.name)
+			}
+		}
+	}
+	reply := make([]byte, 0)
+	for _, name := range names {
+		if subscriptionId := s.find(name, pattern); subscriptionId != "" {
+			if err := s.server.brokerService.Unsubscribe(s.clientId, s.subscriptions[subscriptionId].topic, subscriptionId); err != nil {
+				log.Errorf("Unsubscribe error for RESP client %s: %v", s.clientId, err)
+			}
+			delete(s.subscriptions, subscriptionId)
+		}
+		reply = appendArray(reply, 3)
+		reply = appendBulk(reply, []byte(kind))
+		reply = appendBulk(reply, []byte(name))
+		reply = appendInteger(reply, len(s.subscriptions))
+	}
+	if len(names) == 0 {
+		reply = appendArray(reply, 3)
+		reply = appendBulk(reply, []byte(kind))
+		reply = appendBulk(reply, nil)
+		reply = appendInteger(reply, len(s.subscriptions))
+	}
+	return reply
+}
+
+// find returns the broker subscription id of a channel or pattern, the
+// caller holds mu
+func (s *session) find(name string, pattern bool) string {
+	for subscriptionId, sub := range s.subscriptions {
+		if sub.name == name && sub.pattern == pattern {
+			return subscriptionId
+		}
+	}
+	return ""
+}
+
+// forward sends the messages of the broker client as message or pmessage
+func (s *session) forward(client common.BrokerClient) {
+	for msg := range client.MessageChan() {
+		s.mu.Lock()
+		sub, ok := s.subscriptions[msg.SubscriptionId]
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		var data []byte
+		if sub.pattern {
+			data = appendArray(nil, 4)
+			data = appendBulk(data, []byte("pmessage"))
+			data = appendBulk(data, []byte(sub.name))
+		} else {
+			data = appendArray(nil, 3)
+			data = appendBulk(data, []byte("message"))
+		}
+		data = appendBulk(data, []byte(msg.Topic))
+		data = appendBulk(data, msg.Payload)
+		if err := s.write(data); err != nil {
+			log.Errorf("Failed to publish message to RESP client %s: %v", s.clientId, err)
+		}
+	}
+}
+
+// validChannel checks a channel name, the mmq wildcards are not allowed
+func validChannel(channel string) bool {
+	return channel != "" && !strings.ContainsAny(channel, "+#\x00")
+}
+
+// patternTopic maps a glob pattern onto an mmq topic filter. A "*" level
+// becomes "+", a trailing "*" level "#" as it matches any depth. Other glob
+// syntax has no mmq equivalent.
+func patternTopic(pattern string) (string, bool) {
+	if pattern == "" || strings.ContainsAny(pattern, "+#?[]\\\x00") {
+		return "", false
+	}
+	levels := strings.Split(pattern, "/")
+	for ii, level := range levels {
+		switch {
+		case level == "*" && ii == len(levels)-1:
+			levels[ii] = "#"
+		case level == "*":
+			levels[ii] = "+"
+		case strings.Contains(level, "*"):
+			return "", false
+		}
+	}
+	return strings.Join(levels, "/"), true
+}
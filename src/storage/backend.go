@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/oo-developer/mmq/src/config"
+)
+
+const (
+	BACKEND_BBOLT  = "bbolt"
+	BACKEND_MEMORY = "memory"
+	BACKEND_FILE   = "file"
+)
+
+// errStop ends a ForEach early without an error
+var errStop = errors.New("stop iteration")
+
+// Backend keeps values by key in nested buckets. Changes are only made in
+// transactions of Update, they are applied completely or not at all.
+type Backend interface {
+	// View runs fn in a read-only transaction
+	View(fn func(tx Tx) error) error
+	// Update runs fn in a transaction that is committed when fn returns nil
+	// and rolled back otherwise
+	Update(fn func(tx Tx) error) error
+	// Snapshot writes a consistent copy of the buckets that the backend
+	// opens as its DbFile
+	Snapshot(w io.Writer) error
+	Close() error
+}
+
+// Tx is a transaction of a Backend, a bucket is addressed by the names of its
+// parents and its own name
+type Tx interface {
+	// Bucket returns the bucket at path, nil when it does not exist
+	Bucket(path ...string) Bucket
+	// CreateBucket returns the bucket at path and creates the missing ones
+	CreateBucket(path ...string) (Bucket, error)
+	// DeleteBucket removes the bucket at path with its nested buckets
+	DeleteBucket(path ...string) error
+	// Buckets returns the names of the buckets in path in key order, the
+	// top-level buckets without path
+	Buckets(path ...string) []string
+}
+
+// Bucket holds values by key, it is only valid during its transaction
+type Bucket interface {
+	// Get returns the value of key, nil when it does not exist
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// ForEach calls fn for the values from start on in key order, a nil
+	// start begins with the first. Nested buckets are skipped.
+	ForEach(start []byte, fn func(key, value []byte) error) error
+}
+
+// BackendFactory opens a backend for a storage configuration
+type BackendFactory func(config *config.Storage) (Backend, error)
+
+var (
+	backends   = make(map[string]BackendFactory)
+	backendsMu sync.RWMutex
+)
+
+// RegisterBackend makes a backend selectable by name in the storage
+// configuration
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[name] = factory
+}
+
+// Backends returns the names of the registered backends in order
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// OpenBackend opens the configured backend, bbolt by default
+func OpenBackend(config *config.Storage) (Backend, error) {
+	name := config.Backend
+	if name == "" {
+		name = BACKEND_BBOLT
+	}
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend '%s'", name)
+	}
+	return factory(config)
+}
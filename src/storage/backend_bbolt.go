@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/oo-developer/mmq/src/config"
+	"go.etcd.io/bbolt"
+)
+
+func init() {
+	RegisterBackend(BACKEND_BBOLT, openBboltBackend)
+}
+
+// bboltBackend keeps the buckets in a bbolt database file
+type bboltBackend struct {
+	db *bbolt.DB
+}
+
+func openBboltBackend(config *config.Storage) (Backend, error) {
+	db, err := bbolt.Open(config.DbFile, 0600, &bbolt.Options{
+		Timeout:         3 * time.Second,
+		NoGrowSync:      true,
+		NoFreelistSync:  true,
+		FreelistType:    bbolt.FreelistArrayType,
+		InitialMmapSize: 10 * 1024 * 1024,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &bboltBackend{db: db}, nil
+}
+
+func (b *bboltBackend) View(fn func(tx Tx) error) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		return fn(&bboltTx{tx: tx})
+	})
+}
+
+func (b *bboltBackend) Update(fn func(tx Tx) error) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return fn(&bboltTx{tx: tx})
+	})
+}
+
+func (b *bboltBackend) Snapshot(w io.Writer) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+func (b *bboltBackend) Close() error {
+	return b.db.Close()
+}
+
+type bboltTx struct {
+	tx *bbolt.Tx
+}
+
+func (t *bboltTx) bucket(path []string) *bbolt.Bucket {
+	if len(path) == 0 {
+		return nil
+	}
+	bucket := t.tx.Bucket([]byte(path[0]))
+	for _, name := range path[1:] {
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket([]byte(name))
+	}
+	return bucket
+}
+
+func (t *bboltTx) Bucket(path ...string) Bucket {
+	bucket := t.bucket(path)
+	if bucket == nil {
+		return nil
+	}
+	return &bboltBucket{bucket: bucket}
+}
+
+func (t *bboltTx) CreateBucket(path ...string) (Bucket, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("bucket without name")
+	}
+	bucket, err := t.tx.CreateBucketIfNotExists([]byte(path[0]))
+	for _, name := range path[1:] {
+		if err != nil {
+			break
+		}
+		bucket, err = bucket.CreateBucketIfNotExists([]byte(name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bboltBucket{bucket: bucket}, nil
+}
+
+func (t *bboltTx) DeleteBucket(path ...string) error {
+	switch len(path) {
+	case 0:
+		return fmt.Errorf("bucket without name")
+	case 1:
+		return t.tx.DeleteBucket([]byte(path[0]))
+	}
+	parent := t.bucket(path[:len(path)-1])
+	if parent == nil {
+		return bbolt.ErrBucketNotFound
+	}
+	return parent.DeleteBucket([]byte(path[len(path)-1]))
+}
+
+func (t *bboltTx) Buckets(path ...string) []string {
+	names := make([]string, 0)
+	if len(path) == 0 {
+		t.tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+		return names
+	}
+	bucket := t.bucket(path)
+	if bucket == nil {
+		return names
+	}
+	bucket.ForEachBucket(func(name []byte) error {
+		names = append(names, string(name))
+		return nil
+	})
+	return names
+}
+
+type bboltBucket struct {
+	bucket *bbolt.Bucket
+}
+
+func (b *bboltBucket) Get(key []byte) []byte {
+	return b.bucket.Get(key)
+}
+
+func (b *bboltBucket) Put(key, value []byte) error {
+	return b.bucket.Put(key, value)
+}
+
+func (b *bboltBucket) Delete(key []byte) error {
+	return b.bucket.Delete(key)
+}
+
+func (b *bboltBucket) ForEach(start []byte, fn func(key, value []byte) error) error {
+	cursor := b.bucket.Cursor()
+	key, value := cursor.First()
+	if start != nil {
+		key, value = cursor.Seek(start)
+	}
+	for ; key != nil; key, value = cursor.Next() {
+		if value == nil {
+			continue
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/oo-developer/mmq/src/config"
+	log "github.com/oo-developer/mmq/src/logging"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// compactMinimum is the number of logged changes below which the log of the
+// file backend is not compacted
+const compactMinimum = 10000
+
+func init() {
+	RegisterBackend(BACKEND_FILE, openFileBackend)
+}
+
+// fileBackend keeps the buckets in memory and appends the changes of each
+// transaction to a log file, which is replayed on open. The log is rewritten
+// with the current buckets once it is twice as long as needed. A lock file
+// next to the log keeps a second process from opening it, the log itself is
+// replaced by the compaction.
+type fileBackend struct {
+	*memoryBackend
+	fileName string
+	file     *os.File
+	lock     *os.File
+	size     int64
+	// logged is the number of changes in the log, live the number after the
+	// last compaction
+	logged int
+	live   int
+}
+
+func openFileBackend(config *config.Storage) (Backend, error) {
+	b := &fileBackend{
+		memoryBackend: newMemoryBackend(),
+		fileName:      config.DbFile,
+	}
+	lock, err := lockFile(b.fileName)
+	if err != nil {
+		return nil, err
+	}
+	b.lock = lock
+	file, err := os.OpenFile(b.fileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	b.file = file
+	if err := b.replay(); err != nil {
+		file.Close()
+		lock.Close()
+		return nil, fmt.Errorf("replaying %s: %w", b.fileName, err)
+	}
+	b.live = len(b.snapshot())
+	if b.logged > 2*b.live && b.logged > compactMinimum {
+		if err := b.compact(); err != nil {
+			b.file.Close()
+			lock.Close()
+			return nil, fmt.Errorf("compacting %s: %w", b.fileName, err)
+		}
+	}
+	b.journal = b.append
+	return b, nil
+}
+
+// lockFile takes the exclusive lock of the storage file fileName without
+// waiting, the lock is held until the returned lock file is closed
+func lockFile(fileName string) (*os.File, error) {
+	file, err := os.OpenFile(fileName+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("storage file %s is in use by another process", fileName)
+		}
+		return nil, fmt.Errorf("locking %s: %w", file.Name(), err)
+	}
+	return file, nil
+}
+
+// replay applies the logged transactions, a transaction torn by a crash is cut
+// off the log
+func (b *fileBackend) replay() error {
+	reader := io.Reader(b.file)
+	tx := &memTx{backend: b.memoryBackend, writable: true}
+	for {
+		data, err := readFrame(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, errTornFrame) || errors.Is(err, errCorruptFrame) {
+			log.Warnf("Storage file %s ends with a %v", b.fileName, err)
+			if err := b.file.Truncate(b.size); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		ops := make([]memOp, 0)
+		if err := msgpack.Unmarshal(data, &ops); err != nil {
+			return err
+		}
+		for _, op := range ops {
+			if err := tx.apply(op); err != nil {
+				return err
+			}
+		}
+		tx.undo = nil
+		b.size += int64(walHeader + len(data))
+		b.logged += len(ops)
+	}
+	_, err := b.file.Seek(b.size, io.SeekStart)
+	return err
+}
+
+// append logs the changes of a transaction and syncs them, b.mu is held
+func (b *fileBackend) append(ops []memOp) error {
+	data, err := msgpack.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	buffer := bytes.Buffer{}
+	appendFrame(&buffer, data)
+	if _, err := b.file.Write(buffer.Bytes()); err == nil {
+		err = b.file.Sync()
+	}
+	if err != nil {
+		// The next transaction must not follow a torn one
+		b.file.Truncate(b.size)
+		b.file.Seek(b.size, io.SeekStart)
+		return err
+	}
+	b.size += int64(buffer.Len())
+	b.logged += len(ops)
+	if b.logged > 2*b.live+compactMinimum {
+		// The transaction is applied once it is logged, a failed compaction
+		// only leaves the log longer
+		b.live = len(b.snapshot())
+		if err := b.compact(); err != nil {
+			log.Errorf("Failed to compact storage file %s: %v", b.fileName, err)
+		}
+	}
+	return nil
+}
+
+// compact replaces the log by one transaction building the current buckets
+func (b *fileBackend) compact() error {
+	ops := b.snapshot()
+	data, err := msgpack.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	buffer := bytes.Buffer{}
+	appendFrame(&buffer, data)
+	compacted := b.fileName + ".compact"
+	file, err := os.OpenFile(compacted, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buffer.Bytes()); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(compacted, b.fileName)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(compacted)
+		return err
+	}
+	b.file.Close()
+	b.file = file
+	b.size = int64(buffer.Len())
+	b.logged = len(ops)
+	b.live = len(ops)
+	log.Infof("Compacted storage file %s to %d entries", b.fileName, len(ops))
+	return nil
+}
+
+func (b *fileBackend) Close() error {
+	b.memoryBackend.Close()
+	defer b.lock.Close()
+	return b.file.Close()
+}
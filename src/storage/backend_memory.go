@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func init() {
+	RegisterBackend(BACKEND_MEMORY, func(config *config.Storage) (Backend, error) {
+		return newMemoryBackend(), nil
+	})
+}
+
+// The changes of a transaction, the file backend appends them to its log
+const (
+	opCreateBucket uint8 = iota + 1
+	opDeleteBucket
+	opPut
+	opDelete
+)
+
+type memOp struct {
+	Kind  uint8    `msgpack:"kind"`
+	Path  []string `msgpack:"path"`
+	Key   []byte   `msgpack:"key,omitempty"`
+	Value []byte   `msgpack:"value,omitempty"`
+}
+
+type memBucket struct {
+	values  map[string][]byte
+	buckets map[string]*memBucket
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{
+		values:  make(map[string][]byte),
+		buckets: make(map[string]*memBucket),
+	}
+}
+
+// memoryBackend keeps the buckets in memory only, for tests and ephemeral
+// brokers
+type memoryBackend struct {
+	root *memBucket
+	// journal is called with the changes of a transaction before it is
+	// committed, an error rolls it back
+	journal func(ops []memOp) error
+	closed  bool
+	mu      sync.RWMutex
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{root: newMemBucket()}
+}
+
+func (b *memoryBackend) View(fn func(tx Tx) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return fmt.Errorf("storage backend closed")
+	}
+	return fn(&memTx{backend: b})
+}
+
+func (b *memoryBackend) Update(fn func(tx Tx) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return fmt.Errorf("storage backend closed")
+	}
+	tx := &memTx{backend: b, writable: true}
+	err := fn(tx)
+	if err == nil && b.journal != nil && len(tx.ops) > 0 {
+		err = b.journal(tx.ops)
+	}
+	if err != nil {
+		tx.rollback()
+	}
+	return err
+}
+
+// Snapshot writes the buckets as a log of the file backend
+func (b *memoryBackend) Snapshot(w io.Writer) error {
+	b.mu.RLock()
+	data, err := msgpack.Marshal(b.snapshot())
+	b.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	buffer := bytes.Buffer{}
+	appendFrame(&buffer, data)
+	_, err = w.Write(buffer.Bytes())
+	return err
+}
+
+func (b *memoryBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+// snapshot returns the changes that build the current buckets, nested
+// buckets after their parents
+func (b *memoryBackend) snapshot() []memOp {
+	ops := make([]memOp, 0)
+	var walk func(path []string, bucket *memBucket)
+	walk = func(path []string, bucket *memBucket) {
+		if len(path) > 0 {
+			ops = append(ops, memOp{Kind: opCreateBucket, Path: path})
+		}
+		for _, key := range sortedKeys(bucket.values) {
+			ops = append(ops, memOp{Kind: opPut, Path: path, Key: []byte(key), Value: bucket.values[key]})
+		}
+		for _, name := range sortedKeys(bucket.buckets) {
+			walk(append(slices.Clip(path), name), bucket.buckets[name])
+		}
+	}
+	walk(nil, b.root)
+	return ops
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+type memTx struct {
+	backend  *memoryBackend
+	writable bool
+	ops      []memOp
+	// undo reverts the changes in reverse order on rollback
+	undo []func()
+}
+
+func (t *memTx) rollback() {
+	for ii := len(t.undo) - 1; ii >= 0; ii-- {
+		t.undo[ii]()
+	}
+	t.undo = nil
+	t.ops = nil
+}
+
+func (t *memTx) lookup(path []string) *memBucket {
+	if len(path) == 0 {
+		return nil
+	}
+	bucket := t.backend.root
+	for _, name := range path {
+		if bucket = bucket.buckets[name]; bucket == nil {
+			return nil
+		}
+	}
+	return bucket
+}
+
+// apply makes a change and records it with its undo
+func (t *memTx) apply(op memOp) error {
+	if !t.writable {
+		return fmt.Errorf("read-only transaction")
+	}
+	if len(op.Path) == 0 {
+		return fmt.Errorf("bucket without name")
+	}
+	switch op.Kind {
+	case opCreateBucket:
+		parent := t.backend.root
+		for _, name := range op.Path {
+			bucket, ok := parent.buckets[name]
+			if !ok {
+				bucket = newMemBucket()
+				parent.buckets[name] = bucket
+				created, name := parent, name
+				t.undo = append(t.undo, func() { delete(created.buckets, name) })
+			}
+			parent = bucket
+		}
+	case opDeleteBucket:
+		parent := t.backend.root
+		if len(op.Path) > 1 {
+			parent = t.lookup(op.Path[:len(op.Path)-1])
+		}
+		name := op.Path[len(op.Path)-1]
+		if parent == nil || parent.buckets[name] == nil {
+			return fmt.Errorf("bucket '%s' not found", strings.Join(op.Path, "/"))
+		}
+		deleted := parent.buckets[name]
+		delete(parent.buckets, name)
+		t.undo = append(t.undo, func() { parent.buckets[name] = deleted })
+	case opPut, opDelete:
+		bucket := t.lookup(op.Path)
+		if bucket == nil {
+			return fmt.Errorf("bucket '%s' not found", strings.Join(op.Path, "/"))
+		}
+		if len(op.Key) == 0 {
+			return fmt.Errorf("empty key")
+		}
+		key := string(op.Key)
+		previous, existed := bucket.values[key]
+		if op.Kind == opPut {
+			if op.Value == nil {
+				op.Value = []byte{}
+			}
+			bucket.values[key] = op.Value
+		} else {
+			delete(bucket.values, key)
+		}
+		t.undo = append(t.undo, func() {
+			if existed {
+				bucket.values[key] = previous
+			} else {
+				delete(bucket.values, key)
+			}
+		})
+	default:
+		return fmt.Errorf("unknown change %d", op.Kind)
+	}
+	t.ops = append(t.ops, op)
+	return nil
+}
+
+func (t *memTx) Bucket(path ...string) Bucket {
+	if t.lookup(path) == nil {
+		return nil
+	}
+	return &memBucketTx{tx: t, path: slices.Clone(path)}
+}
+
+func (t *memTx) CreateBucket(path ...string) (Bucket, error) {
+	path = slices.Clone(path)
+	if err := t.apply(memOp{Kind: opCreateBucket, Path: path}); err != nil {
+		return nil, err
+	}
+	return &memBucketTx{tx: t, path: path}, nil
+}
+
+func (t *memTx) DeleteBucket(path ...string) error {
+	return t.apply(memOp{Kind: opDeleteBucket, Path: slices.Clone(path)})
+}
+
+func (t *memTx) Buckets(path ...string) []string {
+	bucket := t.backend.root
+	if len(path) > 0 {
+		bucket = t.lookup(path)
+	}
+	if bucket == nil {
+		return make([]string, 0)
+	}
+	return sortedKeys(bucket.buckets)
+}
+
+type memBucketTx struct {
+	tx   *memTx
+	path []string
+}
+
+func (b *memBucketTx) Get(key []byte) []byte {
+	bucket := b.tx.lookup(b.path)
+	if bucket == nil {
+		return nil
+	}
+	return bucket.values[string(key)]
+}
+
+func (b *memBucketTx) Put(key, value []byte) error {
+	return b.tx.apply(memOp{Kind: opPut, Path: b.path, Key: slices.Clone(key), Value: append(make([]byte, 0, len(value)), value...)})
+}
+
+func (b *memBucketTx) Delete(key []byte) error {
+	return b.tx.apply(memOp{Kind: opDelete, Path: b.path, Key: slices.Clone(key)})
+}
+
+func (b *memBucketTx) ForEach(start []byte, fn func(key, value []byte) error) error {
+	bucket := b.tx.lookup(b.path)
+	if bucket == nil {
+		return nil
+	}
+	keys := sortedKeys(bucket.values)
+	first, _ := slices.BinarySearch(keys, string(start))
+	for _, key := range keys[first:] {
+		value, ok := bucket.values[key]
+		if !ok {
+			continue
+		}
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	EXPORT_FORMAT = 1
+
+	RECORD_HEADER              = "header"
+	RECORD_USER                = "user"
+	RECORD_MESSAGE             = "message"
+	RECORD_REVOKED_CERTIFICATE = "revokedCertificate"
+	RECORD_GROUP               = "group"
+	RECORD_ENTRY               = "entry"
+
+	// importBatch is the number of records imported in one transaction
+	importBatch = 1000
+	// maxRecordLength allows a message with the largest payload in a record
+	maxRecordLength = 64 * 1024 * 1024
+)
+
+// exportRecord is a line of an export. Data holds the header, a user, a
+// message, a revoked certificate or a consumer group, Bucket, Key and Value an
+// entry of any other bucket.
+type exportRecord struct {
+	Kind   string          `json:"kind"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Bucket []string        `json:"bucket,omitempty"`
+	Key    []byte          `json:"key,omitempty"`
+	Value  []byte          `json:"value,omitempty"`
+}
+
+type exportHeader struct {
+	Format  int    `json:"format"`
+	Created string `json:"created"`
+}
+
+// typedBuckets are exported as records of their kind, all other buckets as
+// entries
+var typedBuckets = map[string]string{
+	BUCKET_USERS:                RECORD_USER,
+	BUCKET_MESSAGES:             RECORD_MESSAGE,
+	BUCKET_REVOKED_CERTIFICATES: RECORD_REVOKED_CERTIFICATE,
+	BUCKET_GROUPS:               RECORD_GROUP,
+}
+
+// flush checkpoints the messages written ahead so a copy of the database
+// holds every acknowledged message
+func (s *storage) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoint()
+}
+
+func (s *storage) Backup(w io.Writer) error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.db.Snapshot(w)
+}
+
+func (s *storage) Export(w io.Writer) error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.db.View(func(tx Tx) error {
+		return export(tx, w)
+	})
+}
+
+func export(tx Tx, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	header, _ := json.Marshal(&exportHeader{Format: EXPORT_FORMAT, Created: time.Now().UTC().Format(time.RFC3339)})
+	if err := encoder.Encode(&exportRecord{Kind: RECORD_HEADER, Data: header}); err != nil {
+		return err
+	}
+	for _, name := range tx.Buckets() {
+		kind, typed := typedBuckets[name]
+		if !typed {
+			if err := exportEntries(tx, encoder, []string{name}); err != nil {
+				return err
+			}
+			continue
+		}
+		err := tx.Bucket(name).ForEach(nil, func(key, value []byte) error {
+			data, err := exportValue(kind, value)
+			if err != nil {
+				return fmt.Errorf("%s '%s': %w", kind, key, err)
+			}
+			return encoder.Encode(&exportRecord{Kind: kind, Data: data})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportEntries exports the values of a bucket and its nested buckets
+func exportEntries(tx Tx, encoder *json.Encoder, path []string) error {
+	err := tx.Bucket(path...).ForEach(nil, func(key, value []byte) error {
+		return encoder.Encode(&exportRecord{Kind: RECORD_ENTRY, Bucket: path, Key: key, Value: value})
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range tx.Buckets(path...) {
+		if err := exportEntries(tx, encoder, append(slices.Clip(path), name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportValue converts a stored value of a typed bucket to its record
+func exportValue(kind string, value []byte) ([]byte, error) {
+	switch kind {
+	case RECORD_USER:
+		entry := &user{}
+		if err := msgpack.Unmarshal(value, entry); err != nil {
+			return nil, err
+		}
+		return json.Marshal(entry)
+	case RECORD_MESSAGE:
+		msg := &storedMessage{}
+		if err := msgpack.Unmarshal(value, msg); err != nil {
+			return nil, err
+		}
+		return json.Marshal(msg)
+	case RECORD_REVOKED_CERTIFICATE:
+		entry := &revokedCertificate{}
+		if err := msgpack.Unmarshal(value, entry); err != nil {
+			return nil, err
+		}
+		return json.Marshal(entry)
+	case RECORD_GROUP:
+		group := &common.GroupOffsets{}
+		if err := msgpack.Unmarshal(value, group); err != nil {
+			return nil, err
+		}
+		return json.Marshal(group)
+	}
+	return nil, fmt.Errorf("unknown record kind '%s'", kind)
+}
+
+// importRecord stores a record of an export, existing values are replaced
+func importRecord(tx Tx, record *exportRecord) error {
+	var bucket, key string
+	var value []byte
+	var err error
+	switch record.Kind {
+	case RECORD_USER:
+		entry := &user{}
+		if err = json.Unmarshal(record.Data, entry); err == nil {
+			bucket, key = BUCKET_USERS, entry.NameValue
+			value, err = msgpack.Marshal(entry)
+		}
+	case RECORD_MESSAGE:
+		entry := &storedMessage{}
+		if err = json.Unmarshal(record.Data, entry); err == nil {
+			bucket, key = BUCKET_MESSAGES, entry.Topic
+			value, err = msgpack.Marshal(entry)
+		}
+	case RECORD_REVOKED_CERTIFICATE:
+		entry := &revokedCertificate{}
+		if err = json.Unmarshal(record.Data, entry); err == nil {
+			bucket, key = BUCKET_REVOKED_CERTIFICATES, entry.Serial
+			value, err = msgpack.Marshal(entry)
+		}
+	case RECORD_GROUP:
+		entry := &common.GroupOffsets{}
+		if err = json.Unmarshal(record.Data, entry); err == nil {
+			bucket, key = BUCKET_GROUPS, entry.Group
+			value, err = msgpack.Marshal(entry)
+		}
+	case RECORD_ENTRY:
+		target, err := tx.CreateBucket(record.Bucket...)
+		if err != nil {
+			return err
+		}
+		return target.Put(record.Key, record.Value)
+	default:
+		return fmt.Errorf("unknown record kind '%s'", record.Kind)
+	}
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf("%s without name", record.Kind)
+	}
+	target, err := tx.CreateBucket(bucket)
+	if err != nil {
+		return err
+	}
+	return target.Put([]byte(key), value)
+}
+
+// Import adds the records of an export to backend and returns their number
+func Import(backend Backend, r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRecordLength)
+	records := make([]*exportRecord, 0, importBatch)
+	line, imported := 0, 0
+	commit := func() error {
+		err := backend.Update(func(tx Tx) error {
+			for ii, record := range records {
+				if err := importRecord(tx, record); err != nil {
+					return fmt.Errorf("line %d: %w", line-len(records)+ii+1, err)
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			imported += len(records)
+		}
+		records = records[:0]
+		return err
+	}
+	for scanner.Scan() {
+		line++
+		record := &exportRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return imported, fmt.Errorf("line %d: %w", line, err)
+		}
+		if line == 1 {
+			header := exportHeader{}
+			if record.Kind != RECORD_HEADER || json.Unmarshal(record.Data, &header) != nil {
+				return 0, fmt.Errorf("export without header")
+			}
+			if header.Format != EXPORT_FORMAT {
+				return 0, fmt.Errorf("unsupported export format %d", header.Format)
+			}
+			continue
+		}
+		records = append(records, record)
+		if len(records) == importBatch {
+			if err := commit(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, err
+	}
+	if line == 0 {
+		return 0, fmt.Errorf("export without header")
+	}
+	err := commit()
+	return imported, err
+}
+
+// Restore works on the database of a stopped broker. A snapshot of Backup
+// replaces the database, the records of an export are added to it. The
+// write-ahead log is dropped with a replaced database.
+func Restore(config *config.Storage, fileName string) error {
+	if config.Backend == BACKEND_MEMORY {
+		return fmt.Errorf("the memory backend keeps nothing to restore")
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", fileName, err)
+	}
+	// Opening the database fails while the broker holds it
+	backend, err := OpenBackend(config)
+	if err != nil {
+		return fmt.Errorf("opening %s, is the broker stopped? %w", config.DbFile, err)
+	}
+	if first[0] == '{' {
+		defer backend.Close()
+		if _, err := migrate(backend, false); err != nil {
+			return err
+		}
+		// The log would replay its records over the imported ones
+		if err := checkpointWal(config, backend); err != nil {
+			return err
+		}
+		_, err := Import(backend, reader)
+		return err
+	}
+	if err := backend.Close(); err != nil {
+		return err
+	}
+
+	restoring := *config
+	restoring.DbFile = config.DbFile + ".restore"
+	if err := copySnapshot(reader, restoring.DbFile); err != nil {
+		os.Remove(restoring.DbFile)
+		return err
+	}
+	if err := checkSnapshot(&restoring); err != nil {
+		os.Remove(restoring.DbFile)
+		return fmt.Errorf("%s is no snapshot of the %s backend: %w", fileName, backendName(config), err)
+	}
+	if err := os.Rename(restoring.DbFile, config.DbFile); err != nil {
+		os.Remove(restoring.DbFile)
+		return err
+	}
+	if err := os.Remove(walFileName(config)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// checkpointWal moves the records a stopped broker left in its write-ahead
+// log to backend and empties the log
+func checkpointWal(storageConfig *config.Storage, backend Backend) error {
+	s := &storage{
+		config:       &config.Config{Storage: *storageConfig},
+		db:           backend,
+		messageCache: make(map[string]*api.Message),
+		streams:      make(map[string]*streamLog),
+	}
+	if err := s.loadStreams(); err != nil {
+		return err
+	}
+	walFile := walFileName(storageConfig)
+	wal, err := openWal(walFile, storageConfig.Sync, 0)
+	if err != nil {
+		return fmt.Errorf("opening write-ahead log %s: %w", walFile, err)
+	}
+	s.wal = wal
+	defer wal.close()
+	if err := s.recover(); err != nil {
+		return fmt.Errorf("recovering write-ahead log %s: %w", walFile, err)
+	}
+	return nil
+}
+
+func copySnapshot(r io.Reader, fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// checkSnapshot opens a snapshot, looks for the buckets of the services and
+// refuses a schema version newer than this broker supports
+func checkSnapshot(config *config.Storage) error {
+	backend, err := OpenBackend(config)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	err = backend.View(func(tx Tx) error {
+		if tx.Bucket(BUCKET_USERS) == nil || tx.Bucket(BUCKET_MESSAGES) == nil {
+			return fmt.Errorf("buckets missing")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = checkSchemaVersion(backend)
+	return err
+}
+
+func backendName(config *config.Storage) string {
+	if config.Backend == "" {
+		return BACKEND_BBOLT
+	}
+	return config.Backend
+}
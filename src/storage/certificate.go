@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/oo-developer/mmq/src/common"
+	log "github.com/oo-developer/mmq/src/logging"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type revokedCertificate struct {
+	Serial    string `msgpack:"serial" json:"serial"`
+	Name      string `msgpack:"name" json:"name"`
+	RevokedAt int64  `msgpack:"revokedAt" json:"revokedAt"`
+}
+
+func (s *storage) GetAllRevokedCertificates() []common.RevokedCertificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	revoked := make([]common.RevokedCertificate, 0)
+	err := s.db.View(func(tx Tx) error {
+		bucket := tx.Bucket(BUCKET_REVOKED_CERTIFICATES)
+		return bucket.ForEach(nil, func(k, v []byte) error {
+			entry := &revokedCertificate{}
+			err := msgpack.Unmarshal(v, entry)
+			if err != nil {
+				return err
+			}
+			revoked = append(revoked, common.RevokedCertificate{
+				Serial:    entry.Serial,
+				Name:      entry.Name,
+				RevokedAt: time.Unix(entry.RevokedAt, 0),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		log.Errorf("Error getting all revoked certificates: %v", err)
+	}
+	return revoked
+}
+
+func (s *storage) AddRevokedCertificate(revoked common.RevokedCertificate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &revokedCertificate{
+		Serial:    revoked.Serial,
+		Name:      revoked.Name,
+		RevokedAt: revoked.RevokedAt.Unix(),
+	}
+	return s.db.Update(func(tx Tx) error {
+		bucket := tx.Bucket(BUCKET_REVOKED_CERTIFICATES)
+		value, err := msgpack.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(entry.Serial), value)
+	})
+}
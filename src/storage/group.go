@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"github.com/oo-developer/mmq/src/common"
+	log "github.com/oo-developer/mmq/src/logging"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// The groups bucket holds the committed offsets of a consumer group under its name
+const BUCKET_GROUPS = "groups"
+
+func (s *storage) Groups() []common.GroupOffsets {
+	groups := make([]common.GroupOffsets, 0)
+	err := s.db.View(func(tx Tx) error {
+		return tx.Bucket(BUCKET_GROUPS).ForEach(nil, func(k, v []byte) error {
+			group := common.GroupOffsets{}
+			if err := msgpack.Unmarshal(v, &group); err != nil {
+				return err
+			}
+			groups = append(groups, group)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Errorf("Error getting consumer groups: %v", err)
+	}
+	return groups
+}
+
+func (s *storage) SaveGroup(group common.GroupOffsets) error {
+	value, err := msgpack.Marshal(&group)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx Tx) error {
+		return tx.Bucket(BUCKET_GROUPS).Put([]byte(group.Group), value)
+	})
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	api "github.com/oo-developer/mmq/pkg"
+)
+
+// storedMessage is a retained or persistent message in the messages bucket
+type storedMessage struct {
+	Type       api.MessageType     `msgpack:"type" json:"type"`
+	Properties api.MessageProperty `msgpack:"properties" json:"properties"`
+	Topic      string              `msgpack:"topic" json:"topic"`
+	Payload    []byte              `msgpack:"payload" json:"payload"`
+	ClientId   string              `msgpack:"clientId" json:"clientId"`
+	Sequence   uint64              `msgpack:"sequence" json:"sequence"`
+	ReplyTo    string              `msgpack:"replyTo,omitempty" json:"replyTo,omitempty"`
+	Timestamp  int64               `msgpack:"timestamp,omitempty" json:"timestamp,omitempty"`
+}
+
+func newStoredMessage(msg *api.Message) *storedMessage {
+	return &storedMessage{
+		Type:       msg.Type,
+		Properties: msg.Properties,
+		Topic:      msg.Topic,
+		Payload:    msg.Payload,
+		ClientId:   msg.ClientId,
+		Sequence:   msg.Sequence,
+		ReplyTo:    msg.ReplyTo,
+		Timestamp:  msg.Timestamp,
+	}
+}
+
+func (m *storedMessage) message() *api.Message {
+	return &api.Message{
+		Type:       m.Type,
+		Properties: m.Properties,
+		Topic:      m.Topic,
+		Payload:    m.Payload,
+		ClientId:   m.ClientId,
+		Sequence:   m.Sequence,
+		ReplyTo:    m.ReplyTo,
+		Timestamp:  m.Timestamp,
+	}
+}
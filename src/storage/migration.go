@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/config"
+	log "github.com/oo-developer/mmq/src/logging"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// The meta bucket holds the schema version of the database, a database
+// without it has version 0
+const (
+	BUCKET_META = "meta"
+
+	// SCHEMA_VERSION is the version of the newest migration, databases of
+	// newer versions are not opened
+	SCHEMA_VERSION = 2
+)
+
+var (
+	schemaVersionKey = []byte("schemaVersion")
+	// errDryRun rolls back the migrations of a dry run
+	errDryRun = errors.New("dry run")
+)
+
+// migration changes the database from the previous version to version
+type migration struct {
+	version     int
+	description string
+	migrate     func(tx Tx) error
+}
+
+var migrations = []migration{
+	{1, "Create the buckets of the services", createBuckets},
+	{2, "Store users, messages and revoked certificates with named fields", nameFields},
+}
+
+// MigrateResult describes the migrations of a database
+type MigrateResult struct {
+	From int
+	To   int
+	// Migrations describes the migrations applied, or checked by a dry run
+	Migrations []string
+	// BackupFile holds the snapshot taken before the migrations
+	BackupFile string
+}
+
+func schemaVersion(tx Tx) (int, error) {
+	bucket := tx.Bucket(BUCKET_META)
+	if bucket == nil {
+		return 0, nil
+	}
+	value := bucket.Get(schemaVersionKey)
+	if value == nil {
+		return 0, nil
+	}
+	version := 0
+	if err := msgpack.Unmarshal(value, &version); err != nil {
+		return 0, fmt.Errorf("schema version: %w", err)
+	}
+	return version, nil
+}
+
+func setSchemaVersion(tx Tx, version int) error {
+	bucket, err := tx.CreateBucket(BUCKET_META)
+	if err != nil {
+		return err
+	}
+	value, err := msgpack.Marshal(version)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(schemaVersionKey, value)
+}
+
+// checkSchemaVersion returns the version of the database and refuses versions
+// newer than this broker supports
+func checkSchemaVersion(backend Backend) (int, error) {
+	version := 0
+	err := backend.View(func(tx Tx) error {
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if version > SCHEMA_VERSION {
+		return version, fmt.Errorf("database schema version %d is newer than version %d of this broker", version, SCHEMA_VERSION)
+	}
+	return version, nil
+}
+
+// migrate brings the database to SCHEMA_VERSION, each migration is applied
+// with its version in one transaction. A dry run applies all of them in one
+// transaction that is rolled back.
+func migrate(backend Backend, dryRun bool) (*MigrateResult, error) {
+	version, err := checkSchemaVersion(backend)
+	if err != nil {
+		return nil, err
+	}
+	result := &MigrateResult{From: version, To: version}
+	pending := migrations[version:]
+	for _, m := range pending {
+		result.Migrations = append(result.Migrations, fmt.Sprintf("%d: %s", m.version, m.description))
+	}
+	if dryRun {
+		err := backend.Update(func(tx Tx) error {
+			for _, m := range pending {
+				if err := m.migrate(tx); err != nil {
+					return fmt.Errorf("migration to version %d: %w", m.version, err)
+				}
+			}
+			return errDryRun
+		})
+		if !errors.Is(err, errDryRun) {
+			return nil, err
+		}
+		result.To = SCHEMA_VERSION
+		return result, nil
+	}
+	for _, m := range pending {
+		err := backend.Update(func(tx Tx) error {
+			if err := m.migrate(tx); err != nil {
+				return err
+			}
+			return setSchemaVersion(tx, m.version)
+		})
+		if err != nil {
+			return result, fmt.Errorf("migration to version %d: %w", m.version, err)
+		}
+		result.To = m.version
+		log.Infof("Migrated storage to schema version %d: %s", m.version, m.description)
+	}
+	return result, nil
+}
+
+// Migrate migrates the database of a stopped broker. With backupFirst a
+// snapshot is written next to the database before anything is changed.
+func Migrate(config *config.Storage, dryRun, backupFirst bool) (*MigrateResult, error) {
+	if config.Backend == BACKEND_MEMORY {
+		return nil, fmt.Errorf("the memory backend keeps nothing to migrate")
+	}
+	// Opening the database fails while the broker holds it
+	backend, err := OpenBackend(config)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s, is the broker stopped? %w", config.DbFile, err)
+	}
+	defer backend.Close()
+	version, err := checkSchemaVersion(backend)
+	if err != nil {
+		return nil, err
+	}
+	backupFile := ""
+	if backupFirst && !dryRun && version < SCHEMA_VERSION {
+		backupFile = fmt.Sprintf("%s.v%d.bak", config.DbFile, version)
+		if err := writeSnapshot(backend, backupFile); err != nil {
+			os.Remove(backupFile)
+			return nil, fmt.Errorf("backing up %s: %w", config.DbFile, err)
+		}
+	}
+	result, err := migrate(backend, dryRun)
+	if result != nil {
+		result.BackupFile = backupFile
+	}
+	return result, err
+}
+
+func writeSnapshot(backend Backend, fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := backend.Snapshot(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// createBuckets creates the buckets of the services that are missing
+func createBuckets(tx Tx) error {
+	for _, name := range []string{BUCKET_USERS, BUCKET_MESSAGES, BUCKET_REVOKED_CERTIFICATES, BUCKET_STREAMS, BUCKET_GROUPS} {
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Before version 2 users, messages and revoked certificates were stored by
+// the names of their Go fields
+type legacyUser struct {
+	NameValue         string
+	AdminValue        bool
+	DisabledValue     bool
+	ExpiresAtValue    int64
+	PublicKeyPemValue string
+}
+
+type legacyRevokedCertificate struct {
+	Serial    string
+	Name      string
+	RevokedAt int64
+}
+
+func nameFields(tx Tx) error {
+	err := rewrite(tx, BUCKET_USERS, func(value []byte) (any, error) {
+		legacy := legacyUser{}
+		if err := msgpack.Unmarshal(value, &legacy); err != nil {
+			return nil, err
+		}
+		return &user{
+			NameValue:         legacy.NameValue,
+			AdminValue:        legacy.AdminValue,
+			DisabledValue:     legacy.DisabledValue,
+			ExpiresAtValue:    legacy.ExpiresAtValue,
+			PublicKeyPemValue: legacy.PublicKeyPemValue,
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+	err = rewrite(tx, BUCKET_MESSAGES, func(value []byte) (any, error) {
+		msg := &api.Message{}
+		if err := msgpack.Unmarshal(value, msg); err != nil {
+			return nil, err
+		}
+		return newStoredMessage(msg), nil
+	})
+	if err != nil {
+		return err
+	}
+	return rewrite(tx, BUCKET_REVOKED_CERTIFICATES, func(value []byte) (any, error) {
+		legacy := legacyRevokedCertificate{}
+		if err := msgpack.Unmarshal(value, &legacy); err != nil {
+			return nil, err
+		}
+		return &revokedCertificate{
+			Serial:    legacy.Serial,
+			Name:      legacy.Name,
+			RevokedAt: legacy.RevokedAt,
+		}, nil
+	})
+}
+
+// rewrite replaces the values of a bucket by their conversion
+func rewrite(tx Tx, name string, convert func(value []byte) (any, error)) error {
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		return nil
+	}
+	values := make(map[string][]byte)
+	err := bucket.ForEach(nil, func(key, value []byte) error {
+		values[string(key)] = append([]byte(nil), value...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		converted, err := convert(value)
+		if err != nil {
+			return fmt.Errorf("%s '%s': %w", name, key, err)
+		}
+		data, err := msgpack.Marshal(converted)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(key), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
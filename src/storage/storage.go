@@ -9,147 +9,237 @@ import (
 	"github.com/oo-developer/mmq/src/config"
 	log "github.com/oo-developer/mmq/src/logging"
 	"github.com/vmihailenco/msgpack/v5"
-	"go.etcd.io/bbolt"
 )
 
 const (
-	BUCKET_MESSAGES = "messages"
-	BUCKET_USERS    = "user"
+	BUCKET_MESSAGES             = "messages"
+	BUCKET_USERS                = "user"
+	BUCKET_REVOKED_CERTIFICATES = "revoked_certificates"
 )
 
 type storage struct {
-	config               *config.Config
-	db                   *bbolt.DB
-	messageAddChannel    chan *api.Message
-	messageRemoveChannel chan string
-	messageCache         map[string]*api.Message
-	mu                   sync.RWMutex
+	config *config.Config
+	db     Backend
+	wal    *wal
+	// messageCache holds the messages written ahead until the checkpoint,
+	// nil for a removed topic
+	messageCache map[string]*api.Message
+	streams      map[string]*streamLog
+	streamMu     sync.Mutex
+	stop         chan struct{}
+	stopped      sync.WaitGroup
+	mu           sync.RWMutex
 }
 
 func NewStorage(config *config.Config) common.StorageService {
 	s := &storage{
-		config:               config,
-		messageAddChannel:    make(chan *api.Message, 10),
-		messageRemoveChannel: make(chan string, 10),
-		messageCache:         make(map[string]*api.Message),
+		config:       config,
+		messageCache: make(map[string]*api.Message),
+		streams:      make(map[string]*streamLog),
+		stop:         make(chan struct{}),
 	}
 
 	return s
 }
 
 func (s *storage) Start() {
-	db, err := bbolt.Open(s.config.Storage.DbFile, 0600, &bbolt.Options{
-		Timeout:         3 * time.Second,
-		NoGrowSync:      true,
-		NoFreelistSync:  true,
-		FreelistType:    bbolt.FreelistArrayType,
-		InitialMmapSize: 10 * 1024 * 1024,
-	})
+	backend, err := OpenBackend(&s.config.Storage)
 	if err != nil {
+		log.Fatalf("Opening storage backend: %v", err)
+	}
+	s.db = backend
+	if _, err := migrate(backend, false); err != nil {
+		log.Fatalf("Migrating storage %s: %v", s.config.Storage.DbFile, err)
+	}
+	if err := s.loadStreams(); err != nil {
 		log.Fatal(err)
 	}
-	s.db = db
-	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("user"))
-		if err != nil {
-			log.Fatal(err)
-		}
-		_, err = tx.CreateBucketIfNotExists([]byte("messages"))
-		if err != nil {
-			log.Fatal(err)
-		}
-		return nil
-	})
+	walFile := walFileName(&s.config.Storage)
+	s.wal, err = openWal(walFile, s.config.Storage.Sync, time.Duration(s.config.Storage.SyncIntervalMillis)*time.Millisecond)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Opening write-ahead log %s: %v", walFile, err)
+	}
+	if err := s.recover(); err != nil {
+		log.Fatalf("Recovering write-ahead log %s: %v", walFile, err)
 	}
 
-	go func() {
-		for {
-			select {
-			case msg := <-s.messageAddChannel:
-				s.mu.Lock()
-				s.messageCache[msg.Topic] = msg
-				s.mu.Unlock()
-			case topic := <-s.messageRemoveChannel:
-				s.removeMessage(topic)
-			}
-		}
-	}()
+	s.stopped.Add(2)
+	go s.writeAhead()
 
 	ticker := time.NewTicker(20 * time.Second)
 	go func() {
+		defer s.stopped.Done()
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
+				s.expireStreams()
 				s.addMessages()
+			case <-s.stop:
+				return
 			}
 		}
 	}()
 
-	log.Info("StorageService started")
+	log.Infof("StorageService started with backend '%s' and sync policy '%s'", backendName(&s.config.Storage), s.wal.policy)
+}
+
+// walFileName returns the write-ahead log of a storage configuration. Nothing
+// survives a restart of the memory backend, its log is not written.
+func walFileName(config *config.Storage) string {
+	if config.Backend == BACKEND_MEMORY {
+		return ""
+	}
+	if config.WalFile == "" {
+		return config.DbFile + ".wal"
+	}
+	return config.WalFile
 }
 
-func (s *storage) RemoveMessageChannel() chan string {
-	return s.messageRemoveChannel
+func (s *storage) AddMessage(msg *api.Message) <-chan error {
+	return s.wal.add(walRecord{Topic: msg.Topic, Message: msg})
 }
 
-func (s *storage) AddMessageChannel() chan *api.Message {
-	return s.messageAddChannel
+func (s *storage) RemoveMessage(topic string) <-chan error {
+	return s.wal.add(walRecord{Topic: topic})
 }
 
+// Shutdown writes the messages still waiting and checkpoints them, the
+// broker is shut down before so nothing is added anymore
 func (s *storage) Shutdown() {
+	close(s.stop)
+	s.stopped.Wait()
+	s.writePending()
 	s.addMessages()
+	if err := s.wal.close(); err != nil {
+		log.Errorf("Error closing write-ahead log: %v", err)
+	}
 	s.db.Close()
 	log.Info("StorageService shut down")
 }
 
-func (s *storage) addMessages() {
+// writeAhead writes the waiting records in groups and syncs the log as the
+// policy says
+func (s *storage) writeAhead() {
+	defer s.stopped.Done()
+	var syncs <-chan time.Time
+	if s.wal.policy == SYNC_INTERVAL {
+		ticker := time.NewTicker(s.wal.interval)
+		defer ticker.Stop()
+		syncs = ticker.C
+	}
+	for {
+		select {
+		case <-s.wal.wake:
+			s.writePending()
+		case <-syncs:
+			s.mu.Lock()
+			if err := s.wal.sync(); err != nil {
+				log.Errorf("Error syncing write-ahead log: %v", err)
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *storage) writePending() {
+	writes := s.wal.take()
+	if len(writes) == 0 {
+		return
+	}
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	err := s.db.Update(func(tx *bbolt.Tx) error {
-		for _, msg := range s.messageCache {
-			bucket := tx.Bucket([]byte(BUCKET_MESSAGES))
-			value, _ := msgpack.Marshal(msg)
-			err := bucket.Put([]byte(msg.Topic), value)
-			if err != nil {
-				return err
+	err := s.wal.write(writes)
+	if err == nil {
+		for _, write := range writes {
+			if !write.record.Stream {
+				s.messageCache[write.record.Topic] = write.record.Message
 			}
-			delete(s.messageCache, msg.Topic)
 		}
-		return nil
-	})
+	}
+	s.mu.Unlock()
 	if err != nil {
-		log.Errorf("Error adding messages to storage: %v", err)
+		log.Errorf("Error writing %d records ahead: %v", len(writes), err)
+	}
+	for _, write := range writes {
+		write.done <- err
+	}
+}
+
+// recover moves the records a crash left in the log to the database
+func (s *storage) recover() error {
+	records, err := s.wal.replay()
+	if err != nil {
+		return err
+	}
+	if err := s.recoverStreams(records); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if !record.Stream {
+			s.messageCache[record.Topic] = record.Message
+		}
+	}
+	if len(records) > 0 {
+		log.Infof("Recovered %d records from the write-ahead log", len(records))
 	}
+	return s.checkpoint()
 }
 
-func (s *storage) removeMessage(topic string) {
+func (s *storage) addMessages() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(BUCKET_MESSAGES))
-		err := bucket.Delete([]byte(topic))
-		return err
+	if err := s.checkpoint(); err != nil {
+		log.Errorf("Error adding messages to storage: %v", err)
+	}
+}
+
+// checkpoint writes the cached messages and the pending stream appends to the
+// database and empties the write-ahead log, s.mu is held
+func (s *storage) checkpoint() error {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	err := s.db.Update(func(tx Tx) error {
+		if err := s.checkpointStreams(tx); err != nil {
+			return err
+		}
+		bucket := tx.Bucket(BUCKET_MESSAGES)
+		for topic, msg := range s.messageCache {
+			if msg == nil {
+				if err := bucket.Delete([]byte(topic)); err != nil {
+					return err
+				}
+				continue
+			}
+			value, _ := msgpack.Marshal(newStoredMessage(msg))
+			if err := bucket.Put([]byte(topic), value); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 	if err != nil {
-		log.Errorf("Error removing message from storage: %v", err)
+		return err
 	}
+	clear(s.messageCache)
+	s.checkpointedStreams()
+	return s.wal.truncate()
 }
 
 func (s *storage) GetAllMessages() []*api.Message {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	messages := make([]*api.Message, 0)
-	err := s.db.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(BUCKET_MESSAGES))
-		err := bucket.ForEach(func(k, v []byte) error {
-			msg := &api.Message{}
+	err := s.db.View(func(tx Tx) error {
+		bucket := tx.Bucket(BUCKET_MESSAGES)
+		err := bucket.ForEach(nil, func(k, v []byte) error {
+			msg := &storedMessage{}
 			err := msgpack.Unmarshal(v, msg)
 			if err != nil {
 				return err
 			}
-			messages = append(messages, msg)
+			messages = append(messages, msg.message())
 			return nil
 		})
 		return err
@@ -165,9 +255,9 @@ func (s *storage) GetAllUsers() []common.User {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	users := make([]common.User, 0)
-	err := s.db.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(BUCKET_USERS))
-		err := bucket.ForEach(func(k, v []byte) error {
+	err := s.db.View(func(tx Tx) error {
+		bucket := tx.Bucket(BUCKET_USERS)
+		err := bucket.ForEach(nil, func(k, v []byte) error {
 			msg := &user{}
 			err := msgpack.Unmarshal(v, msg)
 			if err != nil {
@@ -191,10 +281,17 @@ func (s *storage) AddUser(u common.User) error {
 	userEntry := &user{
 		NameValue:         u.Name(),
 		AdminValue:        u.IsAdmin(),
+		DisabledValue:     u.IsDisabled(),
 		PublicKeyPemValue: u.PublicKeyPem(),
 	}
-	err := s.db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(BUCKET_USERS))
+	if !u.ExpiresAt().IsZero() {
+		userEntry.ExpiresAtValue = u.ExpiresAt().Unix()
+	}
+	if !u.SessionsRevokedAt().IsZero() {
+		userEntry.RevokedAtValue = u.SessionsRevokedAt().Unix()
+	}
+	err := s.db.Update(func(tx Tx) error {
+		bucket := tx.Bucket(BUCKET_USERS)
 		value, _ := msgpack.Marshal(userEntry)
 		err := bucket.Put([]byte(userEntry.Name()), value)
 		if err != nil {
@@ -208,8 +305,8 @@ func (s *storage) AddUser(u common.User) error {
 func (s *storage) RemoveUserByName(userName string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(BUCKET_USERS))
+	err := s.db.Update(func(tx Tx) error {
+		bucket := tx.Bucket(BUCKET_USERS)
 		err := bucket.Delete([]byte(userName))
 		if err != nil {
 			return err
@@ -0,0 +1,454 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	log "github.com/oo-developer/mmq/src/logging"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// The streams bucket holds a bucket per stream topic with a bucket per
+// segment, named by its base offset. A segment keeps its entries under their
+// offset and its index entry under segmentMetaKey.
+const (
+	BUCKET_STREAMS = "streams"
+
+	defaultSegmentMessages = 1000
+)
+
+var segmentMetaKey = []byte("meta")
+
+// segment is the index entry of a segment
+type segment struct {
+	Base      uint64 `msgpack:"base"`
+	Count     int64  `msgpack:"count"`
+	Bytes     int64  `msgpack:"bytes"`
+	FirstTime int64  `msgpack:"firstTime"`
+	LastTime  int64  `msgpack:"lastTime"`
+}
+
+func (s *segment) next() uint64 {
+	return s.Base + uint64(s.Count)
+}
+
+// streamEntry is a message in the log of a stream topic
+type streamEntry struct {
+	Properties api.MessageProperty `msgpack:"properties"`
+	Payload    []byte              `msgpack:"payload"`
+	ClientId   string              `msgpack:"clientId"`
+	Timestamp  int64               `msgpack:"timestamp"`
+	Sequence   uint64              `msgpack:"sequence,omitempty"`
+}
+
+// streamLog indexes the segments of a stream topic, the last one is active.
+// Appended messages are written ahead and kept in pending until the
+// checkpoint, which also deletes the buckets of the dropped segments.
+type streamLog struct {
+	config   *config.Stream
+	segments []*segment
+	next     uint64
+	pending  []*api.Message
+	dropped  []uint64
+}
+
+func (l *streamLog) info(topic string) common.StreamInfo {
+	info := common.StreamInfo{
+		Topic:    topic,
+		First:    l.next,
+		Next:     l.next,
+		Segments: len(l.segments),
+	}
+	if len(l.segments) > 0 {
+		info.First = l.segments[0].Base
+	}
+	for _, seg := range l.segments {
+		info.Messages += seg.Count
+		info.Bytes += seg.Bytes
+	}
+	return info
+}
+
+// expired counts the oldest segments beyond the retention of segments, the
+// active segment is never dropped
+func (l *streamLog) expired(segments []*segment, now time.Time) int {
+	if l.config == nil {
+		return 0
+	}
+	var messages, bytes int64
+	for _, seg := range segments {
+		messages += seg.Count
+		bytes += seg.Bytes
+	}
+	maxAge := time.Duration(l.config.MaxAgeSeconds) * time.Second
+	drop := 0
+	for ; drop < len(segments)-1; drop++ {
+		seg := segments[drop]
+		tooOld := maxAge > 0 && now.Sub(time.Unix(0, seg.LastTime)) > maxAge
+		tooMany := l.config.MaxMessages > 0 && messages > l.config.MaxMessages
+		tooBig := l.config.MaxBytes > 0 && bytes > l.config.MaxBytes
+		if !tooOld && !tooMany && !tooBig {
+			break
+		}
+		messages -= seg.Count
+		bytes -= seg.Bytes
+	}
+	return drop
+}
+
+// drop removes the oldest count segments from the index
+func (l *streamLog) drop(count int) {
+	if count == 0 {
+		return
+	}
+	for _, seg := range l.segments[:count] {
+		l.dropped = append(l.dropped, seg.Base)
+	}
+	l.segments = l.segments[count:]
+	first := l.segments[0].Base
+	l.pending = slices.DeleteFunc(l.pending, func(msg *api.Message) bool {
+		return msg.Offset < first
+	})
+}
+
+// segment returns the segment of offset, nil when it was dropped
+func (l *streamLog) segment(offset uint64) *segment {
+	for _, seg := range l.segments {
+		if offset >= seg.Base && offset < seg.next() {
+			return seg
+		}
+	}
+	return nil
+}
+
+func (l *streamLog) segmentMessages() int64 {
+	if l.config != nil && l.config.SegmentMessages > 0 {
+		return int64(l.config.SegmentMessages)
+	}
+	return defaultSegmentMessages
+}
+
+func offsetKey(offset uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, offset)
+	return key
+}
+
+// streamConfig returns the first stream configuration matching topic
+func (s *storage) streamConfig(topic string) *config.Stream {
+	for ii := range s.config.Streams {
+		if common.TopicMatches(s.config.Streams[ii].Pattern, topic) {
+			return &s.config.Streams[ii]
+		}
+	}
+	return nil
+}
+
+// loadStreams builds the index of the logs, logs of topics that are no
+// streams anymore stay readable
+func (s *storage) loadStreams() error {
+	return s.db.View(func(tx Tx) error {
+		for _, topic := range tx.Buckets(BUCKET_STREAMS) {
+			l := &streamLog{config: s.streamConfig(topic)}
+			for _, base := range tx.Buckets(BUCKET_STREAMS, topic) {
+				seg := &segment{}
+				value := tx.Bucket(BUCKET_STREAMS, topic, base).Get(segmentMetaKey)
+				if err := msgpack.Unmarshal(value, seg); err != nil {
+					return fmt.Errorf("segment %x of stream '%s': %w", base, topic, err)
+				}
+				l.segments = append(l.segments, seg)
+				l.next = seg.next()
+			}
+			s.streams[topic] = l
+		}
+		return nil
+	})
+}
+
+func (s *storage) IsStream(topic string) bool {
+	return s.streamConfig(topic) != nil
+}
+
+// AppendStream gives msg the next offset of its log and writes it ahead, the
+// returned channel reports when the log is written as the sync policy says
+func (s *storage) AppendStream(msg *api.Message) <-chan error {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().UnixNano()
+	}
+	entry := *msg
+	if err := s.index(&entry); err != nil {
+		failed := make(chan error, 1)
+		failed <- fmt.Errorf("failed to append to stream '%s': %w", msg.Topic, err)
+		return failed
+	}
+	msg.Offset = entry.Offset
+	// Appends are written ahead in the order of their offsets
+	return s.wal.add(walRecord{Topic: msg.Topic, Message: &entry, Stream: true})
+}
+
+// index adds msg at the next offset of its log as pending and applies the
+// retention, s.streamMu is held
+func (s *storage) index(msg *api.Message) error {
+	value, err := encodeEntry(msg)
+	if err != nil {
+		return err
+	}
+	l, ok := s.streams[msg.Topic]
+	if !ok {
+		l = &streamLog{config: s.streamConfig(msg.Topic)}
+		s.streams[msg.Topic] = l
+	}
+	// Readers keep the segments they copied, the index is changed by copies
+	segments := append([]*segment(nil), l.segments...)
+	var active segment
+	if len(segments) > 0 && segments[len(segments)-1].Count < l.segmentMessages() {
+		active = *segments[len(segments)-1]
+		segments = segments[:len(segments)-1]
+	} else {
+		active = segment{Base: l.next, FirstTime: msg.Timestamp}
+	}
+	active.Count++
+	active.Bytes += int64(len(value))
+	active.LastTime = msg.Timestamp
+	l.segments = append(segments, &active)
+	msg.Offset = l.next
+	l.next++
+	l.pending = append(l.pending, msg)
+	l.drop(l.expired(l.segments, time.Now()))
+	return nil
+}
+
+func encodeEntry(msg *api.Message) ([]byte, error) {
+	return msgpack.Marshal(&streamEntry{
+		Properties: msg.Properties,
+		Payload:    msg.Payload,
+		ClientId:   msg.ClientId,
+		Timestamp:  msg.Timestamp,
+		Sequence:   msg.Sequence,
+	})
+}
+
+// recoverStreams indexes the appends of records again, the appends the last
+// checkpoint wrote already are skipped
+func (s *storage) recoverStreams(records []walRecord) error {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	for _, record := range records {
+		if !record.Stream {
+			continue
+		}
+		if l, ok := s.streams[record.Topic]; ok && record.Message.Offset < l.next {
+			continue
+		}
+		if err := s.index(record.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpointStreams writes the pending messages and the index of their
+// segments to tx and deletes the dropped segments, s.streamMu is held
+func (s *storage) checkpointStreams(tx Tx) error {
+	for topic, l := range s.streams {
+		for _, base := range l.dropped {
+			if tx.Bucket(BUCKET_STREAMS, topic, string(offsetKey(base))) == nil {
+				continue
+			}
+			if err := tx.DeleteBucket(BUCKET_STREAMS, topic, string(offsetKey(base))); err != nil {
+				return err
+			}
+		}
+		changed := make(map[*segment]bool)
+		for _, msg := range l.pending {
+			seg := l.segment(msg.Offset)
+			value, err := encodeEntry(msg)
+			if err != nil {
+				return err
+			}
+			segmentBucket, err := tx.CreateBucket(BUCKET_STREAMS, topic, string(offsetKey(seg.Base)))
+			if err != nil {
+				return err
+			}
+			if err := segmentBucket.Put(offsetKey(msg.Offset), value); err != nil {
+				return err
+			}
+			changed[seg] = true
+		}
+		for seg := range changed {
+			meta, err := msgpack.Marshal(seg)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(BUCKET_STREAMS, topic, string(offsetKey(seg.Base))).Put(segmentMetaKey, meta); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkpointedStreams empties the pending messages once they are in the
+// database, s.streamMu is held
+func (s *storage) checkpointedStreams() {
+	for _, l := range s.streams {
+		l.pending = nil
+		l.dropped = nil
+	}
+}
+
+func (s *storage) ReadStream(topic string, offset uint64, limit int) ([]*api.Message, error) {
+	s.streamMu.Lock()
+	l, ok := s.streams[topic]
+	var segments []*segment
+	var pending []*api.Message
+	if ok {
+		segments = append(segments, l.segments...)
+		pending = append(pending, l.pending...)
+	}
+	s.streamMu.Unlock()
+	messages := make([]*api.Message, 0)
+	err := s.db.View(func(tx Tx) error {
+		for _, seg := range segments {
+			if seg.next() <= offset {
+				continue
+			}
+			segmentBucket := tx.Bucket(BUCKET_STREAMS, topic, string(offsetKey(seg.Base)))
+			if segmentBucket == nil {
+				// Dropped by retention meanwhile
+				continue
+			}
+			err := segmentBucket.ForEach(offsetKey(offset), func(key, value []byte) error {
+				if len(key) != 8 {
+					return nil
+				}
+				entry := &streamEntry{}
+				if err := msgpack.Unmarshal(value, entry); err != nil {
+					return err
+				}
+				messages = append(messages, &api.Message{
+					Type:       api.TypeMessage,
+					Properties: entry.Properties,
+					Topic:      topic,
+					Payload:    entry.Payload,
+					ClientId:   entry.ClientId,
+					Offset:     binary.BigEndian.Uint64(key),
+					Timestamp:  entry.Timestamp,
+					Sequence:   entry.Sequence,
+				})
+				if len(messages) >= limit {
+					return errStop
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errStop) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stream '%s': %w", topic, err)
+	}
+	// The messages not checkpointed yet follow, a checkpoint in between
+	// may have put some of them into the database already
+	if len(messages) > 0 {
+		offset = max(offset, messages[len(messages)-1].Offset+1)
+	}
+	for _, msg := range pending {
+		if len(messages) >= limit {
+			break
+		}
+		if msg.Offset >= offset {
+			msgCopy := *msg
+			messages = append(messages, &msgCopy)
+		}
+	}
+	return messages, nil
+}
+
+func (s *storage) StreamOffset(topic string, t time.Time) uint64 {
+	s.streamMu.Lock()
+	l, ok := s.streams[topic]
+	if !ok {
+		s.streamMu.Unlock()
+		return 0
+	}
+	next := l.next
+	var found *segment
+	for _, seg := range l.segments {
+		if seg.LastTime >= t.UnixNano() {
+			found = seg
+			break
+		}
+	}
+	offset := next
+	if found != nil {
+		offset = found.next()
+		for _, msg := range l.pending {
+			if msg.Offset >= found.Base && msg.Timestamp >= t.UnixNano() {
+				offset = min(offset, msg.Offset)
+				break
+			}
+		}
+	}
+	s.streamMu.Unlock()
+	if found == nil {
+		return next
+	}
+	s.db.View(func(tx Tx) error {
+		segmentBucket := tx.Bucket(BUCKET_STREAMS, topic, string(offsetKey(found.Base)))
+		if segmentBucket == nil {
+			return nil
+		}
+		return segmentBucket.ForEach(nil, func(key, value []byte) error {
+			if len(key) != 8 {
+				return nil
+			}
+			entry := &streamEntry{}
+			if err := msgpack.Unmarshal(value, entry); err != nil {
+				return err
+			}
+			if entry.Timestamp >= t.UnixNano() {
+				offset = min(offset, binary.BigEndian.Uint64(key))
+			}
+			return nil
+		})
+	})
+	return offset
+}
+
+func (s *storage) Streams() []common.StreamInfo {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	streams := make([]common.StreamInfo, 0, len(s.streams))
+	for topic, l := range s.streams {
+		streams = append(streams, l.info(topic))
+	}
+	return streams
+}
+
+// expireStreams applies the age limits to logs without new messages, the
+// next checkpoint deletes the segments
+func (s *storage) expireStreams() {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	now := time.Now()
+	for topic, l := range s.streams {
+		if drop := l.expired(l.segments, now); drop > 0 {
+			l.drop(drop)
+			log.Infof("Dropped %d segments of stream '%s'", drop, topic)
+		}
+	}
+}
@@ -1,11 +1,19 @@
 package storage
 
-import api "github.com/oo-developer/mmq/pkg"
+import (
+	"time"
+
+	api "github.com/oo-developer/mmq/pkg"
+)
 
 type user struct {
-	NameValue         string `json:"name"`
-	AdminValue        bool   `json:"admin"`
-	PublicKeyPemValue string `json:"publicKeyPem"`
+	NameValue         string `msgpack:"name" json:"name"`
+	AdminValue        bool   `msgpack:"admin" json:"admin"`
+	DisabledValue     bool   `msgpack:"disabled" json:"disabled"`
+	ExpiresAtValue    int64  `msgpack:"expiresAt" json:"expiresAt"`
+	PublicKeyPemValue string `msgpack:"publicKeyPem" json:"publicKeyPem"`
+	// RevokedAtValue is missing in users stored before tickets were revoked
+	RevokedAtValue int64 `msgpack:"revokedAt,omitempty" json:"revokedAt,omitempty"`
 }
 
 func (n *user) Name() string {
@@ -20,6 +28,24 @@ func (n *user) IsAdmin() bool {
 	return n.AdminValue
 }
 
+func (n *user) IsDisabled() bool {
+	return n.DisabledValue
+}
+
+func (n *user) ExpiresAt() time.Time {
+	if n.ExpiresAtValue == 0 {
+		return time.Time{}
+	}
+	return time.Unix(n.ExpiresAtValue, 0)
+}
+
+func (n *user) SessionsRevokedAt() time.Time {
+	if n.RevokedAtValue == 0 {
+		return time.Time{}
+	}
+	return time.Unix(n.RevokedAtValue, 0)
+}
+
 func (n *user) PublicKey() *api.KyberPublicKey {
 	return nil
 }
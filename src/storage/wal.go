@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	api "github.com/oo-developer/mmq/pkg"
+	log "github.com/oo-developer/mmq/src/logging"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	SYNC_ALWAYS   = "always"
+	SYNC_INTERVAL = "interval"
+	SYNC_NONE     = "none"
+
+	defaultSyncInterval = time.Second
+	// walHeader is the length and the checksum of a record
+	walHeader = 8
+)
+
+var (
+	errTornFrame    = errors.New("torn record")
+	errCorruptFrame = errors.New("corrupt record")
+)
+
+// appendFrame adds data to buffer behind its length and checksum
+func appendFrame(buffer *bytes.Buffer, data []byte) {
+	header := make([]byte, walHeader)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(data))
+	buffer.Write(header)
+	buffer.Write(data)
+}
+
+// readFrame returns the data of the next frame, io.EOF at the end and
+// errTornFrame or errCorruptFrame for a frame a crash left incomplete
+func readFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, walHeader)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errTornFrame
+		}
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errTornFrame
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errCorruptFrame
+	}
+	return data, nil
+}
+
+// walRecord is a change of the stored messages, the message is nil when the
+// topic was removed. Stream records append the message to the log of its
+// topic at its offset.
+type walRecord struct {
+	Topic   string       `msgpack:"topic"`
+	Message *api.Message `msgpack:"message"`
+	Stream  bool         `msgpack:"stream,omitempty"`
+}
+
+type walWrite struct {
+	record walRecord
+	done   chan error
+}
+
+// wal is the write-ahead log of the stored messages. Waiting writes are
+// written together and synced once. The log is emptied when the messages are
+// checkpointed to the database. A wal without file only groups the writes.
+type wal struct {
+	file     *os.File
+	policy   string
+	interval time.Duration
+	pending  []*walWrite
+	// dirty is set when records were written since the last sync
+	dirty bool
+	wake  chan struct{}
+	mu    sync.Mutex
+}
+
+func openWal(fileName, policy string, interval time.Duration) (*wal, error) {
+	switch policy {
+	case "":
+		policy = SYNC_ALWAYS
+	case SYNC_ALWAYS, SYNC_INTERVAL, SYNC_NONE:
+	default:
+		return nil, fmt.Errorf("unknown sync policy '%s'", policy)
+	}
+	if interval <= 0 {
+		interval = defaultSyncInterval
+	}
+	w := &wal{
+		policy:   policy,
+		interval: interval,
+		wake:     make(chan struct{}, 1),
+	}
+	if fileName == "" {
+		return w, nil
+	}
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	return w, nil
+}
+
+// add queues a record for the writer
+func (w *wal) add(record walRecord) <-chan error {
+	write := &walWrite{
+		record: record,
+		done:   make(chan error, 1),
+	}
+	w.mu.Lock()
+	w.pending = append(w.pending, write)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return write.done
+}
+
+func (w *wal) take() []*walWrite {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pending := w.pending
+	w.pending = nil
+	return pending
+}
+
+// write appends the records of writes and syncs them when the policy says so
+func (w *wal) write(writes []*walWrite) error {
+	if w.file == nil {
+		return nil
+	}
+	buffer := bytes.Buffer{}
+	for _, write := range writes {
+		data, err := msgpack.Marshal(&write.record)
+		if err != nil {
+			return err
+		}
+		appendFrame(&buffer, data)
+	}
+	if _, err := w.file.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	w.dirty = true
+	if w.policy == SYNC_ALWAYS {
+		return w.sync()
+	}
+	return nil
+}
+
+func (w *wal) sync() error {
+	if w.file == nil || !w.dirty {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// replay reads the records of the log, a record torn by a crash ends it
+func (w *wal) replay() ([]walRecord, error) {
+	if w.file == nil {
+		return nil, nil
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	records := make([]walRecord, 0)
+	for {
+		data, err := readFrame(w.file)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, errTornFrame) || errors.Is(err, errCorruptFrame) {
+			log.Warnf("Write-ahead log ends with a %v", err)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := walRecord{}
+		if err := msgpack.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// truncate empties the log once its records are in the database
+func (w *wal) truncate() error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := w.file.Seek(0, io.SeekStart)
+	w.dirty = false
+	return err
+}
+
+func (w *wal) close() error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
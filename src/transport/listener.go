@@ -0,0 +1,306 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/oo-developer/mmq/src/gateway"
+	"github.com/oo-developer/mmq/src/handoff"
+	log "github.com/oo-developer/mmq/src/logging"
+)
+
+const (
+	PROTOCOL_MMQ  = "mmq"
+	PROTOCOL_MQTT = "mqtt"
+	PROTOCOL_HTTP = "http"
+	PROTOCOL_NATS = "nats"
+	PROTOCOL_RESP = "resp"
+)
+
+// listener accepts the command and publish connections of one configured endpoint
+type listener struct {
+	config          *config.Listener
+	tlsConfig       *tls.Config
+	secureChannel   bool
+	listenerCommand net.Listener
+	listenerPublish net.Listener
+	httpServer      *http.Server
+	guardService    common.GuardService
+	connections     atomic.Int32
+	open            *openConnections
+	acceptors       sync.WaitGroup
+	// sockets are the listening sockets a restart hands to the new process
+	sockets   []handoff.Socket
+	handedOff bool
+}
+
+func newListener(config *config.Listener, guardService common.GuardService) (*listener, error) {
+	switch config.Protocol {
+	case PROTOCOL_MMQ, PROTOCOL_MQTT, PROTOCOL_NATS, PROTOCOL_RESP:
+	case PROTOCOL_HTTP:
+		if config.Network == NETWORK_WS || config.Network == NETWORK_WSS {
+			return nil, fmt.Errorf("protocol http is not available on network '%s'", config.Network)
+		}
+	default:
+		return nil, fmt.Errorf("unknown protocol '%s'", config.Protocol)
+	}
+	l := &listener{
+		config:       config,
+		guardService: guardService,
+	}
+	if config.Network == NETWORK_TLS || config.Network == NETWORK_WSS {
+		tlsConfig, err := newServerTLSConfig(&config.Tls)
+		if err != nil {
+			return nil, err
+		}
+		l.tlsConfig = tlsConfig
+		l.secureChannel = config.Network == NETWORK_TLS && config.Tls.SkipSessionCipher
+	}
+	return l, nil
+}
+
+func (l *listener) start(s *transport) error {
+	var err error
+	l.open = s.open
+	l.listenerCommand, err = l.listen(l.config.AddressCommand, "command", s.inherited)
+	if err != nil {
+		return err
+	}
+	if err := applySocketPermissions(l.config, l.config.AddressCommand); err != nil {
+		return err
+	}
+	switch l.config.Protocol {
+	case PROTOCOL_MQTT:
+		log.Infof("Listener '%s' listening for MQTT on %s", l.config.Name, l.listenerCommand.Addr())
+		l.acceptors.Add(1)
+		go l.accept(l.listenerCommand, l.limited(func(conn net.Conn) {
+			s.mqtt.Serve(conn, l.config)
+		}))
+		return nil
+	case PROTOCOL_NATS:
+		log.Infof("Listener '%s' listening for NATS on %s", l.config.Name, l.listenerCommand.Addr())
+		l.acceptors.Add(1)
+		go l.accept(l.listenerCommand, l.limited(func(conn net.Conn) {
+			s.nats.Serve(conn, l.config)
+		}))
+		return nil
+	case PROTOCOL_RESP:
+		log.Infof("Listener '%s' listening for RESP on %s", l.config.Name, l.listenerCommand.Addr())
+		l.acceptors.Add(1)
+		go l.accept(l.listenerCommand, l.limited(func(conn net.Conn) {
+			s.resp.Serve(conn, l.config)
+		}))
+		return nil
+	case PROTOCOL_HTTP:
+		log.Infof("Listener '%s' listening for HTTP on %s", l.config.Name, l.listenerCommand.Addr())
+		l.httpServer = &http.Server{
+			Handler:           s.gateway.Handler(l.config),
+			ConnContext:       gateway.ConnContext,
+			ReadHeaderTimeout: s.guardService.HandshakeTimeout(),
+		}
+		l.acceptors.Add(1)
+		go func() {
+			defer l.acceptors.Done()
+			l.httpServer.Serve(&limitedListener{Listener: l.listenerCommand, l: l})
+		}()
+		return nil
+	}
+	l.listenerPublish, err = l.listen(l.config.AddressPublish, "publish", s.inherited)
+	if err != nil {
+		return err
+	}
+	if err := applySocketPermissions(l.config, l.config.AddressPublish); err != nil {
+		return err
+	}
+	log.Infof("Listener '%s' listening on %s, publish %s", l.config.Name, l.listenerCommand.Addr(), l.listenerPublish.Addr())
+	l.acceptors.Add(1)
+	go l.accept(l.listenerCommand, l.limited(func(conn net.Conn) {
+		s.handleConnectionCommand(l, conn)
+	}))
+	l.acceptors.Add(1)
+	go l.accept(l.listenerPublish, l.limited(func(conn net.Conn) {
+		s.handleConnectionPublish(l, conn)
+	}))
+	return nil
+}
+
+// listen creates the net listener of address, a socket inherited from the
+// previous process is taken over. "tls" listens on tcp and the WebSocket
+// networks serve the HTTP upgrade.
+func (l *listener) listen(address string, socket string, inherited *handoff.Inherited) (net.Listener, error) {
+	name := l.config.Name + "." + socket
+	netListener, ok := inherited.Listener(name)
+	if ok {
+		log.Infof("Listener '%s' took over the socket of %s", l.config.Name, address)
+	} else {
+		network := l.config.Network
+		switch network {
+		case NETWORK_TLS, NETWORK_WS, NETWORK_WSS:
+			network = "tcp"
+		case "unix":
+			_ = os.Remove(address)
+		}
+		var err error
+		if netListener, err = net.Listen(network, address); err != nil {
+			return nil, err
+		}
+	}
+	l.sockets = append(l.sockets, handoff.Socket{Name: name, Listener: netListener})
+	switch l.config.Network {
+	case NETWORK_TLS:
+		return tls.NewListener(netListener, l.tlsConfig), nil
+	case NETWORK_WS, NETWORK_WSS:
+		return listenWebSocket(netListener, l.tlsConfig, &l.config.WebSocket, l.config.Protocol), nil
+	}
+	return netListener, nil
+}
+
+func (l *listener) accept(netListener net.Listener, handle func(conn net.Conn)) {
+	defer l.acceptors.Done()
+	for {
+		conn, err := netListener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			log.Infof("Listener '%s' closed", l.config.Name)
+			return
+		}
+		if err != nil {
+			log.Infof("Accept error on listener '%s': %v", l.config.Name, err)
+			continue
+		}
+		release := l.open.hold(conn)
+		go func() {
+			defer release()
+			handle(conn)
+		}()
+	}
+}
+
+// limited applies the connection limits before handle
+func (l *listener) limited(handle func(conn net.Conn)) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		release, ok := l.admit(conn)
+		if !ok {
+			conn.Close()
+			return
+		}
+		defer release()
+		handle(conn)
+	}
+}
+
+// limitedListener applies the connection limit to the connections of an http.Server
+type limitedListener struct {
+	net.Listener
+	l *listener
+}
+
+func (ll *limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if release, ok := ll.l.admit(conn); ok {
+			return &limitedConn{Conn: conn, release: release}, nil
+		}
+		conn.Close()
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// admit applies the limit of the listener and the caps of the guard, release
+// frees both
+func (l *listener) admit(conn net.Conn) (func(), bool) {
+	if !l.acquire() {
+		log.Warnf("Listener '%s' rejected '%s': connection limit %d reached", l.config.Name, conn.RemoteAddr(), l.config.Limits.MaxConnections)
+		return nil, false
+	}
+	release, err := l.guardService.Admit(conn)
+	if err != nil {
+		l.connections.Add(-1)
+		log.Warnf("Listener '%s' rejected '%s': %v", l.config.Name, conn.RemoteAddr(), err)
+		return nil, false
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.connections.Add(-1)
+			release()
+		})
+	}, true
+}
+
+// acquire counts a connection against the connection limit
+func (l *listener) acquire() bool {
+	count := l.connections.Add(1)
+	if l.config.Limits.MaxConnections > 0 && int(count) > l.config.Limits.MaxConnections {
+		l.connections.Add(-1)
+		return false
+	}
+	return true
+}
+
+// stopAccepting closes the command listener, the open connections are served
+// on and the clients already accepted still get their publish connection
+func (l *listener) stopAccepting() {
+	if l.listenerCommand != nil {
+		l.listenerCommand.Close()
+	}
+}
+
+// close waits for the HTTP requests in flight until deadline and the
+// accepting goroutines
+func (l *listener) close(deadline time.Time) {
+	l.stopAccepting()
+	if l.listenerPublish != nil {
+		l.listenerPublish.Close()
+	}
+	if l.httpServer != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		if err := l.httpServer.Shutdown(ctx); err != nil {
+			log.Warnf("Listener '%s' closed with requests in flight: %v", l.config.Name, err)
+			l.httpServer.Close()
+		}
+		cancel()
+	}
+	l.acceptors.Wait()
+	l.cleanupUnixSocket()
+}
+
+// cleanupUnixSocket removes the socket files, after a handoff they belong
+// to the new process
+func (l *listener) cleanupUnixSocket() {
+	if l.config.Network == "unix" && !l.handedOff {
+		_ = os.Remove(l.config.AddressCommand)
+		_ = os.Remove(l.config.AddressPublish)
+	}
+}
+
+// topicAllowed checks the topic length limit of the listener
+func (l *listener) topicAllowed(topic string) bool {
+	return l.config.Limits.MaxTopicLength <= 0 || len(topic) <= l.config.Limits.MaxTopicLength
+}
+
+// payloadAllowed checks the payload length limit of the listener
+func (l *listener) payloadAllowed(payload []byte) bool {
+	return l.config.Limits.MaxPayloadLength <= 0 || len(payload) <= l.config.Limits.MaxPayloadLength
+}
@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+
+	api "github.com/oo-developer/mmq/pkg"
+)
+
+const pairingTokenSize = 32
+
+// pairing binds a pairing token to the client of a command connection
+type pairing struct {
+	clientId string
+	redeemed bool
+}
+
+// pairings binds publish connections to their command connection. Every
+// handshake hands out its own one-time token, the publish connection of the
+// same client redeems it. A client thereby gets exactly one publish
+// connection and a handshake that fails leaves the pairing of the connected
+// client untouched.
+type pairings struct {
+	entries map[string]*pairing
+	mu      sync.Mutex
+}
+
+func newPairings() *pairings {
+	return &pairings{
+		entries: make(map[string]*pairing),
+	}
+}
+
+// issue creates a pairing token for a handshake of clientId
+func (p *pairings) issue(clientId string) (string, error) {
+	buffer := make([]byte, pairingTokenSize)
+	if _, err := io.ReadFull(rand.Reader, buffer); err != nil {
+		return "", fmt.Errorf("failed to generate pairing token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buffer)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries[token] = &pairing{clientId: clientId}
+	return token, nil
+}
+
+// redeem consumes a pairing token of clientId
+func (p *pairings) redeem(clientId string, token string) *api.Rejection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.entries[token]
+	if !ok || subtle.ConstantTimeCompare([]byte(entry.clientId), []byte(clientId)) != 1 {
+		return &api.Rejection{
+			Reason:  api.RejectInvalidPairing,
+			Message: fmt.Sprintf("pairing token of client '%s' does not match", clientId),
+		}
+	}
+	if entry.redeemed {
+		return &api.Rejection{
+			Reason:  api.RejectAlreadyPaired,
+			Message: fmt.Sprintf("client '%s' already has a publish connection", clientId),
+		}
+	}
+	entry.redeemed = true
+	return nil
+}
+
+// release drops the pairing of token when the command connection that issued
+// it ends, other connections of the same client keep their pairings
+func (p *pairings) release(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.entries, token)
+}
@@ -0,0 +1,232 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/auth"
+	"github.com/oo-developer/mmq/src/common"
+	log "github.com/oo-developer/mmq/src/logging"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func (s *transport) issueTicket(identity *common.Identity) ([]byte, error) {
+	grant, err := s.tickets.issue(identity.User.Name(), identity.Provider, keyHash(identity.User))
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(grant)
+}
+
+// resumption is a RESUME message with a valid ticket
+type resumption struct {
+	user     common.User
+	provider string
+	request  *api.ResumeRequest
+	state    *ticketState
+	secret   []byte
+}
+
+// openResume validates the ticket of a RESUME message on listener l, the
+// provider that authenticated the session must be allowed on l
+func (s *transport) openResume(l *listener, msg *api.Message) (*resumption, error) {
+	if !s.tickets.enabled {
+		return nil, fmt.Errorf("session tickets are disabled")
+	}
+	request := &api.ResumeRequest{}
+	if err := msgpack.Unmarshal(msg.Payload, request); err != nil {
+		return nil, fmt.Errorf("failed to decode RESUME: %w", err)
+	}
+	state, err := s.tickets.open(request.Ticket)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := s.userService.LookupUserByName(state.User)
+	if !ok {
+		return nil, fmt.Errorf("user '%s' not found", state.User)
+	}
+	if err := common.CheckUser(user); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(state.KeyHash, keyHash(user)) {
+		return nil, fmt.Errorf("key of user '%s' changed since the ticket was issued", state.User)
+	}
+	if revokedAt := user.SessionsRevokedAt(); !revokedAt.IsZero() && state.IssuedAt <= revokedAt.Unix() {
+		return nil, errTicketRevoked
+	}
+	// Tickets issued before the provider was recorded come from key sessions
+	provider := state.Provider
+	if provider == "" {
+		provider = auth.PROVIDER_KEY
+	}
+	if len(l.config.AuthProviders) > 0 && !slices.Contains(l.config.AuthProviders, provider) {
+		return nil, fmt.Errorf("provider '%s' of the ticket is not allowed on listener '%s'", provider, l.config.Name)
+	}
+	return &resumption{
+		user:     user,
+		provider: provider,
+		request:  request,
+		state:    state,
+		secret:   state.Secret,
+	}, nil
+}
+
+// acceptResume answers a validated RESUME message with RESUME_ACK carrying grant
+func (s *transport) acceptResume(conn net.Conn, msg *api.Message, r *resumption, grant *api.TicketGrant) (api.Cipher, error) {
+	serverNonce, err := api.NewResumeNonce()
+	if err != nil {
+		return nil, err
+	}
+	transportCipher, err := api.NewResumedCipher(r.secret, r.request.Nonce, serverNonce)
+	if err != nil {
+		return nil, err
+	}
+	grantBytes, err := msgpack.Marshal(grant)
+	if err != nil {
+		return nil, err
+	}
+	// The client proves knowledge of the ticket secret by being able to read the grant
+	encryptedGrant, err := transportCipher.Encrypt(grantBytes)
+	if err != nil {
+		return nil, err
+	}
+	response, err := msgpack.Marshal(&api.ResumeResponse{
+		Nonce: serverNonce,
+		Grant: encryptedGrant,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resumeAck := &api.Message{
+		Type:       api.TypeResumeAck,
+		ClientId:   msg.ClientId,
+		Payload:    response,
+		Properties: msg.Properties & api.Multiplex,
+	}
+	if err := resumeAck.Send(conn, api.NewNoCipher()); err != nil {
+		return nil, fmt.Errorf("failed to send RESUME_ACK: %w", err)
+	}
+	return transportCipher, nil
+}
+
+// keyHash binds a ticket to the key of its user, rotating the key invalidates the ticket
+func keyHash(user common.User) []byte {
+	hash := sha256.Sum256([]byte(user.PublicKeyPem()))
+	return hash[:]
+}
+
+func (s *transport) resumeCommand(l *listener, conn net.Conn, msg *api.Message) {
+	r, err := s.openResume(l, msg)
+	if err == nil {
+		// A recorded RESUME can not be replayed
+		err = s.tickets.redeem(r.state)
+	}
+	if err != nil {
+		log.Warnf("Session resumption from '%s' rejected: %v", conn.RemoteAddr(), err)
+		s.guardService.AuthFailed(conn)
+		return
+	}
+	user := r.user
+	if err := s.guardService.CheckUser(user.Name(), msg.ClientId); err != nil {
+		log.Warnf("Session resumption from '%s' rejected: %v", conn.RemoteAddr(), err)
+		return
+	}
+	clientId := msg.ClientId
+	grant, err := s.tickets.issue(user.Name(), r.provider, keyHash(user))
+	if err != nil {
+		log.Errorf("Failed to issue session ticket: %v", err)
+		return
+	}
+	grant.PairingToken, err = s.pairings.issue(clientId)
+	if err != nil {
+		log.Errorf("Failed to pair client '%s': %v", clientId, err)
+		return
+	}
+	defer s.pairings.release(grant.PairingToken)
+	transportCipher, err := s.acceptResume(conn, msg, r, grant)
+	if err != nil {
+		log.Warnf("Session resumption from '%s' failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	// The pairing token of the grant proves the client holds the secret of
+	// the ticket, the session is taken over only then
+	proof, err := api.Receive(conn, transportCipher)
+	if err != nil {
+		log.Warnf("Session resumption from '%s' failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	sessionKey := &api.SessionKey{}
+	if proof.Type != api.TypeSessionKey || msgpack.Unmarshal(proof.Payload, sessionKey) != nil || subtle.ConstantTimeCompare([]byte(sessionKey.PairingToken), []byte(grant.PairingToken)) != 1 {
+		s.guardService.AuthFailed(conn)
+		reject(conn, clientId, transportCipher, &api.Rejection{
+			Reason:  api.RejectKeyNotProven,
+			Message: fmt.Sprintf("client '%s' did not prove the secret of the ticket", clientId),
+		})
+		return
+	}
+	// The client is registered before the publish connection resumes, so it
+	// finds it
+	client, err := s.brokerService.RegisterClient(clientId, &common.Identity{
+		Provider: r.provider,
+		User:     user,
+	}, common.ClientOptions{
+		Listener:   l.config.Name,
+		Persistent: msg.Properties&api.PersistentSession != 0,
+	})
+	if err != nil {
+		reject(conn, clientId, transportCipher, &api.Rejection{
+			Reason:  api.RejectClientIdInUse,
+			Message: fmt.Sprintf("client '%s' refused: %v", clientId, err),
+		})
+		return
+	}
+	defer s.brokerService.UnregisterClient(client)
+	sessionKeyAck := &api.Message{
+		Type:     api.TypeSessionKeyAck,
+		ClientId: clientId,
+	}
+	if err := sessionKeyAck.Send(conn, transportCipher); err != nil {
+		log.Errorf("Failed to send SESSION_KEY_ACK: %v", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Infof("Resumed session from '%s' for user '%s'", conn.RemoteAddr(), user.Name())
+	go s.closeWhenDone(conn, client, transportCipher)
+	if msg.Properties&api.Multiplex != 0 {
+		s.forward(conn, clientId, client, transportCipher)
+	}
+	s.serve(l, conn, clientId, transportCipher)
+}
+
+func (s *transport) resumePublish(l *listener, conn net.Conn, msg *api.Message) {
+	clientId := msg.ClientId
+	r, err := s.openResume(l, msg)
+	if err != nil {
+		log.Warnf("Session resumption from '%s' rejected: %v", conn.RemoteAddr(), err)
+		s.guardService.AuthFailed(conn)
+		conn.Close()
+		return
+	}
+	client, rejection := s.pair(clientId, r.user, r.request.PairingToken)
+	if rejection != nil {
+		// Nothing of the session is known to the peer yet, the answer is not encrypted
+		reject(conn, clientId, api.NewNoCipher(), rejection)
+		conn.Close()
+		return
+	}
+	transportCipher, err := s.acceptResume(conn, msg, r, &api.TicketGrant{})
+	if err != nil {
+		log.Warnf("Session resumption from '%s' failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.forward(conn, clientId, client, transportCipher)
+}
@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oo-developer/mmq/src/handoff"
+	log "github.com/oo-developer/mmq/src/logging"
+)
+
+const (
+	defaultDrainTimeout   = 10 * time.Second
+	defaultReconnectDelay = time.Second
+	defaultHandoffTimeout = 10 * time.Second
+)
+
+// openConnections tracks the connections the transport still serves, a
+// shutdown waits for them and closes those that outlive the deadline. A
+// connection is held by its handler and by the goroutines serving it.
+type openConnections struct {
+	holders map[net.Conn]int
+	mu      sync.Mutex
+}
+
+func newOpenConnections() *openConnections {
+	return &openConnections{
+		holders: make(map[net.Conn]int),
+	}
+}
+
+// hold counts a holder of conn, the returned func releases it
+func (o *openConnections) hold(conn net.Conn) func() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.holders[conn]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			if o.holders[conn]--; o.holders[conn] == 0 {
+				delete(o.holders, conn)
+			}
+		})
+	}
+}
+
+// wait waits until all connections are released, at the deadline the
+// remaining connections are closed. It reports false when it had to close.
+func (o *openConnections) wait(deadline time.Time) bool {
+	for o.count() > 0 {
+		if time.Now().After(deadline) {
+			o.mu.Lock()
+			for conn := range o.holders {
+				conn.Close()
+			}
+			o.mu.Unlock()
+			for o.count() > 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func (o *openConnections) count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.holders)
+}
+
+// Handoff passes the listening sockets to a new process of the broker and
+// waits until it is ready, the sockets stay open while this process drains
+func (s *transport) Handoff() (func(), error) {
+	sockets := make([]handoff.Socket, 0)
+	for _, l := range s.listeners {
+		sockets = append(sockets, l.sockets...)
+	}
+	successor, err := handoff.Restart(sockets, s.handoffTimeout())
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range s.listeners {
+		l.handedOff = true
+	}
+	log.Infof("Listening sockets handed to process %d", successor.Pid)
+	return successor.Release, nil
+}
+
+// drainTimeout bounds each step of a shutdown
+func (s *transport) drainTimeout() time.Duration {
+	if s.config.Shutdown.DrainTimeoutMillis > 0 {
+		return time.Duration(s.config.Shutdown.DrainTimeoutMillis) * time.Millisecond
+	}
+	return defaultDrainTimeout
+}
+
+// handoffTimeout bounds the start of the new process of a restart
+func (s *transport) handoffTimeout() time.Duration {
+	if s.config.Shutdown.HandoffTimeoutMillis > 0 {
+		return time.Duration(s.config.Shutdown.HandoffTimeoutMillis) * time.Millisecond
+	}
+	return defaultHandoffTimeout
+}
+
+// reconnectDelay is the hint given to the clients disconnected by a shutdown
+func (s *transport) reconnectDelay() time.Duration {
+	if s.config.Shutdown.ReconnectDelayMillis > 0 {
+		return time.Duration(s.config.Shutdown.ReconnectDelayMillis) * time.Millisecond
+	}
+	return defaultReconnectDelay
+}
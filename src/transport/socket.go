@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/oo-developer/mmq/src/config"
+)
+
+// applySocketPermissions sets mode and ownership of a unix socket file. The
+// socket is created with the process umask, so it is accessible with those
+// permissions until this is done.
+func applySocketPermissions(config *config.Listener, address string) error {
+	if config.Network != "unix" {
+		return nil
+	}
+	if config.SocketMode != "" {
+		mode, err := strconv.ParseUint(config.SocketMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket mode '%s': %w", config.SocketMode, err)
+		}
+		if err := os.Chmod(address, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+	if config.SocketOwner == "" && config.SocketGroup == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if config.SocketOwner != "" {
+		id, err := lookupId(config.SocketOwner, func(name string) (string, error) {
+			owner, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return owner.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid socket owner '%s': %w", config.SocketOwner, err)
+		}
+		uid = id
+	}
+	if config.SocketGroup != "" {
+		id, err := lookupId(config.SocketGroup, func(name string) (string, error) {
+			group, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return group.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid socket group '%s': %w", config.SocketGroup, err)
+		}
+		gid = id
+	}
+	return os.Chown(address, uid, gid)
+}
+
+// lookupId accepts a numeric id or a name resolved by lookup
+func lookupId(value string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(value); err == nil {
+		return id, nil
+	}
+	id, err := lookup(value)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
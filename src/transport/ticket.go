@@ -0,0 +1,189 @@
+package transport
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const defaultTicketLifetime = 24 * time.Hour
+
+var (
+	errTicketInvalid = errors.New("session ticket invalid")
+	errTicketExpired = errors.New("session ticket expired")
+	errTicketRevoked = errors.New("session ticket revoked")
+	errTicketUsed    = errors.New("session ticket already used")
+)
+
+// ticketState is the content of a session ticket, it is sealed with the
+// ticket key and only readable by the broker
+type ticketState struct {
+	Id   string `msgpack:"id"`
+	User string `msgpack:"user"`
+	// Provider is the authentication provider of the session the ticket
+	// was issued to
+	Provider  string `msgpack:"provider,omitempty"`
+	Secret    []byte `msgpack:"secret"`
+	KeyHash   []byte `msgpack:"keyHash"`
+	IssuedAt  int64  `msgpack:"issuedAt"`
+	ExpiresAt int64  `msgpack:"expiresAt"`
+}
+
+type tickets struct {
+	enabled  bool
+	lifetime time.Duration
+	key      []byte
+	revoked  map[string]int64
+	// redeemed holds the ids of the tickets that resumed a session until
+	// they expire, a ticket resumes one session only
+	redeemed map[string]int64
+	mu       sync.RWMutex
+}
+
+func newTickets(config *config.Tickets) (*tickets, error) {
+	t := &tickets{
+		enabled:  config.Enabled,
+		lifetime: defaultTicketLifetime,
+		revoked:  make(map[string]int64),
+		redeemed: make(map[string]int64),
+	}
+	if config.LifetimeSeconds > 0 {
+		t.lifetime = time.Duration(config.LifetimeSeconds) * time.Second
+	}
+	if !t.enabled {
+		return t, nil
+	}
+	key, err := loadTicketKey(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	t.key = key
+	now := time.Now().Unix()
+	for _, userName := range config.RevokedUsers {
+		t.revoked[userName] = now
+	}
+	return t, nil
+}
+
+// loadTicketKey reads the ticket key from keyFile, creating it if necessary.
+// Without a key file every broker start invalidates all issued tickets.
+func loadTicketKey(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err == nil {
+			if len(key) != chacha20poly1305.KeySize {
+				return nil, fmt.Errorf("ticket key file '%s' has invalid size %d", keyFile, len(key))
+			}
+			return key, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate ticket key: %w", err)
+	}
+	if keyFile != "" {
+		if err := os.MkdirAll(filepath.Dir(keyFile), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyFile, key, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// issue creates a new ticket for userName authenticated by provider
+func (t *tickets) issue(userName, provider string, keyHash []byte) (*api.TicketGrant, error) {
+	secret := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, fmt.Errorf("failed to generate ticket secret: %w", err)
+	}
+	now := time.Now()
+	state := &ticketState{
+		Id:        uuid.NewString(),
+		User:      userName,
+		Provider:  provider,
+		Secret:    secret,
+		KeyHash:   keyHash,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(t.lifetime).Unix(),
+	}
+	plaintext, err := msgpack.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(t.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return &api.TicketGrant{
+		Ticket:    aead.Seal(nonce, nonce, plaintext, nil),
+		Secret:    secret,
+		ExpiresAt: state.ExpiresAt,
+	}, nil
+}
+
+// open validates a ticket and returns its content
+func (t *tickets) open(ticket []byte) (*ticketState, error) {
+	aead, err := chacha20poly1305.NewX(t.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ticket) < aead.NonceSize() {
+		return nil, errTicketInvalid
+	}
+	plaintext, err := aead.Open(nil, ticket[:aead.NonceSize()], ticket[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errTicketInvalid
+	}
+	state := &ticketState{}
+	if err := msgpack.Unmarshal(plaintext, state); err != nil {
+		return nil, errTicketInvalid
+	}
+	if time.Now().Unix() >= state.ExpiresAt {
+		return nil, errTicketExpired
+	}
+	t.mu.RLock()
+	revokedAt, ok := t.revoked[state.User]
+	t.mu.RUnlock()
+	if ok && state.IssuedAt <= revokedAt {
+		return nil, errTicketRevoked
+	}
+	return state, nil
+}
+
+// redeem marks the ticket of state as used, a ticket that was used before is
+// refused. Expired tickets are forgotten as they are refused by open anyway.
+func (t *tickets) redeem(state *ticketState) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now().Unix()
+	for id, expiresAt := range t.redeemed {
+		if now >= expiresAt {
+			delete(t.redeemed, id)
+		}
+	}
+	if _, ok := t.redeemed[state.Id]; ok {
+		return errTicketUsed
+	}
+	t.redeemed[state.Id] = state.ExpiresAt
+	return nil
+}
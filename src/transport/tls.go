@@ -0,0 +1,40 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/oo-developer/mmq/src/config"
+)
+
+const NETWORK_TLS = "tls"
+
+// newServerTLSConfig requires TLS 1.3 and prefers the hybrid post-quantum key exchange
+func newServerTLSConfig(config *config.Tls) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates:     []tls.Certificate{certificate},
+		MinVersion:       tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{tls.X25519MLKEM768, tls.X25519},
+	}
+	if config.ClientCaFile != "" {
+		caPem, err := os.ReadFile(config.ClientCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in client CA file '%s'", config.ClientCaFile)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
@@ -1,31 +1,49 @@
 package transport
 
 import (
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
+	"time"
 
 	"github.com/oo-developer/mmq/pkg"
 	"github.com/oo-developer/mmq/src/common"
 	"github.com/oo-developer/mmq/src/config"
+	"github.com/oo-developer/mmq/src/gateway"
+	"github.com/oo-developer/mmq/src/handoff"
 	log "github.com/oo-developer/mmq/src/logging"
+	"github.com/oo-developer/mmq/src/mqtt"
+	"github.com/oo-developer/mmq/src/nats"
+	"github.com/oo-developer/mmq/src/resp"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 type transport struct {
-	config          *config.Transport
+	config          *config.Config
 	brokerService   common.BrokerService
 	userService     common.UserService
+	authService     common.AuthService
 	cliService      common.CliService
+	guardService    common.GuardService
 	privateKey      *api.KyberPrivateKey
 	publicKey       *api.KyberPublicKey
 	publicKeyPem    []byte
 	securityEnabled bool
-	listenerCommand net.Listener
-	listenerPublish net.Listener
+	listeners       []*listener
+	tickets         *tickets
+	pairings        *pairings
+	open            *openConnections
+	inherited       *handoff.Inherited
+	mqtt            *mqtt.Server
+	nats            *nats.Server
+	resp            *resp.Server
+	gateway         *gateway.Server
 }
 
-func NewTransportService(config *config.Config, b common.BrokerService, u common.UserService, c common.CliService) common.Service {
+func NewTransportService(config *config.Config, inherited *handoff.Inherited, b common.BrokerService, u common.UserService, a common.AuthService, c common.CliService, g common.GuardService) common.TransportService {
 
 	privateKey, err := api.LoadKyberPrivateKeyFile(config.Crypto.PrivateKeyFile)
 	if err != nil {
@@ -39,73 +57,78 @@ func NewTransportService(config *config.Config, b common.BrokerService, u common
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	tickets, err := newTickets(&config.Tickets)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	listeners := make([]*listener, 0)
+	for _, listenerConfig := range config.AllListeners() {
+		l, err := newListener(&listenerConfig, g)
+		if err != nil {
+			log.Fatalf("listener '%s': %v", listenerConfig.Name, err)
+		}
+		listeners = append(listeners, l)
+	}
 	return &transport{
-		config:          &config.Transport,
+		config:          config,
 		brokerService:   b,
 		userService:     u,
+		authService:     a,
 		cliService:      c,
+		guardService:    g,
 		privateKey:      privateKey,
 		publicKey:       publicKey,
 		publicKeyPem:    publicKeyPem,
 		securityEnabled: false,
+		listeners:       listeners,
+		tickets:         tickets,
+		pairings:        newPairings(),
+		open:            newOpenConnections(),
+		inherited:       inherited,
+		mqtt:            mqtt.NewServer(b, a, g.HandshakeTimeout()),
+		nats:            nats.NewServer(b, a, g.HandshakeTimeout()),
+		resp:            resp.NewServer(b, a, g.HandshakeTimeout()),
+		gateway:         gateway.NewServer(b, a),
 	}
 }
 
 func (s *transport) Start() {
-	var err error
-
-	os.Remove(s.config.AddressCommand)
-	os.Remove(s.config.AddressPublish)
-
-	s.listenerCommand, err = net.Listen(s.config.Network, s.config.AddressCommand)
-	if err != nil {
-		log.Fatal("failed to create listenerCommand: %w", err)
-	}
-	log.Infof("transport listening on %s", s.listenerCommand.Addr())
-	s.listenerPublish, err = net.Listen(s.config.Network, s.config.AddressPublish)
-	if err != nil {
-		log.Fatalf("failed to create publish listenerCommand: %v", err)
-	}
-	log.Infof("transport listening on publish %s", s.listenerPublish.Addr())
-	go func() {
-		for {
-			conn, err := s.listenerCommand.Accept()
-			if errors.Is(err, net.ErrClosed) {
-				log.Infof("Connection closed!")
-				break
-			}
-			go s.handleConnectionCommand(conn)
+	for _, l := range s.listeners {
+		if err := l.start(s); err != nil {
+			log.Fatalf("failed to start listener '%s': %v", l.config.Name, err)
 		}
-	}()
-	go func() {
-		for {
-			connChannel, err := s.listenerPublish.Accept()
-			if err != nil {
-				log.Infof("Accept error: %v", err)
-				continue
-			}
-			go s.handleConnectionPublish(connChannel)
-		}
-	}()
-	log.Info("Transport started")
-}
-
-func (s *transport) cleanupUnixSocket() {
-	if s.config.Network == "unix" {
-		_ = os.Remove(s.config.AddressCommand)
-		_ = os.Remove(s.config.AddressPublish)
 	}
+	// Sockets of listeners removed from the configuration
+	s.inherited.Close()
+	log.Info("Transport started")
 }
 
+// Shutdown stops accepting connections, lets the broker drain the queues of
+// the clients and disconnects them with a reconnect hint
 func (s *transport) Shutdown() {
-	s.listenerCommand.Close()
-	s.cleanupUnixSocket()
+	for _, l := range s.listeners {
+		l.stopAccepting()
+	}
+	if !s.brokerService.Drain(time.Now().Add(s.drainTimeout())) {
+		log.Warnf("Client queues not drained within %v", s.drainTimeout())
+	}
+	s.brokerService.DisconnectAll(common.DISCONNECT_SHUTDOWN)
+	deadline := time.Now().Add(s.drainTimeout())
+	if !s.open.wait(deadline) {
+		log.Warnf("Connections still open after %v were closed", s.drainTimeout())
+	}
+	for _, l := range s.listeners {
+		l.close(deadline)
+	}
+	// Publish connections accepted while the clients were disconnected
+	s.open.wait(deadline)
 	log.Infof("Transport shut down")
 }
 
-func (s *transport) handleConnectionCommand(conn net.Conn) {
+func (s *transport) handleConnectionCommand(l *listener, conn net.Conn) {
 	defer conn.Close()
-	log.Infof("New connection from '%s'", conn.RemoteAddr().String())
+	log.Infof("New connection from '%s' on listener '%s'", conn.RemoteAddr().String(), l.config.Name)
+	conn.SetDeadline(time.Now().Add(s.guardService.HandshakeTimeout()))
 
 	// CONNECT
 	noCipher := api.NewNoCipher()
@@ -114,15 +137,28 @@ func (s *transport) handleConnectionCommand(conn net.Conn) {
 		log.Errorf("Error receiving CONNECT: %v", err)
 		return
 	}
+	if msg.Type == api.TypeResume {
+		s.resumeCommand(l, conn, msg)
+		return
+	}
 	if msg.Type != api.TypeConnect {
 		log.Errorf("Error receiving CONNECT (%d): %v", msg.Type, msg)
 		return
 	}
+	// In multiplex mode the published messages share the command connection
+	multiplex := msg.Properties&api.Multiplex != 0
+	persistent := msg.Properties&api.PersistentSession != 0
 	connectAckMsg := &api.Message{
 		Type:     api.TypeConnectAck,
 		Payload:  s.publicKeyPem,
 		ClientId: msg.ClientId,
 	}
+	if l.secureChannel {
+		connectAckMsg.Properties |= api.SecureChannel
+	}
+	if multiplex {
+		connectAckMsg.Properties |= api.Multiplex
+	}
 	err = connectAckMsg.Send(conn, noCipher)
 	if err != nil {
 		log.Errorf("Error sending CONNECT_ACK: %v", err)
@@ -132,37 +168,50 @@ func (s *transport) handleConnectionCommand(conn net.Conn) {
 	handshakeCipher := api.NewKyberCipher(s.privateKey, nil)
 	msg, err = api.Receive(conn, handshakeCipher)
 	if err != nil {
-		log.Errorf("Failed to decode AUZTHENTICATE message: %v", err)
+		log.Errorf("Failed to decode AUTHENTICATE message: %v", err)
+		s.guardService.AuthFailed(conn)
 		return
 	}
 	if msg.Type != api.TypeAuthenticate {
 		log.Errorf("Expected AUTHENTICATE, got %v", msg.Type)
 		return
 	}
-	userName := string(msg.Payload)
-	user, ok := s.userService.LookupUserByName(userName)
-	if !ok {
-		log.Warnf("User %s not found", userName)
+	identity, _, err := s.authenticate(l, conn, msg, true)
+	if err != nil {
+		log.Warnf("Authentication from '%s' failed: %v", conn.RemoteAddr(), err)
 		return
 	}
-	log.Infof("New connection from '%s' for user '%s'", conn.RemoteAddr(), user.Name())
+	user := identity.User
+	log.Infof("New connection from '%s' for user '%s' (%s)", conn.RemoteAddr(), user.Name(), identity.Provider)
 	clientId := msg.ClientId
-
-	s.brokerService.RegisterClient(clientId, user)
-	defer s.brokerService.UnregisterClient(clientId)
 	handshakeCipher = api.NewKyberCipher(s.privateKey, user.PublicKey())
 
+	pairingToken, err := s.pairings.issue(clientId)
+	if err != nil {
+		log.Errorf("Failed to pair client '%s': %v", clientId, err)
+		return
+	}
+	defer s.pairings.release(pairingToken)
+	grant, err := msgpack.Marshal(&api.AuthenticateGrant{
+		PublishAddress: l.config.AddressPublish,
+		PairingToken:   pairingToken,
+	})
+	if err != nil {
+		log.Errorf("Failed to encode AUTHENTICATE_ACK: %v", err)
+		return
+	}
 	authAck := &api.Message{
 		Type:     api.TypeAuthenticateAck,
 		ClientId: clientId,
-		Payload:  []byte(s.config.AddressPublish),
+		Payload:  grant,
 	}
 	if err := authAck.Send(conn, handshakeCipher); err != nil {
 		log.Errorf("Failed to send AUTHENTICATE_ACK: %v", err)
 		return
 	}
 
-	// SESSION KEY
+	// SESSION KEY, the pairing token proves the client could read the
+	// AUTHENTICATE_ACK with the key of the user
 	msg, err = api.Receive(conn, handshakeCipher)
 	if err != nil {
 		log.Errorf("Failed to receive SESSION_KEY: %v", err)
@@ -172,55 +221,210 @@ func (s *transport) handleConnectionCommand(conn net.Conn) {
 		log.Errorf("Error receiving SESSION_KEY (%d): %v", msg.Type, msg)
 		return
 	}
-	transportCipher, err := api.RecoverCHaCha20Cipher(s.privateKey, msg.Payload)
+	sessionKey := &api.SessionKey{}
+	if err := msgpack.Unmarshal(msg.Payload, sessionKey); err != nil || subtle.ConstantTimeCompare([]byte(sessionKey.PairingToken), []byte(pairingToken)) != 1 {
+		s.guardService.AuthFailed(conn)
+		reject(conn, clientId, handshakeCipher, &api.Rejection{
+			Reason:  api.RejectKeyNotProven,
+			Message: fmt.Sprintf("client '%s' did not prove the key of user '%s'", clientId, user.Name()),
+		})
+		return
+	}
+	var transportCipher api.Cipher = api.NewNoCipher()
+	if !l.secureChannel {
+		transportCipher, err = api.RecoverCHaCha20Cipher(s.privateKey, sessionKey.KemCipherText)
+		if err != nil {
+			log.Errorf("Error recovering CHA-20-CIPHER: %v", err)
+			return
+		}
+		transportCipher.Enable(true)
+	}
+	client, err := s.brokerService.RegisterClient(clientId, identity, common.ClientOptions{
+		Listener:   l.config.Name,
+		Persistent: persistent,
+	})
 	if err != nil {
-		log.Errorf("Error recovering CHA-20-CIPHER: %v", err)
+		reject(conn, clientId, handshakeCipher, &api.Rejection{
+			Reason:  api.RejectClientIdInUse,
+			Message: fmt.Sprintf("client '%s' refused: %v", clientId, err),
+		})
 		return
 	}
-	transportCipher.Enable(true)
+	defer s.brokerService.UnregisterClient(client)
 	sessionKeyAck := &api.Message{
 		Type:     api.TypeSessionKeyAck,
 		ClientId: clientId,
 	}
+	if s.tickets.enabled && !l.secureChannel && s.resumable(user) {
+		sessionKeyAck.Payload, err = s.issueTicket(identity)
+		if err != nil {
+			log.Errorf("Failed to issue session ticket: %v", err)
+			return
+		}
+	}
 	err = sessionKeyAck.Send(conn, handshakeCipher)
 	if err != nil {
 		log.Errorf("Failed to send SESSION_KEY_ACK: %v", err)
 		return
 	}
 
+	conn.SetDeadline(time.Time{})
+	go s.closeWhenDone(conn, client, transportCipher)
+	if multiplex {
+		s.forward(conn, clientId, client, transportCipher)
+	}
+	s.serve(l, conn, clientId, transportCipher)
+}
+
+func (s *transport) serve(l *listener, conn net.Conn, clientId string, transportCipher api.Cipher) {
 	for {
 		msg, err := api.Receive(conn, transportCipher)
-		if errors.Is(err, io.EOF) {
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 			return
 		}
 		if err != nil {
 			log.Errorf("Client %s receive error: %v", clientId, err)
 			continue
 		}
-		if !s.handleMessage(clientId, conn, transportCipher, msg) {
+		if !s.handleMessage(l, clientId, conn, transportCipher, msg) {
 			break
 		}
 	}
 	log.Infof("Client %s disconnected", clientId)
 }
 
-func (s *transport) handleMessage(clientId string, conn net.Conn, cipher api.Cipher, msg *api.Message) bool {
+// authenticate resolves the identity of an AUTHENTICATE payload, the
+// publish connection joins the session of its command connection
+func (s *transport) authenticate(l *listener, conn net.Conn, msg *api.Message, newSession bool) (*common.Identity, *api.Credentials, error) {
+	credentials := &api.Credentials{}
+	if err := msgpack.Unmarshal(msg.Payload, credentials); err != nil {
+		// Older clients send the plain user name
+		credentials.User = string(msg.Payload)
+	}
+	identity, err := s.authService.Authenticate(&common.AuthRequest{
+		Conn:        conn,
+		Credentials: credentials,
+		Providers:   l.config.AuthProviders,
+		NewSession:  newSession,
+		ClientId:    msg.ClientId,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// The handshake answers are encrypted to the key of the user
+	if identity.User.PublicKey() == nil {
+		return nil, nil, fmt.Errorf("no public key for user '%s'", identity.User.Name())
+	}
+	return identity, credentials, nil
+}
+
+// pair binds a publish connection of user to the command connection of
+// clientId, the pairing token is redeemed once
+func (s *transport) pair(clientId string, user common.User, pairingToken string) (common.BrokerClient, *api.Rejection) {
+	client := s.brokerService.Client(clientId)
+	if client == nil {
+		return nil, &api.Rejection{
+			Reason:  api.RejectUnknownClient,
+			Message: fmt.Sprintf("client '%s' has no command connection", clientId),
+		}
+	}
+	if client.User().Name() != user.Name() {
+		return nil, &api.Rejection{
+			Reason:  api.RejectUserMismatch,
+			Message: fmt.Sprintf("client '%s' does not belong to user '%s'", clientId, user.Name()),
+		}
+	}
+	if rejection := s.pairings.redeem(clientId, pairingToken); rejection != nil {
+		return nil, rejection
+	}
+	return client, nil
+}
+
+// reject answers a connection that is refused in the handshake
+func reject(conn net.Conn, clientId string, cipher api.Cipher, rejection *api.Rejection) {
+	log.Warnf("Connection from '%s' rejected: %s", conn.RemoteAddr(), rejection.Message)
+	msg, err := api.NewRejectMessage(clientId, rejection)
+	if err != nil {
+		log.Errorf("Failed to encode REJECT: %v", err)
+		return
+	}
+	if err := msg.Send(conn, cipher); err != nil {
+		log.Errorf("Failed to send REJECT: %v", err)
+	}
+}
+
+// resumable reports whether user is registered with the UserService, tickets
+// are resumed against it and other identities do the full handshake
+func (s *transport) resumable(user common.User) bool {
+	registered, ok := s.userService.LookupUserByName(user.Name())
+	return ok && registered == user
+}
+
+// closeWhenDone closes conn as soon as the broker disconnects the client,
+// the client is told the reason with a DISCONNECT
+func (s *transport) closeWhenDone(conn net.Conn, client common.BrokerClient, cipher api.Cipher) {
+	defer s.open.hold(conn)()
+	<-client.Done()
+	if err := s.notifyDisconnect(conn, client, cipher); err != nil {
+		log.Warnf("Failed to send DISCONNECT to client %s: %v", client.Id(), err)
+	}
+	conn.Close()
+}
+
+// notifyDisconnect sends the reason of a disconnect by the broker, clients
+// disconnected by a shutdown get a reconnect hint
+func (s *transport) notifyDisconnect(conn net.Conn, client common.BrokerClient, cipher api.Cipher) error {
+	reason := client.DisconnectReason()
+	if reason == "" {
+		return nil
+	}
+	disconnect := &api.Disconnect{Reason: reason}
+	if reason == common.DISCONNECT_SHUTDOWN {
+		disconnect.ReconnectAfterMillis = s.reconnectDelay().Milliseconds()
+	}
+	msg, err := api.NewDisconnectMessage(client.Id(), disconnect)
+	if err != nil {
+		return err
+	}
+	return msg.Send(conn, cipher)
+}
+
+func (s *transport) handleMessage(l *listener, clientId string, conn net.Conn, cipher api.Cipher, msg *api.Message) bool {
 	switch msg.Type {
 	case api.TypePublish:
-		s.brokerService.Publish(msg.Properties, msg.Topic, msg.Payload, clientId)
 		connAck := &api.Message{
 			Type:     api.TypePublishAck,
 			ClientId: clientId,
 		}
+		if l.topicAllowed(msg.Topic) && l.payloadAllowed(msg.Payload) {
+			// The acknowledgement follows once a persistent message is stored
+			if err := s.brokerService.Publish(msg.Properties, msg.Topic, msg.Payload, clientId); err != nil {
+				connAck.Payload = []byte(err.Error())
+			}
+		} else {
+			log.Warnf("Client %s exceeded the limits of listener '%s' publishing to topic: %s", clientId, l.config.Name, msg.Topic)
+		}
 		if err := connAck.Send(conn, cipher); err != nil {
 			log.Errorf("Failed to send PublishAck message: %v", err)
 			return true
 		}
 	case api.TypeSubscribe:
-		subscriptionId, err := s.brokerService.Subscribe(clientId, msg.Topic)
+		var subscriptionId string
+		var err error
+		var replay func()
+		if !l.topicAllowed(msg.Topic) {
+			err = fmt.Errorf("topic exceeds the limit of listener '%s'", l.config.Name)
+		} else if msg.Properties&api.Stream != 0 {
+			start := api.StreamStart{}
+			if err = msgpack.Unmarshal(msg.Payload, &start); err == nil {
+				subscriptionId, replay, err = s.brokerService.SubscribeStream(clientId, msg.Topic, start)
+			}
+		} else {
+			subscriptionId, err = s.brokerService.Subscribe(clientId, msg.Topic)
+		}
 		if err != nil {
+			// An empty subscription id tells the client the subscription was rejected
 			log.Errorf("Subscribe error for client %s: %v", clientId, err)
-			return true
 		}
 		connAck := &api.Message{
 			Type:           api.TypeSubscribeAck,
@@ -231,6 +435,16 @@ func (s *transport) handleMessage(clientId string, conn net.Conn, cipher api.Cip
 			log.Errorf("Failed to send SubscribeAck message: %v", err)
 			return true
 		}
+		if replay != nil {
+			replay()
+		}
+	case api.TypeMessageAck:
+		// A commit of a consumer group is not answered
+		if msg.Properties&api.Stream != 0 {
+			if err := s.brokerService.Commit(clientId, msg.SubscriptionId, msg.Topic, msg.Offset); err != nil {
+				log.Warnf("Commit of client %s rejected: %v", clientId, err)
+			}
+		}
 	case api.TypeUnsubscribe:
 		if err := s.brokerService.Unsubscribe(clientId, msg.Topic, msg.SubscriptionId); err != nil {
 			log.Errorf("Unsubscribe error for client %s: %v", clientId, err)
@@ -271,8 +485,21 @@ func (s *transport) handleMessage(clientId string, conn net.Conn, cipher api.Cip
 	return true
 }
 
-func (s *transport) handleConnectionPublish(conn net.Conn) {
-	log.Infof("New publish connection from %s", conn.RemoteAddr())
+func (s *transport) handleConnectionPublish(l *listener, conn net.Conn) {
+	log.Infof("New publish connection from %s on listener '%s'", conn.RemoteAddr(), l.config.Name)
+	if s.guardService.Banned(conn) {
+		log.Warnf("Publish connection from '%s' rejected: banned", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	// forward owns the connection once the handshake is done
+	forwarding := false
+	defer func() {
+		if !forwarding {
+			conn.Close()
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(s.guardService.HandshakeTimeout()))
 
 	// CONNECT
 	noCipher := api.NewNoCipher()
@@ -281,6 +508,11 @@ func (s *transport) handleConnectionPublish(conn net.Conn) {
 		log.Errorf("Error receiving CONNECT: %v", err)
 		return
 	}
+	if msg.Type == api.TypeResume {
+		forwarding = true
+		s.resumePublish(l, conn, msg)
+		return
+	}
 	if msg.Type != api.TypeConnect {
 		log.Errorf("Error receiving CONNECT (%d): %v", msg.Type, msg)
 		return
@@ -290,6 +522,9 @@ func (s *transport) handleConnectionPublish(conn net.Conn) {
 		Payload:  s.publicKeyPem,
 		ClientId: msg.ClientId,
 	}
+	if l.secureChannel {
+		connectAckMsg.Properties = api.SecureChannel
+	}
 	err = connectAckMsg.Send(conn, noCipher)
 	if err != nil {
 		log.Errorf("Error sending CONNECT_ACK: %v", err)
@@ -300,38 +535,41 @@ func (s *transport) handleConnectionPublish(conn net.Conn) {
 	msg, err = api.Receive(conn, handshakeCipher)
 	if err != nil {
 		log.Infof("Failed to decode connect message: %v", err)
+		s.guardService.AuthFailed(conn)
 		return
 	}
 	if msg.Type != api.TypeAuthenticate {
 		log.Infof("Expected AUTHENTICATE, got %v", msg.Type)
 		return
 	}
-	userName := string(msg.Payload)
-	user, ok := s.userService.LookupUserByName(userName)
-	if !ok {
-		log.Warnf("User '%s' not found", userName)
+	identity, credentials, err := s.authenticate(l, conn, msg, false)
+	if err != nil {
+		log.Warnf("Authentication from '%s' failed: %v", conn.RemoteAddr(), err)
 		return
 	}
+	user := identity.User
 	log.Infof("New publish connection from '%s' for user '%s'", conn.RemoteAddr().Network(), user.Name())
 	clientID := msg.ClientId
-	if clientID == "" {
-		log.Warnf("Empty client ID")
+	handshakeCipher = api.NewKyberCipher(s.privateKey, user.PublicKey())
+	client, rejection := s.pair(clientID, user, credentials.PairingToken)
+	if rejection != nil {
+		reject(conn, clientID, handshakeCipher, rejection)
 		return
 	}
-	handshakeCipher = api.NewKyberCipher(s.privateKey, user.PublicKey())
 	connAck := &api.Message{
 		Type:     api.TypeAuthenticateAck,
 		ClientId: clientID,
-		Payload:  []byte(s.config.AddressPublish),
+		Payload:  []byte(l.config.AddressPublish),
 	}
 	if err := connAck.Send(conn, handshakeCipher); err != nil {
 		log.Errorf("Failed to send message: %v", err)
 		return
 	}
-
-	client := s.brokerService.Client(clientID)
-	if client == nil {
-		log.Warnf("Broker client '%s' not found", clientID)
+	if l.secureChannel {
+		conn.SetDeadline(time.Time{})
+		forwarding = true
+		s.forward(conn, clientID, client, api.NewNoCipher())
+		return
 	}
 
 	// SESSION KEY
@@ -360,13 +598,25 @@ func (s *transport) handleConnectionPublish(conn net.Conn) {
 		return
 	}
 
+	conn.SetDeadline(time.Time{})
+	forwarding = true
+	s.forward(conn, clientID, client, transportCipher)
+}
+
+func (s *transport) forward(conn net.Conn, clientId string, client common.BrokerClient, transportCipher api.Cipher) {
+	release := s.open.hold(conn)
 	go func() {
+		defer release()
+		defer conn.Close()
 		for msg := range client.MessageChan() {
-			err = msg.Send(conn, transportCipher)
+			err := msg.Send(conn, transportCipher)
 			if err != nil {
 				log.Errorf("Failed publish message: %v", err)
 			}
 		}
+		// An idle client learns the reason on the publish connection, in
+		// multiplex mode the connection is closed already
+		s.notifyDisconnect(conn, client, transportCipher)
 	}()
-	log.Infof("Client '%s' connected to publish", clientID)
+	log.Infof("Client '%s' connected to publish", clientId)
 }
@@ -0,0 +1,156 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/config"
+	log "github.com/oo-developer/mmq/src/logging"
+)
+
+const (
+	NETWORK_WS  = "ws"
+	NETWORK_WSS = "wss"
+)
+
+// webSocketListener serves the HTTP upgrade and hands out the upgraded
+// connections like a net.Listener
+type webSocketListener struct {
+	config      *config.WebSocket
+	protocol    string
+	netListener net.Listener
+	server      *http.Server
+	conns       chan net.Conn
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// listenWebSocket accepts upgrades on netListener, protocol is confirmed as subprotocol
+func listenWebSocket(netListener net.Listener, tlsConfig *tls.Config, config *config.WebSocket, protocol string) net.Listener {
+	if tlsConfig != nil {
+		netListener = tls.NewListener(netListener, tlsConfig)
+	}
+	w := &webSocketListener{
+		config:      config,
+		protocol:    protocol,
+		netListener: netListener,
+		conns:       make(chan net.Conn),
+		done:        make(chan struct{}),
+	}
+	w.server = &http.Server{
+		Handler:           w,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go w.server.Serve(netListener)
+	return w
+}
+
+func (w *webSocketListener) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	path := w.config.Path
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(request.URL.Path, path) {
+		http.NotFound(writer, request)
+		return
+	}
+	if request.Method != http.MethodGet ||
+		!headerContains(request.Header, "Connection", "upgrade") ||
+		!headerContains(request.Header, "Upgrade", "websocket") ||
+		request.Header.Get("Sec-Websocket-Version") != "13" {
+		http.Error(writer, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	key := request.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(writer, "missing websocket key", http.StatusBadRequest)
+		return
+	}
+	if !w.originAllowed(request) {
+		log.Warnf("WebSocket upgrade from '%s' rejected: origin '%s' not allowed", request.RemoteAddr, request.Header.Get("Origin"))
+		http.Error(writer, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		http.Error(writer, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("WebSocket hijack failed: %v", err)
+		return
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + api.WebSocketAccept(key) + "\r\n"
+	if headerContains(request.Header, "Sec-Websocket-Protocol", w.protocol) {
+		response += "Sec-WebSocket-Protocol: " + w.protocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(response + "\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case w.conns <- api.NewWebSocketConn(conn, buffer.Reader, false):
+	case <-w.done:
+		conn.Close()
+	}
+}
+
+// originAllowed accepts requests without origin, which do not come from a
+// browser, and origins of the same host unless a list of origins is configured
+func (w *webSocketListener) originAllowed(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(w.config.AllowedOrigins) > 0 {
+		return slices.Contains(w.config.AllowedOrigins, "*") || slices.Contains(w.config.AllowedOrigins, origin)
+	}
+	originUrl, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(originUrl.Host, request.Host)
+}
+
+func (w *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-w.conns:
+		return conn, nil
+	case <-w.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (w *webSocketListener) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+	return w.server.Close()
+}
+
+func (w *webSocketListener) Addr() net.Addr {
+	return w.netListener.Addr()
+}
+
+// headerContains checks a comma separated header for value, ignoring case
+func headerContains(header http.Header, name, value string) bool {
+	for _, entry := range header.Values(name) {
+		for _, token := range strings.Split(entry, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
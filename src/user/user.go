@@ -3,6 +3,8 @@ package user
 import (
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	api "github.com/oo-developer/mmq/pkg"
 	"github.com/oo-developer/mmq/src/common"
@@ -13,6 +15,9 @@ import (
 type user struct {
 	name         string
 	admin        bool
+	disabled     bool
+	expiresAt    time.Time
+	revokedAt    time.Time
 	publicKeyPem string
 	publicKey    api.KyberPublicKey
 }
@@ -29,21 +34,38 @@ func (n *user) IsAdmin() bool {
 	return n.admin
 }
 
+func (n *user) IsDisabled() bool {
+	return n.disabled
+}
+
+func (n *user) ExpiresAt() time.Time {
+	return n.expiresAt
+}
+
+func (n *user) SessionsRevokedAt() time.Time {
+	return n.revokedAt
+}
+
 func (n *user) PublicKey() *api.KyberPublicKey {
 	return &n.publicKey
 }
 
+// users hands out *user values to other services, so entries are never
+// modified in place but replaced by a changed copy
 type users struct {
 	config         *config.Config
 	users          map[string]*user
 	storageService common.StorageService
+	brokerService  common.BrokerService
+	mu             sync.RWMutex
 }
 
-func NewUserService(config *config.Config, storageService common.StorageService) common.UserService {
+func NewUserService(config *config.Config, storageService common.StorageService, brokerService common.BrokerService) common.UserService {
 	u := &users{
 		config:         config,
 		users:          make(map[string]*user),
 		storageService: storageService,
+		brokerService:  brokerService,
 	}
 	return u
 }
@@ -54,11 +76,16 @@ func (u *users) Start() {
 }
 
 func (u *users) load() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	userList := u.storageService.GetAllUsers()
 	for _, entry := range userList {
 		userEntry := &user{
 			name:         entry.Name(),
 			admin:        entry.IsAdmin(),
+			disabled:     entry.IsDisabled(),
+			expiresAt:    entry.ExpiresAt(),
+			revokedAt:    entry.SessionsRevokedAt(),
 			publicKeyPem: entry.PublicKeyPem(),
 		}
 
@@ -77,45 +104,72 @@ func (u *users) Shutdown() {
 }
 
 func (u *users) LookupUserByName(name string) (common.User, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
 	user, ok := u.users[name]
 	return user, ok
 }
 
-func (u *users) AddUser(userName string, admin bool) (string, error) {
+// AddUser registers a user with a key pair generated on the server, the zero
+// expiresAt means the user never expires
+func (u *users) AddUser(userName string, admin bool, expiresAt time.Time) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	if _, ok := u.users[userName]; ok {
 		return "", fmt.Errorf("user '%s' already exists", userName)
 	}
-	publicKey, privateKey, err := api.GenerateKyberKeyPair()
+	publicKeyBytes, privateKeyBytes, publicKey, err := generateKeyPair()
 	if err != nil {
 		return "", err
 	}
-	publicKeyBytes, err := api.EncodeKyberPublicKeyPEM(publicKey)
+	err = os.WriteFile(fmt.Sprintf("%s_private_key.pem", userName), privateKeyBytes, 0600)
 	if err != nil {
 		return "", err
 	}
-	privateKeyBytes, err := api.EncodeKyberPrivateKeyPEM(privateKey)
+	err = u.addUser(userName, admin, expiresAt, string(publicKeyBytes), publicKey)
 	if err != nil {
 		return "", err
 	}
-	err = os.WriteFile(fmt.Sprintf("%s_private_key.pem", userName), privateKeyBytes, 0600)
+	return string(privateKeyBytes), nil
+}
+
+// AddUserWithPublicKey registers a user whose key pair was generated elsewhere,
+// no private key is created on the server
+func (u *users) AddUserWithPublicKey(userName string, admin bool, publicKeyPem string, expiresAt time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.users[userName]; ok {
+		return fmt.Errorf("user '%s' already exists", userName)
+	}
+	publicKey, err := api.LoadKyberPublicKey([]byte(publicKeyPem))
 	if err != nil {
-		return "", err
+		return err
 	}
+	return u.addUser(userName, admin, expiresAt, publicKeyPem, publicKey)
+}
+
+// addUser stores a new user, tickets of a removed user with the same name
+// are revoked
+func (u *users) addUser(userName string, admin bool, expiresAt time.Time, publicKeyPem string, publicKey *api.KyberPublicKey) error {
 	userEntry := &user{
 		name:         userName,
 		admin:        admin,
-		publicKeyPem: string(publicKeyBytes),
+		expiresAt:    expiresAt,
+		revokedAt:    time.Now(),
+		publicKeyPem: publicKeyPem,
 		publicKey:    *publicKey,
 	}
-	err = u.storageService.AddUser(userEntry)
+	err := u.storageService.AddUser(userEntry)
 	if err != nil {
-		return "", err
+		return err
 	}
 	u.users[userName] = userEntry
-	return string(privateKeyBytes), nil
+	return nil
 }
 
 func (u *users) RemoveUserByName(userName string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	if _, ok := u.users[userName]; !ok {
 		return fmt.Errorf("user '%s' does not exists", userName)
 	}
@@ -124,13 +178,100 @@ func (u *users) RemoveUserByName(userName string) error {
 		return err
 	}
 	delete(u.users, userName)
+	u.brokerService.DisconnectUser(userName, "user removed")
+	return nil
+}
+
+// RotateKey replaces the key pair of a user. Without publicKeyPem a new key pair
+// is generated and the private key is returned, it is not written to disk.
+func (u *users) RotateKey(userName string, publicKeyPem string) (string, error) {
+	privateKeyPem := ""
+	var publicKey *api.KyberPublicKey
+	var err error
+	if publicKeyPem == "" {
+		var publicKeyBytes, privateKeyBytes []byte
+		publicKeyBytes, privateKeyBytes, publicKey, err = generateKeyPair()
+		if err != nil {
+			return "", err
+		}
+		publicKeyPem = string(publicKeyBytes)
+		privateKeyPem = string(privateKeyBytes)
+	} else {
+		publicKey, err = api.LoadKyberPublicKey([]byte(publicKeyPem))
+		if err != nil {
+			return "", err
+		}
+	}
+	err = u.update(userName, "key rotated", func(entry *user) {
+		entry.publicKeyPem = publicKeyPem
+		entry.publicKey = *publicKey
+	})
+	if err != nil {
+		return "", err
+	}
+	return privateKeyPem, nil
+}
+
+func (u *users) SetDisabled(userName string, disabled bool) error {
+	reason := "user enabled"
+	if disabled {
+		reason = "user disabled"
+	}
+	return u.update(userName, reason, func(entry *user) {
+		entry.disabled = disabled
+	})
+}
+
+// SetExpiry sets the time the user expires, the zero time means never
+func (u *users) SetExpiry(userName string, expiresAt time.Time) error {
+	return u.update(userName, "user expiry changed", func(entry *user) {
+		entry.expiresAt = expiresAt
+	})
+}
+
+// update stores a changed copy of a user and terminates the user's sessions,
+// including those a session ticket would resume
+func (u *users) update(userName string, reason string, change func(entry *user)) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	current, ok := u.users[userName]
+	if !ok {
+		return fmt.Errorf("user '%s' does not exists", userName)
+	}
+	changed := *current
+	change(&changed)
+	changed.revokedAt = time.Now()
+	err := u.storageService.AddUser(&changed)
+	if err != nil {
+		return err
+	}
+	u.users[userName] = &changed
+	u.brokerService.DisconnectUser(userName, reason)
 	return nil
 }
 
 func (u *users) AllUsers() []common.User {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
 	userList := make([]common.User, 0, len(u.users))
 	for _, user := range u.users {
 		userList = append(userList, user)
 	}
 	return userList
 }
+
+func generateKeyPair() ([]byte, []byte, *api.KyberPublicKey, error) {
+	publicKey, privateKey, err := api.GenerateKyberKeyPair()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	publicKeyBytes, err := api.EncodeKyberPublicKeyPEM(publicKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	privateKeyBytes, err := api.EncodeKyberPrivateKeyPEM(privateKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return publicKeyBytes, privateKeyBytes, publicKey, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	testtools "github.com/oo-developer/mmq/test"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+	WEBHOOK_ADDRESS   = "127.0.0.1:9998"
+)
+
+// startWebhookStub answers the webhook provider, only 'hook' with password 'secret' is allowed
+func startWebhookStub() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		request := struct {
+			User     string `json:"user"`
+			Password string `json:"password"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		response := map[string]interface{}{
+			"allow": request.User == "hook" && request.Password == "secret",
+			"acl":   []string{"hook/#"},
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+	go http.ListenAndServe(WEBHOOK_ADDRESS, mux)
+}
+
+func connect(config *mmq.Config) *mmq.Client {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Printf("Connect of '%s' failed: %v", config.User, err)
+		return nil
+	}
+	log.Printf("Connect of '%s' succeeded", config.User)
+	return client
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	startWebhookStub()
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+
+	// Key
+	if client := connect(clientConfig); client == nil {
+		log.Fatal("key authentication failed")
+	} else {
+		client.Disconnect()
+	}
+
+	// Token
+	token, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "device1",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Acl:       []string{"devices/device1/#"},
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	tokenConfig := &mmq.Config{Network: clientConfig.Network, Address: clientConfig.Address, User: "device1", Token: token}
+	client := connect(tokenConfig)
+	if client == nil {
+		log.Fatal("token authentication failed")
+	}
+	if err := client.Subscribe("devices/device1/status", func(topic string, payload []byte) {}); err != nil {
+		log.Fatalf("subscription within ACL failed: %v", err)
+	}
+	if err := client.Subscribe("devices/device2/status", func(topic string, payload []byte) {}); err == nil {
+		log.Fatal("subscription outside ACL succeeded")
+	}
+	client.Disconnect()
+
+	expired, _ := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "device1",
+		ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+	}, secret)
+	if client := connect(&mmq.Config{Network: clientConfig.Network, Address: clientConfig.Address, Token: expired}); client != nil {
+		log.Fatal("expired token accepted")
+	}
+
+	// Webhook
+	if client := connect(&mmq.Config{Network: clientConfig.Network, Address: clientConfig.Address, User: "hook", Password: "secret"}); client == nil {
+		log.Fatal("webhook authentication failed")
+	} else {
+		client.Disconnect()
+	}
+	if client := connect(&mmq.Config{Network: clientConfig.Network, Address: clientConfig.Address, User: "hook", Password: "wrong"}); client != nil {
+		log.Fatal("webhook accepted a wrong password")
+	}
+	log.Printf("All authentication providers work")
+}
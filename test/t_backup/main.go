@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/oo-developer/mmq/cli/module"
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/application"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/oo-developer/mmq/src/storage"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+	TOPICS            = 10
+	STREAMED          = 20
+)
+
+func start(configuration *config.Config) common.Service {
+	server := application.NewApplication(configuration)
+	go server.Start()
+	time.Sleep(2 * time.Second)
+	return server
+}
+
+func connect(config *mmq.Config) *mmq.Client {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	return client
+}
+
+func publish(client *mmq.Client, topic, payload string, properties ...mmq.MessageProperty) {
+	if err := client.Publish(topic, []byte(payload), properties...); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+}
+
+func copyFile(from, to string) {
+	source, err := os.Open(from)
+	if err != nil {
+		panic(err)
+	}
+	defer source.Close()
+	target, err := os.Create(to)
+	if err != nil {
+		panic(err)
+	}
+	defer target.Close()
+	if _, err := io.Copy(target, source); err != nil {
+		panic(err)
+	}
+}
+
+// restore runs mmq restore for a configuration written to dir
+func restore(configuration *config.Config, dir, from string) {
+	configFile := filepath.Join(dir, "restore_config.json")
+	data, _ := json.Marshal(configuration)
+	if err := os.WriteFile(configFile, data, 0600); err != nil {
+		panic(err)
+	}
+	command := exec.Command("go", "run", "../..", "restore", "--config", configFile, "--from", from)
+	output, err := command.CombinedOutput()
+	if err != nil {
+		log.Fatalf("restore failed: %v\n%s", err, output)
+	}
+	log.Printf("%s", output)
+}
+
+// verify checks the broker holds the state of the backup
+func verify(clientConfig *mmq.Config, prefix, stream string) {
+	client := connect(clientConfig)
+	defer client.Disconnect()
+	var mu sync.Mutex
+	retained := make(map[string]string)
+	if err := client.Subscribe(prefix+"/#", func(topic string, payload []byte) {
+		mu.Lock()
+		retained[topic] = string(payload)
+		mu.Unlock()
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	streamed := make(chan uint64, STREAMED*2)
+	if err := client.SubscribeStream(stream, mmq.FromOffset(0), func(topic string, payload []byte, offset uint64, timestamp time.Time) {
+		streamed <- offset
+	}); err != nil {
+		log.Fatalf("stream subscribe failed: %v", err)
+	}
+	for ii := 0; ii < STREAMED; ii++ {
+		select {
+		case offset := <-streamed:
+			if offset != uint64(ii) {
+				log.Fatalf("expected stream offset %d, got %d", ii, offset)
+			}
+		case <-time.After(5 * time.Second):
+			log.Fatalf("%d of %d stream messages restored", ii, STREAMED)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(retained) != TOPICS {
+		log.Fatalf("%d retained messages restored, expected %d: %v", len(retained), TOPICS, retained)
+	}
+	for topic, payload := range retained {
+		if payload != "before" {
+			log.Fatalf("message of %s changed after the backup restored: %s", topic, payload)
+		}
+	}
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	dir, err := os.MkdirTemp("", "mmq_backup")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The broker works on a copy of the test database, which it replaces
+	configuration := config.Load(*serverConfigFile)
+	brokerDb := filepath.Join(dir, "broker.db")
+	copyFile(configuration.Storage.DbFile, brokerDb)
+	configuration.Storage.DbFile = brokerDb
+	server := start(configuration)
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	run := time.Now().UnixNano()
+	prefix := fmt.Sprintf("test/backup/%d", run)
+	stream := fmt.Sprintf("test/backup/stream/%d", run)
+	publisher := connect(clientConfig)
+	for ii := 0; ii < TOPICS; ii++ {
+		publish(publisher, fmt.Sprintf("%s/%d", prefix, ii), "before", mmq.Persistent, mmq.Retained)
+	}
+	for ii := 0; ii < STREAMED; ii++ {
+		publish(publisher, stream, fmt.Sprintf("message %d", ii))
+	}
+
+	adminToken, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "operator",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Admin:     true,
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	adminConfig := *clientConfig
+	adminConfig.User = ""
+	adminConfig.ClientPrivateKeyFile = ""
+	adminConfig.Token = adminToken
+	admin := connect(&adminConfig)
+	snapshot := filepath.Join(dir, "backup.db")
+	export := filepath.Join(dir, "export.ndjson")
+	if err := module.Modules["storage"].Execute(admin, "backup", "--file", snapshot); err != nil {
+		log.Fatalf("backup failed: %v", err)
+	}
+	if err := module.Modules["storage"].Execute(admin, "export", "--file", export); err != nil {
+		log.Fatalf("export failed: %v", err)
+	}
+	admin.Disconnect()
+
+	// The database of a running broker is not replaced
+	if err := storage.Restore(&configuration.Storage, snapshot); err == nil {
+		log.Fatalf("restored the database of a running broker")
+	}
+	publish(publisher, fmt.Sprintf("%s/0", prefix), "after", mmq.Persistent, mmq.Retained)
+	publish(publisher, fmt.Sprintf("%s/%d", prefix, TOPICS), "after", mmq.Persistent, mmq.Retained)
+	publisher.Disconnect()
+	server.Shutdown()
+
+	// The snapshot replaces the database with the changes after the backup
+	restore(configuration, dir, snapshot)
+	server = start(configuration)
+	verify(clientConfig, prefix, stream)
+
+	// A record a crash left in the write-ahead log does not replay over an
+	// imported export
+	publisher = connect(clientConfig)
+	publish(publisher, fmt.Sprintf("%s/0", prefix), "stale", mmq.Persistent, mmq.Retained)
+	publisher.Disconnect()
+	wal := brokerDb + ".wal"
+	copyFile(wal, wal+".crashed")
+	server.Shutdown()
+	copyFile(wal+".crashed", wal)
+	restore(configuration, dir, export)
+	server = start(configuration)
+	verify(clientConfig, prefix, stream)
+	server.Shutdown()
+
+	// The export seeds a broker with another backend
+	imported := *configuration
+	imported.Storage.Backend = storage.BACKEND_FILE
+	imported.Storage.DbFile = filepath.Join(dir, "imported.db")
+	restore(&imported, dir, export)
+	server = start(&imported)
+	verify(clientConfig, prefix, stream)
+	if err := storage.Restore(&imported.Storage, export); err == nil {
+		log.Fatalf("imported into the storage file of a running broker")
+	}
+	server.Shutdown()
+	log.Printf("Snapshots and exports restore the state of the broker")
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oo-developer/mmq/cli/module"
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/application"
+	"github.com/oo-developer/mmq/src/certificate"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/oo-developer/mmq/src/storage"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+)
+
+func start(configuration *config.Config) common.Service {
+	server := application.NewApplication(configuration)
+	go server.Start()
+	time.Sleep(2 * time.Second)
+	return server
+}
+
+func connect(config *mmq.Config) *mmq.Client {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	return client
+}
+
+// refused reports whether the broker refuses a connection of config
+func refused(config *mmq.Config) bool {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		return true
+	}
+	client.Disconnect()
+	return false
+}
+
+func copyFile(from, to string) {
+	source, err := os.Open(from)
+	if err != nil {
+		panic(err)
+	}
+	defer source.Close()
+	target, err := os.Create(to)
+	if err != nil {
+		panic(err)
+	}
+	defer target.Close()
+	if _, err := io.Copy(target, source); err != nil {
+		panic(err)
+	}
+}
+
+// waitForReason waits until client was disconnected by the broker
+func waitForReason(client *mmq.Client) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for client.DisconnectReason() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return client.DisconnectReason()
+}
+
+// writeCa writes a CA key pair to dir and returns the files of the private
+// and the public key
+func writeCa(dir, name string) (string, string) {
+	publicKey, privateKey, err := mmq.GenerateMLDSAKeyPair()
+	if err != nil {
+		panic(err)
+	}
+	publicKeyPem, _ := mmq.EncodeMLDSAPublicKeyPEM(publicKey)
+	privateKeyPem, _ := mmq.EncodeMLDSAPrivateKeyPEM(privateKey)
+	privateKeyFile := filepath.Join(dir, name+"_private_key.pem")
+	publicKeyFile := filepath.Join(dir, name+"_public_key.pem")
+	if err := os.WriteFile(privateKeyFile, privateKeyPem, 0600); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(publicKeyFile, publicKeyPem, 0644); err != nil {
+		panic(err)
+	}
+	return privateKeyFile, publicKeyFile
+}
+
+// foreignCertificate issues a certificate with a CA the broker does not know
+// and returns the files of the certificate and its private key
+func foreignCertificate(dir, name string) (string, string) {
+	foreign := &config.Config{}
+	foreign.Storage.Backend = storage.BACKEND_MEMORY
+	foreign.Certificates.Enabled = true
+	foreign.Certificates.CaPrivateKeyFile, foreign.Certificates.CaPublicKeyFile = writeCa(dir, "foreign_ca")
+	storageService := storage.NewStorage(foreign)
+	storageService.Start()
+	defer storageService.Shutdown()
+	certService := certificate.NewCertificateService(foreign, storageService, nil)
+	certService.Start()
+	defer certService.Shutdown()
+
+	publicKey, privateKey, err := mmq.GenerateKyberKeyPair()
+	if err != nil {
+		panic(err)
+	}
+	publicKeyPem, _ := mmq.EncodeKyberPublicKeyPEM(publicKey)
+	privateKeyPem, _ := mmq.EncodeKyberPrivateKeyPEM(privateKey)
+	_, certificatePem, err := certService.Issue(name, true, nil, string(publicKeyPem), time.Hour)
+	if err != nil {
+		log.Fatalf("issuing the foreign certificate failed: %v", err)
+	}
+	certFile := filepath.Join(dir, "foreign_cert.pem")
+	keyFile := filepath.Join(dir, "foreign_private_key.pem")
+	if err := os.WriteFile(certFile, []byte(certificatePem), 0644); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(keyFile, privateKeyPem, 0600); err != nil {
+		panic(err)
+	}
+	return certFile, keyFile
+}
+
+func certificates(clientConfig *mmq.Config, secret []byte, command string, args ...string) error {
+	adminToken, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "operator",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Admin:     true,
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	adminConfig := *clientConfig
+	adminConfig.User = ""
+	adminConfig.ClientPrivateKeyFile = ""
+	adminConfig.Token = adminToken
+	admin := connect(&adminConfig)
+	defer admin.Disconnect()
+	return module.Modules["certificates"].Execute(admin, command, args...)
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	dir, err := os.MkdirTemp("", "mmq_certificates")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The broker works on a copy of the test database with a CA of its own
+	configuration := config.Load(*serverConfigFile)
+	brokerDb := filepath.Join(dir, "broker.db")
+	copyFile(configuration.Storage.DbFile, brokerDb)
+	configuration.Storage.DbFile = brokerDb
+	configuration.Certificates.CaPrivateKeyFile, configuration.Certificates.CaPublicKeyFile = writeCa(dir, "ca")
+	configuration.Certificates.Groups = map[string][]string{
+		"sensors": {"test/certificates/sensors/#"},
+	}
+	deviceName := fmt.Sprintf("cert-device-%d", time.Now().UnixNano())
+	foreignCertFile, foreignKeyFile := foreignCertificate(dir, deviceName)
+	server := start(configuration)
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+
+	// A device connects with the certificate issued by the broker
+	certFile := filepath.Join(dir, "device_cert.pem")
+	keyFile := filepath.Join(dir, "device_private_key.pem")
+	if err := certificates(clientConfig, secret, "issue", "--name", deviceName, "--key-file", keyFile, "--cert-file", certFile); err != nil {
+		log.Fatalf("issuing the certificate failed: %v", err)
+	}
+	deviceConfig := *clientConfig
+	deviceConfig.User = deviceName
+	deviceConfig.ClientPrivateKeyFile = keyFile
+	deviceConfig.CertificateFile = certFile
+	device := connect(&deviceConfig)
+	topic := fmt.Sprintf("test/certificates/%d", time.Now().UnixNano())
+	received := make(chan string, 1)
+	if err := device.Subscribe(topic, func(topic string, payload []byte) {
+		received <- string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	if err := device.Publish(topic, []byte("certified")); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		log.Fatalf("message of the certificate user not delivered")
+	}
+
+	// The ACL groups of a certificate restrict its topics, unknown groups are
+	// not signed
+	sensorCertFile := filepath.Join(dir, "sensor_cert.pem")
+	sensorKeyFile := filepath.Join(dir, "sensor_private_key.pem")
+	if err := certificates(clientConfig, secret, "issue", "--name", deviceName+"-sensor", "--groups", "sensors", "--key-file", sensorKeyFile, "--cert-file", sensorCertFile); err != nil {
+		log.Fatalf("issuing the sensor certificate failed: %v", err)
+	}
+	if err := certificates(clientConfig, secret, "issue", "--name", deviceName+"-unknown", "--groups", "unknown", "--key-file", filepath.Join(dir, "unknown_private_key.pem"), "--cert-file", filepath.Join(dir, "unknown_cert.pem")); err == nil {
+		log.Fatalf("certificate with an unknown ACL group issued")
+	}
+	sensorConfig := *clientConfig
+	sensorConfig.User = deviceName + "-sensor"
+	sensorConfig.ClientPrivateKeyFile = sensorKeyFile
+	sensorConfig.CertificateFile = sensorCertFile
+	sensor := connect(&sensorConfig)
+	if err := sensor.Subscribe("test/certificates/sensors/temperature", func(topic string, payload []byte) {}); err != nil {
+		log.Fatalf("topic of the ACL group refused: %v", err)
+	}
+	if err := sensor.Subscribe(topic, func(topic string, payload []byte) {}); err == nil {
+		log.Fatalf("topic outside the ACL group of the certificate allowed")
+	}
+	sensor.Disconnect()
+
+	// A certificate of another CA is refused
+	foreignConfig := deviceConfig
+	foreignConfig.ClientPrivateKeyFile = foreignKeyFile
+	foreignConfig.CertificateFile = foreignCertFile
+	if !refused(&foreignConfig) {
+		log.Fatalf("certificate of a foreign CA accepted")
+	}
+
+	// Revoking the certificate drops the live session and refuses reconnects
+	if err := certificates(clientConfig, secret, "revoke", "--cert-file", certFile); err != nil {
+		log.Fatalf("revoking the certificate failed: %v", err)
+	}
+	if reason := waitForReason(device); reason != "certificate revoked" {
+		log.Fatalf("session of the revoked certificate not dropped: '%s'", reason)
+	}
+	if !refused(&deviceConfig) {
+		log.Fatalf("revoked certificate accepted")
+	}
+	server.Shutdown()
+
+	// The revocation is kept over a restart
+	server = start(configuration)
+	if !refused(&deviceConfig) {
+		log.Fatalf("revoked certificate accepted after a restart")
+	}
+	server.Shutdown()
+	log.Printf("Certificates of the CA authenticate within their ACL groups until they are revoked, foreign ones are refused")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oo-developer/mmq/cli/module"
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/application"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/oo-developer/mmq/src/storage"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+)
+
+func start(configuration *config.Config) common.Service {
+	server := application.NewApplication(configuration)
+	go server.Start()
+	time.Sleep(2 * time.Second)
+	return server
+}
+
+func connect(config *mmq.Config) *mmq.Client {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	return client
+}
+
+func copyFile(from, to string) {
+	source, err := os.Open(from)
+	if err != nil {
+		panic(err)
+	}
+	defer source.Close()
+	target, err := os.Create(to)
+	if err != nil {
+		panic(err)
+	}
+	defer target.Close()
+	if _, err := io.Copy(target, source); err != nil {
+		panic(err)
+	}
+}
+
+// privateKeyFiles lists the private key PEM files below dir
+func privateKeyFiles(dir string) []string {
+	found := make([]string, 0)
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasSuffix(path, "_private_key.pem") {
+			found = append(found, path)
+		}
+		return nil
+	})
+	return found
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	serverDir, err := os.MkdirTemp("", "mmq_device_key_server")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(serverDir)
+	deviceDir, err := os.MkdirTemp("", "mmq_device_key_device")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(deviceDir)
+
+	// The broker works on a copy of the test database
+	configuration := config.Load(*serverConfigFile)
+	brokerDb := filepath.Join(serverDir, "broker.db")
+	copyFile(configuration.Storage.DbFile, brokerDb)
+	configuration.Storage.DbFile = brokerDb
+	workingDir, _ := os.Getwd()
+	before := privateKeyFiles(workingDir)
+	server := start(configuration)
+
+	// The device generates its key pair and keeps the private key
+	deviceName := fmt.Sprintf("device-%d", time.Now().UnixNano())
+	publicKey, privateKey, err := mmq.GenerateKyberKeyPair()
+	if err != nil {
+		panic(err)
+	}
+	publicKeyPem, _ := mmq.EncodeKyberPublicKeyPEM(publicKey)
+	privateKeyPem, _ := mmq.EncodeKyberPrivateKeyPEM(privateKey)
+	publicKeyFile := filepath.Join(deviceDir, "device_public_key.pem")
+	privateKeyFile := filepath.Join(deviceDir, "device_private_key.pem")
+	if err := os.WriteFile(publicKeyFile, publicKeyPem, 0644); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(privateKeyFile, privateKeyPem, 0600); err != nil {
+		panic(err)
+	}
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	adminToken, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "operator",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Admin:     true,
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	adminConfig := *clientConfig
+	adminConfig.User = ""
+	adminConfig.ClientPrivateKeyFile = ""
+	adminConfig.Token = adminToken
+	admin := connect(&adminConfig)
+	if err := module.Modules["users"].Execute(admin, "add", "--name", deviceName, "--public-key", publicKeyFile); err != nil {
+		log.Fatalf("users add failed: %v", err)
+	}
+	// A public key that is no Kyber key is refused
+	if err := module.Modules["users"].Execute(admin, "add", "--name", deviceName+"-invalid", "--public-key", TOKEN_SECRET_FILE); err == nil {
+		log.Fatalf("user with an invalid public key registered")
+	}
+	admin.Disconnect()
+
+	// The device connects with its own private key
+	deviceConfig := *clientConfig
+	deviceConfig.User = deviceName
+	deviceConfig.ClientPrivateKeyFile = privateKeyFile
+	device := connect(&deviceConfig)
+	topic := fmt.Sprintf("test/device/%d", time.Now().UnixNano())
+	received := make(chan string, 1)
+	if err := device.Subscribe(topic, func(topic string, payload []byte) {
+		received <- string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	if err := device.Publish(topic, []byte("device")); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		log.Fatalf("message of the device not delivered")
+	}
+	device.Disconnect()
+	server.Shutdown()
+
+	// No private key was written on the server, it stores the public key only
+	if _, err := os.Stat(deviceName + "_private_key.pem"); !errors.Is(err, os.ErrNotExist) {
+		log.Fatalf("private key of the device written on the server")
+	}
+	if after := privateKeyFiles(workingDir); len(after) != len(before) {
+		log.Fatalf("private keys written on the server: %v", after)
+	}
+	if found := privateKeyFiles(serverDir); len(found) != 0 {
+		log.Fatalf("private keys written on the server: %v", found)
+	}
+	backend, err := storage.OpenBackend(&configuration.Storage)
+	if err != nil {
+		panic(err)
+	}
+	defer backend.Close()
+	backend.View(func(tx storage.Tx) error {
+		stored := make(map[string]any)
+		if err := msgpack.Unmarshal(tx.Bucket(storage.BUCKET_USERS).Get([]byte(deviceName)), &stored); err != nil {
+			log.Fatalf("device user not stored: %v", err)
+		}
+		if stored["publicKeyPem"] != string(publicKeyPem) {
+			log.Fatalf("device user stored with another key: %v", stored)
+		}
+		for field, value := range stored {
+			if text, ok := value.(string); ok && strings.Contains(text, "PRIVATE KEY") {
+				log.Fatalf("device user stored with a private key in '%s'", field)
+			}
+		}
+		return nil
+	})
+	log.Printf("Users register with the public key of their device, the private key stays on the device")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/config"
+	testtools "github.com/oo-developer/mmq/test"
+)
+
+const (
+	PUBLISHERS = 8
+	MESSAGES   = 50
+)
+
+func connect(config *mmq.Config) (*mmq.Client, error) {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	return client, client.Connect()
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	dir, err := os.MkdirTemp("", "mmq_durable")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	binary := filepath.Join(dir, "mmq")
+	build := exec.Command("go", "build", "-o", binary, "../..")
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		log.Fatalf("build failed: %v", err)
+	}
+	broker := exec.Command(binary, "--config", *serverConfigFile)
+	if err := broker.Start(); err != nil {
+		log.Fatalf("failed to start broker: %v", err)
+	}
+	defer broker.Process.Kill()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		client, err := connect(clientConfig)
+		if err == nil {
+			client.Disconnect()
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Fatalf("broker did not start: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Concurrent publishers share the syncs of the write-ahead log, the
+	// stream appends included
+	prefix := fmt.Sprintf("test/durable/%d", time.Now().UnixNano())
+	streamTopic := prefix + "/stream"
+	start := time.Now()
+	var wg sync.WaitGroup
+	for ii := 0; ii < PUBLISHERS; ii++ {
+		wg.Add(1)
+		go func(publisher int) {
+			defer wg.Done()
+			client, err := connect(clientConfig)
+			if err != nil {
+				log.Fatalf("connect failed: %v", err)
+			}
+			for jj := 0; jj < MESSAGES; jj++ {
+				topic := fmt.Sprintf("%s/%d/%d", prefix, publisher, jj)
+				if err := client.Publish(topic, []byte("durable"), mmq.Persistent|mmq.Retained); err != nil {
+					log.Fatalf("publish failed: %v", err)
+				}
+				if err := client.Publish(streamTopic, []byte(topic)); err != nil {
+					log.Fatalf("stream publish failed: %v", err)
+				}
+			}
+		}(ii)
+	}
+	wg.Wait()
+	log.Printf("%d persistent messages and stream appends acknowledged in %v", PUBLISHERS*MESSAGES, time.Since(start))
+
+	// The broker dies before its checkpoint, the log ends with a torn record
+	broker.Process.Kill()
+	broker.Wait()
+	configuration := config.Load(*serverConfigFile)
+	wal, err := os.OpenFile(configuration.Storage.DbFile+".wal", os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatalf("write-ahead log missing: %v", err)
+	}
+	wal.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	wal.Close()
+
+	// The acknowledged messages are recovered
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+	client, err := connect(clientConfig)
+	if err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	defer client.Disconnect()
+	var mu sync.Mutex
+	recovered := make(map[string]bool)
+	if err := client.Subscribe(prefix+"/+/+", func(topic string, payload []byte) {
+		mu.Lock()
+		recovered[topic] = true
+		mu.Unlock()
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	appended := make(map[string]bool)
+	if err := client.SubscribeStream(streamTopic, mmq.FromOffset(0), func(topic string, payload []byte, offset uint64, timestamp time.Time) {
+		mu.Lock()
+		appended[string(payload)] = true
+		mu.Unlock()
+	}); err != nil {
+		log.Fatalf("stream subscribe failed: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		count, appends := len(recovered), len(appended)
+		mu.Unlock()
+		if count == PUBLISHERS*MESSAGES && appends == PUBLISHERS*MESSAGES {
+			log.Printf("Acknowledged persistent messages and stream appends survive a crash")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Fatalf("%d of %d acknowledged messages and %d stream appends recovered", len(recovered), PUBLISHERS*MESSAGES, len(appended))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/application"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+)
+
+// consumed collects the offsets the members of a group handled
+type consumed struct {
+	offsets map[uint64]string
+	mu      sync.Mutex
+}
+
+func (c *consumed) add(member string, offset uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if previous, ok := c.offsets[offset]; ok {
+		log.Fatalf("offset %d consumed by %s and %s", offset, previous, member)
+	}
+	c.offsets[offset] = member
+}
+
+// wait waits until the offsets from first to next are consumed and returns
+// the number of offsets per member
+func (c *consumed) wait(first, next uint64) map[string]int {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		shares := make(map[string]int)
+		for offset := first; offset < next; offset++ {
+			if member, ok := c.offsets[offset]; ok {
+				shares[member]++
+			}
+		}
+		complete := len(c.offsets) == int(next) && sum(shares) == int(next-first)
+		c.mu.Unlock()
+		if complete {
+			return shares
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Fatalf("offsets %d to %d not consumed", first, next)
+	return nil
+}
+
+func sum(shares map[string]int) int {
+	total := 0
+	for _, count := range shares {
+		total += count
+	}
+	return total
+}
+
+func start(configuration *config.Config) common.Service {
+	server := application.NewApplication(configuration)
+	go server.Start()
+	time.Sleep(2 * time.Second)
+	return server
+}
+
+func connect(config *mmq.Config) *mmq.Client {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	return client
+}
+
+// join connects a member of group that records what it handles
+func join(config *mmq.Config, group, topic, name string, c *consumed) *mmq.Client {
+	client := connect(config)
+	if err := client.ConsumeGroup(group, topic, func(topic string, payload []byte, offset uint64, timestamp time.Time) {
+		c.add(name, offset)
+	}); err != nil {
+		log.Fatalf("joining group failed: %v", err)
+	}
+	return client
+}
+
+func publish(client *mmq.Client, topic string, from, to int) {
+	for ii := from; ii < to; ii++ {
+		if err := client.Publish(topic, []byte(fmt.Sprintf("message %d", ii))); err != nil {
+			log.Fatalf("publish failed: %v", err)
+		}
+	}
+}
+
+func listGroups(admin *mmq.Client) []common.GroupResp {
+	request, _ := msgpack.Marshal(common.ListGroupsReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_LIST_GROUPS,
+		},
+	})
+	responseBytes, err := admin.SendCommand(request)
+	if err != nil {
+		panic(err)
+	}
+	response := common.ListGroupsResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+		panic(err)
+	}
+	if response.Error {
+		log.Fatalf("listing groups failed: %s", response.ErrorMessage)
+	}
+	return response.Groups
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	configuration := config.Load(*serverConfigFile)
+	server := start(configuration)
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	// The log and the offsets are kept in the storage, every run uses new names
+	run := time.Now().UnixNano()
+	topic := fmt.Sprintf("test/group/%d", run)
+	group := fmt.Sprintf("workers-%d", run)
+	publisher := connect(clientConfig)
+
+	// Each message goes to one member
+	c := &consumed{offsets: make(map[uint64]string)}
+	first := join(clientConfig, group, topic, "first", c)
+	second := join(clientConfig, group, topic, "second", c)
+	publish(publisher, topic, 0, 100)
+	shares := c.wait(0, 100)
+	if len(shares) != 2 {
+		log.Fatalf("messages were not shared: %v", shares)
+	}
+	log.Printf("Shares of the members: %v", shares)
+
+	// A member that leaves without committing hands its messages to the others
+	stuck := connect(clientConfig)
+	if err := stuck.ConsumeGroup(group, topic, func(topic string, payload []byte, offset uint64, timestamp time.Time) {
+		select {}
+	}); err != nil {
+		log.Fatalf("joining group failed: %v", err)
+	}
+	publish(publisher, topic, 100, 130)
+	time.Sleep(500 * time.Millisecond)
+	stuck.Disconnect()
+	shares = c.wait(100, 130)
+	log.Printf("Shares after the rebalance: %v", shares)
+
+	// The lag counts the messages the group did not commit yet
+	first.Disconnect()
+	second.Disconnect()
+	publish(publisher, topic, 130, 140)
+	time.Sleep(100 * time.Millisecond)
+	adminToken, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "operator",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Admin:     true,
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	adminConfig := *clientConfig
+	adminConfig.User = ""
+	adminConfig.ClientPrivateKeyFile = ""
+	adminConfig.Token = adminToken
+	admin := connect(&adminConfig)
+	var lag *common.GroupStreamResp
+	for _, entry := range listGroups(admin) {
+		if entry.Group == group && len(entry.Streams) == 1 {
+			lag = &entry.Streams[0]
+		}
+	}
+	if lag == nil || lag.Committed != 130 || lag.Next != 140 || lag.Lag != 10 {
+		log.Fatalf("unexpected position of the group %+v", lag)
+	}
+	admin.Disconnect()
+	publisher.Disconnect()
+
+	// The committed offsets survive a restart
+	server.Shutdown()
+	server = start(configuration)
+	defer server.Shutdown()
+	c = &consumed{offsets: make(map[uint64]string)}
+	for offset := uint64(0); offset < 130; offset++ {
+		c.offsets[offset] = "before restart"
+	}
+	third := join(clientConfig, group, topic, "third", c)
+	defer third.Disconnect()
+	c.wait(130, 140)
+	log.Printf("Consumer groups share the messages and keep their offsets")
+}
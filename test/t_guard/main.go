@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	testtools "github.com/oo-developer/mmq/test"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+	COMMAND_ADDRESS   = "127.0.0.1:9956"
+	LOCAL_ADDRESS     = "/tmp/mmq_guard_command.sock"
+)
+
+// closedWithin reports whether the server closes an idle connection within timeout
+func closedWithin(conn net.Conn, timeout time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func dial() net.Conn {
+	conn, err := net.Dial("tcp", COMMAND_ADDRESS)
+	if err != nil {
+		log.Fatalf("dial failed: %v", err)
+	}
+	return conn
+}
+
+func connect(config *mmq.Config) (*mmq.Client, error) {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	return client, client.Connect()
+}
+
+func listBans(admin *mmq.Client) []common.BanResp {
+	request, _ := msgpack.Marshal(common.ListBansReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_LIST_BANS,
+		},
+	})
+	responseBytes, err := admin.SendCommand(request)
+	if err != nil {
+		panic(err)
+	}
+	response := common.ListBansResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+		panic(err)
+	}
+	if response.Error {
+		log.Fatalf("listing bans failed: %s", response.ErrorMessage)
+	}
+	return response.Bans
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+
+	// A client that never sends its CONNECT is dropped after the handshake timeout
+	idle := dial()
+	if !closedWithin(idle, 2*time.Second) {
+		log.Fatal("idle handshake was not closed")
+	}
+	idle.Close()
+
+	// The third connection of an IP is refused right away
+	first, second := dial(), dial()
+	time.Sleep(100 * time.Millisecond)
+	third := dial()
+	if !closedWithin(third, 200*time.Millisecond) {
+		log.Fatal("connection above the per-IP cap was accepted")
+	}
+	first.Close()
+	second.Close()
+	third.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// A user gets one connection
+	native, err := connect(clientConfig)
+	if err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	otherConfig := *clientConfig
+	otherConfig.ClientId = ""
+	if _, err := connect(&otherConfig); err == nil {
+		log.Fatal("connection above the per-user cap was accepted")
+	}
+	// Reconnecting with the client id takes the session over
+	takeover, err := connect(clientConfig)
+	if err != nil {
+		log.Fatalf("takeover at the per-user cap failed: %v", err)
+	}
+	takeover.Disconnect()
+	native.Disconnect()
+	time.Sleep(100 * time.Millisecond)
+
+	// Failed authentications ban the IP once the burst is used up
+	invalidConfig := *clientConfig
+	invalidConfig.User = ""
+	invalidConfig.ClientId = ""
+	invalidConfig.ClientPrivateKeyFile = ""
+	invalidConfig.Token = "invalid.token.value"
+	for ii := 0; ii < 3; ii++ {
+		if _, err := connect(&invalidConfig); err == nil {
+			log.Fatal("invalid token accepted")
+		}
+	}
+	if _, err := connect(clientConfig); err == nil {
+		log.Fatal("banned IP was accepted")
+	}
+
+	// The local socket has no IP and lists the ban
+	adminToken, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "operator",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Admin:     true,
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	adminConfig := invalidConfig
+	adminConfig.Network = "unix"
+	adminConfig.Address = LOCAL_ADDRESS
+	adminConfig.Token = adminToken
+	admin, err := connect(&adminConfig)
+	if err != nil {
+		log.Fatalf("admin connect failed: %v", err)
+	}
+	defer admin.Disconnect()
+	bans := listBans(admin)
+	if len(bans) != 1 || bans[0].Ip != "127.0.0.1" {
+		log.Fatalf("unexpected bans %+v", bans)
+	}
+	request, _ := msgpack.Marshal(common.RemoveBanReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_REMOVE_BAN,
+		},
+		Ip: "127.0.0.1",
+	})
+	responseBytes, err := admin.SendCommand(request)
+	if err != nil {
+		panic(err)
+	}
+	response := common.RemoveBanResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil || response.Error {
+		log.Fatalf("removing the ban failed: %s", response.ErrorMessage)
+	}
+	if len(listBans(admin)) != 0 {
+		log.Fatal("ban still listed")
+	}
+	native, err = connect(clientConfig)
+	if err != nil {
+		log.Fatalf("connect after unban failed: %v", err)
+	}
+	native.Disconnect()
+	log.Printf("Handshake timeouts, connection caps and bans work")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+)
+
+const (
+	TOPIC_HANDOFF = "test/handoff"
+)
+
+// roundTrip connects, subscribes and receives its own message
+func roundTrip(config *mmq.Config) error {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		return err
+	}
+	if err := client.Connect(); err != nil {
+		return err
+	}
+	defer client.Disconnect()
+	received := make(chan struct{}, 1)
+	if err := client.Subscribe(TOPIC_HANDOFF, func(topic string, payload []byte) {
+		received <- struct{}{}
+	}); err != nil {
+		return err
+	}
+	if err := client.Publish(TOPIC_HANDOFF, []byte("handoff")); err != nil {
+		return err
+	}
+	select {
+	case <-received:
+		return nil
+	case <-time.After(5 * time.Second):
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// processOf finds the process running binary other than pid, the new broker
+// is not a child of this program
+func processOf(binary string, pid int) int {
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		candidate, err := strconv.Atoi(entry.Name())
+		if err != nil || candidate == pid {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err == nil && bytes.HasPrefix(cmdline, []byte(binary+"\x00")) {
+			return candidate
+		}
+	}
+	return 0
+}
+
+func running(pid int) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	return err == nil && !bytes.Contains(stat, []byte(") Z "))
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	dir, err := os.MkdirTemp("", "mmq_handoff")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	binary := filepath.Join(dir, "mmq")
+	build := exec.Command("go", "build", "-o", binary, "../..")
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		log.Fatalf("build failed: %v", err)
+	}
+
+	broker := exec.Command(binary, "--config", *serverConfigFile)
+	if err := broker.Start(); err != nil {
+		log.Fatalf("failed to start broker: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		broker.Wait()
+		close(exited)
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for roundTrip(clientConfig) != nil {
+		if time.Now().After(deadline) {
+			broker.Process.Kill()
+			log.Fatal("broker did not start")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	client, err := mmq.NewClient(clientConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+
+	// Clients keep connecting while the broker restarts
+	var attempts, failures atomic.Int32
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			attempts.Add(1)
+			err := roundTrip(clientConfig)
+			// A client connected to the previous broker is told to reconnect
+			var disconnectErr *mmq.DisconnectError
+			if errors.As(err, &disconnectErr) && disconnectErr.Reason == common.DISCONNECT_SHUTDOWN {
+				time.Sleep(disconnectErr.ReconnectAfter)
+				continue
+			}
+			if err != nil {
+				log.Printf("Round trip during the restart failed: %v", err)
+				failures.Add(1)
+			}
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+	if err := broker.Process.Signal(syscall.SIGUSR2); err != nil {
+		log.Fatalf("failed to signal the broker: %v", err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(20 * time.Second):
+		broker.Process.Kill()
+		log.Fatal("previous broker did not exit")
+	}
+	successor := processOf(binary, broker.Process.Pid)
+	if successor == 0 {
+		log.Fatal("no broker running after the restart")
+	}
+	defer func() {
+		if running(successor) {
+			syscall.Kill(successor, syscall.SIGKILL)
+		}
+	}()
+	if reason := client.DisconnectReason(); reason != common.DISCONNECT_SHUTDOWN {
+		log.Fatalf("client of the previous broker was disconnected with '%s'", reason)
+	}
+	time.Sleep(client.ReconnectAfter())
+	if err := client.Connect(); err != nil {
+		log.Fatalf("reconnect failed: %v", err)
+	}
+	client.Disconnect()
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if failures.Load() > 0 || attempts.Load() < 2 {
+		log.Fatalf("%d of %d round trips failed during the restart", failures.Load(), attempts.Load())
+	}
+	log.Printf("%d round trips during the restart to process %d", attempts.Load(), successor)
+
+	// The new broker shuts down on SIGTERM and removes its sockets
+	syscall.Kill(successor, syscall.SIGTERM)
+	deadline = time.Now().Add(10 * time.Second)
+	for running(successor) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if running(successor) {
+		log.Fatal("new broker did not shut down on SIGTERM")
+	}
+	if _, err := os.Stat(clientConfig.Address); !os.IsNotExist(err) {
+		log.Fatalf("socket %s left behind", clientConfig.Address)
+	}
+	log.Printf("Listening sockets are handed to the new broker without a gap")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	testtools "github.com/oo-developer/mmq/test"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+	GATEWAY_URL       = "http://127.0.0.1:8086"
+	TOPIC_VALUE       = "test/http/value"
+)
+
+func request(method, path, token, body string) (int, string) {
+	req, err := http.NewRequest(method, GATEWAY_URL+path, strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	native, err := mmq.NewClient(clientConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := native.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	defer native.Disconnect()
+	received := make(chan string, 10)
+	if err := native.Subscribe("test/http/#", func(topic string, payload []byte) {
+		received <- string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+
+	token, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "script",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Acl:       []string{"test/http/#"},
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	if status, _ := request(http.MethodGet, "/topics", "", ""); status != http.StatusUnauthorized {
+		log.Fatalf("request without token answered with %d", status)
+	}
+	if status, _ := request(http.MethodGet, "/topics", "invalid", ""); status != http.StatusUnauthorized {
+		log.Fatalf("request with invalid token answered with %d", status)
+	}
+
+	if status, body := request(http.MethodPost, "/topics/"+TOPIC_VALUE+"?retained=true", token, "42"); status != http.StatusNoContent {
+		log.Fatalf("publish answered with %d: %s", status, body)
+	}
+	defer request(http.MethodPost, "/topics/"+TOPIC_VALUE+"?retained=true", token, "")
+	select {
+	case payload := <-received:
+		if payload != "42" {
+			log.Fatalf("native client received '%s'", payload)
+		}
+	case <-time.After(5 * time.Second):
+		log.Fatal("native client did not receive the published message")
+	}
+	if status, body := request(http.MethodGet, "/topics/"+TOPIC_VALUE, token, ""); status != http.StatusOK || body != "42" {
+		log.Fatalf("retained value answered with %d: %s", status, body)
+	}
+	if status, _ := request(http.MethodGet, "/topics/test/http/missing", token, ""); status != http.StatusNotFound {
+		log.Fatalf("missing retained value answered with %d", status)
+	}
+	if status, _ := request(http.MethodPost, "/topics/other/value", token, "1"); status != http.StatusForbidden {
+		log.Fatalf("publish outside the ACL answered with %d", status)
+	}
+
+	status, body := request(http.MethodGet, "/topics", token, "")
+	topics := make([]struct {
+		Topic    string `json:"topic"`
+		Retained bool   `json:"retained"`
+	}, 0)
+	if err := json.Unmarshal([]byte(body), &topics); status != http.StatusOK || err != nil {
+		log.Fatalf("topic list answered with %d: %s", status, body)
+	}
+	found := false
+	for _, topic := range topics {
+		if !strings.HasPrefix(topic.Topic, "test/http/") {
+			log.Fatalf("topic '%s' outside the ACL listed", topic.Topic)
+		}
+		found = found || (topic.Topic == TOPIC_VALUE && topic.Retained)
+	}
+	if !found {
+		log.Fatalf("topic '%s' not listed", TOPIC_VALUE)
+	}
+	log.Printf("HTTP gateway publishes and reads retained values")
+}
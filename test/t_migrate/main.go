@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/oo-developer/mmq/src/storage"
+	testtools "github.com/oo-developer/mmq/test"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// legacyUser is a user as brokers before the schema version stored it, by the
+// names of the Go fields
+type legacyUser struct {
+	NameValue         string
+	AdminValue        bool
+	DisabledValue     bool
+	ExpiresAtValue    int64
+	PublicKeyPemValue string
+}
+
+// writeFixture writes a database of schema version 0 with the users and the
+// retained message of topic, it has the buckets of such brokers and no meta
+// bucket
+func writeFixture(storageConfig *config.Storage, users []*legacyUser, topic string) {
+	backend, err := storage.OpenBackend(storageConfig)
+	if err != nil {
+		panic(err)
+	}
+	defer backend.Close()
+	err = backend.Update(func(tx storage.Tx) error {
+		bucket, err := tx.CreateBucket(storage.BUCKET_USERS)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			value, _ := msgpack.Marshal(user)
+			if err := bucket.Put([]byte(user.NameValue), value); err != nil {
+				return err
+			}
+		}
+		bucket, err = tx.CreateBucket(storage.BUCKET_MESSAGES)
+		if err != nil {
+			return err
+		}
+		value, _ := msgpack.Marshal(&mmq.Message{
+			Type:       mmq.TypeMessage,
+			Properties: mmq.Persistent | mmq.Retained,
+			Topic:      topic,
+			Payload:    []byte("legacy"),
+		})
+		return bucket.Put([]byte(topic), value)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// userKey writes a key pair for a user to dir and returns the public key PEM
+// and the file of the private key
+func userKey(dir, name string) (string, string) {
+	publicKey, privateKey, err := mmq.GenerateKyberKeyPair()
+	if err != nil {
+		panic(err)
+	}
+	publicKeyPem, _ := mmq.EncodeKyberPublicKeyPEM(publicKey)
+	privateKeyPem, _ := mmq.EncodeKyberPrivateKeyPEM(privateKey)
+	privateKeyFile := filepath.Join(dir, name+"_private_key.pem")
+	if err := os.WriteFile(privateKeyFile, privateKeyPem, 0600); err != nil {
+		panic(err)
+	}
+	return string(publicKeyPem), privateKeyFile
+}
+
+func checksum(fileName string) [32]byte {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		panic(err)
+	}
+	return sha256.Sum256(data)
+}
+
+// broker runs the broker binary with args and returns its output
+func broker(args ...string) (string, error) {
+	command := exec.Command("go", append([]string{"run", "../.."}, args...)...)
+	output, err := command.CombinedOutput()
+	return string(output), err
+}
+
+// migrate runs mmq migrate and checks its output
+func migrate(configFile, expected string, args ...string) {
+	output, err := broker(append([]string{"migrate", "--config", configFile}, args...)...)
+	if err != nil {
+		log.Fatalf("migrate %v failed: %v\n%s", args, err, output)
+	}
+	if !strings.Contains(output, expected) {
+		log.Fatalf("migrate %v did not report '%s':\n%s", args, expected, output)
+	}
+	log.Printf("migrate %v:\n%s", args, output)
+}
+
+// named counts the values of bucket and checks they are stored with the
+// field that holds their key
+func named(dbFile, bucket, field string) int {
+	backend, err := storage.OpenBackend(&config.Storage{DbFile: dbFile})
+	if err != nil {
+		log.Fatalf("opening %s failed: %v", dbFile, err)
+	}
+	defer backend.Close()
+	count := 0
+	backend.View(func(tx storage.Tx) error {
+		return tx.Bucket(bucket).ForEach(nil, func(key, value []byte) error {
+			fields := make(map[string]any)
+			if err := msgpack.Unmarshal(value, &fields); err != nil {
+				log.Fatalf("%s '%s' unreadable: %v", bucket, key, err)
+			}
+			if fields[field] != string(key) {
+				log.Fatalf("%s '%s' stored without field '%s': %v", bucket, key, field, fields)
+			}
+			count++
+			return nil
+		})
+	})
+	return count
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	dir, err := os.MkdirTemp("", "mmq_migrate")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The broker gets a database as brokers before the schema version wrote it
+	configuration := config.Load(*serverConfigFile)
+	dbFile := filepath.Join(dir, "broker.db")
+	configuration.Storage.DbFile = dbFile
+	configFile := filepath.Join(dir, "server_config.json")
+	data, _ := json.Marshal(configuration)
+	if err := os.WriteFile(configFile, data, 0600); err != nil {
+		panic(err)
+	}
+	publicKeyPem, privateKeyFile := userKey(dir, "legacy")
+	legacyTopic := fmt.Sprintf("test/migrate/legacy/%d", time.Now().UnixNano())
+	writeFixture(&configuration.Storage, []*legacyUser{
+		{NameValue: "legacy", PublicKeyPemValue: publicKeyPem},
+		{NameValue: "legacy-admin", AdminValue: true, ExpiresAtValue: time.Now().Add(time.Hour).Unix(), PublicKeyPemValue: publicKeyPem},
+	}, legacyTopic)
+
+	// A dry run leaves the database as it is
+	before := checksum(dbFile)
+	migrate(configFile, fmt.Sprintf("can be migrated from schema version 0 to %d", storage.SCHEMA_VERSION), "--dry-run")
+	if checksum(dbFile) != before {
+		log.Fatalf("dry run changed the database")
+	}
+
+	migrate(configFile, fmt.Sprintf("Migrated %s from schema version 0 to %d", dbFile, storage.SCHEMA_VERSION), "--backup-first")
+	if checksum(dbFile+".v0.bak") == checksum(dbFile) {
+		log.Fatalf("backup is not the database before the migration")
+	}
+	users := named(dbFile, storage.BUCKET_USERS, "name")
+	messages := named(dbFile, storage.BUCKET_MESSAGES, "topic")
+	if users != 2 || messages != 1 {
+		log.Fatalf("%d users and %d messages migrated", users, messages)
+	}
+	migrate(configFile, fmt.Sprintf("is at schema version %d", storage.SCHEMA_VERSION))
+
+	// The migrated users and messages are used by the broker
+	server := testtools.StartServer(configFile)
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	clientConfig.User = "legacy"
+	clientConfig.ClientPrivateKeyFile = privateKeyFile
+	client, err := mmq.NewClient(clientConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("migrated user cannot connect: %v", err)
+	}
+	received := make(chan string, 1)
+	if err := client.Subscribe(legacyTopic, func(topic string, payload []byte) {
+		received <- string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	select {
+	case payload := <-received:
+		if payload != "legacy" {
+			log.Fatalf("migrated message changed: %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		log.Fatalf("migrated message not retained")
+	}
+	topic := fmt.Sprintf("test/migrate/%d", time.Now().UnixNano())
+	if err := client.Publish(topic, []byte("migrated"), mmq.Persistent, mmq.Retained); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	client.Disconnect()
+	server.Shutdown()
+	if named(dbFile, storage.BUCKET_MESSAGES, "topic") != messages+1 {
+		log.Fatalf("message of the migrated broker not stored")
+	}
+
+	// A database of a newer broker is not opened
+	backend, err := storage.OpenBackend(&configuration.Storage)
+	if err != nil {
+		panic(err)
+	}
+	backend.Update(func(tx storage.Tx) error {
+		value, _ := msgpack.Marshal(storage.SCHEMA_VERSION + 1)
+		return tx.Bucket(storage.BUCKET_META).Put([]byte("schemaVersion"), value)
+	})
+	backend.Close()
+	if output, err := broker("migrate", "--config", configFile); err == nil || !strings.Contains(output, "newer") {
+		log.Fatalf("migrated a newer database: %s", output)
+	}
+	if output, err := broker("--config", configFile); err == nil || !strings.Contains(output, "newer") {
+		log.Fatalf("broker opened a newer database: %s", output)
+	}
+	log.Printf("Databases are migrated to schema version %d and newer ones are refused", storage.SCHEMA_VERSION)
+}
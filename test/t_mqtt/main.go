@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	testtools "github.com/oo-developer/mmq/test"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+	MQTT_ADDRESS      = "127.0.0.1:1883"
+	TOPIC_RETAINED    = "test/mqtt/retained"
+	TOPIC_NATIVE      = "test/mqtt/native"
+	TOPIC_DEVICE      = "test/mqtt/device"
+	TOPIC_WILL        = "test/mqtt/will"
+	TOPIC_QOS2        = "test/mqtt/qos2/flood"
+)
+
+// mqttClient speaks just enough MQTT to test the adapter
+type mqttClient struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	version byte
+	pending []*mqttPacket
+}
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func appendString(data []byte, value string) []byte {
+	data = binary.BigEndian.AppendUint16(data, uint16(len(value)))
+	return append(data, value...)
+}
+
+func (c *mqttClient) send(kind, flags byte, body []byte) {
+	data := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length & 0x7F)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		data = append(data, b)
+		if length == 0 {
+			break
+		}
+	}
+	if _, err := c.conn.Write(append(data, body...)); err != nil {
+		log.Fatalf("MQTT write failed: %v", err)
+	}
+}
+
+func (c *mqttClient) receive() *mqttPacket {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		log.Fatalf("MQTT read failed: %v", err)
+	}
+	length, shift := 0, 0
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			log.Fatalf("MQTT read failed: %v", err)
+		}
+		length |= int(b&0x7F) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	p := &mqttPacket{kind: header >> 4, flags: header & 0x0F, body: make([]byte, length)}
+	if _, err := io.ReadFull(c.reader, p.body); err != nil {
+		log.Fatalf("MQTT read failed: %v", err)
+	}
+	return p
+}
+
+// connectMqtt returns the client and the CONNACK code
+func connectMqtt(version byte, clientId, user, password string, willTopic string) (*mqttClient, byte) {
+	conn, err := net.Dial("tcp", MQTT_ADDRESS)
+	if err != nil {
+		log.Fatalf("MQTT dial failed: %v", err)
+	}
+	c := &mqttClient{conn: conn, reader: bufio.NewReader(conn), version: version}
+	flags := byte(0x02 | 0x80 | 0x40)
+	if willTopic != "" {
+		flags |= 0x04
+	}
+	body := appendString(nil, "MQTT")
+	body = append(body, version, flags, 0, 30)
+	if version == 5 {
+		body = append(body, 0)
+	}
+	body = appendString(body, clientId)
+	if willTopic != "" {
+		if version == 5 {
+			body = append(body, 0)
+		}
+		body = appendString(body, willTopic)
+		body = appendString(body, "gone")
+	}
+	body = appendString(body, user)
+	body = appendString(body, password)
+	c.send(1, 0, body)
+	ack := c.receive()
+	if ack.kind != 2 || len(ack.body) < 2 {
+		log.Fatalf("expected CONNACK, got packet type %d", ack.kind)
+	}
+	return c, ack.body[1]
+}
+
+func (c *mqttClient) subscribe(filter string) byte {
+	body := []byte{0, 1}
+	if c.version == 5 {
+		body = append(body, 0)
+	}
+	body = appendString(body, filter)
+	c.send(8, 0x02, append(body, 0))
+	// Retained messages may arrive before SUBACK
+	for {
+		p := c.receive()
+		if p.kind == 9 {
+			return p.body[len(p.body)-1]
+		}
+		c.pending = append(c.pending, p)
+	}
+}
+
+// expectPublish waits for a PUBLISH to topic and returns its payload and retain flag
+func (c *mqttClient) expectPublish(topic string) (string, bool) {
+	for {
+		var p *mqttPacket
+		if len(c.pending) > 0 {
+			p, c.pending = c.pending[0], c.pending[1:]
+		} else {
+			p = c.receive()
+		}
+		if p.kind != 3 {
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(p.body))
+		received := string(p.body[2 : 2+length])
+		payload := p.body[2+length:]
+		if c.version == 5 {
+			payload = payload[1:]
+		}
+		if received == topic {
+			return string(payload), p.flags&0x01 != 0
+		}
+	}
+}
+
+func connect(config *mmq.Config) *mmq.Client {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	return client
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	native := connect(clientConfig)
+	defer native.Disconnect()
+	received := make(chan string, 10)
+	if err := native.Subscribe("test/mqtt/+", func(topic string, payload []byte) {
+		received <- topic + "=" + string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	expect := func(expected string) {
+		for {
+			select {
+			case message := <-received:
+				if message == expected {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				log.Fatalf("native client did not receive '%s'", expected)
+			}
+		}
+	}
+	if err := native.Publish(TOPIC_RETAINED, []byte("kept"), mmq.Retained); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	defer native.Publish(TOPIC_RETAINED, nil, mmq.Retained)
+	expect(TOPIC_RETAINED + "=kept")
+
+	token, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "device1",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Acl:       []string{"test/mqtt/#"},
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	if _, code := connectMqtt(4, "bad", "device1", "wrong", ""); code != 0x04 {
+		log.Fatalf("wrong password answered with %d", code)
+	}
+
+	// MQTT 3.1.1 subscriber gets the retained message of the native client
+	subscriber, code := connectMqtt(4, "subscriber", "", token, "")
+	if code != 0 {
+		log.Fatalf("MQTT 3.1.1 connect refused with %d", code)
+	}
+	defer subscriber.conn.Close()
+	if code := subscriber.subscribe("test/mqtt/#"); code != 0 {
+		log.Fatalf("MQTT subscribe refused with %d", code)
+	}
+	if payload, retained := subscriber.expectPublish(TOPIC_RETAINED); payload != "kept" || !retained {
+		log.Fatalf("retained message not delivered to MQTT: '%s' %v", payload, retained)
+	}
+	// A retained message published to an existing subscription is delivered
+	// without RETAIN
+	if err := native.Publish(TOPIC_RETAINED, []byte("updated"), mmq.Retained); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	expect(TOPIC_RETAINED + "=updated")
+	if payload, retained := subscriber.expectPublish(TOPIC_RETAINED); payload != "updated" || retained {
+		log.Fatalf("live retained message delivered to MQTT as '%s' with RETAIN %v", payload, retained)
+	}
+	if code := subscriber.subscribe("other/#"); code != 0x80 {
+		log.Fatalf("subscription outside the ACL answered with %d", code)
+	}
+	if err := native.Publish(TOPIC_NATIVE, []byte("hello")); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	if payload, _ := subscriber.expectPublish(TOPIC_NATIVE); payload != "hello" {
+		log.Fatalf("native message not delivered to MQTT: '%s'", payload)
+	}
+
+	// MQTT 5 publisher with QoS 1 reaches native and MQTT subscribers
+	publisher, code := connectMqtt(5, "publisher", "device1", token, "")
+	if code != 0 {
+		log.Fatalf("MQTT 5 connect refused with %d", code)
+	}
+	body := appendString(nil, TOPIC_DEVICE)
+	body = append(body, 0, 7, 0)
+	publisher.send(3, 0x02, append(body, "on"...))
+	if ack := publisher.receive(); ack.kind != 4 || binary.BigEndian.Uint16(ack.body) != 7 {
+		log.Fatalf("expected PUBACK for packet 7, got packet type %d", ack.kind)
+	}
+	expect(TOPIC_DEVICE + "=on")
+	if payload, _ := subscriber.expectPublish(TOPIC_DEVICE); payload != "on" {
+		log.Fatalf("MQTT message not delivered to MQTT: '%s'", payload)
+	}
+
+	// A connection with the same client id takes the session over
+	successor, code := connectMqtt(5, "publisher", "device1", token, "")
+	if code != 0 {
+		log.Fatalf("MQTT 5 takeover refused with %d", code)
+	}
+	if p := publisher.receive(); p.kind != 14 || p.body[0] != 0x8E {
+		log.Fatalf("expected DISCONNECT with reason 0x8E, got packet type %d", p.kind)
+	}
+	publisher.conn.Close()
+	successor.send(14, 0, []byte{0, 0})
+	successor.conn.Close()
+
+	// The will is published when the connection is lost
+	dying, code := connectMqtt(4, "dying", "", token, TOPIC_WILL)
+	if code != 0 {
+		log.Fatalf("MQTT connect with will refused with %d", code)
+	}
+	dying.conn.Close()
+	expect(TOPIC_WILL + "=gone")
+
+	// A client leaving too many QoS 2 messages without PUBREL is disconnected
+	flooding, code := connectMqtt(5, "flooding", "device1", token, "")
+	if code != 0 {
+		log.Fatalf("MQTT 5 connect refused with %d", code)
+	}
+	defer flooding.conn.Close()
+	released := 0
+	for id := 1; ; id++ {
+		body := appendString(nil, TOPIC_QOS2)
+		body = append(body, byte(id>>8), byte(id), 0)
+		flooding.send(3, 0x04, append(body, "x"...))
+		p := flooding.receive()
+		if p.kind == 14 && p.body[0] == 0x93 {
+			break
+		}
+		if p.kind != 5 || id > 1000 {
+			log.Fatalf("QoS 2 message %d answered with packet type %d", id, p.kind)
+		}
+		// The first message is released, it no longer counts
+		if id == 1 {
+			flooding.send(6, 0x02, []byte{0, 1})
+			if p := flooding.receive(); p.kind != 7 {
+				log.Fatalf("expected PUBCOMP, got packet type %d", p.kind)
+			}
+			released++
+		}
+		if id-released > 64 {
+			log.Fatalf("%d QoS 2 messages waiting for PUBREL accepted", id-released)
+		}
+	}
+	log.Printf("MQTT and native clients see each other's messages")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	testtools "github.com/oo-developer/mmq/test"
+)
+
+const (
+	TOPIC_TEST    = "test/listeners"
+	UNIX_ADDRESS  = "/tmp/mmq_listener_command.sock"
+	MESSAGE_COUNT = 100
+)
+
+func connect(config *mmq.Config) (*mmq.Client, error) {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return client, client.Connect()
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	tcpConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	unixConfig := *tcpConfig
+	unixConfig.Network = "unix"
+	unixConfig.Address = UNIX_ADDRESS
+
+	unixClient, err := connect(&unixConfig)
+	if err != nil {
+		log.Fatalf("connect on unix listener failed: %v", err)
+	}
+	defer unixClient.Disconnect()
+	tcpClient, err := connect(tcpConfig)
+	if err != nil {
+		log.Fatalf("connect on tcp listener failed: %v", err)
+	}
+	defer tcpClient.Disconnect()
+
+	// The tcp listener allows the command and publish connection of one client
+	if _, err := connect(tcpConfig); err == nil {
+		log.Fatal("connection limit of the tcp listener not enforced")
+	}
+
+	received := make(chan struct{}, MESSAGE_COUNT)
+	if err := unixClient.Subscribe(TOPIC_TEST, func(topic string, payload []byte) {
+		received <- struct{}{}
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	for ii := 0; ii < MESSAGE_COUNT; ii++ {
+		if err := tcpClient.Publish(TOPIC_TEST, []byte("hello")); err != nil {
+			log.Fatalf("publish failed: %v", err)
+		}
+	}
+	for ii := 0; ii < MESSAGE_COUNT; ii++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			log.Fatalf("received %d of %d messages", ii, MESSAGE_COUNT)
+		}
+	}
+	log.Printf("Messages published on tcp were delivered on unix")
+}
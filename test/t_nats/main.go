@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	testtools "github.com/oo-developer/mmq/test"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+	NATS_ADDRESS      = "127.0.0.1:4222"
+)
+
+// natsClient speaks just enough of the NATS text protocol to test the adapter
+type natsClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type natsMsg struct {
+	subject string
+	sid     string
+	replyTo string
+	payload string
+}
+
+func connectNats(token string) (*natsClient, string) {
+	conn, err := net.Dial("tcp", NATS_ADDRESS)
+	if err != nil {
+		log.Fatalf("NATS dial failed: %v", err)
+	}
+	c := &natsClient{conn: conn, reader: bufio.NewReader(conn)}
+	if line := c.readLine(); !strings.HasPrefix(line, "INFO ") {
+		log.Fatalf("expected INFO, got '%s'", line)
+	}
+	c.send(fmt.Sprintf(`CONNECT {"verbose":false,"auth_token":"%s","name":"test"}`+"\r\nPING\r\n", token))
+	return c, c.readLine()
+}
+
+func (c *natsClient) send(data string) {
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		log.Fatalf("NATS write failed: %v", err)
+	}
+}
+
+func (c *natsClient) readLine() string {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		log.Fatalf("NATS read failed: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// sync waits for the server to process all operations sent before
+func (c *natsClient) sync() string {
+	c.send("PING\r\n")
+	return c.readLine()
+}
+
+func (c *natsClient) publish(subject, replyTo, payload string) {
+	if replyTo != "" {
+		subject += " " + replyTo
+	}
+	c.send(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(payload), payload))
+}
+
+// expectMsg waits for the next MSG, answering pings of the server
+func (c *natsClient) expectMsg() *natsMsg {
+	for {
+		line := c.readLine()
+		if line == "PING" {
+			c.send("PONG\r\n")
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "MSG" {
+			log.Fatalf("expected MSG, got '%s'", line)
+		}
+		msg := &natsMsg{subject: fields[1], sid: fields[2]}
+		if len(fields) == 5 {
+			msg.replyTo = fields[3]
+		}
+		size, _ := strconv.Atoi(fields[len(fields)-1])
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			log.Fatalf("NATS read failed: %v", err)
+		}
+		msg.payload = string(data[:size])
+		return msg
+	}
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	native, err := mmq.NewClient(clientConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := native.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	defer native.Disconnect()
+	received := make(chan string, 10)
+	if err := native.Subscribe("test/nats/#", func(topic string, payload []byte) {
+		received <- topic + "=" + string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+
+	token, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "service",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Acl:       []string{"test/nats/#", "_INBOX/#"},
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	if _, answer := connectNats("invalid"); answer != "-ERR 'Authorization Violation'" {
+		log.Fatalf("invalid token answered with '%s'", answer)
+	}
+	responder, answer := connectNats(token)
+	if answer != "PONG" {
+		log.Fatalf("connect answered with '%s'", answer)
+	}
+	defer responder.conn.Close()
+	requester, answer := connectNats(token)
+	if answer != "PONG" {
+		log.Fatalf("connect answered with '%s'", answer)
+	}
+	defer requester.conn.Close()
+
+	// Subjects map onto topics in both directions
+	responder.send("SUB test.nats.* 1\r\n")
+	if answer := responder.sync(); answer != "PONG" {
+		log.Fatalf("SUB answered with '%s'", answer)
+	}
+	responder.send("SUB other.> 2\r\n")
+	if answer := responder.sync(); !strings.HasPrefix(answer, "-ERR 'Permissions Violation") {
+		log.Fatalf("SUB outside the ACL answered with '%s'", answer)
+	}
+	responder.readLine()
+	if err := native.Publish("test/nats/native", []byte("hello")); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	if msg := responder.expectMsg(); msg.subject != "test.nats.native" || msg.sid != "1" || msg.payload != "hello" {
+		log.Fatalf("unexpected MSG %+v", msg)
+	}
+	requester.publish("test.nats.event", "", "fired")
+	for message := ""; message != "test/nats/event=fired"; {
+		select {
+		case message = <-received:
+		case <-time.After(5 * time.Second):
+			log.Fatal("native client did not receive the NATS message")
+		}
+	}
+	if msg := responder.expectMsg(); msg.subject != "test.nats.event" || msg.payload != "fired" {
+		log.Fatalf("unexpected MSG %+v", msg)
+	}
+
+	// Request and reply through an inbox
+	requester.send("SUB _INBOX.abc.* 7\r\n")
+	requester.sync()
+	requester.publish("test.nats.request", "_INBOX.abc.1", "ping")
+	request := responder.expectMsg()
+	if request.subject != "test.nats.request" || request.replyTo != "_INBOX.abc.1" || request.payload != "ping" {
+		log.Fatalf("unexpected request %+v", request)
+	}
+	responder.publish(request.replyTo, "", "pong")
+	if reply := requester.expectMsg(); reply.subject != "_INBOX.abc.1" || reply.sid != "7" || reply.payload != "pong" {
+		log.Fatalf("unexpected reply %+v", reply)
+	}
+
+	// Requests and replies without payload are delivered
+	requester.publish("test.nats.request", "_INBOX.abc.2", "")
+	request = responder.expectMsg()
+	if request.subject != "test.nats.request" || request.replyTo != "_INBOX.abc.2" || request.payload != "" {
+		log.Fatalf("unexpected empty request %+v", request)
+	}
+	responder.publish(request.replyTo, "", "")
+	if reply := requester.expectMsg(); reply.subject != "_INBOX.abc.2" || reply.sid != "7" || reply.payload != "" {
+		log.Fatalf("unexpected empty reply %+v", reply)
+	}
+	log.Printf("NATS clients publish, subscribe and request through mmq")
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/pem"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cloudflare/circl/kem/kyber/kyber768"
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/application"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	TOPIC_PAIRING = "test/pairing"
+)
+
+// authenticate does the CONNECT and AUTHENTICATE steps of the handshake on
+// address and returns the answer to AUTHENTICATE
+func authenticate(address, clientId string, privateKey *mmq.KyberPrivateKey, credentials *mmq.Credentials) (net.Conn, *mmq.Message) {
+	conn, err := net.Dial("unix", address)
+	if err != nil {
+		log.Fatalf("dial failed: %v", err)
+	}
+	noCipher := mmq.NewNoCipher()
+	connectMsg := &mmq.Message{
+		Type:     mmq.TypeConnect,
+		ClientId: clientId,
+	}
+	if err := connectMsg.Send(conn, noCipher); err != nil {
+		log.Fatalf("failed to send CONNECT: %v", err)
+	}
+	msg, err := mmq.Receive(conn, noCipher)
+	if err != nil || msg.Type != mmq.TypeConnectAck {
+		log.Fatalf("failed to receive CONNECT_ACK: %v", err)
+	}
+	serverPublicKey, err := mmq.LoadKyberPublicKey(msg.Payload)
+	if err != nil {
+		panic(err)
+	}
+	handshakeCipher := mmq.NewKyberCipher(privateKey, serverPublicKey)
+	payload, _ := msgpack.Marshal(credentials)
+	authMsg := &mmq.Message{
+		Type:     mmq.TypeAuthenticate,
+		ClientId: clientId,
+		Payload:  payload,
+	}
+	if err := authMsg.Send(conn, handshakeCipher); err != nil {
+		log.Fatalf("failed to send AUTHENTICATE: %v", err)
+	}
+	msg, err = mmq.Receive(conn, handshakeCipher)
+	if err != nil {
+		log.Fatalf("failed to receive answer to AUTHENTICATE: %v", err)
+	}
+	return conn, msg
+}
+
+// sessionKey sends the SESSION_KEY of a command connection with the pairing
+// token as proof of the key and returns the answer
+func sessionKey(conn net.Conn, clientId string, privateKey *mmq.KyberPrivateKey, serverKeyFile string, pairingToken string) *mmq.Message {
+	keyData, err := os.ReadFile(serverKeyFile)
+	if err != nil {
+		panic(err)
+	}
+	block, _ := pem.Decode(keyData)
+	serverKey, err := kyber768.Scheme().UnmarshalBinaryPublicKey(block.Bytes)
+	if err != nil {
+		panic(err)
+	}
+	_, kemCipherText, err := mmq.EstablishChCha20Cipher(serverKey.(*kyber768.PublicKey))
+	if err != nil {
+		panic(err)
+	}
+	payload, _ := msgpack.Marshal(&mmq.SessionKey{
+		KemCipherText: kemCipherText,
+		PairingToken:  pairingToken,
+	})
+	serverPublicKey, err := mmq.LoadKyberPublicKey(keyData)
+	if err != nil {
+		panic(err)
+	}
+	handshakeCipher := mmq.NewKyberCipher(privateKey, serverPublicKey)
+	msg := &mmq.Message{
+		Type:     mmq.TypeSessionKey,
+		ClientId: clientId,
+		Payload:  payload,
+	}
+	if err := msg.Send(conn, handshakeCipher); err != nil {
+		log.Fatalf("failed to send SESSION_KEY: %v", err)
+	}
+	answer, err := mmq.Receive(conn, handshakeCipher)
+	if err != nil {
+		log.Fatalf("failed to receive answer to SESSION_KEY: %v", err)
+	}
+	return answer
+}
+
+// expectReject checks that a publish connection is refused for reason
+func expectReject(reason mmq.RejectReason, address, clientId string, privateKey *mmq.KyberPrivateKey, credentials *mmq.Credentials) {
+	conn, msg := authenticate(address, clientId, privateKey, credentials)
+	defer conn.Close()
+	if msg.Type != mmq.TypeReject {
+		log.Fatalf("expected REJECT (%s), got %v", reason, msg.Type)
+	}
+	rejection := &mmq.Rejection{}
+	if err := msgpack.Unmarshal(msg.Payload, rejection); err != nil {
+		panic(err)
+	}
+	if rejection.Reason != reason {
+		log.Fatalf("expected REJECT (%s), got %v", reason, rejection)
+	}
+	log.Printf("Publish connection rejected: %v", rejection)
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	// Map the uid of this process to the 'local' user
+	configuration := config.Load(*serverConfigFile)
+	uid := uint32(os.Getuid())
+	configuration.Auth.Providers[1].Peers[0].Uid = &uid
+	server := application.NewApplication(configuration)
+	go server.Start()
+	time.Sleep(2 * time.Second)
+	defer server.Shutdown()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+
+	// A client pairs its publish connection on its own
+	client, err := mmq.NewClient(clientConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	defer client.Disconnect()
+	received := make(chan string, 1)
+	if err := client.Subscribe(TOPIC_PAIRING, func(topic string, payload []byte) {
+		received <- string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	if err := client.Publish(TOPIC_PAIRING, []byte("paired")); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		log.Fatal("message not delivered on the paired publish connection")
+	}
+
+	privateKey, err := mmq.LoadKyberPrivateKeyFile(clientConfig.ClientPrivateKeyFile)
+	if err != nil {
+		panic(err)
+	}
+	serverKeyFile := configuration.Crypto.PublicKeyFile
+
+	// A command connection without the pairing token of its AUTHENTICATE_ACK
+	// did not prove the key and is refused
+	clientId := "pairing-victim"
+	unproven, msg := authenticate(configuration.Transport.AddressCommand, clientId, privateKey, &mmq.Credentials{
+		User: clientConfig.User,
+	})
+	if msg.Type != mmq.TypeAuthenticateAck {
+		log.Fatalf("expected AUTHENTICATE_ACK, got %v", msg.Type)
+	}
+	msg = sessionKey(unproven, clientId, privateKey, serverKeyFile, "forged")
+	unproven.Close()
+	rejection := &mmq.Rejection{}
+	if msg.Type != mmq.TypeReject || msgpack.Unmarshal(msg.Payload, rejection) != nil || rejection.Reason != mmq.RejectKeyNotProven {
+		log.Fatalf("command connection without proof of the key not rejected: %v %v", msg.Type, rejection)
+	}
+
+	// A command connection of 'test' that stops after SESSION_KEY_ACK
+	command, msg := authenticate(configuration.Transport.AddressCommand, clientId, privateKey, &mmq.Credentials{
+		User: clientConfig.User,
+	})
+	defer command.Close()
+	if msg.Type != mmq.TypeAuthenticateAck {
+		log.Fatalf("expected AUTHENTICATE_ACK, got %v", msg.Type)
+	}
+	grant := &mmq.AuthenticateGrant{}
+	if err := msgpack.Unmarshal(msg.Payload, grant); err != nil || grant.PairingToken == "" {
+		log.Fatalf("AUTHENTICATE_ACK without pairing token: %v", err)
+	}
+	if grant.PublishAddress != configuration.Transport.AddressPublish {
+		log.Fatalf("unexpected publish address '%s'", grant.PublishAddress)
+	}
+	if msg := sessionKey(command, clientId, privateKey, serverKeyFile, grant.PairingToken); msg.Type != mmq.TypeSessionKeyAck {
+		log.Fatalf("expected SESSION_KEY_ACK, got %v", msg.Type)
+	}
+
+	// A failed handshake of the same client id leaves the pairing of the
+	// connected command connection intact
+	failed, msg := authenticate(configuration.Transport.AddressCommand, clientId, privateKey, &mmq.Credentials{
+		User: clientConfig.User,
+	})
+	if msg.Type != mmq.TypeAuthenticateAck {
+		log.Fatalf("expected AUTHENTICATE_ACK, got %v", msg.Type)
+	}
+	if msg := sessionKey(failed, clientId, privateKey, serverKeyFile, "forged"); msg.Type != mmq.TypeReject {
+		log.Fatalf("expected REJECT, got %v", msg.Type)
+	}
+	failed.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	publishAddress := grant.PublishAddress
+	expectReject(mmq.RejectUnknownClient, publishAddress, "unknown-client", privateKey, &mmq.Credentials{
+		User:         clientConfig.User,
+		PairingToken: grant.PairingToken,
+	})
+	// 'local' authenticates with its peer credentials and an ephemeral key
+	publicKey, ephemeralKey, err := mmq.GenerateKyberKeyPair()
+	if err != nil {
+		panic(err)
+	}
+	publicKeyPem, err := mmq.EncodeKyberPublicKeyPEM(publicKey)
+	if err != nil {
+		panic(err)
+	}
+	expectReject(mmq.RejectUserMismatch, publishAddress, clientId, ephemeralKey, &mmq.Credentials{
+		PublicKeyPem: string(publicKeyPem),
+		PairingToken: grant.PairingToken,
+	})
+	expectReject(mmq.RejectInvalidPairing, publishAddress, clientId, privateKey, &mmq.Credentials{
+		User:         clientConfig.User,
+		PairingToken: "forged",
+	})
+	publish, msg := authenticate(publishAddress, clientId, privateKey, &mmq.Credentials{
+		User:         clientConfig.User,
+		PairingToken: grant.PairingToken,
+	})
+	defer publish.Close()
+	if msg.Type != mmq.TypeAuthenticateAck {
+		log.Fatalf("pairing with the issued token failed: %v", msg.Type)
+	}
+	expectReject(mmq.RejectAlreadyPaired, publishAddress, clientId, privateKey, &mmq.Credentials{
+		User:         clientConfig.User,
+		PairingToken: grant.PairingToken,
+	})
+	log.Printf("Publish connections are paired with their command connection")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/application"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	// Map the uid of this process to the 'local' admin
+	configuration := config.Load(*serverConfigFile)
+	uid := uint32(os.Getuid())
+	configuration.Auth.Providers[1].Peers[0].Uid = &uid
+	server := application.NewApplication(configuration)
+	go server.Start()
+	time.Sleep(2 * time.Second)
+	defer server.Shutdown()
+
+	info, err := os.Stat(configuration.Transport.AddressCommand)
+	if err != nil {
+		panic(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		log.Fatalf("socket mode is %o, expected 660", info.Mode().Perm())
+	}
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	client, err := mmq.NewClient(clientConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("peer credential authentication failed: %v", err)
+	}
+	defer client.Disconnect()
+
+	request, _ := msgpack.Marshal(common.ListConnectionsReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_LIST_CONNECTIONS,
+		},
+	})
+	responseBytes, err := client.SendCommand(request)
+	if err != nil {
+		panic(err)
+	}
+	response := common.ListConnectionsResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+		panic(err)
+	}
+	if response.Error {
+		log.Fatalf("listing connections failed: %s", response.ErrorMessage)
+	}
+	for _, entry := range response.Connections {
+		log.Printf("Connection %s of user '%s' via '%s'", entry.Id, entry.Username, entry.Provider)
+	}
+	log.Printf("Peer credential authentication works")
+}
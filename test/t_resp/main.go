@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	testtools "github.com/oo-developer/mmq/test"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+	RESP_ADDRESS      = "127.0.0.1:6379"
+	TOPIC_RETAINED    = "test/resp/retained"
+)
+
+// respClient speaks just enough RESP to test the adapter
+type respClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func connectResp() *respClient {
+	conn, err := net.Dial("tcp", RESP_ADDRESS)
+	if err != nil {
+		log.Fatalf("RESP dial failed: %v", err)
+	}
+	return &respClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *respClient) send(args ...string) {
+	data := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		data += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		log.Fatalf("RESP write failed: %v", err)
+	}
+}
+
+// receive reads one reply, arrays are joined with spaces, integers lose
+// their type prefix and a null bulk string is "(nil)"
+func (c *respClient) receive() string {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		log.Fatalf("RESP read failed: %v", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch line[0] {
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return "(nil)"
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			log.Fatalf("RESP read failed: %v", err)
+		}
+		return string(data[:size])
+	case '*':
+		count, _ := strconv.Atoi(line[1:])
+		elements := make([]string, 0, count)
+		for ii := 0; ii < count; ii++ {
+			elements = append(elements, c.receive())
+		}
+		return strings.Join(elements, " ")
+	case ':':
+		return line[1:]
+	}
+	return line
+}
+
+func (c *respClient) command(expected string, args ...string) {
+	c.send(args...)
+	if reply := c.receive(); reply != expected {
+		log.Fatalf("%s answered with '%s', expected '%s'", args[0], reply, expected)
+	}
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	native, err := mmq.NewClient(clientConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := native.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	defer native.Disconnect()
+	received := make(chan string, 10)
+	if err := native.Subscribe("test/resp/#", func(topic string, payload []byte) {
+		received <- topic + "=" + string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	if err := native.Publish(TOPIC_RETAINED, []byte("kept"), mmq.Retained); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	defer native.Publish(TOPIC_RETAINED, nil, mmq.Retained)
+
+	token, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "tool",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Acl:       []string{"test/resp/#"},
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+
+	publisher := connectResp()
+	defer publisher.conn.Close()
+	publisher.command("-NOAUTH Authentication required.", "PUBLISH", "test/resp/a", "1")
+	publisher.command("-WRONGPASS invalid username-password pair or user is disabled.", "AUTH", "invalid")
+	publisher.command("+OK", "AUTH", token)
+	publisher.command("+PONG", "PING")
+	publisher.command("kept", "GET", TOPIC_RETAINED)
+	publisher.command("(nil)", "GET", "test/resp/missing")
+	publisher.command("-NOPERM no permissions to access the 'other/a' channel", "GET", "other/a")
+
+	subscriber := connectResp()
+	defer subscriber.conn.Close()
+	subscriber.command("+OK", "AUTH", "tool", token)
+	subscriber.command("subscribe test/resp/a 1", "SUBSCRIBE", "test/resp/a")
+	subscriber.command("psubscribe test/resp/* 2", "PSUBSCRIBE", "test/resp/*")
+	// The pattern subscription gets the retained message
+	if reply := subscriber.receive(); reply != "pmessage test/resp/* "+TOPIC_RETAINED+" kept" {
+		log.Fatalf("expected retained message, got '%s'", reply)
+	}
+	subscriber.command("-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", "GET", TOPIC_RETAINED)
+	subscriber.command("pong ", "PING")
+
+	// PUBLISH counts the subscriptions of the native and RESP clients
+	publisher.command("3", "PUBLISH", "test/resp/a", "hello")
+	expected := map[string]bool{"message test/resp/a hello": true, "pmessage test/resp/* test/resp/a hello": true}
+	for len(expected) > 0 {
+		reply := subscriber.receive()
+		if !expected[reply] {
+			log.Fatalf("unexpected message '%s'", reply)
+		}
+		delete(expected, reply)
+	}
+	for message := ""; message != "test/resp/a=hello"; {
+		select {
+		case message = <-received:
+		case <-time.After(5 * time.Second):
+			log.Fatal("native client did not receive the RESP message")
+		}
+	}
+	// An empty message is delivered
+	publisher.command("3", "PUBLISH", "test/resp/a", "")
+	expected = map[string]bool{"message test/resp/a ": true, "pmessage test/resp/* test/resp/a ": true}
+	for len(expected) > 0 {
+		reply := subscriber.receive()
+		if !expected[reply] {
+			log.Fatalf("unexpected message '%s'", reply)
+		}
+		delete(expected, reply)
+	}
+	if err := native.Publish("test/resp/deep/b", []byte("native")); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	if reply := subscriber.receive(); reply != "pmessage test/resp/* test/resp/deep/b native" {
+		log.Fatalf("expected native message, got '%s'", reply)
+	}
+
+	subscriber.command("unsubscribe test/resp/a 1", "UNSUBSCRIBE")
+	subscriber.command("punsubscribe test/resp/* 0", "PUNSUBSCRIBE", "test/resp/*")
+	subscriber.command("+PONG", "PING")
+	publisher.command("1", "PUBLISH", "test/resp/a", "again")
+	subscriber.command("+OK", "QUIT")
+	log.Printf("RESP clients publish, subscribe and read retained values")
+}
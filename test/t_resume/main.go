@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oo-developer/mmq/cli/module"
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/application"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+)
+
+func start(configuration *config.Config) common.Service {
+	server := application.NewApplication(configuration)
+	go server.Start()
+	time.Sleep(2 * time.Second)
+	return server
+}
+
+func connect(config *mmq.Config) *mmq.Client {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	return client
+}
+
+func copyFile(from, to string) {
+	source, err := os.Open(from)
+	if err != nil {
+		panic(err)
+	}
+	defer source.Close()
+	target, err := os.Create(to)
+	if err != nil {
+		panic(err)
+	}
+	defer target.Close()
+	if _, err := io.Copy(target, source); err != nil {
+		panic(err)
+	}
+}
+
+// waitForReason waits until client was disconnected by the broker
+func waitForReason(client *mmq.Client) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for client.DisconnectReason() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return client.DisconnectReason()
+}
+
+// resumed sends the ticket of ticketFile in a RESUME and reports whether the
+// broker answered with RESUME_ACK instead of closing the connection
+func resumed(address, ticketFile string) bool {
+	return resumedAs(address, ticketFile, fmt.Sprintf("resume-check-%d", time.Now().UnixNano()))
+}
+
+// resumedAs is resumed for clientId, the connection is closed after the
+// RESUME_ACK without proving the ticket secret
+func resumedAs(address, ticketFile, clientId string) bool {
+	ticket, err := mmq.LoadSessionTicketFile(ticketFile)
+	if err != nil {
+		log.Fatalf("no session ticket: %v", err)
+	}
+	conn, err := net.Dial("unix", address)
+	if err != nil {
+		log.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	nonce, err := mmq.NewResumeNonce()
+	if err != nil {
+		panic(err)
+	}
+	request, _ := msgpack.Marshal(&mmq.ResumeRequest{
+		Ticket: ticket.Ticket,
+		Nonce:  nonce,
+	})
+	resume := &mmq.Message{
+		Type:     mmq.TypeResume,
+		Payload:  request,
+		ClientId: clientId,
+	}
+	if err := resume.Send(conn, mmq.NewNoCipher()); err != nil {
+		log.Fatalf("failed to send RESUME: %v", err)
+	}
+	answer, err := mmq.Receive(conn, mmq.NewNoCipher())
+	return err == nil && answer.Type == mmq.TypeResumeAck
+}
+
+// roundTrip checks a message published by client reaches its subscription
+func roundTrip(client *mmq.Client) {
+	topic := fmt.Sprintf("test/resume/%d", time.Now().UnixNano())
+	received := make(chan string, 1)
+	if err := client.Subscribe(topic, func(topic string, payload []byte) {
+		received <- string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	if err := client.Publish(topic, []byte("resumed")); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		log.Fatalf("message of the resumed session not delivered")
+	}
+}
+
+// deviceKey writes a key pair as a device generates it and returns the files
+// of the public and the private key
+func deviceKey(dir, name string) (string, string) {
+	publicKey, privateKey, err := mmq.GenerateKyberKeyPair()
+	if err != nil {
+		panic(err)
+	}
+	publicKeyPem, _ := mmq.EncodeKyberPublicKeyPEM(publicKey)
+	privateKeyPem, _ := mmq.EncodeKyberPrivateKeyPEM(privateKey)
+	publicKeyFile := filepath.Join(dir, name+"_public_key.pem")
+	privateKeyFile := filepath.Join(dir, name+"_private_key.pem")
+	if err := os.WriteFile(publicKeyFile, publicKeyPem, 0600); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(privateKeyFile, privateKeyPem, 0600); err != nil {
+		panic(err)
+	}
+	return publicKeyFile, privateKeyFile
+}
+
+func users(clientConfig *mmq.Config, secret []byte, command string, args ...string) {
+	adminToken, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "operator",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Admin:     true,
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	adminConfig := *clientConfig
+	adminConfig.User = ""
+	adminConfig.ClientPrivateKeyFile = ""
+	adminConfig.TicketFile = ""
+	adminConfig.Token = adminToken
+	admin := connect(&adminConfig)
+	defer admin.Disconnect()
+	if err := module.Modules["users"].Execute(admin, command, args...); err != nil {
+		log.Fatalf("users %s %v failed: %v", command, args, err)
+	}
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	dir, err := os.MkdirTemp("", "mmq_resume")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The broker works on a copy of the test database, the ticket key
+	// outlives its restarts
+	configuration := config.Load(*serverConfigFile)
+	brokerDb := filepath.Join(dir, "broker.db")
+	copyFile(configuration.Storage.DbFile, brokerDb)
+	configuration.Storage.DbFile = brokerDb
+	configuration.Tickets.KeyFile = filepath.Join(dir, "ticket.key")
+	server := start(configuration)
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	address := clientConfig.Address
+	ticketFile := filepath.Join(dir, "test_ticket.json")
+	clientConfig.TicketFile = ticketFile
+
+	// A valid ticket resumes the session
+	client := connect(clientConfig)
+	client.Disconnect()
+	if !resumed(address, ticketFile) {
+		log.Fatalf("valid ticket not resumed")
+	}
+	client = connect(clientConfig)
+	roundTrip(client)
+	client.Disconnect()
+
+	// A tampered ticket is rejected and the client does the full handshake
+	ticket, _ := mmq.LoadSessionTicketFile(ticketFile)
+	ticket.Ticket[len(ticket.Ticket)/2] ^= 0xff
+	tamperedFile := filepath.Join(dir, "tampered_ticket.json")
+	mmq.SaveSessionTicketFile(tamperedFile, ticket)
+	if resumed(address, tamperedFile) {
+		log.Fatalf("tampered ticket resumed")
+	}
+	tamperedConfig := *clientConfig
+	tamperedConfig.TicketFile = tamperedFile
+	client = connect(&tamperedConfig)
+	roundTrip(client)
+	client.Disconnect()
+	if !resumed(address, tamperedFile) {
+		log.Fatalf("full handshake after a tampered ticket issued no ticket")
+	}
+
+	// A recorded RESUME does not take over the session of its client, the
+	// ticket resumes once and the secret is proven before the takeover
+	victimConfig := *clientConfig
+	victimConfig.ClientId = fmt.Sprintf("resume-victim-%d", time.Now().UnixNano())
+	victimConfig.TicketFile = filepath.Join(dir, "victim_ticket.json")
+	victim := connect(&victimConfig)
+	if !resumedAs(address, victimConfig.TicketFile, victimConfig.ClientId) {
+		log.Fatalf("ticket of the victim not resumed")
+	}
+	if resumedAs(address, victimConfig.TicketFile, victimConfig.ClientId) {
+		log.Fatalf("ticket resumed twice")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if reason := victim.DisconnectReason(); reason != "" {
+		log.Fatalf("session taken over by a RESUME without the secret: '%s'", reason)
+	}
+	roundTrip(victim)
+	victim.Disconnect()
+
+	// Rotating the key of a user invalidates the tickets of the old key
+	deviceName := fmt.Sprintf("resume-device-%d", time.Now().UnixNano())
+	publicKeyFile, privateKeyFile := deviceKey(dir, deviceName)
+	users(clientConfig, secret, "add", "--name", deviceName, "--public-key", publicKeyFile)
+	// Tickets have a resolution of seconds, those of the second the user
+	// changed are revoked as well
+	time.Sleep(1100 * time.Millisecond)
+	deviceConfig := *clientConfig
+	deviceConfig.User = deviceName
+	deviceConfig.ClientPrivateKeyFile = privateKeyFile
+	deviceConfig.TicketFile = filepath.Join(dir, "device_ticket.json")
+	device := connect(&deviceConfig)
+	if !resumed(address, deviceConfig.TicketFile) {
+		log.Fatalf("ticket of the device not resumed")
+	}
+	rotatedPublicKeyFile, rotatedPrivateKeyFile := deviceKey(dir, deviceName+"-rotated")
+	users(clientConfig, secret, "rotate-key", "--name", deviceName, "--public-key", rotatedPublicKeyFile)
+	if reason := waitForReason(device); reason == "" {
+		log.Fatalf("session of the device not terminated by the key rotation")
+	}
+	if resumed(address, deviceConfig.TicketFile) {
+		log.Fatalf("ticket resumed after the key was rotated")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	deviceConfig.ClientPrivateKeyFile = rotatedPrivateKeyFile
+	device = connect(&deviceConfig)
+	device.Disconnect()
+	if !resumed(address, deviceConfig.TicketFile) {
+		log.Fatalf("ticket of the rotated key not resumed")
+	}
+
+	// Disabling a user revokes the tickets at once, enabling the user again
+	// does not bring them back
+	disabledTicketFile := filepath.Join(dir, "disabled_ticket.json")
+	copyFile(deviceConfig.TicketFile, disabledTicketFile)
+	users(clientConfig, secret, "disable", "--name", deviceName)
+	if resumed(address, disabledTicketFile) {
+		log.Fatalf("ticket of a disabled user resumed")
+	}
+	users(clientConfig, secret, "enable", "--name", deviceName)
+	if resumed(address, disabledTicketFile) {
+		log.Fatalf("ticket resumed after the user was disabled and enabled again")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	device = connect(&deviceConfig)
+	device.Disconnect()
+
+	// Revocations are kept over a restart, tickets issued after them resume
+	server.Shutdown()
+	server = start(configuration)
+	if resumed(address, disabledTicketFile) {
+		log.Fatalf("revoked ticket resumed after a restart")
+	}
+	if !resumed(address, deviceConfig.TicketFile) {
+		log.Fatalf("ticket not resumed after a restart")
+	}
+	server.Shutdown()
+
+	// Users revoked in the configuration resume no ticket issued before
+	revoking := *configuration
+	revoking.Tickets.RevokedUsers = []string{deviceName}
+	server = start(&revoking)
+	if resumed(address, deviceConfig.TicketFile) {
+		log.Fatalf("ticket of a user revoked in the configuration resumed")
+	}
+	if !resumed(address, ticketFile) {
+		log.Fatalf("ticket of a user not revoked rejected")
+	}
+	server.Shutdown()
+
+	// A listener that does not allow the provider of the session resumes
+	// none of its tickets
+	keyless := *configuration
+	listener := keyless.AllListeners()[0]
+	listener.AuthProviders = []string{"token"}
+	keyless.Transport.Listeners = []config.Listener{listener}
+	server = start(&keyless)
+	if resumed(address, ticketFile) {
+		log.Fatalf("ticket of a key session resumed on a listener without key authentication")
+	}
+	server.Shutdown()
+
+	// An expired ticket is rejected
+	expiring := *configuration
+	expiring.Tickets.LifetimeSeconds = 1
+	server = start(&expiring)
+	client = connect(clientConfig)
+	client.Disconnect()
+	time.Sleep(2 * time.Second)
+	if resumed(address, ticketFile) {
+		log.Fatalf("expired ticket resumed")
+	}
+	client = connect(clientConfig)
+	roundTrip(client)
+	client.Disconnect()
+	server.Shutdown()
+	log.Printf("Session tickets resume one session until they expire, are tampered with or revoked")
+}
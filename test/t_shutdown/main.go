@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"sync/atomic"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/application"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	TOPIC_SHUTDOWN = "test/shutdown"
+	TOPIC_RETAINED = "test/shutdown/retained"
+	MESSAGES       = 10000
+)
+
+func connect(config *mmq.Config) *mmq.Client {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	return client
+}
+
+// waitForReason waits until client was disconnected by the broker
+func waitForReason(client *mmq.Client) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for client.DisconnectReason() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return client.DisconnectReason()
+}
+
+// retained reads the message of topic the storage flushed to dbFile
+func retained(dbFile, topic string) string {
+	db, err := bbolt.Open(dbFile, 0600, &bbolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		log.Fatalf("failed to open storage: %v", err)
+	}
+	defer db.Close()
+	var payload string
+	db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket([]byte("messages")).Get([]byte(topic))
+		if value == nil {
+			return nil
+		}
+		msg := &struct {
+			Payload []byte `msgpack:"payload"`
+		}{}
+		if err := msgpack.Unmarshal(value, msg); err != nil {
+			return err
+		}
+		payload = string(msg.Payload)
+		return nil
+	})
+	return payload
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	configuration := config.Load(*serverConfigFile)
+	server := application.NewApplication(configuration)
+	stopped := make(chan struct{})
+	go func() {
+		server.Start()
+		close(stopped)
+	}()
+	time.Sleep(2 * time.Second)
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	subscriber := connect(clientConfig)
+	var received atomic.Int32
+	if err := subscriber.Subscribe(TOPIC_SHUTDOWN, func(topic string, payload []byte) {
+		received.Add(1)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	multiplexConfig := *clientConfig
+	multiplexConfig.Multiplex = true
+	publisher := connect(&multiplexConfig)
+	for ii := 0; ii < MESSAGES; ii++ {
+		if err := publisher.Publish(TOPIC_SHUTDOWN, []byte("queued")); err != nil {
+			log.Fatalf("publish failed: %v", err)
+		}
+	}
+	if err := publisher.Publish(TOPIC_RETAINED, []byte("flushed"), mmq.Persistent); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+
+	// The queued messages are delivered before the clients are disconnected
+	start := time.Now()
+	server.Shutdown()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		log.Fatal("Start did not return after Shutdown")
+	}
+	log.Printf("Shut down in %v", time.Since(start))
+	if time.Since(start) > 6*time.Second {
+		log.Fatal("shutdown exceeded its deadlines")
+	}
+	for _, client := range []*mmq.Client{subscriber, publisher} {
+		if reason := waitForReason(client); reason != common.DISCONNECT_SHUTDOWN {
+			log.Fatalf("client was disconnected with '%s'", reason)
+		}
+		if client.ReconnectAfter() != 1500*time.Millisecond {
+			log.Fatalf("unexpected reconnect hint %v", client.ReconnectAfter())
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for received.Load() < MESSAGES && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := received.Load(); count != MESSAGES {
+		log.Fatalf("%d of %d queued messages delivered before the shutdown", count, MESSAGES)
+	}
+	_, err = publisher.SendCommand(nil)
+	var disconnectErr *mmq.DisconnectError
+	if !errors.As(err, &disconnectErr) || disconnectErr.ReconnectAfter != 1500*time.Millisecond {
+		log.Fatalf("command after the shutdown returned %v", err)
+	}
+
+	// The listeners are closed and the storage is flushed
+	late, err := mmq.NewClient(clientConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := late.Connect(); err == nil {
+		log.Fatal("connected after the shutdown")
+	}
+	if payload := retained(configuration.Storage.DbFile, TOPIC_RETAINED); payload != "flushed" {
+		log.Fatalf("retained message not flushed, got '%s'", payload)
+	}
+	log.Printf("Clients are drained and told to reconnect on shutdown")
+}
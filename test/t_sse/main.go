@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	testtools "github.com/oo-developer/mmq/test"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+	GATEWAY_URL       = "http://127.0.0.1:8087"
+	TOPIC_RETAINED    = "test/sse/retained/temp"
+	TOPIC_LIVE        = "test/sse/live/temp"
+	TOPIC_STREAM      = "test/sse/stream/temp"
+)
+
+type event struct {
+	id       string
+	topic    string
+	payload  string
+	retained bool
+}
+
+// stream reads the events of a subscription
+type stream struct {
+	resp   *http.Response
+	events chan *event
+}
+
+func subscribe(token, topic, lastEventId string) (*stream, int) {
+	req, err := http.NewRequest(http.MethodGet, GATEWAY_URL+"/subscribe?topic="+url.QueryEscape(topic), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, resp.StatusCode
+	}
+	s := &stream{resp: resp, events: make(chan *event, 10)}
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		e := &event{}
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if e.topic != "" {
+					s.events <- e
+				}
+				e = &event{}
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				data := struct {
+					Topic    string `json:"topic"`
+					Payload  string `json:"payload"`
+					Retained bool   `json:"retained"`
+				}{}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+					log.Fatalf("invalid event data '%s'", line)
+				}
+				e.topic, e.payload, e.retained = data.Topic, data.Payload, data.Retained
+			}
+		}
+	}()
+	return s, resp.StatusCode
+}
+
+func (s *stream) expect(topic, payload string) *event {
+	for {
+		select {
+		case e := <-s.events:
+			if e.topic == topic && e.payload == payload {
+				return e
+			}
+		case <-time.After(5 * time.Second):
+			log.Fatalf("event stream did not receive '%s' on '%s'", payload, topic)
+		}
+	}
+}
+
+func (s *stream) close() {
+	s.resp.Body.Close()
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	native, err := mmq.NewClient(clientConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := native.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	defer native.Disconnect()
+	if err := native.Publish(TOPIC_RETAINED, []byte("21"), mmq.Retained); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	defer native.Publish(TOPIC_RETAINED, nil, mmq.Retained)
+
+	token, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "dashboard",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Acl:       []string{"test/sse/#"},
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	if _, status := subscribe(token, "other/#", ""); status != http.StatusForbidden {
+		log.Fatalf("subscription outside the ACL answered with %d", status)
+	}
+
+	// Retained messages come first, live messages follow
+	events, status := subscribe(token, "test/sse/+/temp", "")
+	if status != http.StatusOK {
+		log.Fatalf("subscribe answered with %d", status)
+	}
+	if e := events.expect(TOPIC_RETAINED, "21"); !e.retained {
+		log.Fatal("retained message not flagged as retained")
+	}
+	if err := native.Publish(TOPIC_LIVE, []byte("22")); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	last := events.expect(TOPIC_LIVE, "22")
+
+	// The stream is a broker client
+	adminToken, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "operator",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Admin:     true,
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	adminConfig := *clientConfig
+	adminConfig.User = ""
+	adminConfig.ClientPrivateKeyFile = ""
+	adminConfig.Token = adminToken
+	admin, err := mmq.NewClient(&adminConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := admin.Connect(); err != nil {
+		log.Fatalf("admin connect failed: %v", err)
+	}
+	defer admin.Disconnect()
+	request, _ := msgpack.Marshal(common.ListConnectionsReq{
+		CliRequest: common.CliRequest{
+			Type: common.COMMAND_LIST_CONNECTIONS,
+		},
+	})
+	responseBytes, err := admin.SendCommand(request)
+	if err != nil {
+		panic(err)
+	}
+	response := common.ListConnectionsResp{}
+	if err := msgpack.Unmarshal(responseBytes, &response); err != nil {
+		panic(err)
+	}
+	if response.Error {
+		log.Fatalf("listing connections failed: %s", response.ErrorMessage)
+	}
+	found := false
+	for _, entry := range response.Connections {
+		found = found || (strings.HasPrefix(entry.Id, "sse-") && entry.Username == "dashboard" && entry.Listener == "http")
+	}
+	if !found {
+		log.Fatal("event stream not listed as connection")
+	}
+	events.close()
+
+	// A resumed stream skips the retained message it has already seen
+	if err := native.Publish(TOPIC_RETAINED, []byte("23"), mmq.Retained); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	resumed, status := subscribe(token, "test/sse/+/temp", last.id)
+	if status != http.StatusOK {
+		log.Fatalf("resume answered with %d", status)
+	}
+	if e := <-resumed.events; e.topic != TOPIC_RETAINED || e.payload != "23" {
+		log.Fatalf("resumed stream started with '%s' on '%s'", e.payload, e.topic)
+	}
+	if err := native.Publish(TOPIC_LIVE, []byte("24")); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	last = resumed.expect(TOPIC_LIVE, "24")
+	resumed.close()
+
+	// Messages published while the stream was closed are replayed, stream
+	// topics with their whole log
+	for _, message := range []struct{ topic, payload string }{
+		{TOPIC_LIVE, "25"},
+		{TOPIC_STREAM, "26"},
+		{TOPIC_STREAM, "27"},
+	} {
+		if err := native.Publish(message.topic, []byte(message.payload)); err != nil {
+			log.Fatalf("publish failed: %v", err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	missed, status := subscribe(token, "test/sse/+/temp", last.id)
+	if status != http.StatusOK {
+		log.Fatalf("resume answered with %d", status)
+	}
+	defer missed.close()
+	missed.expect(TOPIC_LIVE, "25")
+	missed.expect(TOPIC_STREAM, "26")
+	missed.expect(TOPIC_STREAM, "27")
+	if err := native.Publish(TOPIC_STREAM, []byte("28")); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	missed.expect(TOPIC_STREAM, "28")
+	log.Printf("Event stream delivers retained and live messages and replays the missed ones")
+}
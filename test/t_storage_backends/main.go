@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	api "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/config"
+	"github.com/oo-developer/mmq/src/storage"
+)
+
+// testUser is a user as the user service hands it to the storage
+type testUser struct {
+	name string
+}
+
+func (u *testUser) Name() string                   { return u.name }
+func (u *testUser) IsAdmin() bool                  { return true }
+func (u *testUser) IsDisabled() bool               { return false }
+func (u *testUser) ExpiresAt() time.Time           { return time.Time{} }
+func (u *testUser) SessionsRevokedAt() time.Time   { return time.Time{} }
+func (u *testUser) PublicKeyPem() string           { return "" }
+func (u *testUser) PublicKey() *api.KyberPublicKey { return nil }
+
+func check(condition bool, format string, args ...any) {
+	if !condition {
+		log.Fatalf(format, args...)
+	}
+}
+
+func update(backend storage.Backend, fn func(tx storage.Tx) error) {
+	if err := backend.Update(fn); err != nil {
+		log.Fatalf("update failed: %v", err)
+	}
+}
+
+func open(storageConfig *config.Storage) storage.Backend {
+	backend, err := storage.OpenBackend(storageConfig)
+	if err != nil {
+		log.Fatalf("opening backend '%s' failed: %v", storageConfig.Backend, err)
+	}
+	return backend
+}
+
+// keys returns the keys of a bucket from start on
+func keys(tx storage.Tx, start string, path ...string) []string {
+	found := make([]string, 0)
+	var from []byte
+	if start != "" {
+		from = []byte(start)
+	}
+	tx.Bucket(path...).ForEach(from, func(key, value []byte) error {
+		found = append(found, string(key))
+		return nil
+	})
+	return found
+}
+
+// conformBuckets checks the buckets of a backend, including buckets no
+// service uses yet
+func conformBuckets(backend storage.Backend) {
+	update(backend, func(tx storage.Tx) error {
+		for _, name := range []string{"messages", "user", "acls"} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket("sessions", "client-1", "subscriptions")
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{"c", "a", "b"} {
+			if err := bucket.Put([]byte(key), []byte("value "+key)); err != nil {
+				return err
+			}
+		}
+		acls := tx.Bucket("acls")
+		if err := acls.Put([]byte("alice"), []byte("test/#")); err != nil {
+			return err
+		}
+		if err := acls.Put([]byte("alice"), []byte("test/+")); err != nil {
+			return err
+		}
+		if err := acls.Put([]byte("bob"), []byte("test/bob")); err != nil {
+			return err
+		}
+		return acls.Delete([]byte("bob"))
+	})
+	backend.View(func(tx storage.Tx) error {
+		check(slices.Equal(tx.Buckets(), []string{"acls", "messages", "sessions", "user"}), "top-level buckets %v", tx.Buckets())
+		check(slices.Equal(tx.Buckets("sessions"), []string{"client-1"}), "nested buckets %v", tx.Buckets("sessions"))
+		check(tx.Bucket("missing") == nil && tx.Bucket("sessions", "missing") == nil, "missing bucket found")
+		acls := tx.Bucket("acls")
+		check(string(acls.Get([]byte("alice"))) == "test/+", "overwritten value %q", acls.Get([]byte("alice")))
+		check(acls.Get([]byte("bob")) == nil, "deleted value found")
+		check(slices.Equal(keys(tx, "", "sessions", "client-1", "subscriptions"), []string{"a", "b", "c"}), "unordered keys")
+		check(slices.Equal(keys(tx, "b", "sessions", "client-1", "subscriptions"), []string{"b", "c"}), "keys from b")
+		check(slices.Equal(keys(tx, "bb", "sessions", "client-1", "subscriptions"), []string{"c"}), "keys from bb")
+		check(len(keys(tx, "", "sessions")) == 0, "nested bucket listed as key")
+		return nil
+	})
+	if err := backend.View(func(tx storage.Tx) error {
+		return tx.Bucket("acls").Put([]byte("carol"), []byte("test/carol"))
+	}); err == nil {
+		log.Fatalf("read-only transaction changed a bucket")
+	}
+
+	// A failed transaction changes nothing
+	failed := errors.New("failed on purpose")
+	err := backend.Update(func(tx storage.Tx) error {
+		if err := tx.Bucket("acls").Put([]byte("alice"), []byte("test/changed")); err != nil {
+			return err
+		}
+		if err := tx.Bucket("acls").Put([]byte("dave"), []byte("test/dave")); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket("sessions", "client-2"); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket("sessions", "client-1"); err != nil {
+			return err
+		}
+		return failed
+	})
+	check(errors.Is(err, failed), "failed transaction returned %v", err)
+	backend.View(func(tx storage.Tx) error {
+		check(string(tx.Bucket("acls").Get([]byte("alice"))) == "test/+", "rolled back value %q", tx.Bucket("acls").Get([]byte("alice")))
+		check(tx.Bucket("acls").Get([]byte("dave")) == nil, "rolled back value found")
+		check(slices.Equal(tx.Buckets("sessions"), []string{"client-1"}), "rolled back buckets %v", tx.Buckets("sessions"))
+		check(len(keys(tx, "", "sessions", "client-1", "subscriptions")) == 3, "rolled back bucket deletion")
+		return nil
+	})
+
+	// Deleting a bucket deletes its nested buckets
+	update(backend, func(tx storage.Tx) error {
+		if _, err := tx.CreateBucket("sessions", "client-2", "subscriptions"); err != nil {
+			return err
+		}
+		return tx.DeleteBucket("sessions", "client-1")
+	})
+	backend.View(func(tx storage.Tx) error {
+		check(slices.Equal(tx.Buckets("sessions"), []string{"client-2"}), "buckets after deletion %v", tx.Buckets("sessions"))
+		check(tx.Bucket("sessions", "client-1", "subscriptions") == nil, "nested bucket survived its parent")
+		return nil
+	})
+	check(backend.Update(func(tx storage.Tx) error {
+		return tx.DeleteBucket("sessions", "client-1")
+	}) != nil, "deleting a missing bucket succeeded")
+}
+
+// conformReopen checks the buckets survive closing a persistent backend
+func conformReopen(storageConfig *config.Storage) {
+	backend := open(storageConfig)
+	backend.View(func(tx storage.Tx) error {
+		check(slices.Equal(tx.Buckets(), []string{"acls", "messages", "sessions", "user"}), "reopened buckets %v", tx.Buckets())
+		check(string(tx.Bucket("acls").Get([]byte("alice"))) == "test/+", "reopened value %q", tx.Bucket("acls").Get([]byte("alice")))
+		check(tx.Bucket("sessions", "client-2", "subscriptions") != nil, "reopened nested bucket missing")
+		return nil
+	})
+	backend.Close()
+}
+
+// conformFile checks the log of the file backend survives a torn write and
+// is compacted
+func conformFile(storageConfig *config.Storage) {
+	file, err := os.OpenFile(storageConfig.DbFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatalf("storage file missing: %v", err)
+	}
+	file.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	file.Close()
+	conformReopen(storageConfig)
+
+	backend := open(storageConfig)
+	update(backend, func(tx storage.Tx) error {
+		for ii := 0; ii < 30000; ii++ {
+			if err := tx.Bucket("acls").Put([]byte("counter"), []byte(fmt.Sprint(ii))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// A second open of the storage file fails while it is open
+	if second, err := storage.OpenBackend(storageConfig); err == nil {
+		second.Close()
+		log.Fatal("storage file opened twice")
+	}
+	backend.Close()
+	info, err := os.Stat(storageConfig.DbFile)
+	check(err == nil && info.Size() < 100*1024, "storage file not compacted: %v", info.Size())
+	conformReopen(storageConfig)
+	backend = open(storageConfig)
+	backend.View(func(tx storage.Tx) error {
+		check(string(tx.Bucket("acls").Get([]byte("counter"))) == "29999", "compacted value %q", tx.Bucket("acls").Get([]byte("counter")))
+		return nil
+	})
+	backend.Close()
+}
+
+// conformService checks the storage service on a backend, persistent reports
+// whether its data survives a restart
+func conformService(configuration *config.Config, persistent bool) {
+	service := storage.NewStorage(configuration)
+	service.Start()
+	if err := service.AddUser(&testUser{name: "conformance"}); err != nil {
+		log.Fatalf("adding user failed: %v", err)
+	}
+	message := &api.Message{Type: api.TypeMessage, Topic: "test/backend", Payload: []byte("stored"), Properties: api.Persistent | api.Retained}
+	if err := <-service.AddMessage(message); err != nil {
+		log.Fatalf("adding message failed: %v", err)
+	}
+	for ii := 0; ii < 25; ii++ {
+		if err := <-service.AppendStream(&api.Message{Topic: "test/stream/backend", Payload: []byte(fmt.Sprint(ii))}); err != nil {
+			log.Fatalf("appending to stream failed: %v", err)
+		}
+	}
+	// The appends are read before they are checkpointed
+	streamed, err := service.ReadStream("test/stream/backend", 5, 100)
+	check(err == nil && len(streamed) == 15 && streamed[0].Offset == 10, "stream before checkpoint %d %v", len(streamed), err)
+	service.Shutdown()
+
+	service = storage.NewStorage(configuration)
+	service.Start()
+	defer service.Shutdown()
+	users := service.GetAllUsers()
+	messages := service.GetAllMessages()
+	streamed, err = service.ReadStream("test/stream/backend", 5, 100)
+	check(err == nil, "reading stream failed: %v", err)
+	if !persistent {
+		check(len(users) == 0 && len(messages) == 0 && len(streamed) == 0, "data survived a restart")
+		return
+	}
+	check(len(users) == 1 && users[0].Name() == "conformance", "users after restart %v", users)
+	check(len(messages) == 1 && bytes.Equal(messages[0].Payload, []byte("stored")), "messages after restart %v", messages)
+	// Retention dropped the oldest segment
+	check(len(streamed) == 15 && streamed[0].Offset == 10 && string(streamed[14].Payload) == "24", "stream after restart %d", len(streamed))
+	if err := service.RemoveUserByName("conformance"); err != nil {
+		log.Fatalf("removing user failed: %v", err)
+	}
+	check(len(service.GetAllUsers()) == 0, "removed user found")
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	flag.Parse()
+
+	dir, err := os.MkdirTemp("", "mmq_backends")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range storage.Backends() {
+		configuration := config.Load(*serverConfigFile)
+		configuration.Storage.Backend = name
+		configuration.Storage.DbFile = filepath.Join(dir, name+".db")
+		persistent := name != storage.BACKEND_MEMORY
+
+		backend := open(&configuration.Storage)
+		conformBuckets(backend)
+		if err := backend.Close(); err != nil {
+			log.Fatalf("closing backend '%s' failed: %v", name, err)
+		}
+		if persistent {
+			conformReopen(&configuration.Storage)
+		}
+		if name == storage.BACKEND_FILE {
+			conformFile(&configuration.Storage)
+		}
+
+		configuration.Storage.DbFile = filepath.Join(dir, name+"_service.db")
+		conformService(configuration, persistent)
+		log.Printf("Backend '%s' conforms", name)
+	}
+	log.Printf("All storage backends conform: %v", storage.Backends())
+}
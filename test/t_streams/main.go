@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	testtools "github.com/oo-developer/mmq/test"
+)
+
+// record is a message received on a stream subscription
+type record struct {
+	payload   string
+	offset    uint64
+	timestamp time.Time
+}
+
+func connect(config *mmq.Config) *mmq.Client {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	return client
+}
+
+func publish(client *mmq.Client, topic string, from, to int) {
+	for ii := from; ii < to; ii++ {
+		if err := client.Publish(topic, []byte(fmt.Sprintf("message %d", ii))); err != nil {
+			log.Fatalf("publish failed: %v", err)
+		}
+	}
+}
+
+// subscribe opens a stream subscription of its own on topic
+func subscribe(config *mmq.Config, topic string, start mmq.StreamStart) (*mmq.Client, chan record) {
+	client := connect(config)
+	received := make(chan record, 1000)
+	if err := client.SubscribeStream(topic, start, func(topic string, payload []byte, offset uint64, timestamp time.Time) {
+		received <- record{payload: string(payload), offset: offset, timestamp: timestamp}
+	}); err != nil {
+		log.Fatalf("stream subscribe failed: %v", err)
+	}
+	return client, received
+}
+
+// collect waits for count messages and checks their offsets follow first
+func collect(received chan record, first uint64, count int) []record {
+	records := make([]record, 0, count)
+	for len(records) < count {
+		select {
+		case r := <-received:
+			expected := first + uint64(len(records))
+			if r.offset != expected || r.payload != fmt.Sprintf("message %d", expected) {
+				log.Fatalf("expected offset %d, got %d '%s'", expected, r.offset, r.payload)
+			}
+			records = append(records, r)
+		case <-time.After(5 * time.Second):
+			log.Fatalf("%d of %d messages received from offset %d", len(records), count, first)
+		}
+	}
+	select {
+	case r := <-received:
+		log.Fatalf("unexpected message at offset %d", r.offset)
+	case <-time.After(200 * time.Millisecond):
+	}
+	return records
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	// The log is kept in the storage, every run uses a new stream topic
+	topic := fmt.Sprintf("test/stream/%d", time.Now().UnixNano())
+	publisher := connect(clientConfig)
+	defer publisher.Disconnect()
+
+	publish(publisher, topic, 0, 20)
+	time.Sleep(100 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(100 * time.Millisecond)
+	publish(publisher, topic, 20, 30)
+	time.Sleep(200 * time.Millisecond)
+
+	// The log is replayed and the live messages follow without gaps
+	replaying, received := subscribe(clientConfig, topic, mmq.FromOffset(0))
+	publish(publisher, topic, 30, 40)
+	records := collect(received, 0, 40)
+	if records[19].timestamp.After(since) || records[20].timestamp.Before(since) {
+		log.Fatalf("unexpected timestamps %v and %v around %v", records[19].timestamp, records[20].timestamp, since)
+	}
+	replaying.Disconnect()
+
+	fromTime, received := subscribe(clientConfig, topic, mmq.FromTime(since))
+	collect(received, 20, 20)
+	fromTime.Disconnect()
+
+	latest, received := subscribe(clientConfig, topic, mmq.FromLatest())
+	publish(publisher, topic, 40, 45)
+	collect(received, 40, 5)
+	latest.Disconnect()
+
+	// Whole segments beyond 50 messages are dropped, the oldest ones first
+	publish(publisher, topic, 45, 80)
+	time.Sleep(200 * time.Millisecond)
+	retained, received := subscribe(clientConfig, topic, mmq.FromOffset(0))
+	collect(received, 30, 50)
+	retained.Disconnect()
+	log.Printf("Stream topics are replayed from offsets, times and the latest message")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/common"
+	testtools "github.com/oo-developer/mmq/test"
+)
+
+const (
+	TOPIC_TAKEOVER    = "test/takeover"
+	TOKEN_SECRET_FILE = "token_secret"
+)
+
+func connect(config *mmq.Config) *mmq.Client {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	return client
+}
+
+// tokenConfig returns a copy of config that authenticates with a token of
+// subject restricted to acl
+func tokenConfig(config *mmq.Config, secret []byte, subject string, acl ...string) *mmq.Config {
+	token, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   subject,
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Acl:       acl,
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	tokenConfig := *config
+	tokenConfig.User = ""
+	tokenConfig.ClientPrivateKeyFile = ""
+	tokenConfig.Token = token
+	return &tokenConfig
+}
+
+// receives reports whether a message published to the topic reaches the
+// received channel of a subscription
+func receives(publisher *mmq.Client, received chan string) bool {
+	if err := publisher.Publish(TOPIC_TAKEOVER, []byte("after takeover")); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	select {
+	case <-received:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+// waitForReason waits until client was disconnected by the broker
+func waitForReason(client *mmq.Client) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for client.DisconnectReason() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return client.DisconnectReason()
+}
+
+// delivered reports whether a message published to the topic reaches the
+// subscription of client after it connected again with the same id
+func delivered(config *mmq.Config, publisher *mmq.Client) bool {
+	client := connect(config)
+	received := make(chan string, 10)
+	if err := client.Subscribe(TOPIC_TAKEOVER, func(topic string, payload []byte) {
+		received <- string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	// The same client connects again while its first connection is open
+	if err := client.Connect(); err != nil {
+		log.Fatalf("reconnect failed: %v", err)
+	}
+	defer client.Disconnect()
+	return receives(publisher, received)
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	dir, err := os.MkdirTemp("", "mmq_takeover")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	publisherConfig := *clientConfig
+	publisherConfig.ClientId = ""
+	publisher := connect(&publisherConfig)
+	defer publisher.Disconnect()
+
+	// The first connection learns that it was taken over
+	first := connect(clientConfig)
+	second := connect(clientConfig)
+	if reason := waitForReason(first); reason != common.DISCONNECT_TAKEN_OVER {
+		log.Fatalf("first connection was disconnected with '%s'", reason)
+	}
+	if reason := second.DisconnectReason(); reason != "" {
+		log.Fatalf("second connection was disconnected with '%s'", reason)
+	}
+	second.Disconnect()
+
+	multiplexConfig := *clientConfig
+	multiplexConfig.Multiplex = true
+	first = connect(&multiplexConfig)
+	second = connect(&multiplexConfig)
+	if reason := waitForReason(first); reason != common.DISCONNECT_TAKEN_OVER {
+		log.Fatalf("first multiplexed connection was disconnected with '%s'", reason)
+	}
+	if _, err := first.SendCommand(nil); err == nil {
+		log.Fatal("command on a taken over connection succeeded")
+	}
+	second.Disconnect()
+
+	// Subscriptions survive a takeover only in a persistent session
+	if delivered(clientConfig, publisher) {
+		log.Fatal("subscription survived the takeover of a clean session")
+	}
+	persistentConfig := *clientConfig
+	persistentConfig.PersistentSession = true
+	if !delivered(&persistentConfig, publisher) {
+		log.Fatal("subscription of a persistent session was lost in the takeover")
+	}
+
+	// Another user can not take over the client id, the session goes on
+	persistent := connect(&persistentConfig)
+	received := make(chan string, 10)
+	if err := persistent.Subscribe(TOPIC_TAKEOVER, func(topic string, payload []byte) {
+		received <- string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	intruderConfig := tokenConfig(&persistentConfig, secret, "intruder")
+	intruder, err := mmq.NewClient(intruderConfig)
+	if err != nil {
+		panic(err)
+	}
+	rejection := &mmq.Rejection{}
+	if err := intruder.Connect(); !errors.As(err, &rejection) || rejection.Reason != mmq.RejectClientIdInUse {
+		log.Fatalf("client id taken over by another user: %v", err)
+	}
+
+	// A client that can not read the handshake with the key of the user does
+	// not take over the client id
+	_, privateKey, err := mmq.GenerateKyberKeyPair()
+	if err != nil {
+		panic(err)
+	}
+	privateKeyPem, _ := mmq.EncodeKyberPrivateKeyPEM(privateKey)
+	foreignKeyConfig := persistentConfig
+	foreignKeyConfig.ClientPrivateKeyFile = filepath.Join(dir, "foreign_private_key.pem")
+	if err := os.WriteFile(foreignKeyConfig.ClientPrivateKeyFile, privateKeyPem, 0600); err != nil {
+		panic(err)
+	}
+	foreignKey, err := mmq.NewClient(&foreignKeyConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := foreignKey.Connect(); err == nil {
+		log.Fatal("client with a foreign key connected")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if reason := persistent.DisconnectReason(); reason != "" {
+		log.Fatalf("session was disconnected with '%s'", reason)
+	}
+	if !receives(publisher, received) {
+		log.Fatal("session lost its subscription to a refused takeover")
+	}
+	persistent.Disconnect()
+
+	// Subscriptions the ACL of the new connection does not allow are dropped
+	// in the takeover
+	aclConfig := tokenConfig(&persistentConfig, secret, "acl-user", "test/#")
+	aclClient := connect(aclConfig)
+	received = make(chan string, 10)
+	if err := aclClient.Subscribe(TOPIC_TAKEOVER, func(topic string, payload []byte) {
+		received <- string(payload)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	aclConfig.Token = tokenConfig(&persistentConfig, secret, "acl-user", "other/#").Token
+	if err := aclClient.Connect(); err != nil {
+		log.Fatalf("reconnect failed: %v", err)
+	}
+	if receives(publisher, received) {
+		log.Fatal("subscription not allowed by the ACL survived the takeover")
+	}
+	aclClient.Disconnect()
+	log.Printf("Client ids are taken over by new connections of the same user")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	testtools "github.com/oo-developer/mmq/test"
+)
+
+const (
+	TLS_DIR    = "/tmp/mmq_tls"
+	TOPIC_TEST = "test/tls"
+)
+
+// createCertificate writes a certificate signed by parent, a nil parent creates a self signed CA
+func createCertificate(name string, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		panic(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	os.WriteFile(filepath.Join(TLS_DIR, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(filepath.Join(TLS_DIR, name+"_key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return certificate, key
+}
+
+func roundTrip(client *mmq.Client) {
+	received := make(chan struct{})
+	if err := client.Subscribe(TOPIC_TEST, func(topic string, payload []byte) {
+		close(received)
+	}); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	if err := client.Publish(TOPIC_TEST, []byte("hello"), 0); err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		log.Fatal("message not received")
+	}
+	client.Unsubscribe(TOPIC_TEST)
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	if err := os.MkdirAll(TLS_DIR, 0700); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(TLS_DIR)
+	ca, caKey := createCertificate("ca", "mmq test CA", nil, nil)
+	createCertificate("server", "127.0.0.1", ca, caKey)
+	createCertificate("client", "test", ca, caKey)
+
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+
+	// Kyber key over TLS
+	client, err := mmq.NewClient(clientConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("key authentication over TLS failed: %v", err)
+	}
+	roundTrip(client)
+	client.Disconnect()
+	log.Printf("Key authentication over TLS works")
+
+	// TLS client certificate without a Kyber key
+	mtlsConfig := *clientConfig
+	mtlsConfig.ClientPrivateKeyFile = ""
+	mtlsConfig.TlsCertFile = filepath.Join(TLS_DIR, "client.pem")
+	mtlsConfig.TlsKeyFile = filepath.Join(TLS_DIR, "client_key.pem")
+	client, err = mmq.NewClient(&mtlsConfig)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("mTLS authentication failed: %v", err)
+	}
+	roundTrip(client)
+	client.Disconnect()
+	log.Printf("mTLS authentication works")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oo-developer/mmq/cli/module"
+	mmq "github.com/oo-developer/mmq/pkg"
+	"github.com/oo-developer/mmq/src/application"
+	"github.com/oo-developer/mmq/src/common"
+	"github.com/oo-developer/mmq/src/config"
+)
+
+const (
+	TOKEN_SECRET_FILE = "token_secret"
+)
+
+func start(configuration *config.Config) common.Service {
+	server := application.NewApplication(configuration)
+	go server.Start()
+	time.Sleep(2 * time.Second)
+	return server
+}
+
+func connect(config *mmq.Config) *mmq.Client {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	return client
+}
+
+// refused reports whether the broker refuses a connection of config
+func refused(config *mmq.Config) bool {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil {
+		return true
+	}
+	client.Disconnect()
+	return false
+}
+
+func copyFile(from, to string) {
+	source, err := os.Open(from)
+	if err != nil {
+		panic(err)
+	}
+	defer source.Close()
+	target, err := os.Create(to)
+	if err != nil {
+		panic(err)
+	}
+	defer target.Close()
+	if _, err := io.Copy(target, source); err != nil {
+		panic(err)
+	}
+}
+
+// waitForReason waits until client was disconnected by the broker
+func waitForReason(client *mmq.Client, timeout time.Duration) string {
+	deadline := time.Now().Add(timeout)
+	for client.DisconnectReason() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return client.DisconnectReason()
+}
+
+// terminated checks the live session of client is terminated with reason
+func terminated(client *mmq.Client, reason string, timeout time.Duration) {
+	if got := waitForReason(client, timeout); got != reason {
+		log.Fatalf("session not terminated with '%s': '%s'", reason, got)
+	}
+}
+
+// deviceKey writes a key pair to dir and returns the files of the public and
+// the private key
+func deviceKey(dir, name string) (string, string) {
+	publicKey, privateKey, err := mmq.GenerateKyberKeyPair()
+	if err != nil {
+		panic(err)
+	}
+	publicKeyPem, _ := mmq.EncodeKyberPublicKeyPEM(publicKey)
+	privateKeyPem, _ := mmq.EncodeKyberPrivateKeyPEM(privateKey)
+	publicKeyFile := filepath.Join(dir, name+"_public_key.pem")
+	privateKeyFile := filepath.Join(dir, name+"_private_key.pem")
+	if err := os.WriteFile(publicKeyFile, publicKeyPem, 0600); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(privateKeyFile, privateKeyPem, 0600); err != nil {
+		panic(err)
+	}
+	return publicKeyFile, privateKeyFile
+}
+
+func users(clientConfig *mmq.Config, secret []byte, command string, args ...string) {
+	adminToken, err := mmq.SignTokenHS256(&mmq.TokenClaims{
+		Subject:   "operator",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Admin:     true,
+	}, secret)
+	if err != nil {
+		panic(err)
+	}
+	adminConfig := *clientConfig
+	adminConfig.User = ""
+	adminConfig.ClientPrivateKeyFile = ""
+	adminConfig.Token = adminToken
+	admin := connect(&adminConfig)
+	defer admin.Disconnect()
+	if err := module.Modules["users"].Execute(admin, command, args...); err != nil {
+		log.Fatalf("users %s %v failed: %v", command, args, err)
+	}
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(TOKEN_SECRET_FILE, secret, 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(TOKEN_SECRET_FILE)
+	dir, err := os.MkdirTemp("", "mmq_user_lifecycle")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The broker works on a copy of the test database
+	configuration := config.Load(*serverConfigFile)
+	brokerDb := filepath.Join(dir, "broker.db")
+	copyFile(configuration.Storage.DbFile, brokerDb)
+	configuration.Storage.DbFile = brokerDb
+	server := start(configuration)
+
+	clientConfig, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	run := time.Now().UnixNano()
+
+	// A user created with an expiry is dropped when it passes
+	expiringName := fmt.Sprintf("expiring-%d", run)
+	publicKeyFile, privateKeyFile := deviceKey(dir, expiringName)
+	expires := time.Now().Add(3 * time.Second).Format(time.RFC3339)
+	users(clientConfig, secret, "add", "--name", expiringName, "--public-key", publicKeyFile, "--expires", expires)
+	expiringConfig := *clientConfig
+	expiringConfig.User = expiringName
+	expiringConfig.ClientPrivateKeyFile = privateKeyFile
+	expiring := connect(&expiringConfig)
+	terminated(expiring, "user expired", 6*time.Second)
+	if !refused(&expiringConfig) {
+		log.Fatalf("expired user connected")
+	}
+
+	deviceName := fmt.Sprintf("device-%d", run)
+	publicKeyFile, privateKeyFile = deviceKey(dir, deviceName)
+	users(clientConfig, secret, "add", "--name", deviceName, "--public-key", publicKeyFile)
+	deviceConfig := *clientConfig
+	deviceConfig.User = deviceName
+	deviceConfig.ClientPrivateKeyFile = privateKeyFile
+
+	// Rotating the key terminates the session, only the new key connects
+	device := connect(&deviceConfig)
+	rotatedPublicKeyFile, rotatedPrivateKeyFile := deviceKey(dir, deviceName+"-rotated")
+	users(clientConfig, secret, "rotate-key", "--name", deviceName, "--public-key", rotatedPublicKeyFile)
+	terminated(device, "key rotated", 5*time.Second)
+	if !refused(&deviceConfig) {
+		log.Fatalf("old key connected after the rotation")
+	}
+	deviceConfig.ClientPrivateKeyFile = rotatedPrivateKeyFile
+
+	// Disabling terminates the session until the user is enabled again
+	device = connect(&deviceConfig)
+	users(clientConfig, secret, "disable", "--name", deviceName)
+	terminated(device, "user disabled", 5*time.Second)
+	if !refused(&deviceConfig) {
+		log.Fatalf("disabled user connected")
+	}
+	users(clientConfig, secret, "enable", "--name", deviceName)
+
+	// An expiry in the past terminates the session, removing it lets the user
+	// connect again
+	device = connect(&deviceConfig)
+	users(clientConfig, secret, "set-expiry", "--name", deviceName, "--expires", time.Now().Add(-time.Minute).Format(time.RFC3339))
+	terminated(device, "user expiry changed", 5*time.Second)
+	if !refused(&deviceConfig) {
+		log.Fatalf("expired user connected")
+	}
+	users(clientConfig, secret, "set-expiry", "--name", deviceName, "--expires", "")
+	device = connect(&deviceConfig)
+	device.Disconnect()
+	server.Shutdown()
+	log.Printf("Key rotation, disabling and expiry terminate the sessions of a user")
+}
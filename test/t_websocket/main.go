@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	mmq "github.com/oo-developer/mmq/pkg"
+	testtools "github.com/oo-developer/mmq/test"
+)
+
+const (
+	TOPIC_TEST    = "test/websocket"
+	MESSAGE_COUNT = 100
+)
+
+func connect(config *mmq.Config) (*mmq.Client, error) {
+	client, err := mmq.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return client, client.Connect()
+}
+
+func main() {
+	serverConfigFile := flag.String("server-config", "server_config.json", "Path to server config file")
+	clientConfigFile := flag.String("client-config", "client_config.json", "Path to client config file")
+	flag.Parse()
+
+	server := testtools.StartServer(*serverConfigFile)
+	defer server.Shutdown()
+
+	config, err := mmq.LoadConfig(*clientConfigFile)
+	if err != nil {
+		panic(err)
+	}
+
+	// Requests outside of the path prefix and from foreign origins are rejected
+	wrongPath := *config
+	wrongPath.WebSocketPath = "/other"
+	if _, err := connect(&wrongPath); err == nil {
+		log.Fatal("upgrade outside of the path prefix accepted")
+	}
+	foreignOrigin := *config
+	foreignOrigin.WebSocketOrigin = "https://evil.example.com"
+	if _, err := connect(&foreignOrigin); err == nil {
+		log.Fatal("upgrade from a foreign origin accepted")
+	}
+	allowedOrigin := *config
+	allowedOrigin.WebSocketOrigin = "https://app.example.com"
+
+	subscriber, err := connect(&allowedOrigin)
+	if err != nil {
+		log.Fatalf("connect failed: %v", err)
+	}
+	defer subscriber.Disconnect()
+	multiplexConfig := *config
+	multiplexConfig.Multiplex = true
+	multiplexed, err := connect(&multiplexConfig)
+	if err != nil {
+		log.Fatalf("connect in multiplex mode failed: %v", err)
+	}
+	defer multiplexed.Disconnect()
+
+	received := make(chan struct{}, 2*MESSAGE_COUNT)
+	handler := func(topic string, payload []byte) {
+		received <- struct{}{}
+	}
+	if err := subscriber.Subscribe(TOPIC_TEST, handler); err != nil {
+		log.Fatalf("subscribe failed: %v", err)
+	}
+	if err := multiplexed.Subscribe(TOPIC_TEST, handler); err != nil {
+		log.Fatalf("subscribe in multiplex mode failed: %v", err)
+	}
+	// The multiplexed client publishes while its own messages arrive on the same connection
+	for ii := 0; ii < MESSAGE_COUNT; ii++ {
+		if err := multiplexed.Publish(TOPIC_TEST, []byte("hello")); err != nil {
+			log.Fatalf("publish failed: %v", err)
+		}
+	}
+	for ii := 0; ii < 2*MESSAGE_COUNT; ii++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			log.Fatalf("received %d of %d messages", ii, 2*MESSAGE_COUNT)
+		}
+	}
+	log.Printf("Messages were delivered over WebSocket with and without multiplex")
+}